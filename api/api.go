@@ -12,6 +12,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/url"
+	"time"
 
 	"maunium.net/go/mautrix/id"
 )
@@ -61,16 +62,29 @@ type ClientConfig struct {
 	UserID id.UserID
 	// A URL with the host and port of the matrix server. E.g. https://matrix.org:8448
 	HomeserverURL string
-	// The matrix access token to authenticate the requests with.
+	// The matrix access token to authenticate the requests with. If this is empty, Go-NEB logs in with
+	// the Password or LoginToken and stores the access token it gets.
 	AccessToken string
-	// The device ID for this access token.
+	// The device ID for this access token. When logging in, this device is used if it is set.
 	DeviceID id.DeviceID
+	// The password to log in with if there is no AccessToken. Go-NEB also logs in again with it if
+	// the access token stops working.
+	Password string
+	// A single use token to log in with if there is no AccessToken, e.g. from an SSO login.
+	LoginToken string
+	// The refresh token Go-NEB got when it logged in, which is used to get a new access token when
+	// the old one expires.
+	RefreshToken string
 	// True to start a sync stream for this user, making this a "syncing client". If false, no
 	// /sync goroutine will be created and this client won't listen for new events from Matrix. For services
 	// which only SEND events into Matrix, it may be desirable to set Sync to false to reduce the
 	// number of goroutines Go-NEB has to maintain. For services which respond to !commands,
 	// Sync MUST be set to true in order to receive those commands.
 	Sync bool
+	// True to act as this user through Go-NEB's application service instead of an AccessToken. The
+	// user must be in the registration's user namespace. Events are pushed by the homeserver, so Sync
+	// is ignored, and no AccessToken is needed.
+	AppService bool
 	// True to automatically join every room this client is invited to.
 	// This is desirable for services which have !commands as that means anyone can pull the bot
 	// into the room. It is up to the service to decide which, if any, users to respond to however.
@@ -82,6 +96,16 @@ type ClientConfig struct {
 	// When a user starts a new SAS verification with us, their user ID has to match one of these regexes
 	// for the verification process to start.
 	AcceptVerificationFromUsers []string
+	// The key which encrypts this client's end-to-end encryption keys in the database. If this is empty,
+	// a key derived from the DeviceID is used, which anyone with access to the database can work out.
+	// Changing it makes the keys stored for the device unreadable, so set it before the device is
+	// first used, or use a new DeviceID.
+	PickleKey string
+	// True to create cross-signing keys for this user and sign this client's device with them, so that
+	// users who have verified the bot see its device as trusted. Keys are only created if the user has
+	// none, and the homeserver may ask for the Password to allow it. The keys are stored in the database,
+	// so this is ignored when the database is in memory.
+	CrossSigning bool
 }
 
 // A IncomingDecimalSAS contains the decimal SAS as displayed on another device. The SAS consists of three numbers.
@@ -113,6 +137,92 @@ type ConfigFile struct {
 	Sessions []Session
 }
 
+// AuditEntry records a single change made to the configuration through the admin API.
+type AuditEntry struct {
+	// Increases with every change. This is used as the version when rolling back a service.
+	ID int64
+	// The admin API call which made the change, e.g. "configureService".
+	Action string
+	// What was changed: "service", "client", "realm" or "session".
+	Kind string
+	// The ID of the service, client or realm which was changed. For sessions this is the realm ID.
+	TargetID string
+	// The service or realm type, if any.
+	TargetType string
+	// The user ID of the service, client or session, if any.
+	UserID id.UserID
+	// Who made the change and where they made it from.
+	Actor    string
+	SourceIP string
+	// The config before and after the change. These are JSON null if it did not exist.
+	OldConfig json.RawMessage
+	NewConfig json.RawMessage
+	Time      time.Time
+}
+
+// The states of a client's /sync stream, as reported by /admin/clientStatus.
+const (
+	// Making the initial /sync request, or the first one after backing off.
+	SyncStateConnecting = "connecting"
+	// The last /sync request succeeded.
+	SyncStateSyncing = "syncing"
+	// The last /sync request failed, and the client is waiting before trying again.
+	SyncStateBackingOff = "backing-off"
+	// The homeserver rejected the access token. The client keeps trying in case it starts working again.
+	SyncStateAuthFailed = "auth-failed"
+)
+
+// ClientStatus is the health of a client's /sync stream.
+type ClientStatus struct {
+	UserID id.UserID
+	// One of SyncStateConnecting, SyncStateSyncing, SyncStateBackingOff or SyncStateAuthFailed.
+	State string
+	// When the last /sync request succeeded. This is the zero time if none has yet.
+	LastSync time.Time
+	// The error from the last failed /sync request, if the client hasn't synced since.
+	LastError string
+	// The number of /sync requests which have failed in a row.
+	Failures int
+	// When the client will next try to /sync, if it is backing off.
+	NextRetry time.Time
+}
+
+// The scopes which an APIKey can have. Each scope allows everything the scopes before it do.
+const (
+	// Read the config, except for secrets.
+	ScopeRead = "read"
+	// Configure, delete and roll back services.
+	ScopeServices = "services"
+	// Full access to the admin API, including clients, auth realms, auth sessions and API keys.
+	ScopeAdmin = "admin"
+)
+
+var scopeLevels = map[string]int{
+	ScopeRead:     1,
+	ScopeServices: 2,
+	ScopeAdmin:    3,
+}
+
+// APIKey is a bearer token which can access the admin API. The token itself is only known when the
+// key is created: only a hash of it is stored.
+type APIKey struct {
+	// A unique name for the key, recorded in the audit log as the actor.
+	Name string
+	// One of ScopeRead, ScopeServices or ScopeAdmin.
+	Scope   string
+	Created time.Time
+}
+
+// Allows returns true if the key's scope includes the given scope.
+func (k *APIKey) Allows(scope string) bool {
+	return scopeLevels[k.Scope] >= scopeLevels[scope] && scopeLevels[scope] > 0
+}
+
+// IsValidScope returns true if the scope is one of ScopeRead, ScopeServices or ScopeAdmin.
+func IsValidScope(scope string) bool {
+	return scopeLevels[scope] > 0
+}
+
 // Check validates the /configureService request
 func (c *ConfigureServiceRequest) Check() error {
 	if c.ID == "" || c.Type == "" || c.UserID == "" || c.Config == nil {
@@ -139,8 +249,11 @@ func (c *Session) Check() error {
 
 // Check that the client has supplied the correct fields.
 func (c *ClientConfig) Check() error {
-	if c.UserID == "" || c.HomeserverURL == "" || c.AccessToken == "" {
-		return errors.New(`Must supply a "UserID", a "HomeserverURL", and an "AccessToken"`)
+	if c.UserID == "" || c.HomeserverURL == "" {
+		return errors.New(`Must supply a "UserID" and a "HomeserverURL"`)
+	}
+	if c.AccessToken == "" && c.Password == "" && c.LoginToken == "" && !c.AppService {
+		return errors.New(`Must supply an "AccessToken", a "Password" or a "LoginToken", or set "AppService"`)
 	}
 	if _, err := url.Parse(c.HomeserverURL); err != nil {
 		return err
@@ -148,6 +261,23 @@ func (c *ClientConfig) Check() error {
 	return nil
 }
 
+// KeepLogin copies the credentials which Go-NEB got by logging in from the old config for the same
+// client, if this config logs in the same way. This makes a config with a Password or LoginToken equal
+// to the stored config it resulted in, so that it does not log in again.
+func (c *ClientConfig) KeepLogin(old ClientConfig) {
+	if c.AccessToken != "" || (c.Password == "" && c.LoginToken == "") ||
+		c.UserID != old.UserID || c.Password != old.Password || c.LoginToken != old.LoginToken {
+		return
+	}
+	if c.DeviceID == "" {
+		c.DeviceID = old.DeviceID
+	}
+	if c.DeviceID == old.DeviceID {
+		c.AccessToken = old.AccessToken
+		c.RefreshToken = old.RefreshToken
+	}
+}
+
 // Check that the received SAS data contains the correct fields.
 func (c *IncomingDecimalSAS) Check() error {
 	if c.UserID == "" || c.OtherUserID == "" || c.OtherDeviceID == "" {
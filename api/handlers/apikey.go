@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+)
+
+type adminContextKey string
+
+// The context keys for the name and scope of the API key which made an admin API request.
+const (
+	actorContextKey = adminContextKey("actor")
+	scopeContextKey = adminContextKey("scope")
+)
+
+// The actor recorded for requests authenticated with the shared secret.
+const sharedSecretActor = "shared-secret"
+
+// The actor recorded for requests without a token, when they are allowed.
+const unauthenticatedActor = "unauthenticated"
+
+// AdminAuth authenticates requests to the admin API. Requests must have an "Authorization: Bearer <token>"
+// header, where the token is either the shared secret or an API key with the scope needed by the handler.
+//
+// If there is no shared secret and no API keys have been created, every admin API request is refused,
+// unless AllowUnauthenticated has been called.
+type AdminAuth struct {
+	db                   *database.ServiceDB
+	sharedSecret         string
+	allowUnauthenticated bool
+}
+
+// NewAdminAuth creates a new AdminAuth. The shared secret has full access to the admin API, and may
+// be empty to only allow API keys.
+func NewAdminAuth(db *database.ServiceDB, sharedSecret string) *AdminAuth {
+	return &AdminAuth{
+		db:           db,
+		sharedSecret: sharedSecret,
+	}
+}
+
+// AllowUnauthenticated lets every request use the admin API, with full access, while there is no shared
+// secret and no API keys have been created. This is how Go-NEB behaved before the admin API needed
+// authentication, and should only be used if the admin API can't be reached by anyone untrusted.
+func (a *AdminAuth) AllowUnauthenticated() {
+	a.allowUnauthenticated = true
+}
+
+// Protect wraps an admin API handler so that it requires the given scope.
+func (a *AdminAuth) Protect(scope string, h util.JSONRequestHandler) util.JSONRequestHandler {
+	return util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		key, res := a.authenticate(req, scope)
+		if res != nil {
+			return *res
+		}
+		ctx := context.WithValue(req.Context(), actorContextKey, key.Name)
+		req = req.WithContext(context.WithValue(ctx, scopeContextKey, key.Scope))
+		return h.OnIncomingRequest(req)
+	})
+}
+
+// requestScope returns the scope of the API key which made an admin API request, or "" if the
+// request wasn't authenticated.
+func requestScope(req *http.Request) string {
+	scope, _ := req.Context().Value(scopeContextKey).(string)
+	return scope
+}
+
+// HasCredentials returns true if there is a shared secret or an API key which can use the admin API.
+func (a *AdminAuth) HasCredentials() (bool, error) {
+	if a.sharedSecret != "" {
+		return true, nil
+	}
+	keys, err := a.db.LoadAPIKeys()
+	return len(keys) > 0, err
+}
+
+// authenticate returns the API key which made the request, or an error response if the request is not
+// allowed. Requests with the shared secret, or allowed without a token, have a key with the admin scope.
+func (a *AdminAuth) authenticate(req *http.Request, scope string) (api.APIKey, *util.JSONResponse) {
+	logger := util.GetLogger(req.Context())
+	if a.allowUnauthenticated {
+		if hasCredentials, err := a.HasCredentials(); err != nil {
+			logger.WithError(err).Error("Failed to load API keys")
+			res := util.MessageResponse(500, "Failed to authenticate request")
+			return api.APIKey{}, &res
+		} else if !hasCredentials {
+			return api.APIKey{Name: unauthenticatedActor, Scope: api.ScopeAdmin}, nil
+		}
+	}
+
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		res := util.MessageResponse(401, "Missing bearer token")
+		return api.APIKey{}, &res
+	}
+
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if a.sharedSecret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.sharedSecret)) == 1 {
+		return api.APIKey{Name: sharedSecretActor, Scope: api.ScopeAdmin}, nil
+	}
+
+	key, err := a.db.LoadAPIKeyByHash(hashAPIKeyToken(token))
+	if err == sql.ErrNoRows {
+		if hasCredentials, herr := a.HasCredentials(); herr == nil && !hasCredentials {
+			res := util.MessageResponse(403, "The admin API is disabled: set ADMIN_API_TOKEN or create an API key")
+			return api.APIKey{}, &res
+		}
+		res := util.MessageResponse(401, "Unknown bearer token")
+		return api.APIKey{}, &res
+	} else if err != nil {
+		logger.WithError(err).Error("Failed to LoadAPIKeyByHash")
+		res := util.MessageResponse(500, "Failed to authenticate request")
+		return api.APIKey{}, &res
+	}
+	if !key.Allows(scope) {
+		res := util.MessageResponse(403, "API key does not have the "+scope+" scope")
+		return api.APIKey{}, &res
+	}
+	return key, nil
+}
+
+// GenerateAPIKey creates a new API key with a random token and stores its hash. Returns the token,
+// which cannot be retrieved again.
+func GenerateAPIKey(db *database.ServiceDB, name, scope string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	token := "neb_" + base64.RawURLEncoding.EncodeToString(b)
+	if err := db.StoreAPIKey(api.APIKey{Name: name, Scope: scope}, hashAPIKeyToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func hashAPIKeyToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey represents an HTTP handler which can process /admin/createAPIKey requests.
+type CreateAPIKey struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/createAPIKey.
+//
+// The request body MUST be a JSON object with a unique "Name" and a "Scope" of "read", "services"
+// or "admin". The token is only returned once: pass it as "Authorization: Bearer <token>".
+//
+// Request:
+//  POST /admin/createAPIKey
+//  {
+//      "Name": "deploy-bot",
+//      "Scope": "services"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Name": "deploy-bot",
+//      "Scope": "services",
+//      "Token": "neb_..."
+//  }
+func (h *CreateAPIKey) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Name  string
+		Scope string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.Name == "" || !api.IsValidScope(body.Scope) {
+		return util.MessageResponse(400, `Must supply a "Name" and a "Scope" of "read", "services" or "admin"`)
+	}
+
+	token, err := GenerateAPIKey(h.Db, body.Name, body.Scope)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to GenerateAPIKey")
+		return util.MessageResponse(500, "Failed to create API key. Is the name already in use?")
+	}
+	recordAudit(h.Db, req, api.AuditEntry{
+		Action:     "createAPIKey",
+		Kind:       "apikey",
+		TargetID:   body.Name,
+		TargetType: body.Scope,
+	}, nil, api.APIKey{Name: body.Name, Scope: body.Scope})
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Name  string
+			Scope string
+			Token string
+		}{body.Name, body.Scope, token},
+	}
+}
+
+// ListAPIKeys represents an HTTP handler which can process /admin/listAPIKeys requests.
+type ListAPIKeys struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/listAPIKeys. Tokens are never returned.
+//
+// Request:
+//  POST /admin/listAPIKeys
+//  {}
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Keys": [
+//          {
+//              "Name": "deploy-bot",
+//              "Scope": "services",
+//              "Created": "2017-01-01T12:00:00Z"
+//          }
+//      ]
+//  }
+func (h *ListAPIKeys) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	keys, err := h.Db.LoadAPIKeys()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadAPIKeys")
+		return util.MessageResponse(500, "Failed to load API keys")
+	}
+	if keys == nil {
+		keys = []api.APIKey{}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Keys []api.APIKey
+		}{keys},
+	}
+}
+
+// RevokeAPIKey represents an HTTP handler which can process /admin/revokeAPIKey requests.
+type RevokeAPIKey struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/revokeAPIKey.
+//
+// The request body MUST be a JSON object with the "Name" of the key to revoke. It stops working immediately.
+//
+// Request:
+//  POST /admin/revokeAPIKey
+//  {
+//      "Name": "deploy-bot"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (h *RevokeAPIKey) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Name string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.Name == "" {
+		return util.MessageResponse(400, `Must supply a "Name"`)
+	}
+
+	deleted, err := h.Db.DeleteAPIKey(body.Name)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to DeleteAPIKey")
+		return util.MessageResponse(500, "Failed to revoke API key")
+	}
+	if !deleted {
+		return util.MessageResponse(404, "API key not found")
+	}
+	recordAudit(h.Db, req, api.AuditEntry{
+		Action:   "revokeAPIKey",
+		Kind:     "apikey",
+		TargetID: body.Name,
+	}, api.APIKey{Name: body.Name}, nil)
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
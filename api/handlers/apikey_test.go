@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestAdminAuth(t *testing.T) {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	var gotActor string
+	handler := util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		gotActor = requestActor(req)
+		return util.JSONResponse{Code: 200, JSON: struct{}{}}
+	})
+
+	auth := NewAdminAuth(db, "")
+	protected := auth.Protect(api.ScopeServices, handler)
+	call := func(token string) int {
+		gotActor = ""
+		req, _ := http.NewRequest("POST", "http://go.neb/admin/configureService", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return protected.OnIncomingRequest(req).Code
+	}
+
+	if code := call(""); code != 401 {
+		t.Errorf("Expected the admin API to refuse requests without a token, got HTTP %d", code)
+	}
+	if code := call("neb_anything"); code != 403 {
+		t.Errorf("Expected the admin API to be disabled without API keys, got HTTP %d", code)
+	}
+
+	readToken, err := GenerateAPIKey(db, "reader", api.ScopeRead)
+	if err != nil {
+		t.Fatalf("Failed to generate API key: %s", err)
+	}
+	servicesToken, err := GenerateAPIKey(db, "deployer", api.ScopeServices)
+	if err != nil {
+		t.Fatalf("Failed to generate API key: %s", err)
+	}
+	if _, err = GenerateAPIKey(db, "deployer", api.ScopeAdmin); err == nil {
+		t.Errorf("Expected a duplicate API key name to be rejected")
+	}
+
+	testCases := []struct {
+		token     string
+		wantCode  int
+		wantActor string
+	}{
+		{"", 401, ""},
+		{"neb_wrong", 401, ""},
+		{readToken, 403, ""},
+		{servicesToken, 200, "deployer"},
+	}
+	for _, tc := range testCases {
+		if code := call(tc.token); code != tc.wantCode || gotActor != tc.wantActor {
+			t.Errorf("Token %q: got HTTP %d actor %q, want HTTP %d actor %q", tc.token, code, gotActor, tc.wantCode, tc.wantActor)
+		}
+	}
+
+	protected = NewAdminAuth(db, "shared").Protect(api.ScopeAdmin, handler)
+	if code := call("shared"); code != 200 || gotActor != sharedSecretActor {
+		t.Errorf("Shared secret: got HTTP %d actor %q", code, gotActor)
+	}
+	if code := call(servicesToken); code != 403 {
+		t.Errorf("Expected services key to be forbidden from admin scope, got HTTP %d", code)
+	}
+
+	if code := call(readToken); code != 403 {
+		t.Errorf("Expected read key to be forbidden from admin scope, got HTTP %d", code)
+	}
+	auth.AllowUnauthenticated()
+	protected = auth.Protect(api.ScopeServices, handler)
+	if code := call(""); code != 401 {
+		t.Errorf("Expected requests without a token to be refused once API keys exist, got HTTP %d", code)
+	}
+
+	if deleted, err := db.DeleteAPIKey("deployer"); err != nil || !deleted {
+		t.Fatalf("Failed to delete API key: %v", err)
+	}
+	protected = auth.Protect(api.ScopeServices, handler)
+	if code := call(servicesToken); code != 401 {
+		t.Errorf("Expected revoked key to be rejected, got HTTP %d", code)
+	}
+
+	// Without any credentials, the old behaviour can be kept
+	if deleted, err := db.DeleteAPIKey("reader"); err != nil || !deleted {
+		t.Fatalf("Failed to delete API key: %v", err)
+	}
+	if code := call(""); code != 200 || gotActor != unauthenticatedActor {
+		t.Errorf("Expected requests without a token to be allowed, got HTTP %d actor %q", code, gotActor)
+	}
+	protected = NewAdminAuth(db, "").Protect(api.ScopeServices, handler)
+	if code := call(""); code != 401 {
+		t.Errorf("Expected requests without a token to be refused by default, got HTTP %d", code)
+	}
+}
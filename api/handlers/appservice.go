@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/appservice"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// How long to remember transaction IDs for. The homeserver retries a transaction until it succeeds,
+// so a retry of one which has already been processed must not be processed again.
+const transactionWindow = time.Hour
+
+// AppServiceTransaction represents an HTTP handler capable of processing the transactions which
+// the homeserver sends to Go-NEB when it is an application service.
+type AppServiceTransaction struct {
+	registration *appservice.Registration
+	clients      *clients.Clients
+	txns         *replayCache
+}
+
+// NewAppServiceTransaction returns a new application service transaction HTTP handler.
+func NewAppServiceTransaction(reg *appservice.Registration, cli *clients.Clients) *AppServiceTransaction {
+	return &AppServiceTransaction{reg, cli, newReplayCache()}
+}
+
+// OnIncomingRequest handles PUT requests to /_matrix/app/v1/transactions/{txnId}. The homeserver
+// authenticates with the registration's hs_token. Each event is passed to the clients it concerns,
+// as if it had arrived down their /sync streams.
+//
+// Request:
+//  PUT /_matrix/app/v1/transactions/35?access_token=<hs_token>
+//  {
+//      "events": [
+//          // Matrix events
+//      ]
+//  }
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (t *AppServiceTransaction) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "PUT" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	if res := checkHomeserverToken(t.registration, req); res != nil {
+		return *res
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	txnID := segments[len(segments)-1]
+	if txnID == "" {
+		return util.MatrixErrorResponse(400, "M_UNRECOGNIZED", "Missing transaction ID")
+	}
+
+	var body struct {
+		Events []json.RawMessage `json:"events"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MatrixErrorResponse(400, "M_NOT_JSON", "Error parsing request JSON")
+	}
+	if !t.txns.checkAndAdd(txnID, time.Now(), transactionWindow) {
+		log.WithField("txn_id", txnID).Info("Ignoring repeated transaction")
+		return util.JSONResponse{Code: 200, JSON: struct{}{}}
+	}
+	log.WithFields(log.Fields{
+		"txn_id": txnID,
+		"events": len(body.Events),
+	}).Debug("Received transaction")
+	t.clients.ProcessTransaction(txnID, body.Events)
+	return util.JSONResponse{Code: 200, JSON: struct{}{}}
+}
+
+// AppServiceUser represents an HTTP handler capable of answering the homeserver's queries about
+// whether a user in the application service's namespace exists.
+type AppServiceUser struct {
+	Registration *appservice.Registration
+	Clients      *clients.Clients
+}
+
+// OnIncomingRequest handles GET requests to /_matrix/app/v1/users/{userId}. Only users which are
+// configured as application service clients exist.
+//
+// Request:
+//  GET /_matrix/app/v1/users/@neb_github:example.com?access_token=<hs_token>
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (u *AppServiceUser) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "GET" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	if res := checkHomeserverToken(u.Registration, req); res != nil {
+		return *res
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	userID := id.UserID(segments[len(segments)-1])
+	if !u.Clients.IsAppServiceUser(userID) {
+		return util.MatrixErrorResponse(404, "M_NOT_FOUND", "No such user")
+	}
+	return util.JSONResponse{Code: 200, JSON: struct{}{}}
+}
+
+// checkHomeserverToken returns an error response if the request doesn't have the registration's
+// hs_token, either as the access_token query parameter or as a bearer token.
+func checkHomeserverToken(reg *appservice.Registration, req *http.Request) *util.JSONResponse {
+	token := req.URL.Query().Get("access_token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		res := util.MatrixErrorResponse(401, "M_UNAUTHORIZED", "Missing token")
+		return &res
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(reg.HSToken)) != 1 {
+		res := util.MatrixErrorResponse(403, "M_FORBIDDEN", "Bad token")
+		return &res
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/appservice"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+)
+
+func TestAppServiceAuth(t *testing.T) {
+	reg, err := appservice.NewRegistration("http://go.neb", "@neb_.*:hs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := clients.New(&database.NopStorage{}, http.DefaultClient)
+	cli.SetAppService(reg)
+	txns := NewAppServiceTransaction(reg, cli)
+	users := &AppServiceUser{reg, cli}
+
+	tests := []struct {
+		method, url, auth string
+		wantCode          int
+	}{
+		{"PUT", "/_matrix/app/v1/transactions/1", "", 401},
+		{"PUT", "/_matrix/app/v1/transactions/1?access_token=wrong", "", 403},
+		{"PUT", "/_matrix/app/v1/transactions/1", "Bearer " + reg.ASToken, 403},
+		{"PUT", "/_matrix/app/v1/transactions/1?access_token=" + reg.HSToken, "", 200},
+		{"PUT", "/transactions/2", "Bearer " + reg.HSToken, 200},
+		// Retries are accepted without being processed again
+		{"PUT", "/transactions/2", "Bearer " + reg.HSToken, 200},
+		{"GET", "/_matrix/app/v1/transactions/3", "Bearer " + reg.HSToken, 405},
+		{"GET", "/_matrix/app/v1/users/@alice:hs", "Bearer " + reg.HSToken, 404},
+		{"GET", "/_matrix/app/v1/users/@alice:hs", "", 401},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://go.neb"+test.url, bytes.NewBufferString(`{"events":[]}`))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		var code int
+		if strings.Contains(test.url, "/users/") {
+			code = users.OnIncomingRequest(req).Code
+		} else {
+			code = txns.OnIncomingRequest(req).Code
+		}
+		if code != test.wantCode {
+			t.Errorf("%s %s with %q: got HTTP %d, want %d", test.method, test.url, test.auth, code, test.wantCode)
+		}
+	}
+}
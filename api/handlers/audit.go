@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// recordAudit stores the change made by an admin API request in the audit log. Failures are logged
+// but do not fail the request, as the change has already been made.
+func recordAudit(db *database.ServiceDB, req *http.Request, entry api.AuditEntry, oldConfig, newConfig interface{}) {
+	entry.Actor = requestActor(req)
+	entry.SourceIP = requestSourceIP(req)
+	storeAudit(db, entry, oldConfig, newConfig)
+}
+
+// storeAudit stores a change in the audit log. Failures are logged, as the change has already been made.
+func storeAudit(db *database.ServiceDB, entry api.AuditEntry, oldConfig, newConfig interface{}) {
+	logger := log.WithFields(log.Fields{
+		"action":    entry.Action,
+		"target_id": entry.TargetID,
+	})
+	var err error
+	if entry.OldConfig, err = json.Marshal(oldConfig); err != nil {
+		logger.WithError(err).Error("Failed to marshal old config for the audit log")
+		return
+	}
+	if entry.NewConfig, err = json.Marshal(newConfig); err != nil {
+		logger.WithError(err).Error("Failed to marshal new config for the audit log")
+		return
+	}
+	if err = db.StoreAuditEntry(entry); err != nil {
+		logger.WithError(err).Error("Failed to StoreAuditEntry")
+	}
+}
+
+// requestActor returns who made an admin API request. This is the name of the API key used.
+func requestActor(req *http.Request) string {
+	actor, _ := req.Context().Value(actorContextKey).(string)
+	return actor
+}
+
+func requestSourceIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// configChange is a single value which differs between two versions of a config.
+type configChange struct {
+	// The path to the value, e.g. "Rooms.!foo:localhost.Repos". Empty if the whole config changed.
+	Path string
+	// The value before and after the change. Missing if the value was added or removed.
+	Old json.RawMessage `json:",omitempty"`
+	New json.RawMessage `json:",omitempty"`
+}
+
+// diffConfigs returns the values which differ between two JSON configs, sorted by path. Objects are
+// compared key by key; any other values, including arrays, are compared as a whole.
+func diffConfigs(oldJSON, newJSON json.RawMessage) []configChange {
+	var oldVal, newVal interface{}
+	if err := json.Unmarshal(oldJSON, &oldVal); err != nil {
+		oldVal = nil
+	}
+	if err := json.Unmarshal(newJSON, &newVal); err != nil {
+		newVal = nil
+	}
+	changes := []configChange{}
+	diffValues("", oldVal, newVal, &changes)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func diffValues(path string, oldVal, newVal interface{}, changes *[]configChange) {
+	oldObj, oldIsObj := oldVal.(map[string]interface{})
+	newObj, newIsObj := newVal.(map[string]interface{})
+	if oldIsObj && newIsObj {
+		for k, v := range oldObj {
+			diffValues(joinPath(path, k), v, newObj[k], changes)
+		}
+		for k, v := range newObj {
+			if _, ok := oldObj[k]; !ok {
+				diffValues(joinPath(path, k), nil, v, changes)
+			}
+		}
+		return
+	}
+	oldJSON, _ := json.Marshal(oldVal)
+	newJSON, _ := json.Marshal(newVal)
+	if bytes.Equal(oldJSON, newJSON) {
+		return
+	}
+	change := configChange{Path: path}
+	if oldVal != nil {
+		change.Old = oldJSON
+	}
+	if newVal != nil {
+		change.New = newJSON
+	}
+	*changes = append(*changes, change)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// redactChanges redacts secrets in the changes, including changes to the secrets themselves.
+func redactChanges(changes []configChange) ([]configChange, error) {
+	for i, c := range changes {
+		keys := strings.Split(c.Path, ".")
+		if isSecretKey(keys[len(keys)-1]) {
+			changes[i].Old, changes[i].New = redactedChange(c.Old), redactedChange(c.New)
+			continue
+		}
+		var err error
+		if changes[i].Old, err = redactSecrets(c.Old); err != nil {
+			return nil, err
+		}
+		if changes[i].New, err = redactSecrets(c.New); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+func redactedChange(v json.RawMessage) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	return json.RawMessage(`"` + redactedValue + `"`)
+}
+
+// ServiceHistory represents an HTTP handler which can process /admin/serviceHistory requests.
+type ServiceHistory struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/serviceHistory.
+//
+// The request body MUST be a JSON body which has an "ID" key which represents the service ID.
+// Every change made to the service through the admin API is returned, oldest first. "Version" can
+// be passed to /admin/rollbackService to restore the config as it was after that change. Secrets in
+// the configs and changes are replaced with "REDACTED".
+//
+// Request:
+//  POST /admin/serviceHistory
+//  {
+//      "ID": "my_service_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "History": [
+//          {
+//              "Version": 42,
+//              "Action": "configureService",
+//              "Type": "github",
+//              "UserID": "@my_bot:localhost",
+//              "Actor": "alice",
+//              "SourceIP": "10.0.0.1",
+//              "Time": "2017-01-01T12:00:00Z",
+//              "Config": {
+//                  // service-specific config information after the change
+//              },
+//              "Changes": [
+//                  {
+//                      "Path": "Rooms.!foo:localhost.Repos",
+//                      "Old": { ... },
+//                      "New": { ... }
+//                  }
+//              ]
+//          }
+//      ]
+//  }
+func (h *ServiceHistory) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.ID == "" {
+		return util.MessageResponse(400, `Must supply a "ID"`)
+	}
+
+	entries, err := h.Db.LoadAuditEntries("service", body.ID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadAuditEntries")
+		return util.MessageResponse(500, "Failed to load service history")
+	}
+
+	type historyEntry struct {
+		Version  int64
+		Action   string
+		Type     string
+		UserID   id.UserID
+		Actor    string
+		SourceIP string
+		Time     time.Time
+		Config   json.RawMessage
+		Changes  []configChange
+	}
+	history := []historyEntry{}
+	for _, e := range entries {
+		config, err := redactSecrets(e.NewConfig)
+		var changes []configChange
+		if err == nil {
+			changes, err = redactChanges(diffConfigs(e.OldConfig, e.NewConfig))
+		}
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("version", e.ID).Error("Failed to redact service history")
+			return util.MessageResponse(500, "Failed to load service history")
+		}
+		history = append(history, historyEntry{
+			e.ID, e.Action, e.TargetType, e.UserID, e.Actor, e.SourceIP, e.Time, config, changes,
+		})
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID      string
+			History []historyEntry
+		}{body.ID, history},
+	}
+}
+
+// RollbackService represents an HTTP handler which can process /admin/rollbackService requests.
+type RollbackService struct {
+	db        *database.ServiceDB
+	configure *ConfigureService
+}
+
+// NewRollbackService creates a new RollbackService handler. Rollbacks are registered in the same
+// way as /admin/configureService requests, and are serialised with them.
+func NewRollbackService(db *database.ServiceDB, configure *ConfigureService) *RollbackService {
+	return &RollbackService{
+		db:        db,
+		configure: configure,
+	}
+}
+
+// OnIncomingRequest handles POST requests to /admin/rollbackService.
+//
+// The request body MUST be a JSON body which has an "ID" key which represents the service ID and
+// a "Version" key from /admin/serviceHistory. The service is registered again with its config as
+// it was after that change, which will restore a deleted service. The rollback is itself recorded
+// in the service history. The response is the same as /admin/configureService.
+//
+// Request:
+//  POST /admin/rollbackService
+//  {
+//      "ID": "my_service_id",
+//      "Version": 42
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "Type": "service-type",
+//      "OldConfig": {
+//          // old service-specific config information
+//      },
+//      "NewConfig": {
+//          // restored service-specific config information
+//      },
+//  }
+func (h *RollbackService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID      string
+		Version int64
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.ID == "" || body.Version == 0 {
+		return util.MessageResponse(400, `Must supply an "ID" and a "Version"`)
+	}
+
+	entry, err := h.db.LoadAuditEntry(body.Version)
+	if err != nil && err != sql.ErrNoRows {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadAuditEntry")
+		return util.MessageResponse(500, "Failed to load service history")
+	}
+	if err == sql.ErrNoRows || entry.Kind != "service" || entry.TargetID != body.ID {
+		return util.MessageResponse(404, "Version not found for this service")
+	}
+	if string(entry.NewConfig) == "null" {
+		return util.MessageResponse(400, "Cannot roll back to a version which deleted the service")
+	}
+
+	service, err := types.CreateService(entry.TargetID, entry.TargetType, entry.UserID, entry.NewConfig)
+	if err != nil {
+		return util.MessageResponse(400, "Error parsing config JSON: "+err.Error())
+	}
+	return h.configure.configure(req, service, "rollbackService")
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	oldJSON := json.RawMessage(`{"api_key":"a","Rooms":{"!a:localhost":{"Repos":["x"]}},"removed":1}`)
+	newJSON := json.RawMessage(`{"api_key":"b","Rooms":{"!a:localhost":{"Repos":["x","y"]}},"added":true}`)
+	want := []configChange{
+		{"Rooms.!a:localhost.Repos", json.RawMessage(`["x"]`), json.RawMessage(`["x","y"]`)},
+		{"added", nil, json.RawMessage(`true`)},
+		{"api_key", json.RawMessage(`"a"`), json.RawMessage(`"b"`)},
+		{"removed", json.RawMessage(`1`), nil},
+	}
+	if got := diffConfigs(oldJSON, newJSON); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffConfigs: got %s, want %s", marshal(got), marshal(want))
+	}
+
+	if got := diffConfigs(newJSON, newJSON); len(got) != 0 {
+		t.Errorf("Expected no changes for identical configs, got %s", marshal(got))
+	}
+
+	got := diffConfigs(json.RawMessage(`null`), json.RawMessage(`{"api_key":"a"}`))
+	if len(got) != 1 || got[0].Path != "" || got[0].Old != nil {
+		t.Errorf("Expected a created config to be a single change, got %s", marshal(got))
+	}
+}
+
+func TestServiceHistoryRedactsSecrets(t *testing.T) {
+	db := newTestDB(t)
+	req := newAdminRequest("/admin/configureService", "")
+	entry := api.AuditEntry{Action: "configureService", Kind: "service", TargetID: "a", TargetType: "secretive"}
+	recordAudit(db, req, entry, nil, json.RawMessage(`{"api_key":"first","rooms":["!a:hs"]}`))
+	recordAudit(db, req, entry, json.RawMessage(`{"api_key":"first","rooms":["!a:hs"]}`),
+		json.RawMessage(`{"api_key":"second","rooms":["!a:hs"],"verification":{"method":"bearer","secret":"third"}}`))
+
+	res := (&ServiceHistory{db}).OnIncomingRequest(newAdminRequest("/admin/serviceHistory", `{"ID":"a"}`))
+	body := marshal(res.JSON)
+	if res.Code != 200 || strings.Contains(body, "first") || strings.Contains(body, "second") || strings.Contains(body, "third") {
+		t.Fatalf("Expected the history without secrets, got HTTP %d %s", res.Code, body)
+	}
+	for _, want := range []string{
+		`"Path":"api_key","Old":"REDACTED","New":"REDACTED"`,
+		`"Path":"verification","New":{"method":"bearer","secret":"REDACTED"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the history to contain %s, got %s", want, body)
+		}
+	}
+}
+
+func marshal(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
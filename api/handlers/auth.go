@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"io"
 	"net/http"
 	"strings"
 
@@ -119,15 +120,28 @@ func (h *RemoveAuthSession) OnIncomingRequest(req *http.Request) util.JSONRespon
 		return util.MessageResponse(400, `Must supply a "UserID", a "RealmID"`)
 	}
 
-	_, err := h.Db.LoadAuthRealm(body.RealmID)
+	realm, err := h.Db.LoadAuthRealm(body.RealmID)
 	if err != nil {
 		return util.MessageResponse(400, "Unknown RealmID")
 	}
 
+	session, err := h.Db.LoadAuthSessionByUser(body.RealmID, body.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		logger.WithError(err).Error("Failed to LoadAuthSessionByUser")
+		return util.MessageResponse(500, "Failed to load auth session")
+	}
+
 	if err := h.Db.RemoveAuthSession(body.RealmID, body.UserID); err != nil {
 		logger.WithError(err).Error("Failed to RemoveAuthSession")
 		return util.MessageResponse(500, "Failed to remove auth session")
 	}
+	recordAudit(h.Db, req, api.AuditEntry{
+		Action:     "removeAuthSession",
+		Kind:       "session",
+		TargetID:   body.RealmID,
+		TargetType: realm.Type(),
+		UserID:     body.UserID,
+	}, session, nil)
 
 	return util.JSONResponse{
 		Code: 200,
@@ -227,6 +241,12 @@ func (h *ConfigureAuthRealm) OnIncomingRequest(req *http.Request) util.JSONRespo
 		logger.WithError(err).Error("Failed to StoreAuthRealm")
 		return util.MessageResponse(500, "Error storing realm")
 	}
+	recordAudit(h.Db, req, api.AuditEntry{
+		Action:     "configureAuthRealm",
+		Kind:       "realm",
+		TargetID:   body.ID,
+		TargetType: body.Type,
+	}, oldRealm, realm)
 
 	return util.JSONResponse{
 		Code: 200,
@@ -310,3 +330,138 @@ func (h *GetSession) OnIncomingRequest(req *http.Request) util.JSONResponse {
 		}{session.ID(), session.Authenticated(), session.Info()},
 	}
 }
+
+// ListRealms represents an HTTP handler capable of processing /admin/listRealms requests.
+type ListRealms struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/listRealms.
+//
+// The request body MAY be a JSON object with a "Type" key to only list realms of that type.
+// Realm configs are not returned as they contain secrets: use the realm ID to look them up.
+//
+// Request:
+//  POST /admin/listRealms
+//  {
+//      "Type": "github"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Realms": [
+//          {
+//              "ID": "github_realm_id",
+//              "Type": "github"
+//          }
+//      ]
+//  }
+func (h *ListRealms) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Type string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	var realms []types.AuthRealm
+	var err error
+	if body.Type != "" {
+		realms, err = h.Db.LoadAuthRealmsByType(body.Type)
+	} else {
+		realms, err = h.Db.LoadAuthRealms()
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to load auth realms")
+		return util.MessageResponse(500, "Failed to load auth realms")
+	}
+
+	type realmInfo struct {
+		ID   string
+		Type string
+	}
+	realmInfos := []realmInfo{}
+	for _, r := range realms {
+		realmInfos = append(realmInfos, realmInfo{r.ID(), r.Type()})
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Realms []realmInfo
+		}{realmInfos},
+	}
+}
+
+// ListSessions represents an HTTP handler capable of processing /admin/listSessions requests.
+type ListSessions struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/listSessions.
+//
+// The request body MAY be a JSON object with "RealmID" and/or "UserID" keys to only list
+// matching sessions. Session tokens are not returned.
+//
+// Request:
+//  POST /admin/listSessions
+//  {
+//      "RealmID": "github_realm_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Sessions": [
+//          {
+//              "ID": "session_id",
+//              "RealmID": "github_realm_id",
+//              "UserID": "@my_user:localhost",
+//              "Authenticated": true
+//          }
+//      ]
+//  }
+func (h *ListSessions) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		RealmID string
+		UserID  id.UserID
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	sessions, err := h.Db.LoadAuthSessions()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadAuthSessions")
+		return util.MessageResponse(500, "Failed to load auth sessions")
+	}
+
+	type sessionInfo struct {
+		ID            string
+		RealmID       string
+		UserID        id.UserID
+		Authenticated bool
+	}
+	sessionInfos := []sessionInfo{}
+	for _, s := range sessions {
+		if body.RealmID != "" && s.RealmID() != body.RealmID {
+			continue
+		}
+		if body.UserID != "" && s.UserID() != body.UserID {
+			continue
+		}
+		sessionInfos = append(sessionInfos, sessionInfo{s.ID(), s.RealmID(), s.UserID(), s.Authenticated()})
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Sessions []sessionInfo
+		}{sessionInfos},
+	}
+}
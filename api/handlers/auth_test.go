@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type fakeRealm struct {
+	id           string
+	ClientSecret string
+}
+
+func (r *fakeRealm) ID() string                                                 { return r.id }
+func (r *fakeRealm) Type() string                                               { return "fake" }
+func (r *fakeRealm) Init() error                                                { return nil }
+func (r *fakeRealm) Register() error                                            { return nil }
+func (r *fakeRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {}
+func (r *fakeRealm) RequestAuthSession(userID id.UserID, config json.RawMessage) interface{} {
+	return nil
+}
+func (r *fakeRealm) AuthSession(sessionID string, userID id.UserID, realmID string) types.AuthSession {
+	return &fakeSession{id: sessionID, userID: userID, realmID: realmID}
+}
+
+type fakeSession struct {
+	id          string
+	userID      id.UserID
+	realmID     string
+	AccessToken string
+}
+
+func (s *fakeSession) ID() string          { return s.id }
+func (s *fakeSession) UserID() id.UserID   { return s.userID }
+func (s *fakeSession) RealmID() string     { return s.realmID }
+func (s *fakeSession) Authenticated() bool { return s.AccessToken != "" }
+func (s *fakeSession) Info() interface{}   { return nil }
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &fakeRealm{id: realmID}
+	})
+}
+
+func TestListRealmsAndSessions(t *testing.T) {
+	db := newTestDB(t)
+	for _, realmID := range []string{"r1", "r2"} {
+		if _, err := db.StoreAuthRealm(&fakeRealm{id: realmID, ClientSecret: "sekrit"}); err != nil {
+			t.Fatalf("Failed to store realm: %s", err)
+		}
+	}
+	sessions := []*fakeSession{
+		{"s1", "@alice:hs", "r1", "alice_token"},
+		{"s2", "@bob:hs", "r1", ""},
+		{"s3", "@alice:hs", "r2", "alice_token"},
+	}
+	for _, s := range sessions {
+		if _, err := db.StoreAuthSession(s); err != nil {
+			t.Fatalf("Failed to store session: %s", err)
+		}
+	}
+
+	res := (&ListRealms{db}).OnIncomingRequest(newAdminRequest("/admin/listRealms", ""))
+	if body := marshal(res.JSON); res.Code != 200 || body != `{"Realms":[{"ID":"r1","Type":"fake"},{"ID":"r2","Type":"fake"}]}` {
+		t.Errorf("Expected both realms without their configs, got HTTP %d %s", res.Code, body)
+	}
+
+	testCases := []struct {
+		body    string
+		wantIDs string
+	}{
+		{"", "s1,s2,s3"},
+		{`{"RealmID":"r1"}`, "s1,s2"},
+		{`{"UserID":"@alice:hs"}`, "s1,s3"},
+		{`{"RealmID":"r2","UserID":"@bob:hs"}`, ""},
+	}
+	for _, tc := range testCases {
+		res = (&ListSessions{db}).OnIncomingRequest(newAdminRequest("/admin/listSessions", tc.body))
+		var got struct {
+			Sessions []struct {
+				ID            string
+				Authenticated bool
+			}
+		}
+		body := marshal(res.JSON)
+		if err := json.Unmarshal([]byte(body), &got); res.Code != 200 || err != nil {
+			t.Fatalf("Body %q: got HTTP %d %s", tc.body, res.Code, body)
+		}
+		var ids []string
+		for _, s := range got.Sessions {
+			ids = append(ids, s.ID)
+		}
+		if strings.Join(ids, ",") != tc.wantIDs || strings.Contains(body, "alice_token") {
+			t.Errorf("Body %q: got %s, want sessions %s without tokens", tc.body, body, tc.wantIDs)
+		}
+	}
+}
@@ -1,17 +1,22 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/util"
 	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
 )
 
 // ConfigureClient represents an HTTP handler capable of processing /admin/configureClient requests.
 type ConfigureClient struct {
+	Db      *database.ServiceDB
 	Clients *clients.Clients
 }
 
@@ -21,6 +26,10 @@ type ConfigureClient struct {
 // If a DisplayName is supplied, this request will set this client's display name
 // if the old ClientConfig DisplayName differs from the new ClientConfig DisplayName.
 //
+// If there is no AccessToken, Go-NEB logs in with the Password or LoginToken and stores the access
+// token, device ID and refresh token it gets. The access token is checked with /account/whoami
+// before the client is stored.
+//
 // Request:
 //  POST /admin/configureClient
 //  {
@@ -56,9 +65,19 @@ func (s *ConfigureClient) OnIncomingRequest(req *http.Request) util.JSONResponse
 
 	oldClient, err := s.Clients.Update(body)
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).WithField("body", body).Error("Failed to Clients.Update")
+		util.GetLogger(req.Context()).WithError(err).WithField("user_id", body.UserID).Error("Failed to Clients.Update")
 		return util.MessageResponse(500, "Error storing token")
 	}
+	var oldConfig interface{}
+	if oldClient.UserID != "" {
+		oldConfig = oldClient
+	}
+	recordAudit(s.Db, req, api.AuditEntry{
+		Action:   "configureClient",
+		Kind:     "client",
+		TargetID: string(body.UserID),
+		UserID:   body.UserID,
+	}, oldConfig, body)
 
 	return util.JSONResponse{
 		Code: 200,
@@ -69,6 +88,197 @@ func (s *ConfigureClient) OnIncomingRequest(req *http.Request) util.JSONResponse
 	}
 }
 
+// ListClients represents an HTTP handler capable of processing /admin/listClients requests.
+type ListClients struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/listClients.
+//
+// The request body MAY be a JSON object with a "UserID" key to only return that client.
+// Access tokens, passwords, login tokens, refresh tokens and pickle keys are never returned.
+//
+// Request:
+//  POST /admin/listClients
+//  {}
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Clients": [
+//          {
+//              "UserID": "@my_bot:localhost",
+//              "HomeserverURL": "http://localhost:8008",
+//              "AccessToken": "",
+//              "Sync": true,
+//              // ... the rest of the api.ClientConfig
+//          }
+//      ]
+//  }
+func (s *ListClients) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		UserID id.UserID
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	configs, err := s.Db.LoadMatrixClientConfigs()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadMatrixClientConfigs")
+		return util.MessageResponse(500, "Failed to load clients")
+	}
+
+	clientConfigs := []api.ClientConfig{}
+	for _, cfg := range configs {
+		if body.UserID != "" && cfg.UserID != body.UserID {
+			continue
+		}
+		cfg.AccessToken = ""
+		cfg.Password = ""
+		cfg.LoginToken = ""
+		cfg.RefreshToken = ""
+		cfg.PickleKey = ""
+		clientConfigs = append(clientConfigs, cfg)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Clients []api.ClientConfig
+		}{clientConfigs},
+	}
+}
+
+// ClientStatus represents an HTTP handler capable of processing /admin/clientStatus requests.
+type ClientStatus struct {
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/clientStatus. It returns the health of the /sync
+// stream of each client which is syncing, so that monitoring can alert when a bot stops receiving
+// events. The State is "connecting", "syncing", "backing-off" or "auth-failed".
+//
+// The request body MAY be a JSON object with a "UserID" key to only return that client.
+//
+// Request:
+//  POST /admin/clientStatus
+//  {}
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Clients": [
+//          {
+//              "UserID": "@my_bot:localhost",
+//              "State": "backing-off",
+//              "LastSync": "2016-10-18T12:00:00Z",
+//              "LastError": "Get http://localhost:8008/_matrix/client/r0/sync: connection refused",
+//              "Failures": 3,
+//              "NextRetry": "2016-10-18T12:00:04Z"
+//          }
+//      ]
+//  }
+func (s *ClientStatus) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		UserID id.UserID
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	statuses := []api.ClientStatus{}
+	for _, st := range s.Clients.Status() {
+		if body.UserID != "" && st.UserID != body.UserID {
+			continue
+		}
+		statuses = append(statuses, st)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Clients []api.ClientStatus
+		}{statuses},
+	}
+}
+
+// RemoveClient represents an HTTP handler capable of processing /admin/removeClient requests.
+type RemoveClient struct {
+	Db      *database.ServiceDB
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/removeClient.
+//
+// The client's /sync stream is stopped and its config is deleted. This will return HTTP 400
+// if any services are still configured to use the client: delete them first.
+//
+// Request:
+//  POST /admin/removeClient
+//  {
+//      "UserID": "@my_bot:localhost"
+//  }
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (s *RemoveClient) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		UserID id.UserID
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.UserID == "" {
+		return util.MessageResponse(400, `Must supply a "UserID"`)
+	}
+
+	logger := util.GetLogger(req.Context()).WithField("user_id", body.UserID)
+	srvs, err := s.Db.LoadServicesForUser(body.UserID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to LoadServicesForUser")
+		return util.MessageResponse(500, "Failed to load services")
+	}
+	if len(srvs) > 0 {
+		return util.MessageResponse(400, "Client is still in use by services")
+	}
+
+	oldConfig, err := s.Db.LoadMatrixClientConfig(body.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		logger.WithError(err).Error("Failed to LoadMatrixClientConfig")
+		return util.MessageResponse(500, "Failed to load client")
+	}
+
+	if err := s.Clients.Remove(body.UserID); err != nil {
+		logger.WithError(err).Error("Failed to Clients.Remove")
+		return util.MessageResponse(500, "Failed to remove client")
+	}
+	if err != sql.ErrNoRows {
+		recordAudit(s.Db, req, api.AuditEntry{
+			Action:   "removeClient",
+			Kind:     "client",
+			TargetID: string(body.UserID),
+			UserID:   body.UserID,
+		}, oldConfig, nil)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
 // VerifySAS represents an HTTP handler capable of processing /verifySAS requests.
 type VerifySAS struct {
 	Clients *clients.Clients
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestListAndRemoveClients(t *testing.T) {
+	db := newTestDB(t)
+	for _, userID := range []string{"@a:hs", "@b:hs"} {
+		if _, err := db.StoreMatrixClientConfig(api.ClientConfig{
+			UserID:        id.UserID(userID),
+			HomeserverURL: "https://hs",
+			AccessToken:   "access_" + userID,
+			Password:      "password_" + userID,
+			RefreshToken:  "refresh_" + userID,
+			PickleKey:     "pickle_" + userID,
+		}); err != nil {
+			t.Fatalf("Failed to store client: %s", err)
+		}
+	}
+	storeTestService(t, db, "a", "@a:hs", `{"rooms":["!a:hs"]}`)
+
+	list := &ListClients{db}
+	res := list.OnIncomingRequest(newAdminRequest("/admin/listClients", ""))
+	body := marshal(res.JSON)
+	if res.Code != 200 || !strings.Contains(body, "@a:hs") || !strings.Contains(body, "@b:hs") {
+		t.Errorf("Expected both clients to be listed, got HTTP %d %s", res.Code, body)
+	}
+	for _, secret := range []string{"access_", "password_", "refresh_", "pickle_"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Expected %s secrets not to be listed, got %s", secret, body)
+		}
+	}
+	res = list.OnIncomingRequest(newAdminRequest("/admin/listClients", `{"UserID":"@b:hs"}`))
+	if body = marshal(res.JSON); strings.Contains(body, "@a:hs") || !strings.Contains(body, "@b:hs") {
+		t.Errorf("Expected only @b:hs to be listed, got %s", body)
+	}
+
+	remove := &RemoveClient{db, clients.New(db, nil)}
+	if res = remove.OnIncomingRequest(newAdminRequest("/admin/removeClient", `{"UserID":"@a:hs"}`)); res.Code != 400 {
+		t.Errorf("Expected a client used by a service not to be removed, got HTTP %d", res.Code)
+	}
+	if res = remove.OnIncomingRequest(newAdminRequest("/admin/removeClient", `{"UserID":"@b:hs"}`)); res.Code != 200 {
+		t.Fatalf("Failed to remove client: HTTP %d %s", res.Code, marshal(res.JSON))
+	}
+	if configs, err := db.LoadMatrixClientConfigs(); err != nil || len(configs) != 1 || configs[0].UserID != "@a:hs" {
+		t.Errorf("Expected only @a:hs to be left, got %+v (%v)", configs, err)
+	}
+	if entries, err := db.LoadAuditEntries("client", "@b:hs"); err != nil || len(entries) != 1 || entries[0].Action != "removeClient" {
+		t.Errorf("Expected the removal to be audited, got %+v (%v)", entries, err)
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+	"maunium.net/go/mautrix/id"
+)
+
+// ValidateConfig represents an HTTP handler capable of processing /admin/validateConfig requests.
+type ValidateConfig struct{}
+
+// OnIncomingRequest handles POST requests to /admin/validateConfig. The JSON object provided
+// is of type "api.ConfigFile", i.e. the config file converted to JSON.
+//
+// The config is checked without contacting Matrix or any third party, and nothing is stored.
+// All problems are reported, along with the path in the config file to the offending entry.
+//
+// Request:
+//  POST /admin/validateConfig
+//  {
+//      "Clients": [ ... ],
+//      "Realms": [ ... ],
+//      "Sessions": [ ... ],
+//      "Services": [ ... ]
+//  }
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Valid": false,
+//      "Errors": [
+//          "services[1].Type: Unknown service type: gihtub"
+//      ]
+//  }
+func (h *ValidateConfig) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body api.ConfigFile
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	errs := []string{}
+	for _, err := range ValidateConfigFile(&body) {
+		errs = append(errs, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Valid  bool
+			Errors []string
+		}{len(errs) == 0, errs},
+	}
+}
+
+// ValidateConfigFile checks every client, realm, session and service in the config, and returns all
+// the problems found. Each error is prefixed with the path to the entry in the config file, e.g.
+// "services[2].Config". Nothing is stored, and Matrix and third parties are not contacted.
+func ValidateConfigFile(cfg *api.ConfigFile) (errs []error) {
+	fail := func(path string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, err))
+	}
+
+	clientIDs := make(map[id.UserID]bool)
+	for i, c := range cfg.Clients {
+		path := fmt.Sprintf("clients[%d]", i)
+		if err := c.Check(); err != nil {
+			fail(path, err)
+		}
+		if clientIDs[c.UserID] {
+			fail(path+".UserID", fmt.Errorf("Duplicate client %s", c.UserID))
+		}
+		clientIDs[c.UserID] = true
+	}
+
+	realms := make(map[string]types.AuthRealm)
+	for i, r := range cfg.Realms {
+		path := fmt.Sprintf("realms[%d]", i)
+		if err := r.Check(); err != nil {
+			fail(path, err)
+			continue
+		}
+		if _, exists := realms[r.ID]; exists {
+			fail(path+".ID", fmt.Errorf("Duplicate realm %s", r.ID))
+			continue
+		}
+		realm, err := types.CreateAuthRealm(r.ID, r.Type, r.Config)
+		if err != nil {
+			fail(path, err)
+			continue
+		}
+		realms[r.ID] = realm
+	}
+
+	for i, s := range cfg.Sessions {
+		path := fmt.Sprintf("sessions[%d]", i)
+		if err := s.Check(); err != nil {
+			fail(path, err)
+			continue
+		}
+		realm := realms[s.RealmID]
+		if realm == nil {
+			fail(path+".RealmID", fmt.Errorf("Unknown realm %s", s.RealmID))
+			continue
+		}
+		session := realm.AuthSession(s.SessionID, s.UserID, s.RealmID)
+		if session == nil {
+			fail(path, fmt.Errorf("Cannot create session for realm %s", s.RealmID))
+			continue
+		}
+		if err := json.Unmarshal(s.Config, session); err != nil {
+			fail(path+".Config", err)
+		}
+	}
+
+	serviceIDs := make(map[string]bool)
+	for i, s := range cfg.Services {
+		path := fmt.Sprintf("services[%d]", i)
+		if err := s.Check(); err != nil {
+			fail(path, err)
+			continue
+		}
+		if serviceIDs[s.ID] {
+			fail(path+".ID", fmt.Errorf("Duplicate service %s", s.ID))
+		}
+		serviceIDs[s.ID] = true
+		if !clientIDs[s.UserID] {
+			fail(path+".UserID", fmt.Errorf("Unknown client %s", s.UserID))
+		}
+		service, err := types.CreateService(s.ID, s.Type, s.UserID, s.Config)
+		if err != nil {
+			if !types.IsServiceType(s.Type) {
+				fail(path+".Type", err)
+			} else {
+				fail(path+".Config", err)
+			}
+			continue
+		}
+		if v, ok := service.(types.ConfigValidator); ok {
+			if err := v.ValidateConfig(); err != nil {
+				fail(path+".Config", err)
+			}
+		}
+		if rl, ok := service.(types.RateLimited); ok {
+			if err := rl.CommandRateLimit().Check(); err != nil {
+				fail(path+".Config.rate_limit", err)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type validatingService struct {
+	types.DefaultService
+	Rooms []id.RoomID
+}
+
+func (s *validatingService) ValidateConfig() error {
+	if len(s.Rooms) == 0 {
+		return errors.New("no rooms")
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &validatingService{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, "validating"),
+		}
+	})
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	client := api.ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost:8008", AccessToken: "token"}
+	cfg := api.ConfigFile{
+		Clients: []api.ClientConfig{
+			client,
+			client,
+			{UserID: "@appservice:localhost", HomeserverURL: "http://localhost:8008", AppService: true},
+			{UserID: "@password:localhost", HomeserverURL: "http://localhost:8008", Password: "hunter2"},
+			{UserID: "@no_login:localhost", HomeserverURL: "http://localhost:8008"},
+			{UserID: "@no_homeserver:localhost", AccessToken: "token"},
+		},
+		Services: []api.ConfigureServiceRequest{
+			{ID: "good", Type: "validating", UserID: "@neb:localhost", Config: json.RawMessage(`{"Rooms":["!a:localhost"]}`)},
+			{ID: "unknown_type", Type: "nope", UserID: "@neb:localhost", Config: json.RawMessage(`{}`)},
+			{ID: "bad_json", Type: "validating", UserID: "@neb:localhost", Config: json.RawMessage(`{"Rooms":"!a:localhost"}`)},
+			{ID: "invalid", Type: "validating", UserID: "@unknown:localhost", Config: json.RawMessage(`{}`)},
+			{ID: "good", Type: "validating", UserID: "@neb:localhost", Config: json.RawMessage(`{"Rooms":["!a:localhost"]}`)},
+			{ID: "missing_config", Type: "validating", UserID: "@neb:localhost"},
+			{ID: "bad_rate_limit", Type: "validating", UserID: "@neb:localhost", Config: json.RawMessage(`{"Rooms":["!a:localhost"],"rate_limit":{"burst":0,"per_minute":5}}`)},
+		},
+		Sessions: []api.Session{
+			{SessionID: "session", RealmID: "no_realm", UserID: "@alice:localhost", Config: json.RawMessage(`{}`)},
+		},
+	}
+
+	wantPrefixes := []string{
+		"clients[1].UserID: Duplicate client",
+		`clients[4]: Must supply an "AccessToken", a "Password" or a "LoginToken", or set "AppService"`,
+		`clients[5]: Must supply a "UserID" and a "HomeserverURL"`,
+		"sessions[0].RealmID: Unknown realm",
+		"services[1].Type: Unknown service type",
+		"services[2].Config: json:",
+		"services[3].UserID: Unknown client",
+		"services[3].Config: no rooms",
+		"services[4].ID: Duplicate service",
+		"services[5]: Must supply",
+		"services[6].Config.rate_limit: rate_limit burst",
+	}
+	errs := ValidateConfigFile(&cfg)
+	if len(errs) != len(wantPrefixes) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(wantPrefixes), len(errs), errs)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), wantPrefixes[i]) {
+			t.Errorf("Error %d: got %q, want prefix %q", i, err.Error(), wantPrefixes[i])
+		}
+	}
+}
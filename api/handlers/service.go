@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/matrix-org/go-neb/api"
@@ -16,6 +18,7 @@ import (
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
 )
 
 // ConfigureService represents an HTTP handler which can process /admin/configureService requests.
@@ -84,6 +87,11 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 	if httpErr != nil {
 		return *httpErr
 	}
+	return s.configure(req, service, "configureService")
+}
+
+// configure registers and stores the service, then records the change in the audit log as the given action.
+func (s *ConfigureService) configure(req *http.Request, service types.Service, action string) util.JSONResponse {
 	logger := util.GetLogger(req.Context())
 	logger.WithFields(log.Fields{
 		"service_id":      service.ServiceID(),
@@ -91,6 +99,46 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 		"service_user_id": service.ServiceUserID(),
 	}).Print("Incoming configure service request")
 
+	oldService, err := s.Apply(service, action, requestActor(req), requestSourceIP(req))
+	if err != nil {
+		code := 500
+		if cerr, ok := err.(*configureError); ok {
+			code = cerr.code
+		}
+		return util.MessageResponse(code, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID        string
+			Type      string
+			OldConfig types.Service
+			NewConfig types.Service
+		}{service.ServiceID(), service.ServiceType(), oldService, service},
+	}
+}
+
+// configureError is an error configuring a service, with the HTTP status code to respond with.
+type configureError struct {
+	code    int
+	message string
+}
+
+func (e *configureError) Error() string {
+	return e.message
+}
+
+// Apply registers and stores a new or changed service, records the change in the audit log as the given
+// action by the given actor, then starts it. If the ID is being reused for a different type of service,
+// the old service is torn down. This is shared by the admin API and config file reloads. Returns the
+// service as it was stored before, or nil if it is new.
+func (s *ConfigureService) Apply(service types.Service, action, actor, sourceIP string) (types.Service, error) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   service.ServiceID(),
+		"service_type": service.ServiceType(),
+	})
+
 	// Have mutexes around each service to queue up multiple requests for the same service ID
 	mut := s.getMutexForServiceID(service.ServiceID())
 	mut.Lock()
@@ -99,51 +147,54 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 	old, err := s.db.LoadService(service.ServiceID())
 	if err != nil && err != sql.ErrNoRows {
 		logger.WithError(err).Error("Failed to LoadService")
-		return util.MessageResponse(500, "Error loading old service")
+		return nil, &configureError{500, "Error loading old service"}
 	}
 
 	client, err := s.clients.Client(service.ServiceUserID())
 	if err != nil {
-		return util.MessageResponse(400, "Unknown matrix client")
+		return nil, &configureError{400, "Unknown matrix client"}
 	}
 
 	if err := checkClientForService(service, client); err != nil {
-		return util.MessageResponse(400, err.Error())
+		return nil, &configureError{400, err.Error()}
 	}
 
 	if err = service.Register(old, client); err != nil {
-		return util.MessageResponse(500, "Failed to register service: "+err.Error())
+		return nil, &configureError{500, "Failed to register service: " + err.Error()}
 	}
 
 	oldService, err := s.db.StoreService(service)
 	if err != nil {
 		logger.WithError(err).Error("Failed to StoreService")
-		return util.MessageResponse(500, "Error storing service")
+		return nil, &configureError{500, "Error storing service"}
+	}
+	storeAudit(s.db, api.AuditEntry{
+		Action:     action,
+		Kind:       "service",
+		TargetID:   service.ServiceID(),
+		TargetType: service.ServiceType(),
+		UserID:     service.ServiceUserID(),
+		Actor:      actor,
+		SourceIP:   sourceIP,
+	}, oldService, service)
+
+	// If the ID has been reused for a different type of service, the old service will never see another
+	// PostRegister so tear it down now, before any polling starts for the new service.
+	if old != nil && old.ServiceType() != service.ServiceType() {
+		TeardownService(old, s.clients)
 	}
 
 	// Start any polling NOW because they may decide to stop it in PostRegister, and we want to make
 	// sure we'll actually stop.
 	if _, ok := service.(types.Poller); ok {
 		if err := polling.StartPolling(service); err != nil {
-			logger.WithFields(log.Fields{
-				"service_id": service.ServiceID(),
-				log.ErrorKey: err,
-			}).Error("Failed to start poll loop.")
+			logger.WithError(err).Error("Failed to start poll loop.")
 		}
 	}
 
 	service.PostRegister(old)
 	metrics.IncrementConfigureService(service.ServiceType())
-
-	return util.JSONResponse{
-		Code: 200,
-		JSON: struct {
-			ID        string
-			Type      string
-			OldConfig types.Service
-			NewConfig types.Service
-		}{service.ServiceID(), service.ServiceType(), oldService, service},
-	}
+	return oldService, nil
 }
 
 func (s *ConfigureService) createService(req *http.Request) (types.Service, *util.JSONResponse) {
@@ -157,12 +208,23 @@ func (s *ConfigureService) createService(req *http.Request) (types.Service, *uti
 		res := util.MessageResponse(400, err.Error())
 		return nil, &res
 	}
+	if hasRedactedSecret(body.Config) {
+		res := util.MessageResponse(400, `Config has a secret set to "`+redactedValue+`": use the real value, `+
+			`which getService returns to API keys with the "services" scope`)
+		return nil, &res
+	}
 
 	service, err := types.CreateService(body.ID, body.Type, body.UserID, body.Config)
 	if err != nil {
 		res := util.MessageResponse(400, "Error parsing config JSON")
 		return nil, &res
 	}
+	if rl, ok := service.(types.RateLimited); ok {
+		if err := rl.CommandRateLimit().Check(); err != nil {
+			res := util.MessageResponse(400, err.Error())
+			return nil, &res
+		}
+	}
 	return service, nil
 }
 
@@ -174,7 +236,8 @@ type GetService struct {
 // OnIncomingRequest handles POST requests to /admin/getService.
 //
 // The request body MUST be a JSON body which has an "ID" key which represents
-// the service ID to get.
+// the service ID to get. Secrets in the config are replaced with "REDACTED" unless the API key has
+// the "services" or "admin" scope, so that the config can be edited and sent back to configureService.
 //
 // Request:
 //  POST /admin/getService
@@ -214,13 +277,213 @@ func (h *GetService) OnIncomingRequest(req *http.Request) util.JSONResponse {
 		return util.MessageResponse(500, `Failed to load service`)
 	}
 
+	config, err := serviceConfig(req, srv)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to marshal service")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+
 	return util.JSONResponse{
 		Code: 200,
 		JSON: struct {
 			ID     string
 			Type   string
-			Config types.Service
-		}{srv.ServiceID(), srv.ServiceType(), srv},
+			Config json.RawMessage
+		}{srv.ServiceID(), srv.ServiceType(), config},
+	}
+}
+
+// ListServices represents an HTTP handler which can process /admin/listServices requests.
+type ListServices struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/listServices.
+//
+// The request body MAY be a JSON object with "Type" and/or "UserID" keys to only list services
+// of that type or for that service user ID. An empty body lists every service. Secrets in the
+// config, such as API keys and tokens, are replaced with "REDACTED" unless the API key has the
+// "services" or "admin" scope.
+//
+// Request:
+//  POST /admin/listServices
+//  {
+//      "Type": "github",
+//      "UserID": "@my_bot:localhost"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Services": [
+//          {
+//              "ID": "my_service_id",
+//              "Type": "github",
+//              "UserID": "@my_bot:localhost",
+//              "Config": {
+//                  // service-specific config information
+//              }
+//          }
+//      ]
+//  }
+func (h *ListServices) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Type   string
+		UserID id.UserID
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	var srvs []types.Service
+	var err error
+	if body.UserID != "" {
+		srvs, err = h.Db.LoadServicesForUser(body.UserID)
+	} else if body.Type != "" {
+		srvs, err = h.Db.LoadServicesByType(body.Type)
+	} else {
+		srvs, err = h.Db.LoadServices()
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to load services")
+		return util.MessageResponse(500, "Failed to load services")
+	}
+
+	type serviceInfo struct {
+		ID     string
+		Type   string
+		UserID id.UserID
+		Config json.RawMessage
+	}
+	services := []serviceInfo{}
+	for _, srv := range srvs {
+		if body.Type != "" && srv.ServiceType() != body.Type {
+			continue
+		}
+		config, err := serviceConfig(req, srv)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("service_id", srv.ServiceID()).Error("Failed to marshal service")
+			return util.MessageResponse(500, "Failed to load services")
+		}
+		services = append(services, serviceInfo{srv.ServiceID(), srv.ServiceType(), srv.ServiceUserID(), config})
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Services []serviceInfo
+		}{services},
+	}
+}
+
+// DeleteService represents an HTTP handler which can process /admin/deleteService requests.
+type DeleteService struct {
+	db        *database.ServiceDB
+	clients   *clients.Clients
+	configure *ConfigureService
+}
+
+// NewDeleteService creates a new DeleteService handler. Requests are serialised with configure
+// requests for the same service ID.
+func NewDeleteService(db *database.ServiceDB, clients *clients.Clients, configure *ConfigureService) *DeleteService {
+	return &DeleteService{
+		db:        db,
+		clients:   clients,
+		configure: configure,
+	}
+}
+
+// OnIncomingRequest handles POST requests to /admin/deleteService.
+//
+// The request body MUST be a JSON body which has an "ID" key which represents
+// the service ID to delete. Any poll loop for the service is stopped, and services
+// which hold remote resources (e.g. webhooks) are given a chance to remove them.
+//
+// Request:
+//  POST /admin/deleteService
+//  {
+//      "ID": "my_service_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (h *DeleteService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.ID == "" {
+		return util.MessageResponse(400, `Must supply a "ID"`)
+	}
+
+	mut := h.configure.getMutexForServiceID(body.ID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	logger := util.GetLogger(req.Context()).WithField("service_id", body.ID)
+	srv, err := h.db.LoadService(body.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, `Service not found`)
+		}
+		logger.WithError(err).Error("Failed to LoadService")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+	logger.WithFields(log.Fields{
+		"service_type":    srv.ServiceType(),
+		"service_user_id": srv.ServiceUserID(),
+	}).Print("Incoming delete service request")
+
+	TeardownService(srv, h.clients)
+
+	if err := h.db.DeleteService(body.ID); err != nil {
+		logger.WithError(err).Error("Failed to DeleteService")
+		return util.MessageResponse(500, `Failed to delete service`)
+	}
+	recordAudit(h.db, req, api.AuditEntry{
+		Action:     "deleteService",
+		Kind:       "service",
+		TargetID:   srv.ServiceID(),
+		TargetType: srv.ServiceType(),
+		UserID:     srv.ServiceUserID(),
+	}, srv, nil)
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// TeardownService stops any poll loop for the service and lets it clean up remote resources.
+// Failures are logged but are not fatal, as the service should be removable even if the remote
+// side is unavailable.
+func TeardownService(srv types.Service, clis *clients.Clients) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   srv.ServiceID(),
+		"service_type": srv.ServiceType(),
+	})
+	if _, ok := srv.(types.Poller); ok {
+		polling.StopPolling(srv)
+	}
+	deregisterer, ok := srv.(types.Deregisterer)
+	if !ok {
+		return
+	}
+	client, err := clis.Client(srv.ServiceUserID())
+	if err != nil {
+		logger.WithError(err).Warn("Cannot deregister service: unknown matrix client")
+		return
+	}
+	if err := deregisterer.Deregister(client); err != nil {
+		logger.WithError(err).Warn("Failed to deregister service")
 	}
 }
 
@@ -239,3 +502,93 @@ func checkClientForService(service types.Service, client *clients.BotClient) err
 	}
 	return nil
 }
+
+// redactedValue replaces secrets in configs returned by the admin API.
+const redactedValue = "REDACTED"
+
+// isSecretKey returns true if the config key holds a secret, e.g. "api_key", "client_secret" or "AccessToken".
+func isSecretKey(key string) bool {
+	key = strings.ToLower(strings.Replace(key, "_", "", -1))
+	return strings.Contains(key, "secret") || strings.Contains(key, "password") ||
+		strings.Contains(key, "token") || strings.HasSuffix(key, "apikey")
+}
+
+// serviceConfig returns the JSON of a service's config for an admin API response. Secrets are only
+// included for API keys which could configure the service themselves.
+func serviceConfig(req *http.Request, srv types.Service) (json.RawMessage, error) {
+	key := api.APIKey{Scope: requestScope(req)}
+	if key.Allows(api.ScopeServices) {
+		return json.Marshal(srv)
+	}
+	return redactedConfig(srv)
+}
+
+// redactedConfig returns the JSON of the config with its secrets redacted.
+func redactedConfig(config interface{}) (json.RawMessage, error) {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return redactSecrets(configJSON)
+}
+
+// redactSecrets replaces the values of secret keys anywhere in the JSON with "REDACTED". Empty
+// values are left alone, so that it is clear which secrets have not been set.
+func redactSecrets(configJSON json.RawMessage) (json.RawMessage, error) {
+	if len(configJSON) == 0 {
+		return configJSON, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(string(configJSON)))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redactValue(v))
+}
+
+func redactValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for key, child := range val {
+			if isSecretKey(key) && child != nil && child != "" {
+				val[key] = redactedValue
+			} else {
+				val[key] = redactValue(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = redactValue(child)
+		}
+	}
+	return v
+}
+
+// hasRedactedSecret returns true if a secret anywhere in the JSON is set to "REDACTED", as it would be
+// if a redacted config was sent back to Go-NEB.
+func hasRedactedSecret(configJSON json.RawMessage) bool {
+	var v interface{}
+	if err := json.Unmarshal(configJSON, &v); err != nil {
+		return false
+	}
+	return isRedacted(v)
+}
+
+func isRedacted(v interface{}) bool {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for key, child := range val {
+			if isSecretKey(key) && child == redactedValue || isRedacted(child) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range val {
+			if isRedacted(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
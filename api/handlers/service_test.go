@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type secretService struct {
+	types.DefaultService
+	APIKey       string                     `json:"api_key"`
+	Rooms        []id.RoomID                `json:"rooms"`
+	Verification *types.WebhookVerification `json:"verification,omitempty"`
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &secretService{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, "secretive"),
+		}
+	})
+}
+
+func newTestDB(t *testing.T) *database.ServiceDB {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	return db
+}
+
+func newAdminRequest(path, body string) *http.Request {
+	req, _ := http.NewRequest("POST", "http://go.neb"+path, strings.NewReader(body))
+	return req
+}
+
+func storeTestService(t *testing.T, db *database.ServiceDB, serviceID string, userID id.UserID, config string) {
+	srv, err := types.CreateService(serviceID, "secretive", userID, []byte(config))
+	if err != nil {
+		t.Fatalf("Failed to create service: %s", err)
+	}
+	if _, err = db.StoreService(srv); err != nil {
+		t.Fatalf("Failed to store service: %s", err)
+	}
+}
+
+func TestListServices(t *testing.T) {
+	db := newTestDB(t)
+	storeTestService(t, db, "a", "@a:hs", `{"api_key":"sekrit","rooms":["!a:hs"],"verification":{"method":"bearer","secret":"hunter2"}}`)
+	storeTestService(t, db, "b", "@b:hs", `{"rooms":["!b:hs"]}`)
+
+	h := &ListServices{db}
+	testCases := []struct {
+		body    string
+		wantIDs []string
+	}{
+		{"", []string{"a", "b"}},
+		{`{"UserID":"@b:hs"}`, []string{"b"}},
+		{`{"Type":"nope"}`, []string{}},
+	}
+	for _, tc := range testCases {
+		res := h.OnIncomingRequest(newAdminRequest("/admin/listServices", tc.body))
+		var got struct {
+			Services []struct {
+				ID     string
+				Config json.RawMessage
+			}
+		}
+		if err := json.Unmarshal([]byte(marshal(res.JSON)), &got); res.Code != 200 || err != nil {
+			t.Fatalf("Body %q: got HTTP %d %s", tc.body, res.Code, marshal(res.JSON))
+		}
+		var ids []string
+		for _, srv := range got.Services {
+			ids = append(ids, srv.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tc.wantIDs, ",") {
+			t.Errorf("Body %q: got services %v, want %v", tc.body, ids, tc.wantIDs)
+		}
+	}
+
+	res := h.OnIncomingRequest(newAdminRequest("/admin/listServices", `{"UserID":"@a:hs"}`))
+	if body := marshal(res.JSON); strings.Contains(body, "sekrit") || strings.Contains(body, "hunter2") ||
+		!strings.Contains(body, `"api_key":"REDACTED"`) || !strings.Contains(body, `"method":"bearer"`) {
+		t.Errorf("Expected secrets to be redacted, got %s", body)
+	}
+}
+
+func TestGetService(t *testing.T) {
+	db := newTestDB(t)
+	storeTestService(t, db, "a", "@a:hs", `{"api_key":"sekrit","rooms":["!a:hs"]}`)
+	res := (&GetService{db}).OnIncomingRequest(newAdminRequest("/admin/getService", `{"ID":"a"}`))
+	if body := marshal(res.JSON); res.Code != 200 || body != `{"ID":"a","Type":"secretive","Config":{"api_key":"REDACTED","rooms":["!a:hs"]}}` {
+		t.Errorf("Expected the service with its secrets redacted, got HTTP %d %s", res.Code, body)
+	}
+	req := newAdminRequest("/admin/getService", `{"ID":"a"}`)
+	req = req.WithContext(context.WithValue(req.Context(), scopeContextKey, api.ScopeServices))
+	res = (&GetService{db}).OnIncomingRequest(req)
+	if body := marshal(res.JSON); res.Code != 200 || body != `{"ID":"a","Type":"secretive","Config":{"api_key":"sekrit","rooms":["!a:hs"]}}` {
+		t.Errorf("Expected the services scope to get the secrets, got HTTP %d %s", res.Code, body)
+	}
+	if res = (&GetService{db}).OnIncomingRequest(newAdminRequest("/admin/getService", `{"ID":"b"}`)); res.Code != 404 {
+		t.Errorf("Expected a missing service to 404, got HTTP %d", res.Code)
+	}
+}
+
+func TestDeleteService(t *testing.T) {
+	db := newTestDB(t)
+	storeTestService(t, db, "a", "@a:hs", `{"rooms":["!a:hs"]}`)
+	clis := clients.New(db, nil)
+	h := NewDeleteService(db, clis, NewConfigureService(db, clis))
+
+	if res := h.OnIncomingRequest(newAdminRequest("/admin/deleteService", `{}`)); res.Code != 400 {
+		t.Errorf("Expected a missing ID to be rejected, got HTTP %d", res.Code)
+	}
+	if res := h.OnIncomingRequest(newAdminRequest("/admin/deleteService", `{"ID":"a"}`)); res.Code != 200 {
+		t.Fatalf("Failed to delete service: HTTP %d %s", res.Code, marshal(res.JSON))
+	}
+	if srvs, err := db.LoadServices(); err != nil || len(srvs) != 0 {
+		t.Errorf("Expected the service to be deleted, got %d services (%v)", len(srvs), err)
+	}
+	if entries, err := db.LoadAuditEntries("service", "a"); err != nil || len(entries) != 1 || entries[0].Action != "deleteService" {
+		t.Errorf("Expected the deletion to be audited, got %+v (%v)", entries, err)
+	}
+	if res := h.OnIncomingRequest(newAdminRequest("/admin/deleteService", `{"ID":"a"}`)); res.Code != 404 {
+		t.Errorf("Expected deleting a missing service to 404, got HTTP %d", res.Code)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	got, err := redactSecrets(json.RawMessage(`{"ClientSecret":"a","nested":[{"access_token":"b","password":""}],"count":12345678901234567890,"name":"c"}`))
+	want := `{"ClientSecret":"REDACTED","count":12345678901234567890,"name":"c","nested":[{"access_token":"REDACTED","password":""}]}`
+	if err != nil || string(got) != want {
+		t.Errorf("redactSecrets: got %s (%v), want %s", got, err, want)
+	}
+}
+
+func TestConfigureServiceRejectsRedacted(t *testing.T) {
+	db := newTestDB(t)
+	h := NewConfigureService(db, clients.New(db, nil))
+	testCases := []struct {
+		config   string
+		wantCode int
+	}{
+		{`{"api_key":"REDACTED","rooms":["!a:hs"]}`, 400},
+		{`{"verification":{"method":"bearer","secret":"REDACTED"}}`, 400},
+		{`{"api_key":"sekrit","rooms":["REDACTED"]}`, 0},
+	}
+	for _, tc := range testCases {
+		req := newAdminRequest("/admin/configureService", `{"ID":"a","Type":"secretive","UserID":"@a:hs","Config":`+tc.config+`}`)
+		code := 0 // accepted
+		if _, res := h.createService(req); res != nil {
+			code = res.Code
+		}
+		if code != tc.wantCode {
+			t.Errorf("Config %s: got HTTP %d, want %d", tc.config, code, tc.wantCode)
+		}
+	}
+}
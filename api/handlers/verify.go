@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+)
+
+// defaultMaxAge is how old a timestamped webhook request can be before it is rejected.
+const defaultMaxAge = 5 * time.Minute
+
+// maxNonces is the most nonces the replay cache remembers. When it is full, the nonces which expire
+// soonest are forgotten first.
+const maxNonces = 100000
+
+var errReplayed = errors.New("request has already been received")
+
+// replayCache remembers recently seen nonces so that replayed webhook requests can be rejected.
+type replayCache struct {
+	mu     sync.Mutex
+	max    int
+	seen   map[string]time.Time // nonce => expiry time
+	expiry nonceHeap            // the seen nonces, soonest to expire first
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{
+		max:  maxNonces,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// checkAndAdd returns false if the nonce has already been seen and has not yet expired, otherwise
+// it remembers the nonce for the given duration and returns true.
+func (c *replayCache) checkAndAdd(nonce string, now time.Time, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.expiry) > 0 && now.After(c.expiry[0].expiry) {
+		c.forgetNext()
+	}
+	if _, exists := c.seen[nonce]; exists {
+		return false
+	}
+	for len(c.expiry) >= c.max {
+		c.forgetNext()
+	}
+	c.seen[nonce] = now.Add(ttl)
+	heap.Push(&c.expiry, nonceExpiry{nonce, now.Add(ttl)})
+	return true
+}
+
+// forgetNext forgets the nonce which expires soonest.
+func (c *replayCache) forgetNext() {
+	n := heap.Pop(&c.expiry).(nonceExpiry)
+	delete(c.seen, n.nonce)
+}
+
+type nonceExpiry struct {
+	nonce  string
+	expiry time.Time
+}
+
+// nonceHeap is a container/heap of nonces ordered by when they expire.
+type nonceHeap []nonceExpiry
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].expiry.Before(h[j].expiry) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(nonceExpiry)) }
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// verifyWebhook checks that the request is authentic according to the verification config.
+// The request body is read and replaced so that it can be read again by the service.
+func verifyWebhook(v *types.WebhookVerification, cache *replayCache, serviceID string, req *http.Request, now time.Time) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	maxAge := defaultMaxAge
+	if v.MaxAgeSecs > 0 {
+		maxAge = time.Duration(v.MaxAgeSecs) * time.Second
+	}
+	var nonce string
+	switch v.Method {
+	case types.VerifyHMACSHA256:
+		header := v.SignatureHeader
+		if header == "" {
+			header = "X-Signature"
+		}
+		message := body
+		if v.NonceHeader != "" {
+			tsHeader := v.TimestampHeader
+			if tsHeader == "" {
+				tsHeader = "X-Timestamp"
+			}
+			ts := req.Header.Get(tsHeader)
+			if err := checkTimestamp(ts, now, maxAge); err != nil {
+				return errors.New(err.Error() + " in " + tsHeader)
+			}
+			if nonce = req.Header.Get(v.NonceHeader); nonce == "" {
+				return errors.New("missing " + v.NonceHeader)
+			}
+			// Header values can't contain newlines, so this can't be confused with another request
+			message = append([]byte(ts+"\n"+nonce+"\n"), body...)
+		}
+		sig := strings.TrimPrefix(req.Header.Get(header), "sha256=")
+		if !checkHMAC(message, sig, []byte(v.Secret)) {
+			return errors.New("bad signature in " + header)
+		}
+	case types.VerifyBearerToken:
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(v.Secret)) != 1 {
+			return errors.New("bad bearer token")
+		}
+	case types.VerifySlackSignature:
+		ts := req.Header.Get("X-Slack-Request-Timestamp")
+		if err := checkTimestamp(ts, now, maxAge); err != nil {
+			return errors.New(err.Error() + " in X-Slack-Request-Timestamp")
+		}
+		sig := req.Header.Get("X-Slack-Signature")
+		base := append([]byte("v0:"+ts+":"), body...)
+		if !strings.HasPrefix(sig, "v0=") || !checkHMAC(base, sig[3:], []byte(v.Secret)) {
+			return errors.New("bad signature in X-Slack-Signature")
+		}
+		// The signature covers the timestamp, so it uniquely identifies this delivery
+		nonce = sig
+	default:
+		return errors.New("unknown verification method: " + v.Method)
+	}
+
+	// The nonce only needs remembering until its timestamp falls out of the window
+	if nonce != "" && !cache.checkAndAdd(serviceID+" "+nonce, now, 2*maxAge) {
+		return errReplayed
+	}
+	return nil
+}
+
+// checkTimestamp checks that a timestamp in seconds since the Unix epoch is within maxAge of now.
+func checkTimestamp(ts string, now time.Time, maxAge time.Duration) error {
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing or malformed timestamp")
+	}
+	age := now.Sub(time.Unix(secs, 0))
+	if age > maxAge || age < -maxAge {
+		return errors.New("timestamp is outside the allowed window")
+	}
+	return nil
+}
+
+// checkHMAC reports whether the hex-encoded messageMAC is a valid HMAC-SHA256 of message.
+func checkHMAC(message []byte, messageMAC string, key []byte) bool {
+	got, err := hex.DecodeString(messageMAC)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return hmac.Equal(got, mac.Sum(nil))
+}
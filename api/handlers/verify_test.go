@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+)
+
+func sign(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookRequest(t *testing.T, body string, headers map[string]string) *http.Request {
+	req, err := http.NewRequest("POST", "/services/hooks/c2VydmljZQ", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	oldTS := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+	body := `{"hello":"world"}`
+	hmacCfg := &types.WebhookVerification{Method: types.VerifyHMACSHA256, Secret: "s3cr3t"}
+	hmacNonceCfg := &types.WebhookVerification{
+		Method: types.VerifyHMACSHA256, Secret: "s3cr3t", SignatureHeader: "X-Hub-Signature-256", NonceHeader: "X-Delivery",
+	}
+	bearerCfg := &types.WebhookVerification{Method: types.VerifyBearerToken, Secret: "t0ken"}
+	slackCfg := &types.WebhookVerification{Method: types.VerifySlackSignature, Secret: "sl4ck"}
+
+	tests := []struct {
+		name    string
+		cfg     *types.WebhookVerification
+		headers map[string]string
+		wantErr bool
+	}{
+		{"hmac valid", hmacCfg, map[string]string{"X-Signature": sign("s3cr3t", body)}, false},
+		{"hmac wrong secret", hmacCfg, map[string]string{"X-Signature": sign("wrong", body)}, true},
+		{"hmac missing", hmacCfg, nil, true},
+		{"hmac with nonce", hmacNonceCfg, map[string]string{
+			"X-Hub-Signature-256": "sha256=" + sign("s3cr3t", ts+"\nabc\n"+body), "X-Delivery": "abc", "X-Timestamp": ts,
+		}, false},
+		{"hmac replayed nonce", hmacNonceCfg, map[string]string{
+			"X-Hub-Signature-256": "sha256=" + sign("s3cr3t", ts+"\nabc\n"+body), "X-Delivery": "abc", "X-Timestamp": ts,
+		}, true},
+		{"hmac changed nonce", hmacNonceCfg, map[string]string{
+			"X-Hub-Signature-256": "sha256=" + sign("s3cr3t", ts+"\nabc\n"+body), "X-Delivery": "abd", "X-Timestamp": ts,
+		}, true},
+		{"hmac nonce not signed", hmacNonceCfg, map[string]string{
+			"X-Hub-Signature-256": "sha256=" + sign("s3cr3t", body), "X-Delivery": "def", "X-Timestamp": ts,
+		}, true},
+		{"hmac missing nonce", hmacNonceCfg, map[string]string{
+			"X-Hub-Signature-256": "sha256=" + sign("s3cr3t", ts+"\n\n"+body), "X-Timestamp": ts,
+		}, true},
+		{"hmac missing timestamp", hmacNonceCfg, map[string]string{
+			"X-Hub-Signature-256": "sha256=" + sign("s3cr3t", "\nghi\n"+body), "X-Delivery": "ghi",
+		}, true},
+		{"hmac nonce too old", hmacNonceCfg, map[string]string{
+			"X-Hub-Signature-256": "sha256=" + sign("s3cr3t", oldTS+"\njkl\n"+body), "X-Delivery": "jkl", "X-Timestamp": oldTS,
+		}, true},
+		{"bearer valid", bearerCfg, map[string]string{"Authorization": "Bearer t0ken"}, false},
+		{"bearer invalid", bearerCfg, map[string]string{"Authorization": "Bearer nope"}, true},
+		{"slack valid", slackCfg, map[string]string{
+			"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + sign("sl4ck", "v0:"+ts+":"+body),
+		}, false},
+		{"slack replayed", slackCfg, map[string]string{
+			"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + sign("sl4ck", "v0:"+ts+":"+body),
+		}, true},
+		{"slack too old", slackCfg, map[string]string{
+			"X-Slack-Request-Timestamp": oldTS, "X-Slack-Signature": "v0=" + sign("sl4ck", "v0:"+oldTS+":"+body),
+		}, true},
+		{"slack bad signature", slackCfg, map[string]string{
+			"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + sign("sl4ck", body),
+		}, true},
+	}
+
+	cache := newReplayCache()
+	for _, test := range tests {
+		req := newWebhookRequest(t, body, test.headers)
+		err := verifyWebhook(test.cfg, cache, "service", req, now)
+		if test.wantErr && err == nil {
+			t.Errorf("%s: expected verification to fail", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: expected verification to pass, got %s", test.name, err)
+		}
+		// the body must still be readable by the service
+		if b, _ := ioutil.ReadAll(req.Body); string(b) != body {
+			t.Errorf("%s: body was not preserved, got %q", test.name, string(b))
+		}
+	}
+}
+
+func TestReplayCacheExpiry(t *testing.T) {
+	cache := newReplayCache()
+	now := time.Now()
+	if !cache.checkAndAdd("nonce", now, time.Minute) {
+		t.Fatal("Expected unseen nonce to be accepted")
+	}
+	if cache.checkAndAdd("nonce", now.Add(30*time.Second), time.Minute) {
+		t.Error("Expected nonce to be rejected within its lifetime")
+	}
+	if !cache.checkAndAdd("nonce", now.Add(2*time.Minute), time.Minute) {
+		t.Error("Expected nonce to be accepted after it expired")
+	}
+}
+
+func TestReplayCacheLimit(t *testing.T) {
+	cache := newReplayCache()
+	cache.max = 2
+	now := time.Now()
+	cache.checkAndAdd("a", now, 3*time.Minute)
+	cache.checkAndAdd("b", now, time.Minute)
+	cache.checkAndAdd("c", now, 2*time.Minute)
+	if len(cache.seen) != 2 || len(cache.expiry) != 2 {
+		t.Fatalf("Expected the cache to hold 2 nonces, got %d", len(cache.seen))
+	}
+	if !cache.checkAndAdd("b", now, time.Minute) {
+		t.Error("Expected the nonce which expires soonest to be forgotten when the cache is full")
+	}
+	if cache.checkAndAdd("a", now, time.Minute) {
+		t.Error("Expected the nonce which expires last to be remembered")
+	}
+}
+
+func TestVerificationNonceNeedsSignature(t *testing.T) {
+	bearer := &types.WebhookVerification{Method: types.VerifyBearerToken, Secret: "t0ken", NonceHeader: "X-Delivery"}
+	if err := bearer.Check(); err == nil {
+		t.Error("Expected a nonce header to be rejected for bearer tokens, which don't sign it")
+	}
+	hmacCfg := &types.WebhookVerification{Method: types.VerifyHMACSHA256, Secret: "s3cr3t", NonceHeader: "X-Delivery"}
+	if err := hmacCfg.Check(); err != nil {
+		t.Errorf("Expected a nonce header to be allowed for hmac-sha256, got %s", err)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"encoding/base64"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/outbox"
+	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -15,11 +18,12 @@ import (
 type Webhook struct {
 	db      *database.ServiceDB
 	clients *clients.Clients
+	replays *replayCache
 }
 
 // NewWebhook returns a new webhook HTTP handler
 func NewWebhook(db *database.ServiceDB, cli *clients.Clients) *Webhook {
-	return &Webhook{db, cli}
+	return &Webhook{db, cli, newReplayCache()}
 }
 
 // Handle an incoming webhook HTTP request.
@@ -27,7 +31,13 @@ func NewWebhook(db *database.ServiceDB, cli *clients.Clients) *Webhook {
 // The webhook MUST have a known base64 encoded service ID as the last path segment
 // in order for this request to be passed to the correct service, or else this will return
 // HTTP 400. If the base64 encoded service ID is unknown, this will return HTTP 404.
+// If the Service is a types.WebhookVerifier, the request is authenticated before being passed
+// to the Service, and this will return HTTP 401 if verification fails or the request is a replay.
 // Beyond this, the exact response is determined by the specific Service implementation.
+//
+// Messages which the Service sends into Matrix in response to the webhook are sent straight away.
+// If that fails, or earlier messages for the room are still waiting, they are left in the outbox and
+// retried later, so they are not lost if the homeserver is unavailable.
 func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
 	log.WithField("path", req.URL.Path).Print("Incoming webhook request")
 	segments := strings.Split(req.URL.Path, "/")
@@ -50,6 +60,16 @@ func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(404)
 		return
 	}
+	if verifier, ok := service.(types.WebhookVerifier); ok {
+		if v := verifier.WebhookVerification(); v != nil {
+			if err := verifyWebhook(v, wh.replays, service.ServiceID(), req, time.Now()); err != nil {
+				log.WithError(err).WithField("service_id", service.ServiceID()).Warn(
+					"Rejecting unverified webhook request")
+				w.WriteHeader(401)
+				return
+			}
+		}
+	}
 	cli, err := wh.clients.Client(service.ServiceUserID())
 	if err != nil {
 		log.WithError(err).WithField("user_id", service.ServiceUserID()).Print(
@@ -62,5 +82,5 @@ func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
 		"service_type": service.ServiceType(),
 	}).Print("Incoming webhook for service")
 	metrics.IncrementWebhook(service.ServiceType())
-	service.OnReceiveWebhook(w, req, cli)
+	service.OnReceiveWebhook(w, req, outbox.NewClient(service, cli))
 }
@@ -0,0 +1,146 @@
+// Package appservice lets Go-NEB run as a Matrix Application Service. Instead of every bot user
+// running its own /sync stream with its own access token, the homeserver pushes events for all of
+// the bot users to Go-NEB in transactions, and Go-NEB acts as each bot user by asserting its user ID.
+package appservice
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	yaml "gopkg.in/yaml.v2"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultID is the ID of the application service in generated registrations.
+const DefaultID = "go-neb"
+
+// DefaultSenderLocalpart is the localpart of the application service's own user in generated registrations.
+const DefaultSenderLocalpart = "go-neb"
+
+// Registration is an application service registration file. The homeserver is given the same file,
+// and uses it to decide which events to send to Go-NEB and to authenticate requests in both directions.
+type Registration struct {
+	// A unique ID for the application service on the homeserver.
+	ID string `yaml:"id"`
+	// The URL the homeserver sends transactions to. This is Go-NEB's BASE_URL.
+	URL string `yaml:"url"`
+	// The token Go-NEB uses to authenticate with the homeserver.
+	ASToken string `yaml:"as_token"`
+	// The token the homeserver uses to authenticate with Go-NEB.
+	HSToken string `yaml:"hs_token"`
+	// The localpart of the application service's own user.
+	SenderLocalpart string `yaml:"sender_localpart"`
+	// False so that bot users are not rate limited by the homeserver.
+	RateLimited bool `yaml:"rate_limited"`
+	// The users, room aliases and rooms which the application service is interested in.
+	Namespaces Namespaces `yaml:"namespaces"`
+
+	userRegexes []*regexp.Regexp
+}
+
+// Namespaces are the users, room aliases and rooms which an application service is interested in.
+type Namespaces struct {
+	Users   []Namespace `yaml:"users"`
+	Aliases []Namespace `yaml:"aliases"`
+	Rooms   []Namespace `yaml:"rooms"`
+}
+
+// A Namespace is a regex of IDs. An exclusive namespace stops anyone else from using matching IDs.
+type Namespace struct {
+	Exclusive bool   `yaml:"exclusive"`
+	Regex     string `yaml:"regex"`
+}
+
+// NewRegistration generates a registration with random tokens for an application service at the
+// given URL, which owns the users matching userRegex, e.g. "@neb_.*:example.com".
+func NewRegistration(url, userRegex string) (*Registration, error) {
+	asToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	hsToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	r := &Registration{
+		ID:              DefaultID,
+		URL:             url,
+		ASToken:         asToken,
+		HSToken:         hsToken,
+		SenderLocalpart: DefaultSenderLocalpart,
+		Namespaces: Namespaces{
+			Users:   []Namespace{{Exclusive: true, Regex: userRegex}},
+			Aliases: []Namespace{},
+			Rooms:   []Namespace{},
+		},
+	}
+	if err := r.compile(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load reads a registration file.
+func Load(path string) (*Registration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Registration
+	if err := yaml.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.ASToken == "" || r.HSToken == "" {
+		return nil, errors.New(`Registration must have an "as_token" and an "hs_token"`)
+	}
+	if err := r.compile(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Save writes the registration file. It contains secrets, so is only readable by its owner.
+func (r *Registration) Save(path string) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// IsAppServiceUser returns true if the user ID is in one of the registration's user namespaces,
+// meaning Go-NEB can act as that user.
+func (r *Registration) IsAppServiceUser(userID id.UserID) bool {
+	for _, regex := range r.userRegexes {
+		if regex.MatchString(string(userID)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registration) compile() error {
+	r.userRegexes = nil
+	for i, ns := range r.Namespaces.Users {
+		// The homeserver matches the whole user ID
+		regex, err := regexp.Compile("^(?:" + ns.Regex + ")$")
+		if err != nil {
+			return fmt.Errorf("namespaces.users[%d]: %s", i, err)
+		}
+		r.userRegexes = append(r.userRegexes, regex)
+	}
+	return nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
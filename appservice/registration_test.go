@@ -0,0 +1,73 @@
+package appservice
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRegistrationRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-neb-appservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg, err := NewRegistration("http://neb:4050", "@neb_.*:example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.ASToken == "" || reg.HSToken == "" || reg.ASToken == reg.HSToken {
+		t.Fatalf("Expected two different random tokens, got %q and %q", reg.ASToken, reg.HSToken)
+	}
+	path := filepath.Join(dir, "registration.yaml")
+	if err := reg.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the registration to only be readable by its owner, got %s", info.Mode())
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ASToken != reg.ASToken || loaded.HSToken != reg.HSToken || loaded.URL != "http://neb:4050" ||
+		loaded.SenderLocalpart != DefaultSenderLocalpart || !loaded.Namespaces.Users[0].Exclusive {
+		t.Errorf("Loaded registration differs: got %+v, want %+v", loaded, reg)
+	}
+
+	for userID, want := range map[string]bool{
+		"@neb_github:example.com":   true,
+		"@neb_github:example.com.x": false,
+		"@alice:example.com":        false,
+		"@xneb_github:example.com":  false,
+	} {
+		if got := loaded.IsAppServiceUser(id.UserID(userID)); got != want {
+			t.Errorf("IsAppServiceUser(%s): got %v, want %v", userID, got, want)
+		}
+	}
+}
+
+func TestLoadInvalidRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-neb-appservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, contents := range map[string]string{
+		"no tokens": "id: go-neb\nurl: http://neb:4050\n",
+		"bad regex": "as_token: a\nhs_token: b\nnamespaces:\n  users:\n  - regex: '@neb_(.*'\n",
+		"not yaml":  "as_token: [",
+	} {
+		path := filepath.Join(dir, "registration.yaml")
+		ioutil.WriteFile(path, []byte(contents), 0600)
+		if _, err := Load(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
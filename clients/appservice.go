@@ -0,0 +1,150 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/go-neb/appservice"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SetAppService makes Go-NEB an application service with the given registration. Clients with
+// AppService set act as their user with the registration's token, and receive events from
+// ProcessTransaction rather than /sync. It must be called before Start.
+func (c *Clients) SetAppService(reg *appservice.Registration) {
+	c.appService = reg
+}
+
+// IsAppServiceUser returns true if the user ID is a configured application service client.
+func (c *Clients) IsAppServiceUser(userID id.UserID) bool {
+	if c.appService == nil || !c.appService.IsAppServiceUser(userID) {
+		return false
+	}
+	botClient, err := c.Client(userID)
+	return err == nil && botClient.config.AppService
+}
+
+// ProcessTransaction passes the events in an application service transaction from the homeserver
+// to the clients they concern, as if they had arrived down the clients' /sync streams. An event
+// concerns a client if it is in a room the client has joined, or is the client's own membership.
+// Transactions don't include to-device events, so application service clients can't decrypt messages.
+func (c *Clients) ProcessTransaction(txnID string, events []json.RawMessage) {
+	c.mapMutex.Lock()
+	var botClients []BotClient
+	for _, botClient := range c.clients {
+		if botClient.config.AppService {
+			botClients = append(botClients, botClient)
+		}
+	}
+	c.mapMutex.Unlock()
+
+	for i := range botClients {
+		botClient := &botClients[i]
+		resp := botClient.transactionResponse(events)
+		if len(resp.Rooms.Join) == 0 {
+			continue
+		}
+		if err := botClient.Syncer.ProcessResponse(resp, txnID); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"user_id":    botClient.config.UserID,
+				"txn_id":     txnID,
+			}).Error("Failed to process transaction")
+		}
+	}
+}
+
+// transactionResponse builds a /sync response from the events which concern this client. Each client
+// unmarshals its own copy of the events, as the syncer modifies them.
+func (botClient *BotClient) transactionResponse(events []json.RawMessage) *mautrix.RespSync {
+	var resp mautrix.RespSync
+	resp.Rooms.Join = make(map[id.RoomID]mautrix.SyncJoinedRoom)
+	// Memberships which change during the transaction, so that a join and the messages after it
+	// can arrive together.
+	joined := make(map[id.RoomID]bool)
+	for _, raw := range events {
+		var header struct {
+			RoomID   id.RoomID `json:"room_id"`
+			Type     string    `json:"type"`
+			StateKey *string   `json:"state_key"`
+			Content  struct {
+				Membership mevt.Membership `json:"membership"`
+			} `json:"content"`
+		}
+		if err := json.Unmarshal(raw, &header); err != nil || header.RoomID == "" {
+			continue
+		}
+		ownMembership := header.Type == mevt.StateMember.Type && header.StateKey != nil && *header.StateKey == botClient.UserID.String()
+		if ownMembership {
+			joined[header.RoomID] = header.Content.Membership == mevt.MembershipJoin
+		} else if isJoined, ok := joined[header.RoomID]; ok && !isJoined {
+			continue
+		} else if !ok && !botClient.stateStore.IsJoined(header.RoomID, botClient.UserID) {
+			continue
+		}
+		var evt mevt.Event
+		if err := json.Unmarshal(raw, &evt); err != nil {
+			log.WithError(err).WithField("room_id", header.RoomID).Warn("Failed to parse event in transaction")
+			continue
+		}
+		room := resp.Rooms.Join[header.RoomID]
+		room.Timeline.Events = append(room.Timeline.Events, &evt)
+		resp.Rooms.Join[header.RoomID] = room
+	}
+	return &resp
+}
+
+// useAppService makes the client act as its user through the application service.
+func (c *Clients) useAppService(client *mautrix.Client, userID id.UserID) error {
+	if c.appService == nil {
+		return fmt.Errorf("client %s uses the application service, but APPSERVICE_REGISTRATION is not set", userID)
+	}
+	if !c.appService.IsAppServiceUser(userID) {
+		return fmt.Errorf("client %s is not in the application service's user namespace", userID)
+	}
+	client.AccessToken = c.appService.ASToken
+	client.AppServiceUserID = userID
+	return nil
+}
+
+// loadAppServiceState registers the client's user if it does not exist yet, then loads the state of
+// the rooms it has joined, which a syncing client would get from its initial /sync.
+func (botClient *BotClient) loadAppServiceState() {
+	logger := log.WithField("user_id", botClient.config.UserID)
+	localpart, _, err := botClient.UserID.Parse()
+	if err != nil {
+		logger.WithError(err).Error("Invalid application service user ID")
+		return
+	}
+	req := struct {
+		Type     string `json:"type"`
+		Username string `json:"username"`
+	}{"m.login.application_service", localpart}
+	if _, err := botClient.MakeRequest("POST", botClient.BuildURL("register"), req, nil); err != nil {
+		if httpErr, ok := err.(mautrix.HTTPError); !ok || httpErr.RespError == nil || httpErr.RespError.ErrCode != "M_USER_IN_USE" {
+			logger.WithError(err).Error("Failed to register application service user")
+			return
+		}
+	}
+
+	joined, err := botClient.JoinedRooms()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load joined rooms")
+		return
+	}
+	var resp mautrix.RespSync
+	resp.Rooms.Join = make(map[id.RoomID]mautrix.SyncJoinedRoom)
+	for _, roomID := range joined.JoinedRooms {
+		var room mautrix.SyncJoinedRoom
+		if _, err := botClient.MakeRequest("GET", botClient.BuildURL("rooms", roomID, "state"), nil, &room.State.Events); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to load room state")
+			continue
+		}
+		resp.Rooms.Join[roomID] = room
+	}
+	botClient.stateStore.UpdateStateStore(&resp)
+	logger.WithField("rooms", len(resp.Rooms.Join)).Info("Loaded application service rooms")
+}
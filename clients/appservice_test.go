@@ -0,0 +1,85 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestProcessTransaction(t *testing.T) {
+	var ranIn []string
+	service := &MockService{commands: []types.Command{
+		{
+			Path: []string{"ping"},
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
+				ranIn = append(ranIn, roomID.String()+" "+strings.Join(args, " "))
+				return nil, nil
+			},
+		},
+	}}
+	store := &MockStore{service: service}
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(*http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unhandled test path")
+	}
+	clients := New(store, &http.Client{Transport: trans})
+
+	addClient := func(config api.ClientConfig) {
+		mxCli, _ := mautrix.NewClient("https://someplace.somewhere", config.UserID, "as_token")
+		mxCli.AppServiceUserID = config.UserID
+		botClient := &BotClient{Client: mxCli, config: config}
+		botClient.stateStore = &NebStateStore{Storer: mautrix.NewInMemoryStore()}
+		botClient.olmMachine = &crypto.OlmMachine{StateStore: botClient.stateStore}
+		syncer := mxCli.Syncer.(*mautrix.DefaultSyncer)
+		syncer.OnSync(botClient.syncCallback)
+		syncer.OnEventType(mevt.EventMessage, func(_ mautrix.EventSource, event *mevt.Event) {
+			clients.onMessageEvent(botClient, event)
+		})
+		clients.setClient(*botClient)
+	}
+	addClient(api.ClientConfig{UserID: "@neb:hs", AppService: true})
+	// Clients which /sync get their events from there
+	addClient(api.ClientConfig{UserID: "@syncing:hs", Sync: true})
+
+	member := func(roomID, userID, membership string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","room_id":%q,"sender":%q,"state_key":%q,"content":{"membership":%q},"event_id":"$member"}`,
+			roomID, userID, userID, membership))
+	}
+	message := func(roomID, body string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","room_id":%q,"sender":"@alice:hs","content":{"msgtype":"m.text","body":%q},"event_id":"$msg"}`,
+			roomID, body))
+	}
+
+	clients.ProcessTransaction("1", []json.RawMessage{
+		message("!joined:hs", "!ping before join"),
+		member("!joined:hs", "@neb:hs", "join"),
+		message("!joined:hs", "!ping after join"),
+		member("!other:hs", "@syncing:hs", "join"),
+		message("!other:hs", "!ping other"),
+		member("!invited:hs", "@neb:hs", "invite"),
+		message("!invited:hs", "!ping invited"),
+	})
+	clients.ProcessTransaction("2", []json.RawMessage{
+		message("!joined:hs", "!ping later"),
+		member("!joined:hs", "@neb:hs", "leave"),
+		message("!joined:hs", "!ping after leave"),
+	})
+	clients.ProcessTransaction("3", []json.RawMessage{
+		message("!joined:hs", "!ping after leave"),
+	})
+
+	want := []string{"!joined:hs after join", "!joined:hs later"}
+	if !reflect.DeepEqual(ranIn, want) {
+		t.Errorf("Expected commands to only run in joined rooms, got %v", ranIn)
+	}
+}
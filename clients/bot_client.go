@@ -33,6 +33,8 @@ type BotClient struct {
 	stateStore               *NebStateStore
 	verificationSAS          *sync.Map
 	ongoingVerificationCount int32
+	dialogs                  *dialogSessions
+	supervisor               *syncSupervisor
 }
 
 // InitOlmMachine initializes a BotClient's internal OlmMachine given a client object and a Neb store,
@@ -45,7 +47,7 @@ func (botClient *BotClient) InitOlmMachine(client *mautrix.Client, nebStore *mat
 		// Create an SQL crypto store based on the ServiceDB used
 		db, dialect := sdb.GetSQLDb()
 		accountID := botClient.config.UserID.String() + "-" + client.DeviceID.String()
-		sqlCryptoStore := crypto.NewSQLCryptoStore(db, dialect, accountID, client.DeviceID, []byte(client.DeviceID.String()+"pickle"), cryptoLogger)
+		sqlCryptoStore := crypto.NewSQLCryptoStore(db, dialect, accountID, client.DeviceID, botClient.pickleKey(), cryptoLogger)
 		// Try to create the tables if they are missing
 		if err = sqlCryptoStore.CreateTables(); err != nil {
 			return
@@ -64,7 +66,20 @@ func (botClient *BotClient) InitOlmMachine(client *mautrix.Client, nebStore *mat
 		cryptoLogger.Debug("Using gob storage as the crypto store")
 	}
 
-	botClient.stateStore = &NebStateStore{&nebStore.InMemoryStore}
+	botClient.stateStore = &NebStateStore{
+		Storer:   &nebStore.InMemoryStore,
+		Database: nebStore.Database,
+		UserID:   botClient.config.UserID,
+	}
+	if rooms, err := botClient.stateStore.LoadState(); err != nil {
+		// The state will be fetched by the initial sync instead
+		log.WithError(err).WithField("user_id", botClient.config.UserID).Error("Failed to load room state")
+	} else {
+		log.WithFields(log.Fields{
+			"user_id": botClient.config.UserID,
+			"rooms":   rooms,
+		}).Info("Loaded room state")
+	}
 	olmMachine := crypto.NewOlmMachine(client, cryptoLogger, cryptoStore, botClient.stateStore)
 
 	regexes := make([]*regexp.Regexp, 0, len(botClient.config.AcceptVerificationFromUsers))
@@ -99,6 +114,15 @@ func (botClient *BotClient) InitOlmMachine(client *mautrix.Client, nebStore *mat
 	return nil
 }
 
+// pickleKey returns the key which encrypts the client's Olm account, sessions and cross-signing keys.
+func (botClient *BotClient) pickleKey() []byte {
+	if botClient.config.PickleKey != "" {
+		return []byte(botClient.config.PickleKey)
+	}
+	// Clients which were set up before the pickle key was configurable used this
+	return []byte(botClient.config.DeviceID.String() + "pickle")
+}
+
 // Register registers a BotClient's Sync and StateMember event callbacks to update its internal state
 // when new events arrive.
 func (botClient *BotClient) Register(syncer mautrix.ExtensibleSyncer) {
@@ -110,6 +134,10 @@ func (botClient *BotClient) Register(syncer mautrix.ExtensibleSyncer) {
 
 func (botClient *BotClient) syncCallback(resp *mautrix.RespSync, since string) bool {
 	botClient.stateStore.UpdateStateStore(resp)
+	if botClient.config.AppService {
+		// Transactions don't have to-device events or key counts for the Olm machine
+		return true
+	}
 	botClient.olmMachine.ProcessSyncResponse(resp, since)
 	if err := botClient.olmMachine.CryptoStore.Flush(); err != nil {
 		log.WithError(err).Error("Could not flush crypto store")
@@ -146,7 +174,7 @@ func (botClient *BotClient) SendMessageEvent(roomID id.RoomID, evtType mevt.Type
 				return nil, err
 			}
 		}
-		enc, err := olmMachine.EncryptMegolmEvent(roomID, mevt.EventMessage, content)
+		enc, err := olmMachine.EncryptMegolmEvent(roomID, evtType, content)
 		if err != nil {
 			return nil, err
 		}
@@ -156,30 +184,44 @@ func (botClient *BotClient) SendMessageEvent(roomID id.RoomID, evtType mevt.Type
 	return botClient.Client.SendMessageEvent(roomID, evtType, content, extra...)
 }
 
-// Sync loops to keep syncing the client with the homeserver by calling the /sync endpoint.
+// Sync loops to keep syncing the client with the homeserver by calling the /sync endpoint. Failed
+// requests are retried with exponential backoff until the client is stopped.
 func (botClient *BotClient) Sync() {
-	// Get the state store up to date
-	resp, err := botClient.SyncRequest(30000, "", "", true, mevt.PresenceOnline)
-	if err != nil {
-		log.WithError(err).Error("Error performing initial sync")
-		return
-	}
-	botClient.stateStore.UpdateStateStore(resp)
-
+	s := botClient.supervisor
+	// A client which has persisted its room state only needs to catch up from where it left off
+	initialised := botClient.stateStore.loaded && botClient.Store.LoadNextBatch(botClient.UserID) != ""
 	for {
-		if e := botClient.Client.Sync(); e != nil {
-			log.WithFields(log.Fields{
-				log.ErrorKey: e,
-				"user_id":    botClient.config.UserID,
-			}).Error("Fatal Sync() error")
-			time.Sleep(10 * time.Second)
-		} else {
+		var err error
+		if !initialised {
+			// Get the state store up to date
+			var resp *mautrix.RespSync
+			if resp, err = botClient.SyncRequest(30000, "", "", true, mevt.PresenceOnline); err == nil {
+				botClient.stateStore.UpdateStateStore(resp)
+				initialised = true
+				s.synced()
+			}
+		}
+		if err == nil {
+			if err = botClient.Client.Sync(); err == nil {
+				log.WithField("user_id", botClient.config.UserID).Info("Stopping Sync()")
+				return
+			}
+		}
+		if err == errSyncStopped || s.stopped() || s.failed(err) != nil {
 			log.WithField("user_id", botClient.config.UserID).Info("Stopping Sync()")
 			return
 		}
 	}
 }
 
+// StopSync stops the client's /sync stream, including while it is backing off.
+func (botClient *BotClient) StopSync() {
+	if botClient.supervisor != nil {
+		botClient.supervisor.Stop()
+	}
+	botClient.Client.StopSync()
+}
+
 // VerifySASMatch returns whether the received SAS matches the SAS that the bot generated.
 // It retrieves the SAS of the other device from the bot client's SAS sync map, where it was stored by the `SubmitDecimalSAS` function.
 func (botClient *BotClient) VerifySASMatch(otherDevice *crypto.DeviceIdentity, sas crypto.SASData) bool {
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/appservice"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/metrics"
@@ -22,19 +24,50 @@ import (
 
 // A Clients is a collection of clients used for bot services.
 type Clients struct {
-	db         database.Storer
-	httpClient *http.Client
-	dbMutex    sync.Mutex
-	mapMutex   sync.Mutex
-	clients    map[id.UserID]BotClient
+	db          database.Storer
+	httpClient  *http.Client
+	dbMutex     sync.Mutex
+	mapMutex    sync.Mutex
+	clients     map[id.UserID]BotClient
+	rateLimiter *rateLimiter
+	appService  *appservice.Registration
+	outbox      OutboxFunc
+	// True if the database is lost when Go-NEB stops
+	ephemeralDB bool
+}
+
+// An OutboxFunc wraps a client so that the message events sent through it on behalf of a service are
+// queued in a persistent outbox, and retried until they are delivered. The service ID is empty for
+// command responses, which may come from several services.
+type OutboxFunc func(serviceID string, userID id.UserID, cli types.MatrixClient) types.MatrixClient
+
+// SetOutbox makes services send messages, including command responses, through the outbox. It must be
+// called before Start.
+func (c *Clients) SetOutbox(outbox OutboxFunc) {
+	c.outbox = outbox
+}
+
+// SetEphemeralDatabase records that the database is not persisted, e.g. because it is in memory. Cross-signing
+// is then turned off, as new keys would be created every time Go-NEB starts. It must be called before Start.
+func (c *Clients) SetEphemeralDatabase() {
+	c.ephemeralDB = true
+}
+
+// serviceClient returns the client to pass to a service, or to send command responses with.
+func (c *Clients) serviceClient(botClient *BotClient, serviceID string) types.MatrixClient {
+	if c.outbox == nil {
+		return botClient
+	}
+	return c.outbox(serviceID, botClient.UserID, botClient)
 }
 
 // New makes a new collection of matrix clients
 func New(db database.Storer, cli *http.Client) *Clients {
 	clients := &Clients{
-		db:         db,
-		httpClient: cli,
-		clients:    make(map[id.UserID]BotClient), // user_id => BotClient
+		db:          db,
+		httpClient:  cli,
+		clients:     make(map[id.UserID]BotClient), // user_id => BotClient
+		rateLimiter: newRateLimiter(),
 	}
 	return clients
 }
@@ -55,14 +88,35 @@ func (c *Clients) Update(config api.ClientConfig) (api.ClientConfig, error) {
 	return old.config, err
 }
 
-// Start listening on client /sync streams
+// Remove deletes the config for a matrix client and stops its /sync stream, if it has one.
+func (c *Clients) Remove(userID id.UserID) error {
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+
+	if err := c.db.DeleteMatrixClientConfig(userID); err != nil {
+		return err
+	}
+
+	c.mapMutex.Lock()
+	old := c.clients[userID]
+	delete(c.clients, userID)
+	c.mapMutex.Unlock()
+
+	if old.Client != nil {
+		old.StopSync()
+	}
+	return nil
+}
+
+// Start listening on client /sync streams, and start the clients which receive events from the
+// application service.
 func (c *Clients) Start() error {
 	configs, err := c.db.LoadMatrixClientConfigs()
 	if err != nil {
 		return err
 	}
 	for _, cfg := range configs {
-		if cfg.Sync {
+		if cfg.Sync || cfg.AppService {
 			if _, err := c.Client(cfg.UserID); err != nil {
 				return err
 			}
@@ -71,6 +125,22 @@ func (c *Clients) Start() error {
 	return nil
 }
 
+// Status returns the health of the /sync streams of the clients which are syncing.
+func (c *Clients) Status() []api.ClientStatus {
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	statuses := []api.ClientStatus{}
+	for _, botClient := range c.clients {
+		if botClient.supervisor != nil {
+			statuses = append(statuses, botClient.supervisor.Status())
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].UserID < statuses[j].UserID
+	})
+	return statuses
+}
+
 func (c *Clients) getClient(userID id.UserID) BotClient {
 	c.mapMutex.Lock()
 	defer c.mapMutex.Unlock()
@@ -99,9 +169,17 @@ func (c *Clients) loadClientFromDB(userID id.UserID) (entry BotClient, err error
 		return
 	}
 
+	loaded := entry.config
 	if err = c.initClient(&entry); err != nil {
 		return
 	}
+	// Store the credentials if the client logged in
+	if !reflect.DeepEqual(loaded, entry.config) {
+		if _, err = c.db.StoreMatrixClientConfig(entry.config); err != nil {
+			entry.StopSync()
+			return
+		}
+	}
 
 	c.setClient(entry)
 	return
@@ -112,6 +190,14 @@ func (c *Clients) updateClientInDB(newConfig api.ClientConfig) (new, old BotClie
 	defer c.dbMutex.Unlock()
 
 	old = c.getClient(newConfig.UserID)
+	stored := old.config
+	if old.Client == nil {
+		// Clients which don't sync may not have been loaded yet
+		if cfg, err := c.db.LoadMatrixClientConfig(newConfig.UserID); err == nil {
+			stored = cfg
+		}
+	}
+	newConfig.KeepLogin(stored)
 	if old.Client != nil && reflect.DeepEqual(old.config, newConfig) {
 		// Already have a client with that config.
 		new = old
@@ -141,12 +227,10 @@ func (c *Clients) updateClientInDB(newConfig api.ClientConfig) (new, old BotClie
 		return
 	}
 
+	c.setClient(new)
 	if old.Client != nil {
-		old.Client.StopSync()
-		return
+		old.StopSync()
 	}
-
-	c.setClient(new)
 	return
 }
 
@@ -161,6 +245,43 @@ func (c *Clients) onMessageEvent(botClient *BotClient, event *mevt.Event) {
 	}
 
 	message := event.Content.AsMessage()
+
+	// An edit replaces the message it edits, so run the new content as if it had been sent instead,
+	// and edit the responses to the original message rather than sending new ones.
+	var previous []id.EventID
+	edited := false
+	if rel := message.OptionalGetRelatesTo(); rel != nil && rel.Type == mevt.RelReplace {
+		edited = true
+		if message.NewContent == nil {
+			return
+		}
+		var senderID id.UserID
+		senderID, previous, err = c.db.LoadCommandResponses(botClient.UserID, event.RoomID, rel.EventID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    event.RoomID,
+				"event_id":   rel.EventID,
+			}).Error("Failed to load responses to edited message")
+			return
+		}
+		if len(previous) > 0 && senderID != event.Sender {
+			log.WithFields(log.Fields{
+				"room_id":  event.RoomID,
+				"event_id": rel.EventID,
+				"sender":   event.Sender,
+			}).Warn("Ignoring edit of a message by someone else")
+			return
+		}
+		original := *event
+		original.ID = rel.EventID
+		event = &original
+		// The new content never has a relation of its own, so keep the thread of the original message
+		newContent := *message.NewContent
+		newContent.RelatesTo = c.threadRelation(botClient, event.RoomID, rel.EventID)
+		message = &newContent
+	}
+
 	body := message.Body
 
 	if body == "" {
@@ -180,38 +301,63 @@ func (c *Clients) onMessageEvent(botClient *BotClient, event *mevt.Event) {
 
 	var responses []interface{}
 
+	// Messages from a user in the middle of a dialog answer it, unless they are other commands
+	if !edited && botClient.dialogs.active(event.RoomID, event.Sender) &&
+		(body[0] != '!' || strings.EqualFold(body[1:], cancelDialog)) {
+		if body[0] == '!' {
+			body = body[1:]
+		}
+		if response := botClient.dialogs.answer(event, body); response != nil {
+			responses = append(responses, response)
+		}
+		c.sendResponses(botClient, event, responseRelation(event, message, responseMode(c.loadBotOptions(botClient.UserID, event.RoomID))), responses, nil)
+		return
+	}
+
+	var opts map[string]interface{}
+	var perms *roomPermissions
+	var args []string
+	if body[0] == '!' { // message is a command
+		opts = c.loadBotOptions(botClient.UserID, event.RoomID)
+		perms = newRoomPermissions(botClient, event.RoomID, opts)
+		if args, err = shellwords.Parse(body[1:]); err != nil {
+			args = strings.Split(body[1:], " ")
+		}
+	}
+
+	// !help is built in, so it isn't passed on to services
+	if len(args) > 0 && strings.EqualFold(args[0], helpCommand) {
+		responses = append(responses, helpForServices(services, botClient, args[1:]))
+		services = nil
+	}
+
 	for _, service := range services {
 		if body[0] == '!' { // message is a command
-			args, err := shellwords.Parse(body[1:])
-			if err != nil {
-				args = strings.Split(body[1:], " ")
-			}
-
-			if response := runCommandForService(service.Commands(botClient), event, args); response != nil {
+			limit := c.serviceLimit(service, event)
+			if response := runCommandForService(service.Commands(c.serviceClient(botClient, service.ServiceID())), event, args, perms, limit, botClient.dialogs); response != nil {
 				responses = append(responses, response)
 			}
 		} else { // message isn't a command, it might need expanding
-			expansions := runExpansionsForService(service.Expansions(botClient), event, body)
+			limit := c.serviceLimit(service, event)
+			expansions := runExpansionsForService(service.Expansions(c.serviceClient(botClient, service.ServiceID())), event, body, limit)
 			responses = append(responses, expansions...)
 		}
 	}
 
-	for _, content := range responses {
-		if _, err := botClient.SendMessageEvent(event.RoomID, mevt.EventMessage, content); err != nil {
-			log.WithFields(log.Fields{
-				"room_id": event.RoomID,
-				"content": content,
-				"sender":  event.Sender,
-			}).WithError(err).Error("Failed to send command response")
-		}
+	if (len(responses) > 0 || len(previous) > 0) && opts == nil {
+		opts = c.loadBotOptions(botClient.UserID, event.RoomID)
 	}
+	c.sendResponses(botClient, event, responseRelation(event, message, responseMode(opts)), responses, previous)
 }
 
 // runCommandForService runs a single command read from a matrix event. Runs
-// the matching command with the longest path. Returns the JSON encodable
-// content of a single matrix message event to use as a response or nil if no
-// response is appropriate.
-func runCommandForService(cmds []types.Command, event *mevt.Event, arguments []string) interface{} {
+// the matching command with the longest path, if the sender has the role it
+// requires, is not rate limited and the arguments match the command's Args. Commands with a Dialog
+// which are given no arguments start the dialog instead. Returns the JSON encodable content of a
+// single matrix message event to use as a response or nil if no response is
+// appropriate.
+func runCommandForService(cmds []types.Command, event *mevt.Event, arguments []string, perms *roomPermissions, limit *serviceLimit,
+	dialogs *dialogSessions) interface{} {
 	var bestMatch *types.Command
 	for i, command := range cmds {
 		matches := command.Matches(arguments)
@@ -225,13 +371,65 @@ func runCommandForService(cmds []types.Command, event *mevt.Event, arguments []s
 		return nil
 	}
 
+	if !perms.hasRole(event.Sender, bestMatch.Role) {
+		log.WithFields(log.Fields{
+			"room_id": event.RoomID,
+			"user_id": event.Sender,
+			"command": bestMatch.Path,
+			"role":    bestMatch.Role,
+		}).Info("Sender does not have the role needed for command")
+		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusForbidden)
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("You need the %s role in this room to use !%s", bestMatch.Role, strings.Join(bestMatch.Path, " ")),
+		}
+	}
+
 	cmdArgs := arguments[len(bestMatch.Path):]
+	if bestMatch.Dialog != nil && len(cmdArgs) == 0 && dialogs != nil {
+		if dialog := bestMatch.Dialog(event.RoomID, event.ID, event.Sender); dialog != nil && len(dialog.Questions) > 0 {
+			if ok, notice := limit.allow("command"); !ok {
+				return notice
+			}
+			return dialogs.start(event, bestMatch.Path, types.NewDialogSession(dialog))
+		}
+	}
+
+	var parsed *types.ParsedArgs
+	if bestMatch.Args != nil || bestMatch.Run != nil {
+		var err error
+		if parsed, err = types.ParseArgs(bestMatch.Args, cmdArgs); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    event.RoomID,
+				"user_id":    event.Sender,
+				"command":    bestMatch.Path,
+				"args":       cmdArgs,
+			}).Info("Invalid command arguments")
+			metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusInvalid)
+			return mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    err.Error() + ". Usage: " + bestMatch.Usage(),
+			}
+		}
+	}
+
+	if ok, notice := limit.allow("command"); !ok {
+		return notice
+	}
+
 	log.WithFields(log.Fields{
 		"room_id": event.RoomID,
 		"user_id": event.Sender,
 		"command": bestMatch.Path,
 	}).Info("Executing command")
-	content, err := bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	var content interface{}
+	var err error
+	if bestMatch.Run != nil {
+		content, err = bestMatch.Run(event.RoomID, event.ID, event.Sender, parsed)
+	} else {
+		content, err = bestMatch.Command(event.RoomID, event.ID, event.Sender, cmdArgs)
+	}
 	if err != nil {
 		if content != nil {
 			log.WithFields(log.Fields{
@@ -254,8 +452,8 @@ func runCommandForService(cmds []types.Command, event *mevt.Event, arguments []s
 	return content
 }
 
-// run the expansions for a matrix event.
-func runExpansionsForService(expans []types.Expansion, event *mevt.Event, body string) []interface{} {
+// run the expansions for a matrix event. Stops expanding when the sender is rate limited.
+func runExpansionsForService(expans []types.Expansion, event *mevt.Event, body string, limit *serviceLimit) []interface{} {
 	var responses []interface{}
 
 	for _, expansion := range expans {
@@ -267,7 +465,13 @@ func runExpansionsForService(expans []types.Expansion, event *mevt.Event, body s
 				continue
 			}
 			matches[matchingText] = true
-			if response := expansion.Expand(event.RoomID, event.Sender, matchingGroups); response != nil {
+			if ok, notice := limit.allow("expansion"); !ok {
+				if notice != nil {
+					responses = append(responses, notice)
+				}
+				return responses
+			}
+			if response := expansion.Expand(event.RoomID, event.ID, event.Sender, matchingGroups); response != nil {
 				responses = append(responses, response)
 			}
 		}
@@ -276,7 +480,24 @@ func runExpansionsForService(expans []types.Expansion, event *mevt.Event, body s
 	return responses
 }
 
-func (c *Clients) onBotOptionsEvent(client *mautrix.Client, event *mevt.Event) {
+// loadBotOptions loads the options for a bot in a room, or nil if there are none.
+func (c *Clients) loadBotOptions(userID id.UserID, roomID id.RoomID) map[string]interface{} {
+	opts, err := c.db.LoadBotOptions(userID, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{
+				log.ErrorKey:  err,
+				"room_id":     roomID,
+				"bot_user_id": userID,
+			}).Error("Failed to load bot options")
+		}
+		return nil
+	}
+	return opts.Options
+}
+
+func (c *Clients) onBotOptionsEvent(botClient *BotClient, event *mevt.Event) {
+	client := botClient.Client
 	// see if these options are for us. The state key is the user ID with a leading _
 	// to get around restrictions in the HS about having user IDs as state keys.
 	if event.StateKey == nil {
@@ -286,12 +507,24 @@ func (c *Clients) onBotOptionsEvent(client *mautrix.Client, event *mevt.Event) {
 	if targetUserID != client.UserID {
 		return
 	}
-	// these options fully clobber what was there previously.
+	// these options fully clobber what was there previously, apart from the permissions which only
+	// admins may change.
+	options := event.Content.Raw
+	if !canChangePermissions(botClient, event.RoomID, event.Sender) {
+		options = keepPermissions(options, c.loadBotOptions(client.UserID, event.RoomID))
+		if _, ok := event.Content.Raw["permissions"]; ok {
+			log.WithFields(log.Fields{
+				"room_id":        event.RoomID,
+				"bot_user_id":    client.UserID,
+				"set_by_user_id": event.Sender,
+			}).Warn("Ignoring permissions in bot options from a user who isn't a room admin")
+		}
+	}
 	opts := types.BotOptions{
 		UserID:      client.UserID,
 		RoomID:      event.RoomID,
 		SetByUserID: event.Sender,
-		Options:     event.Content.Raw,
+		Options:     options,
 	}
 	if _, err := c.db.StoreBotOptions(opts); err != nil {
 		log.WithFields(log.Fields{
@@ -328,8 +561,13 @@ func (c *Clients) onRoomMemberEvent(client *mautrix.Client, event *mevt.Event) {
 	}
 }
 
-func (c *Clients) initClient(botClient *BotClient) error {
+func (c *Clients) initClient(botClient *BotClient) (err error) {
 	config := botClient.config
+	if config.AccessToken == "" && !config.AppService {
+		if config, err = c.login(config); err != nil {
+			return fmt.Errorf("failed to log in as %s: %s", config.UserID, err)
+		}
+	}
 	client, err := mautrix.NewClient(config.HomeserverURL, config.UserID, config.AccessToken)
 	if err != nil {
 		return err
@@ -337,13 +575,41 @@ func (c *Clients) initClient(botClient *BotClient) error {
 
 	client.Client = c.httpClient
 	client.DeviceID = config.DeviceID
+	if config.AppService {
+		if err = c.useAppService(client, config.UserID); err != nil {
+			return err
+		}
+	}
+	session := c.renewLogins(client, config)
+
+	// Check that the access token is valid for the user ID. If the homeserver can't be reached, the
+	// client starts anyway, as a syncing client keeps retrying.
+	if whoami, err := client.Whoami(); err != nil {
+		if httpErr, ok := err.(mautrix.HTTPError); ok && (httpErr.Code == 401 || httpErr.Code == 403) {
+			return fmt.Errorf("the access token for %s is not valid: %s", config.UserID, err)
+		}
+		log.WithError(err).WithField("user_id", config.UserID).Warn("Failed to check access token")
+	} else if whoami.UserID != config.UserID {
+		return fmt.Errorf("the access token for %s belongs to %s", config.UserID, whoami.UserID)
+	}
+	if session != nil {
+		// The access token may have been renewed by the check
+		config = session.config
+	}
+	botClient.config = config
+	client.DeviceID = config.DeviceID
 	if client.DeviceID == "" {
 		log.Warn("Device ID is not set which will result in E2E encryption/decryption not working")
 	}
 	botClient.Client = client
 	botClient.verificationSAS = &sync.Map{}
+	botClient.dialogs = newDialogSessions(c.serviceClient(botClient, ""))
 
 	syncer := client.Syncer.(*mautrix.DefaultSyncer)
+	if config.Sync && !config.AppService {
+		botClient.supervisor = newSyncSupervisor(config.UserID)
+		client.Syncer = &supervisedSyncer{syncer, botClient.supervisor}
+	}
 
 	nebStore := &matrix.NEBStore{
 		InMemoryStore: *mautrix.NewInMemoryStore(),
@@ -352,12 +618,18 @@ func (c *Clients) initClient(botClient *BotClient) error {
 	}
 	client.Store = nebStore
 
-	// TODO: Check that the access token is valid for the userID by peforming
-	// a request against the server.
-
 	if err = botClient.InitOlmMachine(client, nebStore); err != nil {
 		return err
 	}
+	// The client works without cross-signing, its device just isn't trusted
+	if config.CrossSigning && !config.AppService && c.ephemeralDB {
+		log.WithField("user_id", config.UserID).Warn(
+			"Not setting up cross-signing: the database is in memory, so the keys would be lost when Go-NEB stops. Set DATABASE_URL to use it.")
+	} else if config.CrossSigning && !config.AppService {
+		if err := botClient.setUpCrossSigning(c.db); err != nil {
+			log.WithError(err).WithField("user_id", config.UserID).Error("Failed to set up cross-signing")
+		}
+	}
 
 	// Register sync callback for maintaining the state store and Olm machine state
 	botClient.Register(syncer)
@@ -366,8 +638,16 @@ func (c *Clients) initClient(botClient *BotClient) error {
 		c.onMessageEvent(botClient, event)
 	})
 
+	syncer.OnEventType(mevt.EventRedaction, func(_ mautrix.EventSource, event *mevt.Event) {
+		c.onRedactionEvent(botClient, event)
+	})
+
+	syncer.OnEventType(mevt.EventReaction, func(_ mautrix.EventSource, event *mevt.Event) {
+		c.onReactionEvent(botClient, event)
+	})
+
 	syncer.OnEventType(mevt.Type{Type: "m.room.bot.options", Class: mevt.UnknownEventType}, func(_ mautrix.EventSource, event *mevt.Event) {
-		c.onBotOptionsEvent(botClient.Client, event)
+		c.onBotOptionsEvent(botClient, event)
 	})
 
 	if config.AutoJoinRooms {
@@ -389,8 +669,11 @@ func (c *Clients) initClient(botClient *BotClient) error {
 				"sender_key": encContent.SenderKey,
 			}).WithError(err).Error("Failed to decrypt message")
 		} else {
-			if decrypted.Type == mevt.EventMessage {
+			switch decrypted.Type {
+			case mevt.EventMessage:
 				c.onMessageEvent(botClient, decrypted)
+			case mevt.EventReaction:
+				c.onReactionEvent(botClient, decrypted)
 			}
 			log.WithFields(log.Fields{
 				"type":      evt.Type,
@@ -401,19 +684,24 @@ func (c *Clients) initClient(botClient *BotClient) error {
 		}
 	})
 
-	// Ignore events before neb's join event.
-	eventIgnorer := mautrix.OldEventIgnorer{UserID: config.UserID}
-	eventIgnorer.Register(syncer)
+	// Ignore events before neb's join event. Transactions only contain new events.
+	if !config.AppService {
+		eventIgnorer := mautrix.OldEventIgnorer{UserID: config.UserID}
+		eventIgnorer.Register(syncer)
+	}
 
 	log.WithFields(log.Fields{
 		"user_id":         config.UserID,
 		"device_id":       config.DeviceID,
 		"sync":            config.Sync,
 		"auto_join_rooms": config.AutoJoinRooms,
+		"app_service":     config.AppService,
 		"since":           nebStore.LoadNextBatch(config.UserID),
 	}).Info("Created new client")
 
-	if config.Sync {
+	if config.AppService {
+		go botClient.loadAppServiceState()
+	} else if config.Sync {
 		go botClient.Sync()
 	}
 
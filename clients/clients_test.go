@@ -59,7 +59,7 @@ func TestCommandParsing(t *testing.T) {
 	cmds := []types.Command{
 		types.Command{
 			Path: []string{"test"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				executedCmdArgs = args
 				return nil, nil
 			},
@@ -151,3 +151,29 @@ func TestSASVerificationHandling(t *testing.T) {
 		t.Error("Verification did not finish after receiving the SAS from the correct user")
 	}
 }
+
+func TestRunCommandValidatesArgs(t *testing.T) {
+	var ran *types.ParsedArgs
+	cmds := []types.Command{
+		{
+			Path: []string{"test"},
+			Args: []types.Arg{{Name: "count", Type: types.ArgInt}},
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+				ran = args
+				return nil, nil
+			},
+		},
+	}
+	event := mevt.Event{Sender: "@someone:somewhere", RoomID: "!foo:bar"}
+
+	content := runCommandForService(cmds, &event, []string{"test", "many"}, nil, nil, nil)
+	want := mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "count must be a number. Usage: !test count"}
+	if !reflect.DeepEqual(content, want) || ran != nil {
+		t.Errorf("Expected usage notice without running the command, got %v", content)
+	}
+
+	runCommandForService(cmds, &event, []string{"test", "3"}, nil, nil, nil)
+	if ran == nil || ran.Int("count") != 3 {
+		t.Errorf("Expected command to run with parsed args, got %v", ran)
+	}
+}
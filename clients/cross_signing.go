@@ -0,0 +1,317 @@
+package clients
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/id"
+)
+
+// crossSigningKey is a public cross-signing key, as uploaded to /keys/device_signing/upload.
+type crossSigningKey struct {
+	UserID     id.UserID                       `json:"user_id"`
+	Usage      []string                        `json:"usage"`
+	Keys       map[string]id.Ed25519           `json:"keys"`
+	Signatures map[id.UserID]map[string]string `json:"signatures,omitempty"`
+}
+
+func newCrossSigningKey(userID id.UserID, usage string, pub ed25519.PublicKey) crossSigningKey {
+	key := id.Ed25519(base64.RawStdEncoding.EncodeToString(pub))
+	return crossSigningKey{
+		UserID: userID,
+		Usage:  []string{usage},
+		Keys:   map[string]id.Ed25519{crossSigningKeyID(key): key},
+	}
+}
+
+func crossSigningKeyID(key id.Ed25519) string {
+	return "ed25519:" + string(key)
+}
+
+// signJSON returns the signature of the canonical JSON of the object, without its signatures and
+// unsigned data.
+func signJSON(key ed25519.PrivateKey, obj interface{}) (string, error) {
+	objJSON, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(objJSON, &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "signatures")
+	delete(fields, "unsigned")
+	if objJSON, err = json.Marshal(fields); err != nil {
+		return "", err
+	}
+	canonical, err := canonicaljson.CanonicalJSON(objJSON)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(ed25519.Sign(key, canonical)), nil
+}
+
+// encryptPrivateKeys encrypts the seeds of the private keys with the pickle key.
+func encryptPrivateKeys(pickleKey []byte, keys ...ed25519.PrivateKey) ([]byte, error) {
+	aead, err := pickleKeyAEAD(pickleKey)
+	if err != nil {
+		return nil, err
+	}
+	var seeds []byte
+	for _, key := range keys {
+		seeds = append(seeds, key.Seed()...)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, seeds, nil), nil
+}
+
+// decryptPrivateKeys returns the private keys encrypted by encryptPrivateKeys.
+func decryptPrivateKeys(pickleKey, encrypted []byte) ([]ed25519.PrivateKey, error) {
+	aead, err := pickleKeyAEAD(pickleKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < aead.NonceSize() {
+		return nil, errors.New("encrypted keys are too short")
+	}
+	seeds, err := aead.Open(nil, encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PrivateKey
+	for ; len(seeds) >= ed25519.SeedSize; seeds = seeds[ed25519.SeedSize:] {
+		keys = append(keys, ed25519.NewKeyFromSeed(seeds[:ed25519.SeedSize]))
+	}
+	return keys, nil
+}
+
+func pickleKeyAEAD(pickleKey []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(pickleKey)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// setUpCrossSigning signs the client's device with the user's self-signing key, creating the user's
+// cross-signing keys first if Go-NEB hasn't already. Keys which the user set up elsewhere are never
+// replaced, as that would untrust all of their other devices.
+func (botClient *BotClient) setUpCrossSigning(db database.Storer) error {
+	if botClient.config.DeviceID == "" {
+		return errors.New("cross-signing needs a DeviceID")
+	}
+	var selfSigning ed25519.PrivateKey
+	keys, err := db.LoadCrossSigningKeys(botClient.config.UserID)
+	if err == sql.ErrNoRows {
+		var masterKey id.Ed25519
+		if masterKey, err = botClient.queryMasterKey(); err != nil {
+			return err
+		}
+		if masterKey != "" {
+			return fmt.Errorf("the user already has the master key %s, which Go-NEB doesn't hold, so it won't be replaced", masterKey)
+		}
+		if keys, selfSigning, err = botClient.bootstrapCrossSigning(); err != nil {
+			return err
+		}
+		if err = db.StoreCrossSigningKeys(keys); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		privateKeys, err := decryptPrivateKeys(botClient.pickleKey(), keys.EncryptedPrivateKeys)
+		if err != nil || len(privateKeys) != 2 {
+			return fmt.Errorf("failed to decrypt the cross-signing keys, has the PickleKey changed? %v", err)
+		}
+		selfSigning = privateKeys[1]
+	}
+	return botClient.signOwnDevice(keys.SelfSigningKey, selfSigning)
+}
+
+// queryMasterKey returns the user's master cross-signing key from the homeserver, or an empty key if the
+// user has none.
+func (botClient *BotClient) queryMasterKey() (id.Ed25519, error) {
+	userID := botClient.config.UserID
+	body := map[string]interface{}{
+		"device_keys": map[id.UserID][]id.DeviceID{userID: {}},
+	}
+	var res struct {
+		MasterKeys map[id.UserID]crossSigningKey `json:"master_keys"`
+	}
+	if _, err := botClient.MakeRequest("POST", botClient.BuildURL("keys", "query"), body, &res); err != nil {
+		return "", err
+	}
+	for _, key := range res.MasterKeys[userID].Keys {
+		return key, nil
+	}
+	return "", nil
+}
+
+// bootstrapCrossSigning creates master and self-signing keys for the user and uploads them. It returns
+// the keys to store, and the private self-signing key.
+func (botClient *BotClient) bootstrapCrossSigning() (keys types.CrossSigningKeys, selfSigning ed25519.PrivateKey, err error) {
+	userID := botClient.config.UserID
+	masterPub, master, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return
+	}
+	selfSigningPub, selfSigning, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return
+	}
+	masterKey := newCrossSigningKey(userID, "master", masterPub)
+	selfSigningKey := newCrossSigningKey(userID, "self_signing", selfSigningPub)
+	keys = types.CrossSigningKeys{
+		UserID:         userID,
+		MasterKey:      id.Ed25519(base64.RawStdEncoding.EncodeToString(masterPub)),
+		SelfSigningKey: id.Ed25519(base64.RawStdEncoding.EncodeToString(selfSigningPub)),
+	}
+	sig, err := signJSON(master, selfSigningKey)
+	if err != nil {
+		return
+	}
+	selfSigningKey.Signatures = map[id.UserID]map[string]string{
+		userID: {crossSigningKeyID(keys.MasterKey): sig},
+	}
+	if keys.EncryptedPrivateKeys, err = encryptPrivateKeys(botClient.pickleKey(), master, selfSigning); err != nil {
+		return
+	}
+
+	if err = botClient.uploadCrossSigningKeys(map[string]interface{}{
+		"master_key":       masterKey,
+		"self_signing_key": selfSigningKey,
+	}); err != nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"user_id":    userID,
+		"master_key": keys.MasterKey,
+	}).Info("Created cross-signing keys")
+	return
+}
+
+// uploadCrossSigningKeys uploads the public keys. Homeservers protect this with user-interactive auth,
+// which is completed with the client's Password.
+func (botClient *BotClient) uploadCrossSigningKeys(body map[string]interface{}) error {
+	url := botClient.BuildURL("keys", "device_signing", "upload")
+	code, res, err := botClient.postJSON(url, body)
+	if err == nil && code == 401 {
+		if botClient.config.Password == "" {
+			return errors.New("the homeserver needs the client's Password to upload cross-signing keys")
+		}
+		localpart, _, perr := botClient.config.UserID.Parse()
+		if perr != nil {
+			return perr
+		}
+		var uia struct {
+			Session string `json:"session"`
+		}
+		// Without a session the homeserver starts a new one, which is enough for a single stage
+		json.Unmarshal(res, &uia)
+		body["auth"] = map[string]interface{}{
+			"type":       "m.login.password",
+			"identifier": mautrix.UserIdentifier{Type: "m.id.user", User: localpart},
+			"password":   botClient.config.Password,
+			"session":    uia.Session,
+		}
+		code, res, err = botClient.postJSON(url, body)
+	}
+	if err == nil && code/100 != 2 {
+		err = fmt.Errorf("failed to upload cross-signing keys: HTTP %d: %s", code, res)
+	}
+	return err
+}
+
+// postJSON makes a POST request and returns the response's status code and body. Unlike MakeRequest,
+// the body is returned for error responses, as user-interactive auth needs it.
+func (botClient *BotClient) postJSON(url string, body interface{}) (int, []byte, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", botClient.UserAgent)
+	req.Header.Set("Authorization", "Bearer "+botClient.AccessToken)
+	res, err := botClient.Client.Client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	return res.StatusCode, resBody, err
+}
+
+// signOwnDevice signs the client's device with the self-signing key, if it isn't signed already.
+func (botClient *BotClient) signOwnDevice(selfSigningKey id.Ed25519, selfSigning ed25519.PrivateKey) error {
+	userID, deviceID := botClient.config.UserID, botClient.config.DeviceID
+	query := &mautrix.ReqQueryKeys{DeviceKeys: mautrix.DeviceKeysRequest{userID: mautrix.DeviceIDList{deviceID}}}
+	resp, err := botClient.QueryKeys(query)
+	if err != nil {
+		return err
+	}
+	device, ok := resp.DeviceKeys[userID][deviceID]
+	if !ok && botClient.olmMachine != nil {
+		// A new device only uploads its keys when it first syncs
+		if err = botClient.olmMachine.ShareKeys(0); err != nil {
+			return err
+		}
+		if resp, err = botClient.QueryKeys(query); err != nil {
+			return err
+		}
+		device, ok = resp.DeviceKeys[userID][deviceID]
+	}
+	if !ok {
+		return fmt.Errorf("the keys for device %s have not been uploaded", deviceID)
+	}
+	keyID := id.DeviceKeyID(crossSigningKeyID(selfSigningKey))
+	if _, signed := device.Signatures[userID][keyID]; signed {
+		return nil
+	}
+
+	sig, err := signJSON(selfSigning, device)
+	if err != nil {
+		return err
+	}
+	device.Signatures = mautrix.Signatures{userID: {keyID: sig}}
+	device.Unsigned = nil
+	body := map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys{userID: {deviceID: device}}
+	var res struct {
+		Failures map[id.UserID]map[string]interface{} `json:"failures"`
+	}
+	if _, err = botClient.MakeRequest("POST", botClient.BuildURL("keys", "signatures", "upload"), body, &res); err != nil {
+		return err
+	}
+	if failure, failed := res.Failures[userID][deviceID.String()]; failed {
+		return fmt.Errorf("the homeserver rejected the device signature: %v", failure)
+	}
+	log.WithFields(log.Fields{
+		"user_id":   userID,
+		"device_id": deviceID,
+	}).Info("Signed device with the self-signing key")
+	return nil
+}
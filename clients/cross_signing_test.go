@@ -0,0 +1,146 @@
+package clients
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/id"
+)
+
+type crossSigningStore struct {
+	database.NopStorage
+	keys map[id.UserID]types.CrossSigningKeys
+}
+
+func (s *crossSigningStore) StoreCrossSigningKeys(keys types.CrossSigningKeys) error {
+	s.keys[keys.UserID] = keys
+	return nil
+}
+
+func (s *crossSigningStore) LoadCrossSigningKeys(userID id.UserID) (types.CrossSigningKeys, error) {
+	keys, ok := s.keys[userID]
+	if !ok {
+		return keys, sql.ErrNoRows
+	}
+	return keys, nil
+}
+
+// verifySignature checks the signature on the JSON object with the public key.
+func verifySignature(t *testing.T, objJSON json.RawMessage, userID id.UserID, key id.Ed25519) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(objJSON, &fields); err != nil {
+		t.Fatalf("Failed to parse signed object: %s", err)
+	}
+	var signatures map[id.UserID]map[string]string
+	json.Unmarshal(fields["signatures"], &signatures)
+	delete(fields, "signatures")
+	delete(fields, "unsigned")
+	unsigned, _ := json.Marshal(fields)
+	canonical, _ := canonicaljson.CanonicalJSON(unsigned)
+	pub, _ := base64.RawStdEncoding.DecodeString(string(key))
+	sig, _ := base64.RawStdEncoding.DecodeString(signatures[userID]["ed25519:"+string(key)])
+	return len(pub) == ed25519.PublicKeySize && ed25519.Verify(pub, canonical, sig)
+}
+
+func TestCrossSigning(t *testing.T) {
+	var uploads []map[string]json.RawMessage
+	var deviceSignatures []json.RawMessage
+	masterKeys := `{}`
+	device := `{"user_id":"@neb:hs","device_id":"NEBDEVICE","algorithms":["m.megolm.v1.aes-sha2"],
+		"keys":{"ed25519:NEBDEVICE":"devkey"},"signatures":{"@neb:hs":{"ed25519:NEBDEVICE":"devsig"}},
+		"unsigned":{"device_display_name":"Go-NEB"}}`
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		respond := func(code int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		switch req.URL.Path {
+		case "/_matrix/client/r0/keys/device_signing/upload":
+			var upload map[string]json.RawMessage
+			json.Unmarshal(body, &upload)
+			uploads = append(uploads, upload)
+			var auth map[string]interface{}
+			json.Unmarshal(upload["auth"], &auth)
+			if auth["password"] != "hunter2" || auth["session"] != "uia" {
+				return respond(401, `{"session":"uia","flows":[{"stages":["m.login.password"]}]}`)
+			}
+			return respond(200, `{}`)
+		case "/_matrix/client/r0/keys/query":
+			return respond(200, `{"device_keys":{"@neb:hs":{"NEBDEVICE":`+device+`}},"master_keys":`+masterKeys+`}`)
+		case "/_matrix/client/r0/keys/signatures/upload":
+			var sigs map[id.UserID]map[id.DeviceID]json.RawMessage
+			json.Unmarshal(body, &sigs)
+			deviceSignatures = append(deviceSignatures, sigs["@neb:hs"]["NEBDEVICE"])
+			return respond(200, `{"failures":{}}`)
+		}
+		return respond(404, `{"errcode":"M_UNRECOGNIZED"}`)
+	}
+	store := &crossSigningStore{keys: make(map[id.UserID]types.CrossSigningKeys)}
+	newBotClient := func(config api.ClientConfig) *BotClient {
+		cli, _ := mautrix.NewClient("https://hs", config.UserID, "token")
+		cli.Client = &http.Client{Transport: trans}
+		return &BotClient{Client: cli, config: config}
+	}
+
+	config := api.ClientConfig{UserID: "@neb:hs", DeviceID: "NEBDEVICE", CrossSigning: true}
+	if err := newBotClient(config).setUpCrossSigning(store); err == nil {
+		t.Errorf("Expected uploading keys without a password to fail")
+	}
+	config.Password = "hunter2"
+	config.PickleKey = "secret"
+	if err := newBotClient(config).setUpCrossSigning(store); err != nil {
+		t.Fatalf("Failed to set up cross-signing: %s", err)
+	}
+
+	keys := store.keys["@neb:hs"]
+	if len(uploads) != 3 || keys.MasterKey == "" || keys.SelfSigningKey == "" {
+		t.Fatalf("Expected the keys to be uploaded with auth and stored, got %d uploads and %+v", len(uploads), keys)
+	}
+	if !verifySignature(t, uploads[2]["self_signing_key"], "@neb:hs", keys.MasterKey) {
+		t.Errorf("Expected the self-signing key to be signed by the master key, got %s", uploads[2]["self_signing_key"])
+	}
+	if len(deviceSignatures) != 1 || !verifySignature(t, deviceSignatures[0], "@neb:hs", keys.SelfSigningKey) {
+		t.Errorf("Expected the device to be signed by the self-signing key, got %s", deviceSignatures)
+	}
+	if _, err := decryptPrivateKeys([]byte("NEBDEVICEpickle"), keys.EncryptedPrivateKeys); err == nil {
+		t.Errorf("Expected the private keys to be encrypted with the pickle key")
+	}
+
+	// Once the device is signed, restarting neither creates new keys nor signs it again
+	device = string(deviceSignatures[0])
+	if err := newBotClient(config).setUpCrossSigning(store); err != nil {
+		t.Fatalf("Failed to set up cross-signing again: %s", err)
+	}
+	if len(uploads) != 3 || len(deviceSignatures) != 1 || store.keys["@neb:hs"].MasterKey != keys.MasterKey {
+		t.Errorf("Expected the stored keys to be reused, got %d uploads and %d signatures", len(uploads), len(deviceSignatures))
+	}
+
+	// The keys can't be used if the pickle key changes
+	config.PickleKey = "changed"
+	if err := newBotClient(config).setUpCrossSigning(store); err == nil {
+		t.Errorf("Expected a changed pickle key to fail")
+	}
+
+	// Keys which the user set up elsewhere are left alone
+	config.UserID = "@alice:hs"
+	masterKeys = `{"@alice:hs":{"user_id":"@alice:hs","usage":["master"],"keys":{"ed25519:alicekey":"alicekey"}}}`
+	if err := newBotClient(config).setUpCrossSigning(store); err == nil || !strings.Contains(err.Error(), "alicekey") {
+		t.Errorf("Expected existing cross-signing keys not to be replaced, got %v", err)
+	}
+	if _, stored := store.keys["@alice:hs"]; stored || len(uploads) != 3 {
+		t.Errorf("Expected no keys to be created, got %d uploads", len(uploads))
+	}
+}
@@ -0,0 +1,161 @@
+package clients
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The answer which stops a dialog.
+const cancelDialog = "cancel"
+
+type dialogKey struct {
+	roomID id.RoomID
+	userID id.UserID
+}
+
+// dialog is a command which is waiting for its sender to answer a question.
+type dialog struct {
+	path    []string
+	session *types.DialogSession
+	timer   *time.Timer
+}
+
+// dialogSessions are the dialogs in progress for a bot, with at most one for each user in a room.
+// A nil dialogSessions has no dialogs, and commands which have one run without it.
+type dialogSessions struct {
+	cli     types.MatrixClient // sends timeout notices
+	mu      sync.Mutex
+	dialogs map[dialogKey]*dialog
+}
+
+func newDialogSessions(cli types.MatrixClient) *dialogSessions {
+	return &dialogSessions{
+		cli:     cli,
+		dialogs: make(map[dialogKey]*dialog),
+	}
+}
+
+// active returns true if the user has a dialog in progress in the room.
+func (d *dialogSessions) active(roomID id.RoomID, userID id.UserID) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.dialogs[dialogKey{roomID, userID}]
+	return ok
+}
+
+// start starts a dialog for the sender of a command, replacing any they already had in the room.
+// It returns the first question to ask them.
+func (d *dialogSessions) start(event *mevt.Event, path []string, session *types.DialogSession) interface{} {
+	key := dialogKey{event.RoomID, event.Sender}
+	dlg := &dialog{path: path, session: session}
+	d.mu.Lock()
+	if old, ok := d.dialogs[key]; ok {
+		old.timer.Stop()
+	}
+	d.dialogs[key] = dlg
+	dlg.timer = time.AfterFunc(session.Timeout(), func() { d.timeout(key, dlg) })
+	d.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"room_id": event.RoomID,
+		"user_id": event.Sender,
+		"command": path,
+	}).Info("Started dialog")
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s (Say %q to stop.)", session.Prompt(), cancelDialog),
+	}
+}
+
+// answer uses a message as the answer to the sender's current question. It returns the next
+// question, or the response of the command once every question has been answered.
+func (d *dialogSessions) answer(event *mevt.Event, body string) interface{} {
+	key := dialogKey{event.RoomID, event.Sender}
+	d.mu.Lock()
+	dlg, ok := d.dialogs[key]
+	if !ok {
+		d.mu.Unlock()
+		return nil
+	}
+	if strings.EqualFold(strings.TrimSpace(body), cancelDialog) {
+		dlg.timer.Stop()
+		delete(d.dialogs, key)
+		d.mu.Unlock()
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Stopped !%s", strings.Join(dlg.path, " ")),
+		}
+	}
+	if err := dlg.session.Answer(body); err != nil {
+		dlg.timer.Reset(dlg.session.Timeout())
+		d.mu.Unlock()
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    err.Error() + ". " + dlg.session.Prompt(),
+		}
+	}
+	if !dlg.session.Done() {
+		dlg.timer.Reset(dlg.session.Timeout())
+		d.mu.Unlock()
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    dlg.session.Prompt(),
+		}
+	}
+	dlg.timer.Stop()
+	delete(d.dialogs, key)
+	d.mu.Unlock()
+
+	logger := log.WithFields(log.Fields{
+		"room_id": event.RoomID,
+		"user_id": event.Sender,
+		"command": dlg.path,
+	})
+	logger.Info("Executing command from dialog")
+	content, err := dlg.session.Dialog.Done(event.RoomID, event.ID, event.Sender, dlg.session.Answers())
+	if err != nil {
+		logger.WithError(err).Warn("Dialog failed")
+		metrics.IncrementCommand(dlg.path[0], metrics.StatusFailure)
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    err.Error(),
+		}
+	}
+	metrics.IncrementCommand(dlg.path[0], metrics.StatusSuccess)
+	return content
+}
+
+// timeout ends a dialog which hasn't been answered in time and tells the user.
+func (d *dialogSessions) timeout(key dialogKey, dlg *dialog) {
+	d.mu.Lock()
+	if d.dialogs[key] != dlg { // already finished or replaced
+		d.mu.Unlock()
+		return
+	}
+	delete(d.dialogs, key)
+	d.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"room_id": key.roomID,
+		"user_id": key.userID,
+		"command": dlg.path,
+	}).Info("Dialog timed out")
+	_, err := d.cli.SendMessageEvent(key.roomID, mevt.EventMessage, mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("%s: !%s timed out. Run it again to start over.", key.userID, strings.Join(dlg.path, " ")),
+	})
+	if err != nil {
+		log.WithError(err).WithField("room_id", key.roomID).Error("Failed to send dialog timeout")
+	}
+}
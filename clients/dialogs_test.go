@@ -0,0 +1,123 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCommandDialog(t *testing.T) {
+	var created []string
+	create := &MockService{commands: []types.Command{
+		{
+			Path: []string{"create"},
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
+				created = append(created, strings.Join(args, " "))
+				return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Created"}, nil
+			},
+			Dialog: func(roomID id.RoomID, eventID id.EventID, userID id.UserID) *types.Dialog {
+				return &types.Dialog{
+					Questions: []types.Question{
+						{Arg: types.Arg{Name: "title"}, Prompt: "Title?"},
+						{Arg: types.Arg{Name: "count", Type: types.ArgInt}, Prompt: "Count?"},
+					},
+					Timeout: 50 * time.Millisecond,
+					Done: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, answers *types.ParsedArgs) (interface{}, error) {
+						created = append(created, answers.String("title"))
+						return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Created " + answers.String("title")}, nil
+					},
+				}
+			},
+		},
+	}}
+	store := &responsesStore{
+		MockStore: MockStore{service: create},
+		senders:   make(map[id.EventID]id.UserID),
+		responses: make(map[id.EventID][]id.EventID),
+	}
+
+	var mu sync.Mutex
+	var sent []string
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		var content mevt.MessageEventContent
+		json.NewDecoder(req.Body).Decode(&content)
+		mu.Lock()
+		sent = append(sent, content.Body)
+		mu.Unlock()
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$response"}`)),
+		}, nil
+	}
+	cli := &http.Client{Transport: trans}
+	clients := New(store, cli)
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = cli
+	botClient := BotClient{Client: mxCli}
+	botClient.olmMachine = &crypto.OlmMachine{StateStore: &NebStateStore{Storer: mautrix.NewInMemoryStore()}}
+	botClient.dialogs = newDialogSessions(&botClient)
+
+	say := func(sender id.UserID, body string) string {
+		content := mevt.Content{Parsed: &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: body}}
+		clients.onMessageEvent(&botClient, &mevt.Event{Type: mevt.EventMessage, ID: "$msg", Sender: sender, RoomID: "!foo:bar", Content: content})
+		mu.Lock()
+		defer mu.Unlock()
+		if len(sent) == 0 {
+			return ""
+		}
+		return sent[len(sent)-1]
+	}
+
+	if got := say("@alice:bar", "!create"); got != `Title? (Say "cancel" to stop.)` {
+		t.Errorf("Expected the dialog to start, got %q", got)
+	}
+	// Other users in the room aren't answering
+	say("@bob:bar", "not a title")
+	if len(sent) != 1 {
+		t.Errorf("Expected messages from other users to be ignored, got %v", sent)
+	}
+	if got := say("@alice:bar", "Broken build"); got != "Count?" {
+		t.Errorf("Expected the next question, got %q", got)
+	}
+	if got := say("@alice:bar", "lots"); got != "count must be a number. Count?" {
+		t.Errorf("Expected the question to be asked again, got %q", got)
+	}
+	if got := say("@alice:bar", "2"); got != "Created Broken build" {
+		t.Errorf("Expected the dialog to finish, got %q", got)
+	}
+	if botClient.dialogs.active("!foo:bar", "@alice:bar") {
+		t.Errorf("Expected the dialog to end")
+	}
+
+	// Commands with arguments run without a dialog
+	say("@alice:bar", "!create now please")
+	if len(created) != 2 || created[1] != "now please" {
+		t.Errorf("Expected the command to run, got %v", created)
+	}
+
+	say("@alice:bar", "!create")
+	if got := say("@alice:bar", "!cancel"); got != "Stopped !create" {
+		t.Errorf("Expected the dialog to be cancelled, got %q", got)
+	}
+
+	say("@alice:bar", "!create")
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	last := sent[len(sent)-1]
+	mu.Unlock()
+	if last != "@alice:bar: !create timed out. Run it again to start over." || botClient.dialogs.active("!foo:bar", "@alice:bar") {
+		t.Errorf("Expected the dialog to time out, got %q", last)
+	}
+}
@@ -0,0 +1,164 @@
+package clients
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// The built-in command which lists the commands and expansions of every service for a bot.
+const helpCommand = "help"
+
+// helpEntry is a row in the !help table.
+type helpEntry struct {
+	usage string
+	help  string
+	role  string
+}
+
+// helpForServices responds to "!help [command path]". It lists the commands of every service
+// for the bot which start with the path, along with the expansions run on messages in the room
+// and the reactions to the bot's messages if no path is given. Services which give their
+// commands, expansions and reactions a Help string are described, without the service needing
+// a help command of its own.
+func helpForServices(services []types.Service, cli types.MatrixClient, path []string) interface{} {
+	var commands []helpEntry
+	seen := make(map[string]bool)
+	for _, service := range services {
+		for _, cmd := range service.Commands(cli) {
+			if !hasPathPrefix(cmd.Path, path) {
+				continue
+			}
+			usage := cmd.Usage()
+			if seen[usage] { // multiple services of the same type
+				continue
+			}
+			seen[usage] = true
+			commands = append(commands, helpEntry{usage, cmd.Help, cmd.Role})
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].usage < commands[j].usage
+	})
+
+	var expansions []helpEntry
+	if len(path) == 0 {
+		for _, service := range services {
+			for _, expansion := range service.Expansions(cli) {
+				help := expansion.Help
+				if help == "" {
+					help = expansion.Regexp.String()
+				}
+				key := service.ServiceType() + "\x00" + help
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				expansions = append(expansions, helpEntry{service.ServiceType(), help, ""})
+			}
+		}
+	}
+	var reactions []helpEntry
+	if len(path) == 0 {
+		for _, service := range services {
+			handler, ok := service.(types.ReactionHandler)
+			if !ok {
+				continue
+			}
+			for _, reaction := range handler.Reactions(cli) {
+				keys := strings.Join(reaction.Keys, " ")
+				key := service.ServiceType() + "\x00" + keys
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				reactions = append(reactions, helpEntry{keys, reaction.Help, reaction.Role})
+			}
+		}
+	}
+	metrics.IncrementCommand(helpCommand, metrics.StatusSuccess)
+
+	if len(commands) == 0 && len(path) > 0 {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No commands match !" + strings.Join(path, " ") + ". Try !help for a list of commands.",
+		}
+	}
+	if len(commands) == 0 && len(expansions) == 0 && len(reactions) == 0 {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "There are no commands or expansions in this room.",
+		}
+	}
+
+	var plain, htmlBody strings.Builder
+	if len(commands) > 0 {
+		plain.WriteString("Commands:\n")
+		htmlBody.WriteString("<table><tr><th>Command</th><th>Description</th><th>Role</th></tr>")
+		for _, e := range commands {
+			fmt.Fprintf(&plain, "%s", e.usage)
+			if e.help != "" {
+				fmt.Fprintf(&plain, " - %s", e.help)
+			}
+			if e.role != types.RoleAnyone {
+				fmt.Fprintf(&plain, " (%s)", e.role)
+			}
+			plain.WriteString("\n")
+			fmt.Fprintf(&htmlBody, "<tr><td><code>%s</code></td><td>%s</td><td>%s</td></tr>",
+				html.EscapeString(e.usage), html.EscapeString(e.help), html.EscapeString(e.role))
+		}
+		htmlBody.WriteString("</table>")
+	}
+	if len(expansions) > 0 {
+		plain.WriteString("Expansions:\n")
+		htmlBody.WriteString("<table><tr><th>Service</th><th>Expands</th></tr>")
+		for _, e := range expansions {
+			fmt.Fprintf(&plain, "%s: %s\n", e.usage, e.help)
+			fmt.Fprintf(&htmlBody, "<tr><td>%s</td><td>%s</td></tr>",
+				html.EscapeString(e.usage), html.EscapeString(e.help))
+		}
+		htmlBody.WriteString("</table>")
+	}
+	if len(reactions) > 0 {
+		plain.WriteString("Reactions to my messages:\n")
+		htmlBody.WriteString("<table><tr><th>Reaction</th><th>Description</th><th>Role</th></tr>")
+		for _, e := range reactions {
+			fmt.Fprintf(&plain, "%s", e.usage)
+			if e.help != "" {
+				fmt.Fprintf(&plain, " - %s", e.help)
+			}
+			if e.role != types.RoleAnyone {
+				fmt.Fprintf(&plain, " (%s)", e.role)
+			}
+			plain.WriteString("\n")
+			fmt.Fprintf(&htmlBody, "<tr><td>%s</td><td>%s</td><td>%s</td></tr>",
+				html.EscapeString(e.usage), html.EscapeString(e.help), html.EscapeString(e.role))
+		}
+		htmlBody.WriteString("</table>")
+	}
+
+	return mevt.MessageEventContent{
+		MsgType:       mevt.MsgNotice,
+		Body:          strings.TrimSuffix(plain.String(), "\n"),
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlBody.String(),
+	}
+}
+
+// hasPathPrefix returns true if a command path starts with the prefix, ignoring case.
+func hasPathPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i, segment := range prefix {
+		if !strings.EqualFold(segment, path[i]) {
+			return false
+		}
+	}
+	return true
+}
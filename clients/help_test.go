@@ -0,0 +1,69 @@
+package clients
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+type expandingService struct {
+	MockService
+	expansions []types.Expansion
+}
+
+func (s *expandingService) Expansions(cli types.MatrixClient) []types.Expansion {
+	return s.expansions
+}
+
+func TestHelpForServices(t *testing.T) {
+	github := &expandingService{
+		MockService: MockService{
+			DefaultService: types.NewDefaultService("github_id", "@neb:localhost", "github"),
+			commands: []types.Command{
+				{Path: []string{"github", "close"}, Arguments: []string{"owner/repo#issue"}, Help: "Close an issue", Role: types.RoleOperator},
+				{Path: []string{"github", "search"}, Arguments: []string{`"query"`}, Help: "Search <issues>"},
+			},
+		},
+		expansions: []types.Expansion{
+			{Regexp: issueRegexpForTest, Help: "Issues, e.g. #12"},
+			{Regexp: issueRegexpForTest},
+		},
+	}
+	echo := &MockService{
+		DefaultService: types.NewDefaultService("echo_id", "@neb:localhost", "echo"),
+		commands: []types.Command{
+			{Path: []string{"echo"}, Arguments: []string{"message"}},
+		},
+	}
+	// A second service of the same type shouldn't list its commands twice
+	services := []types.Service{github, echo, github}
+
+	content := helpForServices(services, nil, nil).(mevt.MessageEventContent)
+	wantBody := strings.Join([]string{
+		"Commands:",
+		"!echo message",
+		"!github close owner/repo#issue - Close an issue (operator)",
+		`!github search "query" - Search <issues>`,
+		"Expansions:",
+		"github: Issues, e.g. #12",
+		"github: " + issueRegexpForTest.String(),
+	}, "\n")
+	if content.Body != wantBody {
+		t.Errorf("Body: got %q, want %q", content.Body, wantBody)
+	}
+	if content.Format != mevt.FormatHTML || !strings.Contains(content.FormattedBody, "<td>Search &lt;issues&gt;</td>") {
+		t.Errorf("Expected an escaped HTML table, got %q", content.FormattedBody)
+	}
+
+	content = helpForServices(services, nil, []string{"GitHub", "close"}).(mevt.MessageEventContent)
+	if content.Body != "Commands:\n!github close owner/repo#issue - Close an issue (operator)" {
+		t.Errorf("Expected only the matching command, got %q", content.Body)
+	}
+
+	content = helpForServices(services, nil, []string{"jira"}).(mevt.MessageEventContent)
+	if !strings.HasPrefix(content.Body, "No commands match !jira") {
+		t.Errorf("Expected no matching commands, got %q", content.Body)
+	}
+}
@@ -0,0 +1,214 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/go-neb/api"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+)
+
+// The display name of devices which Go-NEB creates by logging in.
+const loginDeviceDisplayName = "Go-NEB"
+
+// reqLogin is a /login request which also asks for a refresh token.
+type reqLogin struct {
+	mautrix.ReqLogin
+	RefreshToken bool `json:"refresh_token"`
+}
+
+// respLogin is a /login or /refresh response, which may include a refresh token.
+type respLogin struct {
+	mautrix.RespLogin
+	RefreshToken string `json:"refresh_token"`
+}
+
+// login logs in with the config's Password or LoginToken, and returns the config with the access token,
+// device ID and refresh token it got.
+func (c *Clients) login(config api.ClientConfig) (api.ClientConfig, error) {
+	cli, err := mautrix.NewClient(config.HomeserverURL, config.UserID, "")
+	if err != nil {
+		return config, err
+	}
+	cli.Client = c.httpClient
+	localpart, _, err := config.UserID.Parse()
+	if err != nil {
+		return config, err
+	}
+
+	req := reqLogin{
+		ReqLogin: mautrix.ReqLogin{
+			Identifier:               mautrix.UserIdentifier{Type: "m.id.user", User: localpart},
+			DeviceID:                 config.DeviceID,
+			InitialDeviceDisplayName: loginDeviceDisplayName,
+		},
+		RefreshToken: true,
+	}
+	if config.Password != "" {
+		req.Type = "m.login.password"
+		req.Password = config.Password
+	} else if config.LoginToken != "" {
+		req.Type = "m.login.token"
+		req.Token = config.LoginToken
+	} else {
+		return config, errors.New("no Password or LoginToken to log in with")
+	}
+
+	var resp respLogin
+	if _, err = cli.MakeRequest("POST", cli.BuildURL("login"), &req, &resp); err != nil {
+		return config, err
+	}
+	if resp.UserID != config.UserID {
+		return config, fmt.Errorf("logged in as %s instead", resp.UserID)
+	}
+	config.AccessToken = resp.AccessToken
+	config.DeviceID = resp.DeviceID
+	config.RefreshToken = resp.RefreshToken
+	log.WithFields(log.Fields{
+		"user_id":   config.UserID,
+		"device_id": config.DeviceID,
+	}).Info("Logged in")
+	return config, nil
+}
+
+// refresh uses the config's RefreshToken to get a new access token, and returns the config with it.
+func (c *Clients) refresh(config api.ClientConfig) (api.ClientConfig, error) {
+	if config.RefreshToken == "" {
+		return config, errors.New("no refresh token")
+	}
+	cli, err := mautrix.NewClient(config.HomeserverURL, config.UserID, "")
+	if err != nil {
+		return config, err
+	}
+	cli.Client = c.httpClient
+
+	req := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{config.RefreshToken}
+	var resp respLogin
+	if _, err = cli.MakeRequest("POST", cli.BuildBaseURL("_matrix", "client", "v3", "refresh"), &req, &resp); err != nil {
+		return config, err
+	}
+	config.AccessToken = resp.AccessToken
+	// The old refresh token may still be used if the homeserver doesn't rotate them
+	if resp.RefreshToken != "" {
+		config.RefreshToken = resp.RefreshToken
+	}
+	log.WithField("user_id", config.UserID).Info("Refreshed access token")
+	return config, nil
+}
+
+// storeLogin persists new credentials for a running client.
+func (c *Clients) storeLogin(client *mautrix.Client, config api.ClientConfig) {
+	c.mapMutex.Lock()
+	entry, ok := c.clients[config.UserID]
+	if ok && entry.Client == client {
+		entry.config = config
+		c.clients[config.UserID] = entry
+	}
+	c.mapMutex.Unlock()
+	// A client which is starting up is stored once it has started, and one which has been replaced
+	// or removed must not be stored.
+	if !ok || entry.Client != client {
+		return
+	}
+	if _, err := c.db.StoreMatrixClientConfig(config); err != nil {
+		log.WithError(err).WithField("user_id", config.UserID).Error("Failed to store new access token")
+	}
+}
+
+// A loginSession keeps a client's access token working when it expires, by refreshing it or by
+// logging in again with the password.
+type loginSession struct {
+	mu      sync.Mutex
+	clients *Clients
+	client  *mautrix.Client
+	config  api.ClientConfig
+}
+
+// renew returns an access token to replace the expired one, or an error if there is no way to get one.
+func (s *loginSession) renew(expired string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config.AccessToken != expired {
+		// Another request already renewed it
+		return s.config.AccessToken, nil
+	}
+	config, err := s.clients.refresh(s.config)
+	if err != nil && s.config.Password != "" {
+		if s.config.RefreshToken != "" {
+			log.WithError(err).WithField("user_id", s.config.UserID).Warn("Failed to refresh access token, logging in again")
+		}
+		config, err = s.clients.login(s.config)
+	}
+	if err != nil {
+		return "", err
+	}
+	s.config = config
+	s.client.AccessToken = config.AccessToken
+	s.clients.storeLogin(s.client, config)
+	return config.AccessToken, nil
+}
+
+// renewingTransport retries requests which failed with M_UNKNOWN_TOKEN once the access token has been renewed.
+type renewingTransport struct {
+	base    http.RoundTripper
+	session *loginSession
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *renewingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil || res.StatusCode != 401 || (req.Body != nil && req.GetBody == nil) {
+		return res, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return res, nil
+	}
+	var respErr mautrix.RespError
+	if json.Unmarshal(body, &respErr) != nil || respErr.ErrCode != "M_UNKNOWN_TOKEN" {
+		return res, nil
+	}
+
+	expired := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	token, err := t.session.renew(expired)
+	if err != nil {
+		log.WithError(err).WithField("user_id", t.session.client.UserID).Error("Access token expired and could not be renewed")
+		return res, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return res, nil
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(retry)
+}
+
+// renewLogins makes the client renew its access token when it expires, if it has a way to.
+// It returns the session which holds the current credentials, or nil.
+func (c *Clients) renewLogins(client *mautrix.Client, config api.ClientConfig) *loginSession {
+	if config.Password == "" && config.RefreshToken == "" {
+		return nil
+	}
+	session := &loginSession{clients: c, client: client, config: config}
+	base := c.httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	httpClient := *c.httpClient
+	httpClient.Transport = &renewingTransport{base, session}
+	client.Client = &httpClient
+	return session
+}
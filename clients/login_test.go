@@ -0,0 +1,117 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"maunium.net/go/mautrix"
+)
+
+type loginStore struct {
+	database.NopStorage
+	stored []api.ClientConfig
+}
+
+func (s *loginStore) StoreMatrixClientConfig(config api.ClientConfig) (api.ClientConfig, error) {
+	s.stored = append(s.stored, config)
+	return api.ClientConfig{}, nil
+}
+
+func TestLoginAndRenew(t *testing.T) {
+	var logins []map[string]interface{}
+	var validToken string
+	validRefreshToken := "ref1"
+	var sentBodies []string
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		respond := func(code int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		}
+		unknownToken := `{"errcode":"M_UNKNOWN_TOKEN","error":"Access token has expired","soft_logout":true}`
+		switch req.URL.Path {
+		case "/_matrix/client/r0/login":
+			var body map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&body)
+			logins = append(logins, body)
+			if body["password"] != "hunter2" {
+				return respond(403, `{"errcode":"M_FORBIDDEN","error":"Invalid password"}`)
+			}
+			validToken = fmt.Sprintf("login%d", len(logins))
+			return respond(200, `{"user_id":"@neb:hs","access_token":"`+validToken+`","device_id":"NEBDEVICE","refresh_token":"`+validRefreshToken+`"}`)
+		case "/_matrix/client/v3/refresh":
+			var body map[string]string
+			json.NewDecoder(req.Body).Decode(&body)
+			if body["refresh_token"] != validRefreshToken {
+				return respond(401, unknownToken)
+			}
+			validToken, validRefreshToken = "tok2", "ref2"
+			return respond(200, `{"access_token":"tok2","refresh_token":"ref2"}`)
+		}
+		if req.Header.Get("Authorization") != "Bearer "+validToken {
+			return respond(401, unknownToken)
+		}
+		if req.Method == "PUT" {
+			body, _ := ioutil.ReadAll(req.Body)
+			sentBodies = append(sentBodies, string(body))
+			return respond(200, `{"event_id":"$sent"}`)
+		}
+		return respond(200, `{"user_id":"@neb:hs"}`)
+	}
+	store := &loginStore{}
+	clients := New(store, &http.Client{Transport: trans})
+
+	if _, err := clients.login(api.ClientConfig{UserID: "@neb:hs", HomeserverURL: "https://hs", Password: "wrong"}); err == nil {
+		t.Errorf("Expected logging in with the wrong password to fail")
+	}
+	config, err := clients.login(api.ClientConfig{UserID: "@neb:hs", HomeserverURL: "https://hs", Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("Failed to log in: %s", err)
+	}
+	if config.AccessToken != "login2" || config.DeviceID != "NEBDEVICE" || config.RefreshToken != "ref1" {
+		t.Errorf("Expected the login credentials to be kept, got %+v", config)
+	}
+	if identifier, _ := logins[1]["identifier"].(map[string]interface{}); identifier["user"] != "neb" || logins[1]["refresh_token"] != true {
+		t.Errorf("Expected to log in as neb with a refresh token, got %v", logins[1])
+	}
+
+	client, _ := mautrix.NewClient(config.HomeserverURL, config.UserID, config.AccessToken)
+	session := clients.renewLogins(client, config)
+	clients.setClient(BotClient{Client: client, config: config})
+
+	// The access token expires and is refreshed
+	validToken = "expired"
+	if _, err := client.Whoami(); err != nil {
+		t.Fatalf("Expected the request to be retried with a refreshed token, got %s", err)
+	}
+	if client.AccessToken != "tok2" || session.config.RefreshToken != "ref2" {
+		t.Errorf("Expected the refreshed token to be used, got %s and %s", client.AccessToken, session.config.RefreshToken)
+	}
+	if len(store.stored) != 1 || store.stored[0].AccessToken != "tok2" || clients.getClient("@neb:hs").config.AccessToken != "tok2" {
+		t.Errorf("Expected the refreshed token to be stored, got %+v", store.stored)
+	}
+
+	// The refresh token stops working too, so the client logs in again. Request bodies are sent again.
+	validToken, validRefreshToken = "expired", "revoked"
+	if _, err := client.SendText("!room:hs", "hello"); err != nil {
+		t.Fatalf("Expected the request to be retried after logging in again, got %s", err)
+	}
+	if len(logins) != 3 || client.AccessToken != validToken || logins[2]["device_id"] != "NEBDEVICE" {
+		t.Errorf("Expected to log in again with the same device, got %v", logins)
+	}
+	if len(sentBodies) != 1 || sentBodies[0] != `{"msgtype":"m.text","body":"hello"}` {
+		t.Errorf("Expected the message to be sent once, got %v", sentBodies)
+	}
+
+	// Without a password there is no way to renew the token
+	session.config.Password = ""
+	validToken, validRefreshToken = "expired", "rotated"
+	if _, err := client.Whoami(); err == nil {
+		t.Errorf("Expected the request to fail when the token can't be renewed")
+	}
+}
@@ -0,0 +1,126 @@
+package clients
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Roles from least to most privileged. A user with a role also has every role before it.
+var roleOrder = []string{types.RoleOperator, types.RoleAdmin}
+
+// The power level needed for each role in rooms which don't configure it.
+var defaultRolePowerLevels = map[string]int{
+	types.RoleOperator: 50,
+	types.RoleAdmin:    100,
+}
+
+// roleConfig is who has a role in a room. It is read from the room's m.room.bot.options:
+//   {
+//     "permissions": {
+//       "operator": { "users": ["@alice:localhost"], "power_level": 50 },
+//       "admin": { "power_level": 100 }
+//     }
+//   }
+type roleConfig struct {
+	// Users who have the role regardless of their power level.
+	Users []id.UserID `json:"users"`
+	// The power level needed to have the role. Defaults to the value in defaultRolePowerLevels.
+	PowerLevel *int `json:"power_level"`
+}
+
+// roomPermissions decides which roles users have in a room.
+type roomPermissions struct {
+	roles map[string]roleConfig
+	// nil if the room's power levels are not known, in which case roles are only granted by user ID.
+	powerLevels *mevt.PowerLevelsEventContent
+}
+
+// newRoomPermissions reads the permissions for a room from its bot options and power levels.
+func newRoomPermissions(botClient *BotClient, roomID id.RoomID, opts map[string]interface{}) *roomPermissions {
+	perms := &roomPermissions{}
+	if botClient.stateStore != nil {
+		perms.powerLevels = botClient.stateStore.GetPowerLevels(roomID)
+	}
+
+	permOpts, ok := opts["permissions"]
+	if !ok {
+		return perms
+	}
+	// Round trip through JSON to convert the generic options into roleConfigs
+	b, err := json.Marshal(permOpts)
+	if err == nil {
+		err = json.Unmarshal(b, &perms.roles)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:  err,
+			"room_id":     roomID,
+			"bot_user_id": botClient.UserID,
+			"permissions": permOpts,
+		}).Warn("Failed to parse permissions in bot options")
+	}
+	return perms
+}
+
+// hasRole returns true if the user has the role, or a more privileged one. Unknown roles are never granted.
+func (p *roomPermissions) hasRole(userID id.UserID, role string) bool {
+	if role == types.RoleAnyone {
+		return true
+	}
+	for i, r := range roleOrder {
+		if r != role {
+			continue
+		}
+		for _, granted := range roleOrder[i:] {
+			if p.grants(userID, granted) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// grants returns true if the user has exactly this role.
+func (p *roomPermissions) grants(userID id.UserID, role string) bool {
+	cfg := p.roles[role]
+	for _, u := range cfg.Users {
+		if u == userID {
+			return true
+		}
+	}
+	if p.powerLevels == nil {
+		return false
+	}
+	level := defaultRolePowerLevels[role]
+	if cfg.PowerLevel != nil {
+		level = *cfg.PowerLevel
+	}
+	return p.powerLevels.GetUserLevel(userID) >= level
+}
+
+// canChangePermissions returns true if the user may change the permissions in a room's bot options. This
+// needs the default admin power level, as the permissions being replaced could otherwise grant it.
+func canChangePermissions(botClient *BotClient, roomID id.RoomID, userID id.UserID) bool {
+	if botClient.stateStore == nil {
+		return false
+	}
+	powerLevels := botClient.stateStore.GetPowerLevels(roomID)
+	return powerLevels != nil && powerLevels.GetUserLevel(userID) >= defaultRolePowerLevels[types.RoleAdmin]
+}
+
+// keepPermissions returns a copy of the new bot options with the permissions from the old ones.
+func keepPermissions(opts, old map[string]interface{}) map[string]interface{} {
+	kept := make(map[string]interface{}, len(opts))
+	for k, v := range opts {
+		kept[k] = v
+	}
+	delete(kept, "permissions")
+	if perms, ok := old["permissions"]; ok {
+		kept["permissions"] = perms
+	}
+	return kept
+}
@@ -0,0 +1,148 @@
+package clients
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type botOptionsStore struct {
+	database.NopStorage
+	opts map[id.RoomID]types.BotOptions
+}
+
+func (s *botOptionsStore) StoreBotOptions(opts types.BotOptions) (types.BotOptions, error) {
+	old := s.opts[opts.RoomID]
+	s.opts[opts.RoomID] = opts
+	return old, nil
+}
+
+func (s *botOptionsStore) LoadBotOptions(userID id.UserID, roomID id.RoomID) (types.BotOptions, error) {
+	opts, ok := s.opts[roomID]
+	if !ok {
+		return opts, sql.ErrNoRows
+	}
+	return opts, nil
+}
+
+func TestRoomPermissions(t *testing.T) {
+	fifty := 50
+	perms := &roomPermissions{
+		roles: map[string]roleConfig{
+			types.RoleOperator: {Users: []id.UserID{"@alice:localhost"}},
+			types.RoleAdmin:    {PowerLevel: &fifty},
+		},
+		powerLevels: &mevt.PowerLevelsEventContent{
+			Users: map[id.UserID]int{
+				"@mod:localhost":  50,
+				"@user:localhost": 10,
+			},
+		},
+	}
+	testCases := []struct {
+		userID id.UserID
+		role   string
+		want   bool
+	}{
+		{"@user:localhost", types.RoleAnyone, true},
+		{"@user:localhost", types.RoleOperator, false},
+		{"@alice:localhost", types.RoleOperator, true},
+		{"@alice:localhost", types.RoleAdmin, false},
+		// admin is granted at power level 50 in this room, which includes operator
+		{"@mod:localhost", types.RoleAdmin, true},
+		{"@mod:localhost", types.RoleOperator, true},
+		{"@mod:localhost", "unknown", false},
+	}
+	for _, tc := range testCases {
+		if got := perms.hasRole(tc.userID, tc.role); got != tc.want {
+			t.Errorf("hasRole(%s, %q): got %v, want %v", tc.userID, tc.role, got, tc.want)
+		}
+	}
+
+	// Without power levels, only listed users have roles
+	perms.powerLevels = nil
+	if perms.hasRole("@mod:localhost", types.RoleOperator) || !perms.hasRole("@alice:localhost", types.RoleOperator) {
+		t.Errorf("Expected only listed users to have roles when power levels are unknown")
+	}
+}
+
+func TestRunCommandRequiresRole(t *testing.T) {
+	executed := false
+	cmds := []types.Command{
+		{
+			Path: []string{"close"},
+			Role: types.RoleOperator,
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
+				executed = true
+				return nil, nil
+			},
+		},
+	}
+	event := &mevt.Event{Sender: "@user:localhost", RoomID: "!foo:bar"}
+	perms := &roomPermissions{powerLevels: &mevt.PowerLevelsEventContent{}}
+
+	response := runCommandForService(cmds, event, []string{"close"}, perms, nil, nil)
+	if executed {
+		t.Fatalf("Command ran without the required role")
+	}
+	if content, ok := response.(mevt.MessageEventContent); !ok || content.MsgType != mevt.MsgNotice {
+		t.Errorf("Expected a notice explaining the missing role, got %+v", response)
+	}
+
+	perms.powerLevels.Users = map[id.UserID]int{"@user:localhost": 50}
+	runCommandForService(cmds, event, []string{"close"}, perms, nil, nil)
+	if !executed {
+		t.Errorf("Command did not run for a user with the required power level")
+	}
+}
+
+func TestBotOptionsPermissions(t *testing.T) {
+	store := &botOptionsStore{opts: make(map[id.RoomID]types.BotOptions)}
+	clients := New(store, nil)
+	mxCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "token")
+	botClient := &BotClient{Client: mxCli, stateStore: &NebStateStore{Storer: mautrix.NewInMemoryStore()}}
+	var resp mautrix.RespSync
+	json.Unmarshal([]byte(`{"rooms":{"join":{"!room:hs":{"state":{"events":[
+		{"type":"m.room.power_levels","state_key":"","sender":"@admin:hs","content":{"users":{"@admin:hs":100,"@mod:hs":50}},"event_id":"$pl"}
+	]}}}}}`), &resp)
+	botClient.stateStore.UpdateStateStore(&resp)
+
+	setOptions := func(sender id.UserID, options string) map[string]interface{} {
+		stateKey := "_@neb:hs"
+		evt := &mevt.Event{Type: mevt.NewEventType("m.room.bot.options"), StateKey: &stateKey, Sender: sender, RoomID: "!room:hs"}
+		json.Unmarshal([]byte(options), &evt.Content.Raw)
+		clients.onBotOptionsEvent(botClient, evt)
+		return store.opts["!room:hs"].Options
+	}
+	operators := func(opts map[string]interface{}) interface{} {
+		perms, _ := opts["permissions"].(map[string]interface{})
+		return perms["operator"]
+	}
+
+	// A moderator can't grant themselves roles
+	opts := setOptions("@mod:hs", `{"response_mode":"thread","permissions":{"admin":{"power_level":50}}}`)
+	if _, ok := opts["permissions"]; ok || opts["response_mode"] != "thread" {
+		t.Errorf("Expected only the other options to be stored, got %v", opts)
+	}
+
+	opts = setOptions("@admin:hs", `{"permissions":{"operator":{"users":["@alice:hs"]}}}`)
+	if operators(opts) == nil {
+		t.Fatalf("Expected an admin to be able to set permissions, got %v", opts)
+	}
+
+	// Nor can they remove or replace the permissions an admin set
+	opts = setOptions("@mod:hs", `{"response_mode":"none"}`)
+	if operators(opts) == nil || opts["response_mode"] != "none" {
+		t.Errorf("Expected the admin's permissions to be kept, got %v", opts)
+	}
+	opts = setOptions("@mod:hs", `{"permissions":{"operator":{"users":["@mod:hs"]}}}`)
+	if users := operators(opts).(map[string]interface{})["users"].([]interface{}); len(users) != 1 || users[0] != "@alice:hs" {
+		t.Errorf("Expected the admin's permissions to be kept, got %v", opts)
+	}
+}
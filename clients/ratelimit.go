@@ -0,0 +1,139 @@
+package clients
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// How often to forget about buckets which have refilled.
+const rateLimitSweepInterval = 10 * time.Minute
+
+type rateLimitKey struct {
+	sender      id.UserID
+	roomID      id.RoomID
+	serviceType string
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// When the bucket will have refilled, after which it can be forgotten.
+	full time.Time
+	// True if the sender has been told they are rate limited since they last used a token.
+	notified bool
+}
+
+// rateLimiter is a token bucket rate limiter for commands and expansions, with a bucket for each sender,
+// room and service type.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[rateLimitKey]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[rateLimitKey]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// take uses a token from the bucket for the key. Returns false if there are no tokens left, along with
+// whether this is the first refusal since the sender last used a token.
+func (l *rateLimiter) take(key rateLimitKey, limit types.RateLimit) (ok, firstRefusal bool) {
+	if limit.Unlimited() {
+		return true, false
+	}
+	burst := math.Max(float64(limit.Burst), 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[key] = b
+		metrics.SetRateLimitBuckets(len(l.buckets))
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Minutes()*limit.PerMinute)
+	b.updated = now
+	if b.tokens < 1 {
+		firstRefusal = !b.notified
+		b.notified = true
+		return false, firstRefusal
+	}
+	b.tokens--
+	b.notified = false
+	b.full = now.Add(time.Duration((burst - b.tokens) / limit.PerMinute * float64(time.Minute)))
+	return true, false
+}
+
+// sweep forgets buckets which have refilled, so that the number of buckets doesn't grow forever.
+// A new bucket starts full, so this doesn't change the outcome of take.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+	metrics.SetRateLimitBuckets(len(l.buckets))
+}
+
+// serviceLimit rate limits the commands and expansions for a single service and message.
+// A nil serviceLimit allows everything.
+type serviceLimit struct {
+	limiter *rateLimiter
+	key     rateLimitKey
+	limit   types.RateLimit
+}
+
+func (c *Clients) serviceLimit(service types.Service, event *mevt.Event) *serviceLimit {
+	limit := types.DefaultRateLimit
+	if rl, ok := service.(types.RateLimited); ok {
+		limit = rl.CommandRateLimit()
+	}
+	return &serviceLimit{
+		limiter: c.rateLimiter,
+		key:     rateLimitKey{event.Sender, event.RoomID, service.ServiceType()},
+		limit:   limit,
+	}
+}
+
+// allow uses a token for a command or expansion. If the sender is rate limited, it returns false along
+// with a notice to send them, which is nil if they have already been told.
+func (s *serviceLimit) allow(kind string) (bool, interface{}) {
+	if s == nil {
+		return true, nil
+	}
+	ok, firstRefusal := s.limiter.take(s.key, s.limit)
+	if ok {
+		return true, nil
+	}
+	metrics.IncrementRateLimited(s.key.serviceType, kind)
+	if !firstRefusal {
+		return false, nil
+	}
+	log.WithFields(log.Fields{
+		"room_id":      s.key.roomID,
+		"user_id":      s.key.sender,
+		"service_type": s.key.serviceType,
+	}).Info("Sender is rate limited")
+	return false, mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "You're sending " + s.key.serviceType + " requests too quickly. Please wait a minute and try again.",
+	}
+}
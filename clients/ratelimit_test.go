@@ -0,0 +1,84 @@
+package clients
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var issueRegexpForTest = regexp.MustCompile(`#\d+`)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	l := newRateLimiter()
+	l.now = func() time.Time { return now }
+	key := rateLimitKey{"@alice:localhost", "!room:localhost", "giphy"}
+	limit := types.RateLimit{Burst: 2, PerMinute: 1}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take(key, limit); !ok {
+			t.Fatalf("Take %d: expected burst to be allowed", i)
+		}
+	}
+	if ok, first := l.take(key, limit); ok || !first {
+		t.Errorf("Expected first refusal after burst, got ok=%v first=%v", ok, first)
+	}
+	if ok, first := l.take(key, limit); ok || first {
+		t.Errorf("Expected repeated refusal without notice, got ok=%v first=%v", ok, first)
+	}
+	other := rateLimitKey{"@bob:localhost", "!room:localhost", "giphy"}
+	if ok, _ := l.take(other, limit); !ok {
+		t.Errorf("Expected other senders to have their own bucket")
+	}
+
+	now = now.Add(time.Minute)
+	if ok, _ := l.take(key, limit); !ok {
+		t.Errorf("Expected a token to be refilled after a minute")
+	}
+	if ok, first := l.take(key, limit); ok || !first {
+		t.Errorf("Expected a new notice after using a token, got ok=%v first=%v", ok, first)
+	}
+
+	if ok, _ := l.take(key, types.RateLimit{}); !ok {
+		t.Errorf("Expected a zero rate limit to be unlimited")
+	}
+
+	now = now.Add(time.Hour)
+	l.take(other, limit)
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected refilled buckets to be swept, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestExpansionsRateLimited(t *testing.T) {
+	limit := &serviceLimit{
+		limiter: newRateLimiter(),
+		key:     rateLimitKey{"@alice:localhost", "!room:localhost", "github"},
+		limit:   types.RateLimit{Burst: 2, PerMinute: 1},
+	}
+	var expanded []string
+	expans := []types.Expansion{
+		{
+			Regexp: issueRegexpForTest,
+			Expand: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, groups []string) interface{} {
+				expanded = append(expanded, groups[0])
+				return groups[0]
+			},
+		},
+	}
+	event := &mevt.Event{Sender: "@alice:localhost", RoomID: "!room:localhost"}
+	responses := runExpansionsForService(expans, event, "#1 #2 #3 #4", limit)
+	if len(expanded) != 2 {
+		t.Errorf("Expected 2 expansions before being rate limited, got %v", expanded)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("Expected 2 expansions and a notice, got %v", responses)
+	}
+	if _, ok := responses[2].(mevt.MessageEventContent); !ok {
+		t.Errorf("Expected the last response to be a notice, got %v", responses[2])
+	}
+}
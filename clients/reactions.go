@@ -0,0 +1,124 @@
+package clients
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// onReactionEvent runs the reactions of services which handle the key of a reaction to one of the
+// bot's messages. Responses are sent as replies to the message which was reacted to, and are
+// stored against the reaction so that they are redacted along with it.
+func (c *Clients) onReactionEvent(botClient *BotClient, event *mevt.Event) {
+	if event.Sender == botClient.UserID {
+		return
+	}
+	reaction := event.Content.AsReaction()
+	rel := reaction.RelatesTo
+	if rel.Type != mevt.RelAnnotation || rel.EventID == "" || rel.Key == "" {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"room_id":   event.RoomID,
+		"event_id":  event.ID,
+		"target_id": rel.EventID,
+		"sender":    event.Sender,
+		"key":       rel.Key,
+	})
+
+	services, err := c.db.LoadServicesForUser(botClient.UserID)
+	if err != nil {
+		logger.WithError(err).Warn("Error loading services")
+		return
+	}
+	type serviceReaction struct {
+		service  types.Service
+		reaction types.Reaction
+	}
+	var matching []serviceReaction
+	for _, service := range services {
+		handler, ok := service.(types.ReactionHandler)
+		if !ok {
+			continue
+		}
+		for _, r := range handler.Reactions(c.serviceClient(botClient, service.ServiceID())) {
+			if r.Matches(rel.Key) {
+				matching = append(matching, serviceReaction{service, r})
+			}
+		}
+	}
+	// Most reactions aren't for services, so don't fetch the message unless one might be
+	if len(matching) == 0 {
+		return
+	}
+
+	target, err := c.loadEvent(botClient, event.RoomID, rel.EventID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load the message which was reacted to")
+		return
+	}
+	if target.Sender != botClient.UserID {
+		return
+	}
+
+	opts := c.loadBotOptions(botClient.UserID, event.RoomID)
+	perms := newRoomPermissions(botClient, event.RoomID, opts)
+	var responses []interface{}
+	for _, m := range matching {
+		serviceType := m.service.ServiceType()
+		if !perms.hasRole(event.Sender, m.reaction.Role) {
+			logger.WithField("role", m.reaction.Role).Info("Sender does not have the role needed for reaction")
+			metrics.IncrementReaction(serviceType, metrics.StatusForbidden)
+			responses = append(responses, mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    fmt.Sprintf("You need the %s role in this room to react with %s", m.reaction.Role, rel.Key),
+			})
+			continue
+		}
+		if ok, notice := c.serviceLimit(m.service, event).allow("reaction"); !ok {
+			if notice != nil {
+				responses = append(responses, notice)
+			}
+			continue
+		}
+		content, err := m.reaction.React(event.RoomID, event.ID, event.Sender, rel.Key, target)
+		if err != nil {
+			logger.WithError(err).WithField("service_type", serviceType).Warn("Failed to handle reaction")
+			metrics.IncrementReaction(serviceType, metrics.StatusFailure)
+			responses = append(responses, mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    err.Error(),
+			})
+			continue
+		}
+		if content == nil {
+			continue
+		}
+		metrics.IncrementReaction(serviceType, metrics.StatusSuccess)
+		responses = append(responses, content)
+	}
+
+	c.sendResponses(botClient, event, responseRelation(target, target.Content.AsMessage(), responseMode(opts)), responses, nil)
+}
+
+// loadEvent fetches an event from the homeserver, decrypting it if needed.
+func (c *Clients) loadEvent(botClient *BotClient, roomID id.RoomID, eventID id.EventID) (*mevt.Event, error) {
+	evt, err := botClient.GetEvent(roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	// The content of events fetched this way isn't parsed, and only message events can be reacted to
+	evt.Type.Class = mevt.MessageEventType
+	evt.RoomID = roomID
+	if err = evt.Content.ParseRaw(evt.Type); err != nil {
+		return nil, err
+	}
+	if evt.Type == mevt.EventEncrypted {
+		return botClient.DecryptMegolmEvent(evt)
+	}
+	return evt, nil
+}
@@ -0,0 +1,117 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type reactingService struct {
+	MockService
+	reactions []types.Reaction
+}
+
+func (s *reactingService) Reactions(cli types.MatrixClient) []types.Reaction {
+	return s.reactions
+}
+
+func TestReactionToBotMessage(t *testing.T) {
+	var reactedTo []id.EventID
+	service := &reactingService{
+		MockService: MockService{DefaultService: types.NewDefaultService("id", "@service:user", "alerts")},
+		reactions: []types.Reaction{
+			{
+				Keys: []string{"✅"},
+				React: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, key string, target *mevt.Event) (interface{}, error) {
+					reactedTo = append(reactedTo, target.ID)
+					return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Silenced " + target.Content.AsMessage().Body}, nil
+				},
+			},
+			{
+				Keys: []string{"🔥"},
+				Role: types.RoleAdmin,
+				React: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, key string, target *mevt.Event) (interface{}, error) {
+					t.Errorf("Expected the sender not to be allowed to react with %s", key)
+					return nil, nil
+				},
+			},
+		},
+	}
+	store := &responsesStore{
+		MockStore: MockStore{service: service},
+		senders:   make(map[id.EventID]id.UserID),
+		responses: make(map[id.EventID][]id.EventID),
+	}
+
+	var sent []map[string]interface{}
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		body := `{"event_id":"$response"}`
+		if req.Method == "GET" {
+			sender := "@service:user"
+			if strings.HasSuffix(req.URL.Path, "/event/$human") {
+				sender = "@alice:bar"
+			}
+			body = fmt.Sprintf(`{"type":"m.room.message","event_id":"$alert","sender":%q,"content":{"msgtype":"m.text","body":"disk full"}}`, sender)
+		} else {
+			var content map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&content)
+			sent = append(sent, content)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	}
+	cli := &http.Client{Transport: trans}
+	clients := New(store, cli)
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = cli
+	botClient := BotClient{Client: mxCli}
+	botClient.olmMachine = &crypto.OlmMachine{StateStore: &NebStateStore{Storer: mautrix.NewInMemoryStore()}}
+
+	reaction := func(eventID, target id.EventID, sender id.UserID, key string) *mevt.Event {
+		content := mevt.Content{Parsed: &mevt.ReactionEventContent{
+			RelatesTo: mevt.RelatesTo{Type: mevt.RelAnnotation, EventID: target, Key: key},
+		}}
+		return &mevt.Event{Type: mevt.EventReaction, ID: eventID, Sender: sender, RoomID: "!foo:bar", Content: content}
+	}
+
+	clients.onReactionEvent(&botClient, reaction("$r1", "$alert", "@alice:bar", "✅"))
+	if len(reactedTo) != 1 || reactedTo[0] != "$alert" {
+		t.Fatalf("Expected the reaction to be handled, got %v", reactedTo)
+	}
+	if len(sent) != 1 || sent[0]["body"] != "Silenced disk full" {
+		t.Fatalf("Expected a response, got %v", sent)
+	}
+	relatesTo, _ := sent[0]["m.relates_to"].(map[string]interface{})
+	if inReplyTo, _ := relatesTo["m.in_reply_to"].(map[string]interface{}); inReplyTo["event_id"] != "$alert" {
+		t.Errorf("Expected the response to reply to the message reacted to, got %v", relatesTo)
+	}
+	if store.senders["$r1"] != "@alice:bar" {
+		t.Errorf("Expected the response to be stored against the reaction, got %v", store.senders)
+	}
+
+	// Reactions by the bot, with other keys or to messages sent by other users are ignored
+	clients.onReactionEvent(&botClient, reaction("$r2", "$alert", "@service:user", "✅"))
+	clients.onReactionEvent(&botClient, reaction("$r3", "$alert", "@alice:bar", "👀"))
+	clients.onReactionEvent(&botClient, reaction("$r4", "$human", "@alice:bar", "✅"))
+	if len(reactedTo) != 1 || len(sent) != 1 {
+		t.Errorf("Expected reactions to be ignored, got %v %v", reactedTo, sent)
+	}
+
+	clients.onReactionEvent(&botClient, reaction("$r5", "$alert", "@alice:bar", "🔥"))
+	if len(sent) != 2 || !strings.HasPrefix(sent[1]["body"].(string), "You need the admin role") {
+		t.Errorf("Expected the sender to be told they need a role, got %v", sent)
+	}
+}
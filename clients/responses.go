@@ -0,0 +1,210 @@
+package clients
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// How responses to commands and expansions relate to the message which triggered them. Rooms
+// choose with the "response_mode" key in their m.room.bot.options.
+const (
+	// Reply to the message, in the same thread if it was sent in one. This is the default.
+	responseModeReply = "reply"
+	// Reply in a thread, starting one on the message if it wasn't sent in a thread.
+	responseModeThread = "thread"
+	// Send responses as new messages with no relation, as Go-NEB used to.
+	responseModeNone = "none"
+)
+
+// The relation type for threads, which this version of mautrix doesn't know about.
+const relThread = mevt.RelationType("m.thread")
+
+// responseMode returns the response mode from a room's bot options.
+func responseMode(opts map[string]interface{}) string {
+	switch mode, _ := opts["response_mode"].(string); mode {
+	case responseModeThread, responseModeNone:
+		return mode
+	}
+	return responseModeReply
+}
+
+// responseRelation returns the "m.relates_to" for responses to a message, or nil if they
+// shouldn't relate to it.
+func responseRelation(event *mevt.Event, message *mevt.MessageEventContent, mode string) map[string]interface{} {
+	if mode == responseModeNone || event.ID == "" {
+		return nil
+	}
+	var threadRoot id.EventID
+	if rel := message.OptionalGetRelatesTo(); rel != nil && rel.Type == relThread {
+		threadRoot = rel.EventID
+	}
+	relation := map[string]interface{}{
+		"m.in_reply_to": map[string]interface{}{"event_id": event.ID},
+	}
+	if threadRoot == "" && mode == responseModeThread {
+		threadRoot = event.ID
+	}
+	if threadRoot != "" {
+		relation["rel_type"] = relThread
+		relation["event_id"] = threadRoot
+		// The response really is a reply to the message, not just a fallback for clients without threads
+		relation["is_falling_back"] = false
+	}
+	return relation
+}
+
+// threadRelation returns the thread relation of a message, or nil if it wasn't sent in a thread or
+// can't be loaded.
+func (c *Clients) threadRelation(botClient *BotClient, roomID id.RoomID, eventID id.EventID) *mevt.RelatesTo {
+	evt, err := c.loadEvent(botClient, roomID, eventID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"room_id":    roomID,
+			"event_id":   eventID,
+		}).Warn("Failed to load edited message")
+		return nil
+	}
+	if rel := evt.Content.AsMessage().OptionalGetRelatesTo(); rel != nil && rel.Type == relThread {
+		return rel
+	}
+	return nil
+}
+
+// withRelation adds the relation to the JSON encodable content of a response, unless the service
+// has already set one.
+func withRelation(content interface{}, relation map[string]interface{}) interface{} {
+	if relation == nil {
+		return content
+	}
+	raw := contentMap(content)
+	if raw == nil {
+		return content
+	}
+	if _, ok := raw["m.relates_to"]; ok {
+		return content
+	}
+	raw["m.relates_to"] = relation
+	return raw
+}
+
+// editResponse returns an edit of an earlier response which replaces it with the new content.
+func editResponse(content interface{}, responseID id.EventID) interface{} {
+	raw := contentMap(content)
+	if raw == nil {
+		return content
+	}
+	delete(raw, "m.relates_to")
+	edit := map[string]interface{}{
+		"msgtype":       raw["msgtype"],
+		"m.new_content": raw,
+		"m.relates_to": map[string]interface{}{
+			"rel_type": mevt.RelReplace,
+			"event_id": responseID,
+		},
+	}
+	// The fallback for clients which don't support edits
+	if body, ok := raw["body"].(string); ok {
+		edit["body"] = "* " + body
+	}
+	if formattedBody, ok := raw["formatted_body"].(string); ok {
+		edit["format"] = raw["format"]
+		edit["formatted_body"] = "* " + formattedBody
+	}
+	return edit
+}
+
+// contentMap converts the JSON encodable content of an event into a map, or nil if it isn't a JSON object.
+func contentMap(content interface{}) map[string]interface{} {
+	b, err := json.Marshal(content)
+	if err != nil {
+		return nil
+	}
+	var raw map[string]interface{}
+	if err = json.Unmarshal(b, &raw); err != nil {
+		return nil
+	}
+	return raw
+}
+
+// sendResponses sends the responses to a message. If the message has been edited, the responses
+// to it are edited instead, and any left over are redacted. The responses are stored so that they
+// can be edited or redacted along with the message.
+func (c *Clients) sendResponses(botClient *BotClient, event *mevt.Event, relation map[string]interface{},
+	responses []interface{}, previous []id.EventID) {
+	logger := log.WithFields(log.Fields{
+		"room_id":  event.RoomID,
+		"event_id": event.ID,
+		"sender":   event.Sender,
+	})
+	cli := c.serviceClient(botClient, "")
+	var responseIDs []id.EventID
+	for i, content := range responses {
+		// A response which was queued in the outbox has no event ID yet, so can't be edited
+		if i < len(previous) && previous[i] != "" {
+			if _, err := cli.SendMessageEvent(event.RoomID, mevt.EventMessage, editResponse(content, previous[i])); err != nil {
+				logger.WithField("content", content).WithError(err).Error("Failed to edit command response")
+			}
+			responseIDs = append(responseIDs, previous[i])
+			continue
+		}
+		resp, err := cli.SendMessageEvent(event.RoomID, mevt.EventMessage, withRelation(content, relation))
+		if err != nil {
+			logger.WithField("content", content).WithError(err).Error("Failed to send command response")
+			continue
+		}
+		responseIDs = append(responseIDs, resp.EventID)
+	}
+	for i := len(responses); i < len(previous); i++ {
+		if previous[i] == "" {
+			continue
+		}
+		if _, err := botClient.RedactEvent(event.RoomID, previous[i], mautrix.ReqRedact{Reason: "The command was edited"}); err != nil {
+			logger.WithField("response_id", previous[i]).WithError(err).Error("Failed to redact command response")
+		}
+	}
+
+	if event.ID == "" || (len(responseIDs) == 0 && len(previous) == 0) {
+		return
+	}
+	if err := c.db.StoreCommandResponses(botClient.UserID, event.RoomID, event.ID, event.Sender, responseIDs); err != nil {
+		logger.WithError(err).Error("Failed to store command responses")
+	}
+}
+
+// onRedactionEvent forgets the responses to a redacted message, and redacts them too if the room
+// has "redact_responses" set in its m.room.bot.options.
+func (c *Clients) onRedactionEvent(botClient *BotClient, event *mevt.Event) {
+	if event.Redacts == "" {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"room_id":  event.RoomID,
+		"event_id": event.Redacts,
+	})
+	_, responseIDs, err := c.db.LoadCommandResponses(botClient.UserID, event.RoomID, event.Redacts)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load responses to redacted message")
+		return
+	}
+	if len(responseIDs) == 0 {
+		return
+	}
+	if redact, _ := c.loadBotOptions(botClient.UserID, event.RoomID)["redact_responses"].(bool); redact {
+		for _, responseID := range responseIDs {
+			if responseID == "" {
+				continue
+			}
+			if _, err := botClient.RedactEvent(event.RoomID, responseID, mautrix.ReqRedact{Reason: "The command was redacted"}); err != nil {
+				logger.WithField("response_id", responseID).WithError(err).Error("Failed to redact command response")
+			}
+		}
+	}
+	if err := c.db.DeleteCommandResponses(botClient.UserID, event.RoomID, event.Redacts); err != nil {
+		logger.WithError(err).Error("Failed to delete command responses")
+	}
+}
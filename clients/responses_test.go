@@ -0,0 +1,200 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestResponseRelation(t *testing.T) {
+	event := &mevt.Event{ID: "$command:localhost"}
+	inThread := &mevt.MessageEventContent{RelatesTo: &mevt.RelatesTo{Type: relThread, EventID: "$root:localhost"}}
+	noThread := &mevt.MessageEventContent{}
+
+	tests := []struct {
+		message *mevt.MessageEventContent
+		opts    map[string]interface{}
+		want    string
+	}{
+		{noThread, nil, `{"m.in_reply_to":{"event_id":"$command:localhost"}}`},
+		{inThread, nil, `{"event_id":"$root:localhost","is_falling_back":false,"m.in_reply_to":{"event_id":"$command:localhost"},"rel_type":"m.thread"}`},
+		{noThread, map[string]interface{}{"response_mode": "thread"}, `{"event_id":"$command:localhost","is_falling_back":false,"m.in_reply_to":{"event_id":"$command:localhost"},"rel_type":"m.thread"}`},
+		{inThread, map[string]interface{}{"response_mode": "thread"}, `{"event_id":"$root:localhost","is_falling_back":false,"m.in_reply_to":{"event_id":"$command:localhost"},"rel_type":"m.thread"}`},
+		{inThread, map[string]interface{}{"response_mode": "none"}, `null`},
+		{noThread, map[string]interface{}{"response_mode": "bogus"}, `{"m.in_reply_to":{"event_id":"$command:localhost"}}`},
+	}
+	for _, test := range tests {
+		relation := responseRelation(event, test.message, responseMode(test.opts))
+		got, _ := json.Marshal(relation)
+		if string(got) != test.want {
+			t.Errorf("responseRelation(%v): got %s, want %s", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestWithRelation(t *testing.T) {
+	relation := map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$command:localhost"}}
+
+	content := withRelation(&mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "hi"}, relation)
+	got, _ := json.Marshal(content)
+	want := `{"body":"hi","m.relates_to":{"m.in_reply_to":{"event_id":"$command:localhost"}},"msgtype":"m.notice"}`
+	if string(got) != want {
+		t.Errorf("withRelation: got %s, want %s", got, want)
+	}
+
+	// Services can set their own relation
+	own := map[string]interface{}{"body": "edit", "m.relates_to": map[string]interface{}{"rel_type": "m.replace"}}
+	got, _ = json.Marshal(withRelation(own, relation))
+	if string(got) != `{"body":"edit","m.relates_to":{"rel_type":"m.replace"}}` {
+		t.Errorf("Expected existing relation to be kept, got %s", got)
+	}
+}
+
+type responsesStore struct {
+	MockStore
+	senders   map[id.EventID]id.UserID
+	responses map[id.EventID][]id.EventID
+	options   map[string]interface{}
+}
+
+func (d *responsesStore) StoreCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID, senderID id.UserID, responseEventIDs []id.EventID) error {
+	d.senders[commandEventID] = senderID
+	d.responses[commandEventID] = responseEventIDs
+	return nil
+}
+
+func (d *responsesStore) LoadCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID) (id.UserID, []id.EventID, error) {
+	return d.senders[commandEventID], d.responses[commandEventID], nil
+}
+
+func (d *responsesStore) DeleteCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID) error {
+	delete(d.responses, commandEventID)
+	return nil
+}
+
+func (d *responsesStore) LoadBotOptions(userID id.UserID, roomID id.RoomID) (types.BotOptions, error) {
+	return types.BotOptions{Options: d.options}, nil
+}
+
+func TestEditAndRedactCommand(t *testing.T) {
+	echo := &MockService{commands: []types.Command{
+		{
+			Path: []string{"echo"},
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
+				return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: strings.Join(args, " ")}, nil
+			},
+		},
+	}}
+	store := &responsesStore{
+		MockStore: MockStore{service: echo},
+		senders:   make(map[id.EventID]id.UserID),
+		responses: make(map[id.EventID][]id.EventID),
+	}
+
+	var requests []string
+	var bodies []map[string]interface{}
+	trans := struct{ MockTransport }{}
+	// The messages which can be fetched from the homeserver when they are edited
+	events := map[string]string{
+		"$command":  `{"type":"m.room.message","content":{"msgtype":"m.text","body":"!echo typo"}}`,
+		"$threaded": `{"type":"m.room.message","content":{"msgtype":"m.text","body":"!ehco hi","m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`,
+	}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		if segs := strings.Split(req.URL.Path, "/event/"); req.Method == "GET" && len(segs) == 2 {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(events[segs[1]])),
+			}, nil
+		}
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		requests = append(requests, req.URL.Path)
+		bodies = append(bodies, body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"event_id":"$response%d"}`, len(requests)))),
+		}, nil
+	}
+	cli := &http.Client{Transport: trans}
+	clients := New(store, cli)
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = cli
+	botClient := BotClient{Client: mxCli}
+	botClient.olmMachine = &crypto.OlmMachine{StateStore: &NebStateStore{Storer: mautrix.NewInMemoryStore()}}
+
+	message := func(eventID id.EventID, sender id.UserID, raw map[string]interface{}) *mevt.Event {
+		content := mevt.Content{Raw: raw}
+		content.VeryRaw, _ = json.Marshal(raw)
+		content.ParseRaw(mevt.EventMessage)
+		return &mevt.Event{Type: mevt.EventMessage, ID: eventID, Sender: sender, RoomID: "!foo:bar", Content: content}
+	}
+	editOf := func(eventID id.EventID, sender id.UserID, edited id.EventID, body string) *mevt.Event {
+		return message(eventID, sender, map[string]interface{}{
+			"msgtype":       "m.text",
+			"body":          "* " + body,
+			"m.new_content": map[string]interface{}{"msgtype": "m.text", "body": body},
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": edited},
+		})
+	}
+	edit := func(eventID id.EventID, sender id.UserID, body string) *mevt.Event {
+		return editOf(eventID, sender, "$command", body)
+	}
+
+	clients.onMessageEvent(&botClient, message("$command", "@alice:bar", map[string]interface{}{"msgtype": "m.text", "body": "!echo typo"}))
+	if len(requests) != 1 || !reflect.DeepEqual(store.responses["$command"], []id.EventID{"$response1"}) {
+		t.Fatalf("Expected one response to be sent and stored, got %v %v", requests, store.responses)
+	}
+
+	clients.onMessageEvent(&botClient, edit("$edit", "@alice:bar", "!echo fixed"))
+	if len(requests) != 2 {
+		t.Fatalf("Expected the response to be edited, got %v", requests)
+	}
+	newContent, _ := bodies[1]["m.new_content"].(map[string]interface{})
+	relatesTo, _ := bodies[1]["m.relates_to"].(map[string]interface{})
+	if newContent["body"] != "fixed" || relatesTo["rel_type"] != "m.replace" || relatesTo["event_id"] != "$response1" {
+		t.Errorf("Expected an edit of the first response, got %v", bodies[1])
+	}
+
+	clients.onMessageEvent(&botClient, edit("$edit2", "@mallory:bar", "!echo hijacked"))
+	if len(requests) != 2 {
+		t.Errorf("Expected edits by someone else to be ignored, got %v", requests)
+	}
+
+	// Fixing a typo in a command sent in a thread responds in the thread
+	clients.onMessageEvent(&botClient, message("$threaded", "@alice:bar", map[string]interface{}{
+		"msgtype":      "m.text",
+		"body":         "!ehco hi",
+		"m.relates_to": map[string]interface{}{"rel_type": "m.thread", "event_id": "$root"},
+	}))
+	clients.onMessageEvent(&botClient, editOf("$edit3", "@alice:bar", "$threaded", "!echo hi"))
+	if len(requests) != 3 {
+		t.Fatalf("Expected a response to the edited command, got %v", requests)
+	}
+	relatesTo, _ = bodies[2]["m.relates_to"].(map[string]interface{})
+	inReplyTo, _ := relatesTo["m.in_reply_to"].(map[string]interface{})
+	if bodies[2]["body"] != "hi" || relatesTo["rel_type"] != "m.thread" || relatesTo["event_id"] != "$root" ||
+		inReplyTo["event_id"] != "$threaded" {
+		t.Errorf("Expected a response in the thread of the edited command, got %v", bodies[2])
+	}
+
+	redaction := &mevt.Event{Type: mevt.EventRedaction, ID: "$redaction", Sender: "@alice:bar", RoomID: "!foo:bar", Redacts: "$command"}
+	store.options = map[string]interface{}{"redact_responses": true}
+	clients.onRedactionEvent(&botClient, redaction)
+	if len(requests) != 4 || !strings.Contains(requests[3], "/redact/$response1/") {
+		t.Errorf("Expected the response to be redacted, got %v", requests)
+	}
+	if _, ok := store.responses["$command"]; ok {
+		t.Errorf("Expected responses to be forgotten after a redaction")
+	}
+}
@@ -3,16 +3,47 @@ package clients
 import (
 	"errors"
 
+	"github.com/matrix-org/go-neb/database"
+	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
+// The state event types which are persisted, so that the bot knows which rooms are encrypted, who is
+// in them and what they are allowed to do as soon as it restarts.
+var persistedStateTypes = map[event.Type]bool{
+	event.StateEncryption:  true,
+	event.StateMember:      true,
+	event.StatePowerLevels: true,
+}
+
 // NebStateStore implements the StateStore interface for OlmMachine.
 // It is used to determine which rooms are encrypted and which rooms are shared with a user.
 // The state is updated by /sync responses.
 type NebStateStore struct {
 	Storer *mautrix.InMemoryStore
+	// If set, the state in persistedStateTypes is stored in the Database for the UserID.
+	Database database.Storer
+	UserID   id.UserID
+	// True if LoadState found state for any rooms.
+	loaded bool
+}
+
+// LoadState loads the state which was persisted for the UserID. It returns the number of rooms loaded.
+func (ss *NebStateStore) LoadState() (int, error) {
+	if ss.Database == nil {
+		return 0, nil
+	}
+	events, err := ss.Database.LoadRoomState(ss.UserID)
+	if err != nil {
+		return 0, err
+	}
+	for _, evt := range events {
+		ss.Storer.UpdateState(mautrix.EventSourceState, evt)
+	}
+	ss.loaded = len(ss.Storer.Rooms) > 0
+	return len(ss.Storer.Rooms), nil
 }
 
 // GetEncryptionEvent returns the encryption event for a room.
@@ -39,6 +70,26 @@ func (ss *NebStateStore) IsEncrypted(roomID id.RoomID) bool {
 	return ok
 }
 
+// IsJoined returns whether the user has joined a room.
+func (ss *NebStateStore) IsJoined(roomID id.RoomID, userID id.UserID) bool {
+	room := ss.Storer.LoadRoom(roomID)
+	return room != nil && room.GetMembershipState(userID) == event.MembershipJoin
+}
+
+// GetPowerLevels returns the power levels for a room, or nil if they are not known.
+func (ss *NebStateStore) GetPowerLevels(roomID id.RoomID) *event.PowerLevelsEventContent {
+	room := ss.Storer.LoadRoom(roomID)
+	if room == nil {
+		return nil
+	}
+	evt, ok := room.State[event.StatePowerLevels][""]
+	if !ok || evt == nil {
+		return nil
+	}
+	evt.Content.ParseRaw(event.StatePowerLevels)
+	return evt.Content.AsPowerLevels()
+}
+
 // FindSharedRooms returns a list of room IDs that the given user ID is also a member of.
 func (ss *NebStateStore) FindSharedRooms(userID id.UserID) []id.RoomID {
 	sharedRooms := make([]id.RoomID, 0)
@@ -52,6 +103,15 @@ func (ss *NebStateStore) FindSharedRooms(userID id.UserID) []id.RoomID {
 
 // UpdateStateStore updates the internal state of NebStateStore from a /sync response.
 func (ss *NebStateStore) UpdateStateStore(resp *mautrix.RespSync) {
+	var persist []*event.Event
+	update := func(room *mautrix.Room, evt *event.Event) {
+		room.UpdateState(evt)
+		if persistedStateTypes[evt.Type] {
+			// Events in /sync responses don't have a room ID
+			evt.RoomID = room.ID
+			persist = append(persist, evt)
+		}
+	}
 	for roomID, evts := range resp.Rooms.Join {
 		room := ss.Storer.LoadRoom(roomID)
 		if room == nil {
@@ -59,14 +119,20 @@ func (ss *NebStateStore) UpdateStateStore(resp *mautrix.RespSync) {
 			ss.Storer.SaveRoom(room)
 		}
 		for _, i := range evts.State.Events {
-			room.UpdateState(i)
+			update(room, i)
 		}
 		for _, i := range evts.Timeline.Events {
 			if i.Type.IsState() {
-				room.UpdateState(i)
+				update(room, i)
 			}
 		}
 	}
+	if ss.Database == nil || len(persist) == 0 {
+		return
+	}
+	if err := ss.Database.StoreRoomState(ss.UserID, persist); err != nil {
+		log.WithError(err).WithField("user_id", ss.UserID).Error("Failed to store room state")
+	}
 }
 
 // GetJoinedMembers returns a list of members that are currently in a room.
@@ -0,0 +1,111 @@
+package clients
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	_ "github.com/mattn/go-sqlite3"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type roomStateStore struct {
+	database.NopStorage
+	state map[id.UserID][]*event.Event
+}
+
+func (s *roomStateStore) StoreRoomState(botUserID id.UserID, events []*event.Event) error {
+	s.state[botUserID] = append(s.state[botUserID], events...)
+	return nil
+}
+
+func (s *roomStateStore) LoadRoomState(botUserID id.UserID) ([]*event.Event, error) {
+	return s.state[botUserID], nil
+}
+
+func TestPersistedStateStore(t *testing.T) {
+	db := &roomStateStore{state: make(map[id.UserID][]*event.Event)}
+	ss := &NebStateStore{Storer: mautrix.NewInMemoryStore(), Database: db, UserID: "@neb:hs"}
+	if rooms, err := ss.LoadState(); rooms != 0 || err != nil || ss.loaded {
+		t.Errorf("Expected no state to be loaded at first, got %d rooms (%v)", rooms, err)
+	}
+
+	var resp mautrix.RespSync
+	if err := json.Unmarshal([]byte(`{"rooms":{"join":{"!room:hs":{
+		"state":{"events":[
+			{"type":"m.room.member","state_key":"@neb:hs","sender":"@neb:hs","content":{"membership":"join"},"event_id":"$1"},
+			{"type":"m.room.name","state_key":"","sender":"@alice:hs","content":{"name":"Room"},"event_id":"$2"}
+		]},
+		"timeline":{"events":[
+			{"type":"m.room.encryption","state_key":"","sender":"@alice:hs","content":{"algorithm":"m.megolm.v1.aes-sha2"},"event_id":"$3"},
+			{"type":"m.room.power_levels","state_key":"","sender":"@alice:hs","content":{"users":{"@alice:hs":100}},"event_id":"$4"},
+			{"type":"m.room.message","sender":"@alice:hs","content":{"msgtype":"m.text","body":"hi"},"event_id":"$5"}
+		]}
+	}}}}`), &resp); err != nil {
+		t.Fatalf("Failed to parse sync response: %s", err)
+	}
+	ss.UpdateStateStore(&resp)
+	if stored := db.state["@neb:hs"]; len(stored) != 3 {
+		t.Errorf("Expected only membership, encryption and power levels to be stored, got %d events", len(stored))
+	}
+
+	// The state is known straight away after a restart
+	restarted := &NebStateStore{Storer: mautrix.NewInMemoryStore(), Database: db, UserID: "@neb:hs"}
+	if rooms, err := restarted.LoadState(); rooms != 1 || err != nil || !restarted.loaded {
+		t.Fatalf("Expected the room to be loaded, got %d rooms (%v)", rooms, err)
+	}
+	if !restarted.IsEncrypted("!room:hs") || restarted.GetEncryptionEvent("!room:hs") == nil {
+		t.Errorf("Expected the room to be encrypted")
+	}
+	if !restarted.IsJoined("!room:hs", "@neb:hs") {
+		t.Errorf("Expected the bot to be joined")
+	}
+	if pl := restarted.GetPowerLevels("!room:hs"); pl == nil || pl.GetUserLevel("@alice:hs") != 100 {
+		t.Errorf("Expected the power levels to be loaded, got %+v", pl)
+	}
+	if rooms := restarted.FindSharedRooms("@neb:hs"); len(rooms) != 1 || rooms[0] != "!room:hs" {
+		t.Errorf("Expected the room to be shared, got %v", rooms)
+	}
+}
+
+func TestPersistedStateStoreRestart(t *testing.T) {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	ss := &NebStateStore{Storer: mautrix.NewInMemoryStore(), Database: db, UserID: "@neb:hs"}
+	var resp mautrix.RespSync
+	if err = json.Unmarshal([]byte(`{"rooms":{"join":{"!room:hs":{
+		"state":{"events":[
+			{"type":"m.room.member","state_key":"@neb:hs","sender":"@neb:hs","content":{"membership":"join"},"event_id":"$1"},
+			{"type":"m.room.encryption","state_key":"","sender":"@alice:hs","content":{
+				"algorithm":"m.megolm.v1.aes-sha2","rotation_period_ms":3600000,"rotation_period_msgs":50
+			},"event_id":"$2"},
+			{"type":"m.room.power_levels","state_key":"","sender":"@alice:hs","content":{"users":{"@alice:hs":100}},"event_id":"$3"}
+		]}
+	}}}}`), &resp); err != nil {
+		t.Fatalf("Failed to parse sync response: %s", err)
+	}
+	ss.UpdateStateStore(&resp)
+
+	// Nothing is shared with the first store, so everything comes from the database
+	restarted := &NebStateStore{Storer: mautrix.NewInMemoryStore(), Database: db, UserID: "@neb:hs"}
+	if rooms, err := restarted.LoadState(); rooms != 1 || err != nil {
+		t.Fatalf("Expected the room to be loaded, got %d rooms (%v)", rooms, err)
+	}
+	enc := restarted.GetEncryptionEvent("!room:hs")
+	if enc == nil || enc.Algorithm != id.AlgorithmMegolmV1 || enc.RotationPeriodMillis != 3600000 || enc.RotationPeriodMessages != 50 {
+		t.Errorf("Expected the encryption settings to be loaded, got %+v", enc)
+	}
+	if !restarted.IsJoined("!room:hs", "@neb:hs") {
+		t.Errorf("Expected the bot to be joined")
+	}
+	if members, err := restarted.GetJoinedMembers("!room:hs"); err != nil || len(members) != 1 {
+		t.Errorf("Expected the bot to be a joined member, got %v (%v)", members, err)
+	}
+	if pl := restarted.GetPowerLevels("!room:hs"); pl == nil || pl.GetUserLevel("@alice:hs") != 100 {
+		t.Errorf("Expected the power levels to be loaded, got %+v", pl)
+	}
+}
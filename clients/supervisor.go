@@ -0,0 +1,181 @@
+package clients
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/metrics"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// The delay before retrying a failed /sync starts at minSyncBackoff and doubles with each failure in a
+// row, up to maxSyncBackoff.
+const (
+	minSyncBackoff = time.Second
+	maxSyncBackoff = 5 * time.Minute
+)
+
+var syncStates = []string{api.SyncStateConnecting, api.SyncStateSyncing, api.SyncStateBackingOff, api.SyncStateAuthFailed}
+
+// errSyncStopped is returned to stop the /sync loop when the client has been stopped while backing off.
+var errSyncStopped = errors.New("sync stopped")
+
+// backoffDelay returns how long to wait after the given number of /sync failures in a row. The delay
+// is jittered so that clients on the same homeserver don't all retry at once.
+func backoffDelay(failures int) time.Duration {
+	d := maxSyncBackoff
+	if failures < 20 {
+		if exp := minSyncBackoff << uint(failures-1); exp < d {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isAuthError returns true if the error means the homeserver rejected the access token.
+func isAuthError(err error) bool {
+	httpErr, ok := err.(mautrix.HTTPError)
+	if !ok {
+		return false
+	}
+	if httpErr.Code == 401 || httpErr.Code == 403 {
+		return true
+	}
+	return httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_UNKNOWN_TOKEN"
+}
+
+// A syncSupervisor tracks the health of a client's /sync stream, and makes the client back off when
+// syncing fails.
+type syncSupervisor struct {
+	mu       sync.Mutex
+	status   api.ClientStatus
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newSyncSupervisor(userID id.UserID) *syncSupervisor {
+	s := &syncSupervisor{
+		status: api.ClientStatus{UserID: userID},
+		stop:   make(chan struct{}),
+	}
+	s.setState(api.SyncStateConnecting)
+	return s
+}
+
+// setState changes the state of the /sync stream.
+func (s *syncSupervisor) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = state
+	s.report()
+}
+
+// synced records a successful /sync request.
+func (s *syncSupervisor) synced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = api.SyncStateSyncing
+	s.status.LastSync = time.Now()
+	s.status.LastError = ""
+	s.status.Failures = 0
+	s.status.NextRetry = time.Time{}
+	s.report()
+}
+
+// failed records a failed /sync request, and waits before the client tries again. It returns
+// errSyncStopped if the client was stopped while waiting.
+func (s *syncSupervisor) failed(err error) error {
+	s.mu.Lock()
+	s.status.Failures++
+	s.status.LastError = err.Error()
+	s.status.State = api.SyncStateBackingOff
+	if isAuthError(err) {
+		// The access token may start working again if the client is reconfigured, so keep trying
+		s.status.State = api.SyncStateAuthFailed
+	}
+	delay := backoffDelay(s.status.Failures)
+	s.status.NextRetry = time.Now().Add(delay)
+	s.report()
+	logger := log.WithFields(log.Fields{
+		log.ErrorKey: err,
+		"user_id":    s.status.UserID,
+		"state":      s.status.State,
+		"failures":   s.status.Failures,
+		"retry_in":   delay,
+	})
+	s.mu.Unlock()
+	logger.Error("Failed to sync")
+
+	select {
+	case <-s.stop:
+		return errSyncStopped
+	case <-time.After(delay):
+	}
+	s.setState(api.SyncStateConnecting)
+	return nil
+}
+
+// report updates the metrics for the /sync stream. s.mu must be held. A client which has been stopped is
+// no longer reported, even if a /sync request which was in flight completes.
+func (s *syncSupervisor) report() {
+	if s.stopped() {
+		return
+	}
+	userID := s.status.UserID.String()
+	metrics.SetClientSyncState(userID, s.status.State, syncStates)
+	metrics.SetClientSyncFailures(userID, s.status.Failures)
+	if !s.status.LastSync.IsZero() {
+		metrics.SetClientLastSync(userID, s.status.LastSync)
+	}
+}
+
+// Stop makes the client stop syncing, and stops reporting its status.
+func (s *syncSupervisor) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		metrics.RemoveClientSync(s.status.UserID.String(), syncStates)
+	})
+}
+
+// stopped returns true if Stop has been called.
+func (s *syncSupervisor) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status returns the current health of the /sync stream.
+func (s *syncSupervisor) Status() api.ClientStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// supervisedSyncer reports each /sync response and failure to the client's supervisor. Instead of
+// retrying every 10 seconds, failed requests are retried with exponential backoff.
+type supervisedSyncer struct {
+	*mautrix.DefaultSyncer
+	supervisor *syncSupervisor
+}
+
+// ProcessResponse implements mautrix.Syncer.
+func (s *supervisedSyncer) ProcessResponse(res *mautrix.RespSync, since string) error {
+	s.supervisor.synced()
+	return s.DefaultSyncer.ProcessResponse(res, since)
+}
+
+// OnFailedSync implements mautrix.Syncer. It returns once the supervisor has waited, so the request
+// is retried straight away.
+func (s *supervisedSyncer) OnFailedSync(res *mautrix.RespSync, err error) (time.Duration, error) {
+	return 0, s.supervisor.failed(err)
+}
@@ -0,0 +1,80 @@
+package clients
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"maunium.net/go/mautrix"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	want := minSyncBackoff
+	for failures := 1; failures < 30; failures++ {
+		for i := 0; i < 10; i++ {
+			if d := backoffDelay(failures); d < want/2 || d > want {
+				t.Errorf("backoffDelay(%d) = %s, want between %s and %s", failures, d, want/2, want)
+			}
+		}
+		if want *= 2; want > maxSyncBackoff {
+			want = maxSyncBackoff
+		}
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection refused"), false},
+		{mautrix.HTTPError{Code: 502}, false},
+		{mautrix.HTTPError{Code: 401, RespError: &mautrix.RespError{ErrCode: "M_UNKNOWN_TOKEN"}}, true},
+		{mautrix.HTTPError{Code: 403, RespError: &mautrix.RespError{ErrCode: "M_FORBIDDEN"}}, true},
+	}
+	for _, test := range tests {
+		if got := isAuthError(test.err); got != test.want {
+			t.Errorf("isAuthError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestSyncSupervisor(t *testing.T) {
+	s := newSyncSupervisor("@neb:hs")
+	if st := s.Status(); st.State != api.SyncStateConnecting || st.UserID != "@neb:hs" {
+		t.Errorf("Expected a new client to be connecting, got %+v", st)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.failed(errors.New("connection refused"))
+	}()
+	// Wait for the supervisor to start backing off
+	deadline := time.Now().Add(time.Second)
+	for s.Status().NextRetry.IsZero() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if st := s.Status(); st.State != api.SyncStateBackingOff || st.Failures != 1 || st.LastError != "connection refused" {
+		t.Errorf("Expected the client to be backing off, got %+v", st)
+	}
+
+	// A successful /sync clears the failures
+	s.synced()
+	if st := s.Status(); st.State != api.SyncStateSyncing || st.Failures != 0 || st.LastError != "" || st.LastSync.IsZero() {
+		t.Errorf("Expected the client to be syncing, got %+v", st)
+	}
+
+	s.Stop()
+	select {
+	case err := <-done:
+		if err != nil && err != errSyncStopped {
+			t.Errorf("Expected stopping to end backing off, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stopping did not end backing off")
+	}
+	if err := s.failed(errors.New("connection refused")); err != errSyncStopped {
+		t.Errorf("Expected a stopped client not to retry, got %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -15,6 +16,7 @@ import (
 type ServiceDB struct {
 	db      *sql.DB
 	dialect string
+	box     *secretBox
 }
 
 // A single global instance of the service DB.
@@ -31,35 +33,76 @@ func GetServiceDB() Storer {
 }
 
 // Open a SQL database to use as a ServiceDB. This will automatically create
-// the necessary database tables if they aren't already present.
+// the necessary database tables if they aren't already present, and upgrade
+// them if they were created by an older version of Go-NEB. Returns an error
+// if they were created by a newer version.
 func Open(databaseType, databaseURL string) (serviceDB *ServiceDB, err error) {
 	db, err := sql.Open(databaseType, databaseURL)
 	if err != nil {
 		return
 	}
-	if _, err = db.Exec(schemaSQL); err != nil {
-		return
-	}
 	if databaseType == "sqlite3" {
 		// Fix for "database is locked" errors
 		// https://github.com/mattn/go-sqlite3/issues/274
 		db.SetMaxOpenConns(1)
 	}
+	if err = migrate(db, databaseType, time.Now()); err != nil {
+		return
+	}
 	serviceDB = &ServiceDB{db: db, dialect: databaseType}
 	return
 }
 
+// SetEncryptionKeys turns on encryption of client configs, auth realms and auth sessions, which
+// contain access tokens and other secrets, and of the other sensitive values listed by ReencryptSecrets. New values are encrypted with the current key. Values
+// encrypted with any of the old keys can still be read: use ReencryptSecrets to move them to the
+// current key. Keys MUST be 32 bytes long. If current is nil, new values are stored unencrypted.
+func (d *ServiceDB) SetEncryptionKeys(current []byte, old ...[]byte) error {
+	box, err := newSecretBox(current, old...)
+	if err != nil {
+		return err
+	}
+	d.box = box
+	return nil
+}
+
+// ReencryptSecrets encrypts every client config, auth realm, auth session, audit entry, set of
+// cross-signing keys and outbox message with the current encryption key, including any which are not yet encrypted. If
+// there is no current key, they are all decrypted instead. Returns the number of rows updated.
+func (d *ServiceDB) ReencryptSecrets() (n int, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		n = 0
+		for _, q := range [][2]string{
+			{selectClientSecretsSQL, updateClientSecretSQL},
+			{selectRealmSecretsSQL, updateRealmSecretSQL},
+			{selectSessionSecretsSQL, updateSessionSecretSQL},
+			{selectAuditOldSecretsSQL, updateAuditOldSecretSQL},
+			{selectAuditNewSecretsSQL, updateAuditNewSecretSQL},
+			{selectCrossSigningSecretsSQL, updateCrossSigningSecretSQL},
+			{selectOutboxSecretsSQL, updateOutboxSecretSQL},
+		} {
+			updated, err := reencryptSecretsTxn(txn, d.box, q[0], q[1])
+			if err != nil {
+				return err
+			}
+			n += updated
+		}
+		return nil
+	})
+	return
+}
+
 // StoreMatrixClientConfig stores the Matrix client config for a bot service.
 // If a config already exists then it will be updated, otherwise a new config
 // will be inserted. The previous config is returned.
 func (d *ServiceDB) StoreMatrixClientConfig(config api.ClientConfig) (oldConfig api.ClientConfig, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		oldConfig, err = selectMatrixClientConfigTxn(txn, config.UserID)
+		oldConfig, err = selectMatrixClientConfigTxn(txn, d.box, config.UserID)
 		now := time.Now()
 		if err == nil {
-			return updateMatrixClientConfigTxn(txn, now, config)
+			return updateMatrixClientConfigTxn(txn, d.box, now, config)
 		} else if err == sql.ErrNoRows {
-			return insertMatrixClientConfigTxn(txn, now, config)
+			return insertMatrixClientConfigTxn(txn, d.box, now, config)
 		} else {
 			return err
 		}
@@ -70,7 +113,7 @@ func (d *ServiceDB) StoreMatrixClientConfig(config api.ClientConfig) (oldConfig
 // LoadMatrixClientConfigs loads all Matrix client configs from the database.
 func (d *ServiceDB) LoadMatrixClientConfigs() (configs []api.ClientConfig, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		configs, err = selectMatrixClientConfigsTxn(txn)
+		configs, err = selectMatrixClientConfigsTxn(txn, d.box)
 		return err
 	})
 	return
@@ -80,12 +123,24 @@ func (d *ServiceDB) LoadMatrixClientConfigs() (configs []api.ClientConfig, err e
 // Returns sql.ErrNoRows if the client isn't in the database.
 func (d *ServiceDB) LoadMatrixClientConfig(userID id.UserID) (config api.ClientConfig, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		config, err = selectMatrixClientConfigTxn(txn, userID)
+		config, err = selectMatrixClientConfigTxn(txn, d.box, userID)
 		return err
 	})
 	return
 }
 
+// DeleteMatrixClientConfig deletes the Matrix client config for the given user.
+// No error is returned if the client did not exist in the first place.
+func (d *ServiceDB) DeleteMatrixClientConfig(userID id.UserID) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteRoomStateTxn(txn, userID); err != nil {
+			return err
+		}
+		return deleteMatrixClientConfigTxn(txn, userID)
+	})
+	return
+}
+
 // UpdateNextBatch updates the next_batch token for the given user.
 func (d *ServiceDB) UpdateNextBatch(userID id.UserID, nextBatch string) (err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
@@ -121,6 +176,16 @@ func (d *ServiceDB) DeleteService(serviceID string) (err error) {
 	return
 }
 
+// LoadServices loads all the bot services configured, ordered by service ID.
+// Returns an empty list if there aren't any services configured.
+func (d *ServiceDB) LoadServices() (services []types.Service, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		services, err = selectServicesTxn(txn)
+		return err
+	})
+	return
+}
+
 // LoadServicesForUser loads all the bot services configured for a given user.
 // Returns an empty list if there aren't any services configured.
 func (d *ServiceDB) LoadServicesForUser(serviceUserID id.UserID) (services []types.Service, err error) {
@@ -168,7 +233,7 @@ func (d *ServiceDB) StoreService(service types.Service) (oldService types.Servic
 // Returns sql.ErrNoRows if the realm isn't in the database.
 func (d *ServiceDB) LoadAuthRealm(realmID string) (realm types.AuthRealm, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		realm, err = selectRealmTxn(txn, realmID)
+		realm, err = selectRealmTxn(txn, d.box, realmID)
 		return err
 	})
 	return
@@ -179,7 +244,17 @@ func (d *ServiceDB) LoadAuthRealm(realmID string) (realm types.AuthRealm, err er
 // Returns an empty list if there are no realms with that type.
 func (d *ServiceDB) LoadAuthRealmsByType(realmType string) (realms []types.AuthRealm, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		realms, err = selectRealmsByTypeTxn(txn, realmType)
+		realms, err = selectRealmsByTypeTxn(txn, d.box, realmType)
+		return err
+	})
+	return
+}
+
+// LoadAuthRealms loads all auth realms from the database, ordered by realm ID.
+// Returns an empty list if there are no realms.
+func (d *ServiceDB) LoadAuthRealms() (realms []types.AuthRealm, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		realms, err = selectRealmsTxn(txn, d.box)
 		return err
 	})
 	return
@@ -190,30 +265,38 @@ func (d *ServiceDB) LoadAuthRealmsByType(realmType string) (realms []types.AuthR
 // returned.
 func (d *ServiceDB) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		old, err = selectRealmTxn(txn, realm.ID())
+		old, err = selectRealmTxn(txn, d.box, realm.ID())
 		if err == sql.ErrNoRows {
-			return insertRealmTxn(txn, time.Now(), realm)
+			return insertRealmTxn(txn, d.box, time.Now(), realm)
 		} else if err != nil {
 			return err
 		} else {
-			return updateRealmTxn(txn, time.Now(), realm)
+			return updateRealmTxn(txn, d.box, time.Now(), realm)
 		}
 	})
 	return
 }
 
+// DeleteAuthRealm deletes the auth realm with the given ID, along with every auth session for it.
+// No error is returned if the realm did not exist in the first place.
+func (d *ServiceDB) DeleteAuthRealm(realmID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteRealmTxn(txn, realmID)
+	})
+}
+
 // StoreAuthSession stores the given AuthSession, clobbering based on the tuple of
 // user ID and realm ID. This function updates the time added/updated values.
 // The previous session, if any, is returned.
 func (d *ServiceDB) StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		old, err = selectAuthSessionByUserTxn(txn, session.RealmID(), session.UserID())
+		old, err = selectAuthSessionByUserTxn(txn, d.box, session.RealmID(), session.UserID())
 		if err == sql.ErrNoRows {
-			return insertAuthSessionTxn(txn, time.Now(), session)
+			return insertAuthSessionTxn(txn, d.box, time.Now(), session)
 		} else if err != nil {
 			return err
 		} else {
-			return updateAuthSessionTxn(txn, time.Now(), session)
+			return updateAuthSessionTxn(txn, d.box, time.Now(), session)
 		}
 	})
 	return
@@ -232,7 +315,7 @@ func (d *ServiceDB) RemoveAuthSession(realmID string, userID id.UserID) error {
 // Returns sql.ErrNoRows if the session isn't in the database.
 func (d *ServiceDB) LoadAuthSessionByUser(realmID string, userID id.UserID) (session types.AuthSession, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		session, err = selectAuthSessionByUserTxn(txn, realmID, userID)
+		session, err = selectAuthSessionByUserTxn(txn, d.box, realmID, userID)
 		return err
 	})
 	return
@@ -243,7 +326,17 @@ func (d *ServiceDB) LoadAuthSessionByUser(realmID string, userID id.UserID) (ses
 // Returns sql.ErrNoRows if the session isn't in the database.
 func (d *ServiceDB) LoadAuthSessionByID(realmID, sessionID string) (session types.AuthSession, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		session, err = selectAuthSessionByIDTxn(txn, realmID, sessionID)
+		session, err = selectAuthSessionByIDTxn(txn, d.box, realmID, sessionID)
+		return err
+	})
+	return
+}
+
+// LoadAuthSessions loads all AuthSessions from the database, ordered by realm ID then user ID.
+// Returns an empty list if there are no sessions.
+func (d *ServiceDB) LoadAuthSessions() (sessions []types.AuthSession, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		sessions, err = selectAuthSessionsTxn(txn, d.box)
 		return err
 	})
 	return
@@ -276,11 +369,201 @@ func (d *ServiceDB) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOpt
 	return
 }
 
-// InsertFromConfig inserts entries from the config file into the database. This only really
-// makes sense for in-memory databases.
+// QueueOutboxMessage inserts a new message into the outbox, to be delivered by the outbox worker.
+func (d *ServiceDB) QueueOutboxMessage(msg types.OutboxMessage) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertOutboxMessageTxn(txn, d.box, time.Now(), msg)
+	})
+}
+
+// UpdateOutboxMessage updates the delivery state (attempts, next attempt time, last error and
+// whether it has been dead-lettered) of an existing outbox message.
+func (d *ServiceDB) UpdateOutboxMessage(msg types.OutboxMessage) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateOutboxMessageTxn(txn, time.Now(), msg)
+	})
+}
+
+// DeleteOutboxMessage removes a message from the outbox, typically once it has been delivered.
+// No error is returned if the message did not exist in the first place.
+func (d *ServiceDB) DeleteOutboxMessage(messageID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteOutboxMessageTxn(txn, messageID)
+	})
+}
+
+// LoadOutboxMessages loads all outbox messages which are either pending delivery or have been
+// dead-lettered, depending on deadLettered. The messages are ordered by user ID, then room ID,
+// then in the order they were queued.
+func (d *ServiceDB) LoadOutboxMessages(deadLettered bool) (msgs []types.OutboxMessage, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		msgs, err = selectOutboxMessagesTxn(txn, d.box, deadLettered)
+		return err
+	})
+	return
+}
+
+// HasOlderOutboxMessage returns true if a message which was queued before the given message is still
+// waiting to be delivered to the same room by the same user.
+func (d *ServiceDB) HasOlderOutboxMessage(userID id.UserID, roomID id.RoomID, messageID string) (older bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		older, err = selectHasOlderOutboxMessageTxn(txn, userID, roomID, messageID)
+		return err
+	})
+	return
+}
+
+// StoreAuditEntry records a change to the configuration. The ID and Time of the entry are ignored.
+func (d *ServiceDB) StoreAuditEntry(entry api.AuditEntry) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertAuditEntryTxn(txn, d.box, time.Now(), entry)
+	})
+}
+
+// LoadAuditEntries loads every change to the given service, client, realm or session from the database,
+// oldest first.
+func (d *ServiceDB) LoadAuditEntries(kind, targetID string) (entries []api.AuditEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		entries, err = selectAuditEntriesTxn(txn, d.box, kind, targetID)
+		return err
+	})
+	return
+}
+
+// LoadAuditEntry loads a single change from the database.
+// Returns sql.ErrNoRows if there is no change with this ID.
+func (d *ServiceDB) LoadAuditEntry(auditID int64) (entry api.AuditEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		entry, err = selectAuditEntryTxn(txn, d.box, auditID)
+		return err
+	})
+	return
+}
+
+// StoreAPIKey stores a new API key for the admin API, identified by the hash of its token.
+// Returns an error if a key with the same name already exists.
+func (d *ServiceDB) StoreAPIKey(key api.APIKey, keyHash string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertAPIKeyTxn(txn, time.Now(), key, keyHash)
+	})
+}
+
+// LoadAPIKeyByHash loads the API key with the given token hash.
+// Returns sql.ErrNoRows if there is no such key.
+func (d *ServiceDB) LoadAPIKeyByHash(keyHash string) (key api.APIKey, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		key, err = selectAPIKeyByHashTxn(txn, keyHash)
+		return err
+	})
+	return
+}
+
+// LoadAPIKeys loads every API key from the database, sorted by name.
+func (d *ServiceDB) LoadAPIKeys() (keys []api.APIKey, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		keys, err = selectAPIKeysTxn(txn)
+		return err
+	})
+	return
+}
+
+// DeleteAPIKey deletes the API key with the given name. Returns false if there was no such key.
+func (d *ServiceDB) DeleteAPIKey(name string) (deleted bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		deleted, err = deleteAPIKeyTxn(txn, name)
+		return err
+	})
+	return
+}
+
+// How long to remember the responses to a command, so that they can be edited or redacted along with it.
+const commandResponseRetention = 7 * 24 * time.Hour
+
+// StoreCommandResponses stores the events which a bot sent in response to a command, replacing any
+// responses stored for it before. Responses older than a week are forgotten.
+func (d *ServiceDB) StoreCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID,
+	senderID id.UserID, responseEventIDs []id.EventID) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		now := time.Now()
+		if err := deleteOldCommandResponsesTxn(txn, now.Add(-commandResponseRetention)); err != nil {
+			return err
+		}
+		if err := deleteCommandResponsesTxn(txn, botUserID, roomID, commandEventID); err != nil {
+			return err
+		}
+		return insertCommandResponsesTxn(txn, now, botUserID, roomID, commandEventID, senderID, responseEventIDs)
+	})
+}
+
+// LoadCommandResponses loads the events which a bot sent in response to a command, in the order they
+// were sent, along with who sent the command. Returns no events if none are known.
+func (d *ServiceDB) LoadCommandResponses(botUserID id.UserID, roomID id.RoomID,
+	commandEventID id.EventID) (senderID id.UserID, responseEventIDs []id.EventID, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		senderID, responseEventIDs, err = selectCommandResponsesTxn(txn, botUserID, roomID, commandEventID)
+		return err
+	})
+	return
+}
+
+// DeleteCommandResponses forgets the responses to a command.
+func (d *ServiceDB) DeleteCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteCommandResponsesTxn(txn, botUserID, roomID, commandEventID)
+	})
+}
+
+// StoreRoomState stores state events which a bot has seen, replacing the events with the same room,
+// type and state key. This lets the bot know the state of its rooms as soon as it restarts.
+func (d *ServiceDB) StoreRoomState(botUserID id.UserID, events []*event.Event) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		now := time.Now()
+		for _, evt := range events {
+			if err := upsertRoomStateTxn(txn, now, botUserID, evt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadRoomState loads the state events which a bot has seen in all of its rooms.
+func (d *ServiceDB) LoadRoomState(botUserID id.UserID) (events []*event.Event, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		events, err = selectRoomStateTxn(txn, botUserID)
+		return err
+	})
+	return
+}
+
+// StoreCrossSigningKeys stores the cross-signing keys for a bot user, replacing any stored before.
+func (d *ServiceDB) StoreCrossSigningKeys(keys types.CrossSigningKeys) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return upsertCrossSigningKeysTxn(txn, d.box, time.Now(), keys)
+	})
+}
+
+// LoadCrossSigningKeys loads the cross-signing keys for a bot user.
+// Returns sql.ErrNoRows if Go-NEB has not created any for the user.
+func (d *ServiceDB) LoadCrossSigningKeys(userID id.UserID) (keys types.CrossSigningKeys, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		keys, err = selectCrossSigningKeysTxn(txn, d.box, userID)
+		return err
+	})
+	return
+}
+
+// InsertFromConfig inserts entries from the config file into the database. Clients which log in with
+// a Password or LoginToken keep the access token which is already stored for them, if any.
 func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
 	// Insert clients
 	for _, cli := range cfg.Clients {
+		// A LoginToken can only be used once, so logging in again on every start would fail
+		old, err := d.LoadMatrixClientConfig(cli.UserID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		cli.KeepLogin(old)
 		if _, err := d.StoreMatrixClientConfig(cli); err != nil {
 			return err
 		}
@@ -0,0 +1,254 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestAuditEntries(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	if err = db.SetEncryptionKeys(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("Failed to set keys: %s", err)
+	}
+	for _, entry := range []api.AuditEntry{
+		{Action: "configureService", Kind: "service", TargetID: "svc", TargetType: "echo", OldConfig: json.RawMessage(`null`), NewConfig: json.RawMessage(`{"v":1}`)},
+		{Action: "configureClient", Kind: "client", TargetID: "svc", OldConfig: json.RawMessage(`null`), NewConfig: json.RawMessage(`{"AccessToken":"secret"}`)},
+		{Action: "deleteService", Kind: "service", TargetID: "svc", TargetType: "echo", Actor: "alice", SourceIP: "10.0.0.1", OldConfig: json.RawMessage(`{"v":1}`), NewConfig: json.RawMessage(`null`)},
+	} {
+		if err = db.StoreAuditEntry(entry); err != nil {
+			t.Fatalf("Failed to store audit entry: %s", err)
+		}
+	}
+
+	entries, err := db.LoadAuditEntries("service", "svc")
+	if err != nil {
+		t.Fatalf("Failed to load audit entries: %s", err)
+	}
+	if len(entries) != 2 || entries[0].Action != "configureService" || entries[1].Action != "deleteService" {
+		t.Fatalf("Expected the two service entries in order, got %+v", entries)
+	}
+	if entries[0].ID >= entries[1].ID || string(entries[0].NewConfig) != `{"v":1}` || entries[1].Actor != "alice" {
+		t.Errorf("Unexpected audit entries: %+v", entries)
+	}
+
+	var raw string
+	if err = db.db.QueryRow(`SELECT new_json FROM audit_log WHERE kind = 'client'`).Scan(&raw); err != nil {
+		t.Fatalf("Failed to select new_json: %s", err)
+	}
+	if !strings.HasPrefix(raw, sealedPrefix) {
+		t.Errorf("Expected audit entry to be encrypted, got %s", raw)
+	}
+
+	entry, err := db.LoadAuditEntry(entries[0].ID)
+	if err != nil || entry.TargetType != "echo" {
+		t.Errorf("LoadAuditEntry: got %+v, err %v", entry, err)
+	}
+}
+
+func TestCommandResponses(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	bot, room := id.UserID("@neb:localhost"), id.RoomID("!room:localhost")
+	if err = db.StoreCommandResponses(bot, room, "$cmd", "@alice:localhost", []id.EventID{"$a", "$b"}); err != nil {
+		t.Fatalf("Failed to store responses: %s", err)
+	}
+	// Storing again replaces the responses
+	if err = db.StoreCommandResponses(bot, room, "$cmd", "@alice:localhost", []id.EventID{"$a"}); err != nil {
+		t.Fatalf("Failed to store responses: %s", err)
+	}
+	sender, responses, err := db.LoadCommandResponses(bot, room, "$cmd")
+	if err != nil || sender != "@alice:localhost" || !reflect.DeepEqual(responses, []id.EventID{"$a"}) {
+		t.Errorf("LoadCommandResponses: got %s %v (%v)", sender, responses, err)
+	}
+	if _, responses, _ = db.LoadCommandResponses(bot, "!other:localhost", "$cmd"); len(responses) != 0 {
+		t.Errorf("Expected responses to be per room, got %v", responses)
+	}
+
+	if err = db.DeleteCommandResponses(bot, room, "$cmd"); err != nil {
+		t.Fatalf("Failed to delete responses: %s", err)
+	}
+	if _, responses, _ = db.LoadCommandResponses(bot, room, "$cmd"); len(responses) != 0 {
+		t.Errorf("Expected responses to be deleted, got %v", responses)
+	}
+}
+
+func TestRoomState(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	bot := id.UserID("@neb:localhost")
+	parse := func(evtJSON string) *event.Event {
+		var evt event.Event
+		if err := json.Unmarshal([]byte(evtJSON), &evt); err != nil {
+			t.Fatalf("Failed to parse event: %s", err)
+		}
+		return &evt
+	}
+	if err = db.StoreRoomState(bot, []*event.Event{
+		parse(`{"type":"m.room.encryption","room_id":"!a:localhost","state_key":"","content":{"algorithm":"m.megolm.v1.aes-sha2"}}`),
+		parse(`{"type":"m.room.member","room_id":"!a:localhost","state_key":"@alice:localhost","content":{"membership":"invite"}}`),
+	}); err != nil {
+		t.Fatalf("Failed to store room state: %s", err)
+	}
+	// Storing an event with the same type and state key replaces it
+	if err = db.StoreRoomState(bot, []*event.Event{
+		parse(`{"type":"m.room.member","room_id":"!a:localhost","state_key":"@alice:localhost","content":{"membership":"join"}}`),
+	}); err != nil {
+		t.Fatalf("Failed to store room state: %s", err)
+	}
+	if err = db.StoreRoomState(bot, []*event.Event{parse(`{"type":"m.room.message","room_id":"!a:localhost","content":{}}`)}); err == nil {
+		t.Errorf("Expected storing a message event as state to fail")
+	}
+
+	events, err := db.LoadRoomState(bot)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("LoadRoomState: got %v (%v)", events, err)
+	}
+	for _, evt := range events {
+		if !evt.Type.IsState() || evt.RoomID != "!a:localhost" {
+			t.Errorf("Unexpected state event %+v", evt)
+		}
+		if evt.Type == event.StateMember && evt.Content.Raw["membership"] != "join" {
+			t.Errorf("Expected the latest membership to be loaded, got %v", evt.Content.Raw)
+		}
+	}
+	if events, _ = db.LoadRoomState("@other:localhost"); len(events) != 0 {
+		t.Errorf("Expected room state to be per bot, got %v", events)
+	}
+
+	if err = db.DeleteMatrixClientConfig(bot); err != nil {
+		t.Fatalf("Failed to delete client: %s", err)
+	}
+	if events, _ = db.LoadRoomState(bot); len(events) != 0 {
+		t.Errorf("Expected room state to be deleted with the client, got %v", events)
+	}
+}
+
+func TestInsertFromConfigKeepsLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-neb-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "go-neb.db")
+
+	cfg := &api.ConfigFile{Clients: []api.ClientConfig{
+		{UserID: "@token:hs", HomeserverURL: "https://hs", LoginToken: "single_use"},
+		{UserID: "@password:hs", HomeserverURL: "https://hs", Password: "hunter2"},
+		{UserID: "@access:hs", HomeserverURL: "https://hs", AccessToken: "from_config"},
+	}}
+	db, err := Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	if err = db.InsertFromConfig(cfg); err != nil {
+		t.Fatalf("Failed to insert config: %s", err)
+	}
+	// Log the clients in, as clients.Update does
+	for _, c := range cfg.Clients {
+		c.AccessToken = "logged_in_" + c.UserID.String()
+		c.DeviceID = "DEVICE"
+		c.RefreshToken = "refresh"
+		if _, err = db.StoreMatrixClientConfig(c); err != nil {
+			t.Fatalf("Failed to store client: %s", err)
+		}
+	}
+	db.db.Close()
+
+	// Restart with the same config file
+	if db, err = Open("sqlite3", dbPath); err != nil {
+		t.Fatalf("Failed to reopen database: %s", err)
+	}
+	if err = db.InsertFromConfig(cfg); err != nil {
+		t.Fatalf("Failed to insert config again: %s", err)
+	}
+	testCases := []struct {
+		userID      id.UserID
+		accessToken string
+	}{
+		{"@token:hs", "logged_in_@token:hs"},
+		{"@password:hs", "logged_in_@password:hs"},
+		{"@access:hs", "from_config"},
+	}
+	for _, tc := range testCases {
+		c, err := db.LoadMatrixClientConfig(tc.userID)
+		if err != nil {
+			t.Fatalf("Failed to load client: %s", err)
+		}
+		if c.AccessToken != tc.accessToken {
+			t.Errorf("%s: got access token %q, want %q", tc.userID, c.AccessToken, tc.accessToken)
+		}
+		if tc.accessToken != "from_config" && (c.DeviceID != "DEVICE" || c.RefreshToken != "refresh") {
+			t.Errorf("%s: expected the device and refresh token to be kept, got %+v", tc.userID, c)
+		}
+	}
+}
+
+func TestOutboxMessages(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	if err = db.SetEncryptionKeys(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("Failed to set keys: %s", err)
+	}
+	msgs := []types.OutboxMessage{
+		{ID: "1", UserID: "@neb:hs", RoomID: "!a:hs", EventType: "m.room.message", DeadLettered: true},
+		{ID: "2", UserID: "@neb:hs", RoomID: "!a:hs", EventType: "m.room.message"},
+		{ID: "3", UserID: "@neb:hs", RoomID: "!a:hs", EventType: "m.room.message"},
+		{ID: "4", UserID: "@neb:hs", RoomID: "!b:hs", EventType: "m.room.message"},
+		{ID: "5", UserID: "@other:hs", RoomID: "!a:hs", EventType: "m.room.message"},
+	}
+	for _, msg := range msgs {
+		msg.Content = json.RawMessage(`{"body":"secret plans"}`)
+		msg.NextAttempt = time.Now()
+		if err = db.QueueOutboxMessage(msg); err != nil {
+			t.Fatalf("Failed to queue message: %s", err)
+		}
+	}
+
+	var raw string
+	if err = db.db.QueryRow(`SELECT content_json FROM outbox WHERE message_id = '2'`).Scan(&raw); err != nil {
+		t.Fatalf("Failed to select content_json: %s", err)
+	}
+	if strings.Contains(raw, "secret plans") {
+		t.Errorf("Expected the message content to be encrypted, got %s", raw)
+	}
+	loaded, err := db.LoadOutboxMessages(false)
+	if err != nil || len(loaded) != 4 || string(loaded[0].Content) != `{"body":"secret plans"}` {
+		t.Errorf("Expected to load 4 decrypted messages, got %+v (%v)", loaded, err)
+	}
+
+	testCases := []struct {
+		msg  types.OutboxMessage
+		want bool
+	}{
+		{msgs[1], false}, // only a dead-lettered message is older
+		{msgs[2], true},
+		{msgs[3], false}, // a different room
+		{msgs[4], false}, // a different user
+	}
+	for _, tc := range testCases {
+		if older, err := db.HasOlderOutboxMessage(tc.msg.UserID, tc.msg.RoomID, tc.msg.ID); err != nil || older != tc.want {
+			t.Errorf("Message %s: got older %v (%v), want %v", tc.msg.ID, older, err, tc.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -11,28 +12,58 @@ type Storer interface {
 	StoreMatrixClientConfig(config api.ClientConfig) (oldConfig api.ClientConfig, err error)
 	LoadMatrixClientConfigs() (configs []api.ClientConfig, err error)
 	LoadMatrixClientConfig(userID id.UserID) (config api.ClientConfig, err error)
+	DeleteMatrixClientConfig(userID id.UserID) (err error)
 
 	UpdateNextBatch(userID id.UserID, nextBatch string) (err error)
 	LoadNextBatch(userID id.UserID) (nextBatch string, err error)
 
 	LoadService(serviceID string) (service types.Service, err error)
 	DeleteService(serviceID string) (err error)
+	LoadServices() (services []types.Service, err error)
 	LoadServicesForUser(serviceUserID id.UserID) (services []types.Service, err error)
 	LoadServicesByType(serviceType string) (services []types.Service, err error)
 	StoreService(service types.Service) (oldService types.Service, err error)
 
 	LoadAuthRealm(realmID string) (realm types.AuthRealm, err error)
 	LoadAuthRealmsByType(realmType string) (realms []types.AuthRealm, err error)
+	LoadAuthRealms() (realms []types.AuthRealm, err error)
 	StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error)
+	DeleteAuthRealm(realmID string) error
 
 	StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error)
 	LoadAuthSessionByUser(realmID string, userID id.UserID) (session types.AuthSession, err error)
 	LoadAuthSessionByID(realmID, sessionID string) (session types.AuthSession, err error)
+	LoadAuthSessions() (sessions []types.AuthSession, err error)
 	RemoveAuthSession(realmID string, userID id.UserID) error
 
 	LoadBotOptions(userID id.UserID, roomID id.RoomID) (opts types.BotOptions, err error)
 	StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOptions, err error)
 
+	QueueOutboxMessage(msg types.OutboxMessage) error
+	UpdateOutboxMessage(msg types.OutboxMessage) error
+	DeleteOutboxMessage(messageID string) error
+	LoadOutboxMessages(deadLettered bool) (msgs []types.OutboxMessage, err error)
+	HasOlderOutboxMessage(userID id.UserID, roomID id.RoomID, messageID string) (older bool, err error)
+
+	StoreAuditEntry(entry api.AuditEntry) error
+	LoadAuditEntries(kind, targetID string) (entries []api.AuditEntry, err error)
+	LoadAuditEntry(auditID int64) (entry api.AuditEntry, err error)
+
+	StoreAPIKey(key api.APIKey, keyHash string) error
+	LoadAPIKeyByHash(keyHash string) (key api.APIKey, err error)
+	LoadAPIKeys() (keys []api.APIKey, err error)
+	DeleteAPIKey(name string) (deleted bool, err error)
+
+	StoreCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID, senderID id.UserID, responseEventIDs []id.EventID) error
+	LoadCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID) (senderID id.UserID, responseEventIDs []id.EventID, err error)
+	DeleteCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID) error
+
+	StoreRoomState(botUserID id.UserID, events []*event.Event) error
+	LoadRoomState(botUserID id.UserID) (events []*event.Event, err error)
+
+	StoreCrossSigningKeys(keys types.CrossSigningKeys) error
+	LoadCrossSigningKeys(userID id.UserID) (keys types.CrossSigningKeys, err error)
+
 	InsertFromConfig(cfg *api.ConfigFile) error
 }
 
@@ -55,6 +86,11 @@ func (s *NopStorage) LoadMatrixClientConfig(userID id.UserID) (config api.Client
 	return
 }
 
+// DeleteMatrixClientConfig NOP
+func (s *NopStorage) DeleteMatrixClientConfig(userID id.UserID) (err error) {
+	return
+}
+
 // UpdateNextBatch NOP
 func (s *NopStorage) UpdateNextBatch(userID id.UserID, nextBatch string) (err error) {
 	return
@@ -75,6 +111,11 @@ func (s *NopStorage) DeleteService(serviceID string) (err error) {
 	return
 }
 
+// LoadServices NOP
+func (s *NopStorage) LoadServices() (services []types.Service, err error) {
+	return
+}
+
 // LoadServicesForUser NOP
 func (s *NopStorage) LoadServicesForUser(serviceUserID id.UserID) (services []types.Service, err error) {
 	return
@@ -100,6 +141,16 @@ func (s *NopStorage) LoadAuthRealmsByType(realmType string) (realms []types.Auth
 	return
 }
 
+// LoadAuthRealms NOP
+func (s *NopStorage) LoadAuthRealms() (realms []types.AuthRealm, err error) {
+	return
+}
+
+// DeleteAuthRealm NOP
+func (s *NopStorage) DeleteAuthRealm(realmID string) error {
+	return nil
+}
+
 // StoreAuthRealm NOP
 func (s *NopStorage) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error) {
 	return
@@ -120,6 +171,11 @@ func (s *NopStorage) LoadAuthSessionByID(realmID, sessionID string) (session typ
 	return
 }
 
+// LoadAuthSessions NOP
+func (s *NopStorage) LoadAuthSessions() (sessions []types.AuthSession, err error) {
+	return
+}
+
 // RemoveAuthSession NOP
 func (s *NopStorage) RemoveAuthSession(realmID string, userID id.UserID) error {
 	return nil
@@ -135,6 +191,101 @@ func (s *NopStorage) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOp
 	return
 }
 
+// QueueOutboxMessage NOP
+func (s *NopStorage) QueueOutboxMessage(msg types.OutboxMessage) error {
+	return nil
+}
+
+// UpdateOutboxMessage NOP
+func (s *NopStorage) UpdateOutboxMessage(msg types.OutboxMessage) error {
+	return nil
+}
+
+// DeleteOutboxMessage NOP
+func (s *NopStorage) DeleteOutboxMessage(messageID string) error {
+	return nil
+}
+
+// LoadOutboxMessages NOP
+func (s *NopStorage) LoadOutboxMessages(deadLettered bool) (msgs []types.OutboxMessage, err error) {
+	return
+}
+
+// HasOlderOutboxMessage NOP
+func (s *NopStorage) HasOlderOutboxMessage(userID id.UserID, roomID id.RoomID, messageID string) (older bool, err error) {
+	return
+}
+
+// StoreAuditEntry NOP
+func (s *NopStorage) StoreAuditEntry(entry api.AuditEntry) error {
+	return nil
+}
+
+// LoadAuditEntries NOP
+func (s *NopStorage) LoadAuditEntries(kind, targetID string) (entries []api.AuditEntry, err error) {
+	return
+}
+
+// LoadAuditEntry NOP
+func (s *NopStorage) LoadAuditEntry(auditID int64) (entry api.AuditEntry, err error) {
+	return
+}
+
+// StoreAPIKey NOP
+func (s *NopStorage) StoreAPIKey(key api.APIKey, keyHash string) error {
+	return nil
+}
+
+// LoadAPIKeyByHash NOP
+func (s *NopStorage) LoadAPIKeyByHash(keyHash string) (key api.APIKey, err error) {
+	return
+}
+
+// LoadAPIKeys NOP
+func (s *NopStorage) LoadAPIKeys() (keys []api.APIKey, err error) {
+	return
+}
+
+// DeleteAPIKey NOP
+func (s *NopStorage) DeleteAPIKey(name string) (deleted bool, err error) {
+	return
+}
+
+// StoreCommandResponses NOP
+func (s *NopStorage) StoreCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID, senderID id.UserID, responseEventIDs []id.EventID) error {
+	return nil
+}
+
+// LoadCommandResponses NOP
+func (s *NopStorage) LoadCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID) (senderID id.UserID, responseEventIDs []id.EventID, err error) {
+	return
+}
+
+// DeleteCommandResponses NOP
+func (s *NopStorage) DeleteCommandResponses(botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID) error {
+	return nil
+}
+
+// StoreRoomState NOP
+func (s *NopStorage) StoreRoomState(botUserID id.UserID, events []*event.Event) error {
+	return nil
+}
+
+// LoadRoomState NOP
+func (s *NopStorage) LoadRoomState(botUserID id.UserID) (events []*event.Event, err error) {
+	return
+}
+
+// StoreCrossSigningKeys NOP
+func (s *NopStorage) StoreCrossSigningKeys(keys types.CrossSigningKeys) error {
+	return nil
+}
+
+// LoadCrossSigningKeys NOP
+func (s *NopStorage) LoadCrossSigningKeys(userID id.UserID) (keys types.CrossSigningKeys, err error) {
+	return
+}
+
 // InsertFromConfig NOP
 func (s *NopStorage) InsertFromConfig(cfg *api.ConfigFile) error {
 	return nil
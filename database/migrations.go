@@ -0,0 +1,117 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A migration upgrades the schema by one version.
+type migration struct {
+	version     int
+	description string
+	// The SQL to run for each dialect. Use the same SQL for both dialects where possible.
+	up map[string]string
+}
+
+func bothDialects(sql string) map[string]string {
+	return map[string]string{
+		"sqlite3":  sql,
+		"postgres": sql,
+	}
+}
+
+// migrations MUST be in version order, starting at 1. Never edit a migration which has been released:
+// add a new one instead.
+var migrations = []migration{
+	{1, "Create the initial tables", bothDialects(initialSchemaSQL)},
+	{2, "Create the outbox table", bothDialects(outboxSchemaSQL)},
+	{3, "Create the audit log table", map[string]string{
+		"sqlite3":  fmt.Sprintf(auditLogSchemaSQL, "INTEGER PRIMARY KEY AUTOINCREMENT"),
+		"postgres": fmt.Sprintf(auditLogSchemaSQL, "BIGSERIAL PRIMARY KEY"),
+	}},
+	{4, "Create the API keys table", bothDialects(apiKeysSchemaSQL)},
+	{5, "Create the command responses table", bothDialects(commandResponsesSchemaSQL)},
+	{6, "Create the room state table", bothDialects(roomStateSchemaSQL)},
+	{7, "Create the cross-signing keys table", bothDialects(crossSigningKeysSchemaSQL)},
+}
+
+// LatestSchemaVersion is the schema version which this version of Go-NEB expects.
+var LatestSchemaVersion = migrations[len(migrations)-1].version
+
+const schemaVersionSchemaSQL = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER NOT NULL,
+	description TEXT NOT NULL,
+	time_applied_ms BIGINT NOT NULL,
+	UNIQUE(version)
+);
+`
+
+const selectSchemaVersionSQL = `
+SELECT COALESCE(MAX(version), 0) FROM schema_version
+`
+
+func selectSchemaVersionTxn(txn *sql.Tx) (version int, err error) {
+	err = txn.QueryRow(selectSchemaVersionSQL).Scan(&version)
+	return
+}
+
+const insertSchemaVersionSQL = `
+INSERT INTO schema_version(version, description, time_applied_ms) VALUES ($1, $2, $3)
+`
+
+func insertSchemaVersionTxn(txn *sql.Tx, now time.Time, m migration) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertSchemaVersionSQL, m.version, m.description, t)
+	return err
+}
+
+// migrate brings the schema up to LatestSchemaVersion, running each pending migration in its own
+// transaction. Returns an error without changing anything if the schema is newer than
+// LatestSchemaVersion, as this version of Go-NEB may not understand it.
+func migrate(db *sql.DB, dialect string, now time.Time) error {
+	if _, err := db.Exec(schemaVersionSchemaSQL); err != nil {
+		return err
+	}
+	var current int
+	err := runTransaction(db, func(txn *sql.Tx) (err error) {
+		current, err = selectSchemaVersionTxn(txn)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion {
+		return fmt.Errorf(
+			"database schema is version %d but this version of Go-NEB only supports up to version %d: upgrade Go-NEB",
+			current, LatestSchemaVersion,
+		)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		upSQL, ok := m.up[dialect]
+		if !ok {
+			return fmt.Errorf("schema migration %d does not support database type %s", m.version, dialect)
+		}
+		log.WithFields(log.Fields{
+			"version":     m.version,
+			"description": m.description,
+		}).Info("Migrating database schema")
+		err = runTransaction(db, func(txn *sql.Tx) error {
+			if _, err := txn.Exec(upSQL); err != nil {
+				return err
+			}
+			return insertSchemaVersionTxn(txn, now, m)
+		})
+		if err != nil {
+			return fmt.Errorf("schema migration %d failed: %s", m.version, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-neb-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "go-neb.db")
+
+	// A database created before schema versions were tracked
+	raw, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	if _, err = raw.Exec(initialSchemaSQL); err != nil {
+		t.Fatalf("Failed to create initial schema: %s", err)
+	}
+	if _, err = raw.Exec(`INSERT INTO matrix_clients VALUES ('@neb:localhost', '{}', '', 0, 0)`); err != nil {
+		t.Fatalf("Failed to insert client: %s", err)
+	}
+	raw.Close()
+
+	db, err := Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open and migrate database: %s", err)
+	}
+	var version int
+	if err = db.db.QueryRow(selectSchemaVersionSQL).Scan(&version); err != nil || version != LatestSchemaVersion {
+		t.Fatalf("Expected schema version %d, got %d (%v)", LatestSchemaVersion, version, err)
+	}
+	if configs, err := db.LoadMatrixClientConfigs(); err != nil || len(configs) != 1 {
+		t.Errorf("Expected existing data to survive migration, got %v (%v)", configs, err)
+	}
+	if _, err = db.LoadOutboxMessages(false); err != nil {
+		t.Errorf("Expected outbox table to be created: %s", err)
+	}
+
+	// A database from a newer version of Go-NEB
+	if _, err = db.db.Exec(insertSchemaVersionSQL, LatestSchemaVersion+1, "From the future", 0); err != nil {
+		t.Fatalf("Failed to insert schema version: %s", err)
+	}
+	db.db.Close()
+	if _, err = Open("sqlite3", dbPath); err == nil || !strings.Contains(err.Error(), "upgrade Go-NEB") {
+		t.Errorf("Expected opening a newer schema to fail, got %v", err)
+	}
+}
@@ -8,10 +8,13 @@ import (
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
-const schemaSQL = `
+// The tables which existed before schema versions were tracked. These use IF NOT EXISTS so that
+// databases created before then can be brought under version control.
+const initialSchemaSQL = `
 CREATE TABLE IF NOT EXISTS services (
 	service_id TEXT NOT NULL,
 	service_type TEXT NOT NULL,
@@ -63,16 +66,102 @@ CREATE TABLE IF NOT EXISTS bot_options (
 );
 `
 
+const outboxSchemaSQL = `
+CREATE TABLE IF NOT EXISTS outbox (
+	message_id TEXT NOT NULL,
+	service_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	content_json TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	next_attempt_ms BIGINT NOT NULL,
+	last_error TEXT NOT NULL,
+	dead_lettered BOOLEAN NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(message_id)
+);
+CREATE INDEX IF NOT EXISTS outbox_user_room_idx ON outbox(user_id, room_id, message_id);
+`
+
+// The audit_id column type differs between dialects, so it is filled in by the migration.
+const auditLogSchemaSQL = `
+CREATE TABLE IF NOT EXISTS audit_log (
+	audit_id %s,
+	action TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	target_id TEXT NOT NULL,
+	target_type TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	source_ip TEXT NOT NULL,
+	old_json TEXT NOT NULL,
+	new_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log(kind, target_id, audit_id);
+`
+
+const apiKeysSchemaSQL = `
+CREATE TABLE IF NOT EXISTS api_keys (
+	name TEXT NOT NULL,
+	scope TEXT NOT NULL,
+	key_hash TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(name),
+	UNIQUE(key_hash)
+);
+`
+
+const commandResponsesSchemaSQL = `
+CREATE TABLE IF NOT EXISTS command_responses (
+	bot_user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	command_event_id TEXT NOT NULL,
+	sender_id TEXT NOT NULL,
+	response_index INTEGER NOT NULL,
+	response_event_id TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(bot_user_id, room_id, command_event_id, response_index)
+);
+CREATE INDEX IF NOT EXISTS command_responses_time_idx ON command_responses(time_added_ms);
+`
+
+const roomStateSchemaSQL = `
+CREATE TABLE IF NOT EXISTS room_state (
+	bot_user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	state_key TEXT NOT NULL,
+	event_json TEXT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(bot_user_id, room_id, event_type, state_key)
+);
+`
+
+const crossSigningKeysSchemaSQL = `
+CREATE TABLE IF NOT EXISTS cross_signing_keys (
+	user_id TEXT NOT NULL,
+	keys_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(user_id)
+);
+`
+
 const selectMatrixClientConfigSQL = `
 SELECT client_json FROM matrix_clients WHERE user_id = $1
 `
 
-func selectMatrixClientConfigTxn(txn *sql.Tx, userID id.UserID) (config api.ClientConfig, err error) {
+func selectMatrixClientConfigTxn(txn *sql.Tx, box *secretBox, userID id.UserID) (config api.ClientConfig, err error) {
 	var configJSON []byte
 	err = txn.QueryRow(selectMatrixClientConfigSQL, userID).Scan(&configJSON)
 	if err != nil {
 		return
 	}
+	if configJSON, err = box.open(configJSON); err != nil {
+		return
+	}
 	err = json.Unmarshal(configJSON, &config)
 	return
 }
@@ -81,7 +170,7 @@ const selectMatrixClientConfigsSQL = `
 SELECT client_json FROM matrix_clients
 `
 
-func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []api.ClientConfig, err error) {
+func selectMatrixClientConfigsTxn(txn *sql.Tx, box *secretBox) (configs []api.ClientConfig, err error) {
 	rows, err := txn.Query(selectMatrixClientConfigsSQL)
 	if err != nil {
 		return
@@ -93,6 +182,9 @@ func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []api.ClientConfig, err
 		if err = rows.Scan(&configJSON); err != nil {
 			return
 		}
+		if configJSON, err = box.open(configJSON); err != nil {
+			return
+		}
 		if err = json.Unmarshal(configJSON, &config); err != nil {
 			return
 		}
@@ -101,18 +193,30 @@ func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []api.ClientConfig, err
 	return
 }
 
+const deleteMatrixClientConfigSQL = `
+DELETE FROM matrix_clients WHERE user_id = $1
+`
+
+func deleteMatrixClientConfigTxn(txn *sql.Tx, userID id.UserID) error {
+	_, err := txn.Exec(deleteMatrixClientConfigSQL, userID)
+	return err
+}
+
 const insertMatrixClientConfigSQL = `
 INSERT INTO matrix_clients(
 	user_id, client_json, next_batch, time_added_ms, time_updated_ms
 ) VALUES ($1, $2, '', $3, $4)
 `
 
-func insertMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientConfig) error {
+func insertMatrixClientConfigTxn(txn *sql.Tx, box *secretBox, now time.Time, config api.ClientConfig) error {
 	t := now.UnixNano() / 1000000
 	configJSON, err := json.Marshal(&config)
 	if err != nil {
 		return err
 	}
+	if configJSON, err = box.seal(configJSON); err != nil {
+		return err
+	}
 	_, err = txn.Exec(insertMatrixClientConfigSQL, config.UserID, configJSON, t, t)
 	return err
 }
@@ -122,12 +226,15 @@ UPDATE matrix_clients SET client_json = $1, time_updated_ms = $2
 	WHERE user_id = $3
 `
 
-func updateMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientConfig) error {
+func updateMatrixClientConfigTxn(txn *sql.Tx, box *secretBox, now time.Time, config api.ClientConfig) error {
 	t := now.UnixNano() / 1000000
 	configJSON, err := json.Marshal(&config)
 	if err != nil {
 		return err
 	}
+	if configJSON, err = box.seal(configJSON); err != nil {
+		return err
+	}
 	_, err = txn.Exec(updateMatrixClientConfigSQL, configJSON, t, config.UserID)
 	return err
 }
@@ -261,6 +368,34 @@ func selectServicesByTypeTxn(txn *sql.Tx, serviceType string) (srvs []types.Serv
 	return
 }
 
+const selectServicesSQL = `
+SELECT service_id, service_type, service_user_id, service_json FROM services ORDER BY service_id
+`
+
+func selectServicesTxn(txn *sql.Tx) (srvs []types.Service, err error) {
+	rows, err := txn.Query(selectServicesSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s types.Service
+		var serviceID string
+		var serviceType string
+		var serviceUserID id.UserID
+		var serviceJSON []byte
+		if err = rows.Scan(&serviceID, &serviceType, &serviceUserID, &serviceJSON); err != nil {
+			return
+		}
+		s, err = types.CreateService(serviceID, serviceType, serviceUserID, serviceJSON)
+		if err != nil {
+			return
+		}
+		srvs = append(srvs, s)
+	}
+	return
+}
+
 const deleteServiceSQL = `
 DELETE FROM services WHERE service_id = $1
 `
@@ -276,11 +411,14 @@ INSERT INTO auth_realms(
 ) VALUES ($1, $2, $3, $4, $5)
 `
 
-func insertRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
+func insertRealmTxn(txn *sql.Tx, box *secretBox, now time.Time, realm types.AuthRealm) error {
 	realmJSON, err := json.Marshal(realm)
 	if err != nil {
 		return err
 	}
+	if realmJSON, err = box.seal(realmJSON); err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		insertRealmSQL,
@@ -293,13 +431,17 @@ const selectRealmSQL = `
 SELECT realm_type, realm_json FROM auth_realms WHERE realm_id = $1
 `
 
-func selectRealmTxn(txn *sql.Tx, realmID string) (types.AuthRealm, error) {
+func selectRealmTxn(txn *sql.Tx, box *secretBox, realmID string) (types.AuthRealm, error) {
 	var realmType string
 	var realmJSON []byte
 	row := txn.QueryRow(selectRealmSQL, realmID)
 	if err := row.Scan(&realmType, &realmJSON); err != nil {
 		return nil, err
 	}
+	realmJSON, err := box.open(realmJSON)
+	if err != nil {
+		return nil, err
+	}
 	return types.CreateAuthRealm(realmID, realmType, realmJSON)
 }
 
@@ -307,7 +449,7 @@ const selectRealmsByTypeSQL = `
 SELECT realm_id, realm_json FROM auth_realms WHERE realm_type = $1 ORDER BY realm_id
 `
 
-func selectRealmsByTypeTxn(txn *sql.Tx, realmType string) (realms []types.AuthRealm, err error) {
+func selectRealmsByTypeTxn(txn *sql.Tx, box *secretBox, realmType string) (realms []types.AuthRealm, err error) {
 	rows, err := txn.Query(selectRealmsByTypeSQL, realmType)
 	if err != nil {
 		return
@@ -320,6 +462,39 @@ func selectRealmsByTypeTxn(txn *sql.Tx, realmType string) (realms []types.AuthRe
 		if err = rows.Scan(&realmID, &realmJSON); err != nil {
 			return
 		}
+		if realmJSON, err = box.open(realmJSON); err != nil {
+			return
+		}
+		realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON)
+		if err != nil {
+			return
+		}
+		realms = append(realms, realm)
+	}
+	return
+}
+
+const selectRealmsSQL = `
+SELECT realm_id, realm_type, realm_json FROM auth_realms ORDER BY realm_id
+`
+
+func selectRealmsTxn(txn *sql.Tx, box *secretBox) (realms []types.AuthRealm, err error) {
+	rows, err := txn.Query(selectRealmsSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realm types.AuthRealm
+		var realmID string
+		var realmType string
+		var realmJSON []byte
+		if err = rows.Scan(&realmID, &realmType, &realmJSON); err != nil {
+			return
+		}
+		if realmJSON, err = box.open(realmJSON); err != nil {
+			return
+		}
 		realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON)
 		if err != nil {
 			return
@@ -334,11 +509,14 @@ UPDATE auth_realms SET realm_type=$1, realm_json=$2, time_updated_ms=$3
 	WHERE realm_id=$4
 `
 
-func updateRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
+func updateRealmTxn(txn *sql.Tx, box *secretBox, now time.Time, realm types.AuthRealm) error {
 	realmJSON, err := json.Marshal(realm)
 	if err != nil {
 		return err
 	}
+	if realmJSON, err = box.seal(realmJSON); err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		updateRealmSQL, realm.Type(), realmJSON, t,
@@ -347,17 +525,36 @@ func updateRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
 	return err
 }
 
+const deleteRealmSQL = `
+DELETE FROM auth_realms WHERE realm_id=$1
+`
+
+const deleteRealmSessionsSQL = `
+DELETE FROM auth_sessions WHERE realm_id=$1
+`
+
+func deleteRealmTxn(txn *sql.Tx, realmID string) error {
+	if _, err := txn.Exec(deleteRealmSessionsSQL, realmID); err != nil {
+		return err
+	}
+	_, err := txn.Exec(deleteRealmSQL, realmID)
+	return err
+}
+
 const insertAuthSessionSQL = `
 INSERT INTO auth_sessions(
 	session_id, realm_id, user_id, session_json, time_added_ms, time_updated_ms
 ) VALUES ($1, $2, $3, $4, $5, $6)
 `
 
-func insertAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
+func insertAuthSessionTxn(txn *sql.Tx, box *secretBox, now time.Time, session types.AuthSession) error {
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
 		return err
 	}
+	if sessionJSON, err = box.seal(sessionJSON); err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		insertAuthSessionSQL,
@@ -381,7 +578,7 @@ SELECT session_id, realm_type, realm_json, session_json FROM auth_sessions
 	WHERE auth_sessions.realm_id = $1 AND auth_sessions.user_id = $2
 `
 
-func selectAuthSessionByUserTxn(txn *sql.Tx, realmID string, userID id.UserID) (types.AuthSession, error) {
+func selectAuthSessionByUserTxn(txn *sql.Tx, box *secretBox, realmID string, userID id.UserID) (types.AuthSession, error) {
 	var id string
 	var realmType string
 	var realmJSON []byte
@@ -390,6 +587,13 @@ func selectAuthSessionByUserTxn(txn *sql.Tx, realmID string, userID id.UserID) (
 	if err := row.Scan(&id, &realmType, &realmJSON, &sessionJSON); err != nil {
 		return nil, err
 	}
+	realmJSON, err := box.open(realmJSON)
+	if err != nil {
+		return nil, err
+	}
+	if sessionJSON, err = box.open(sessionJSON); err != nil {
+		return nil, err
+	}
 	realm, err := types.CreateAuthRealm(realmID, realmType, realmJSON)
 	if err != nil {
 		return nil, err
@@ -410,7 +614,7 @@ SELECT user_id, realm_type, realm_json, session_json FROM auth_sessions
 	WHERE auth_sessions.realm_id = $1 AND auth_sessions.session_id = $2
 `
 
-func selectAuthSessionByIDTxn(txn *sql.Tx, realmID, sid string) (types.AuthSession, error) {
+func selectAuthSessionByIDTxn(txn *sql.Tx, box *secretBox, realmID, sid string) (types.AuthSession, error) {
 	var userID id.UserID
 	var realmType string
 	var realmJSON []byte
@@ -419,6 +623,13 @@ func selectAuthSessionByIDTxn(txn *sql.Tx, realmID, sid string) (types.AuthSessi
 	if err := row.Scan(&userID, &realmType, &realmJSON, &sessionJSON); err != nil {
 		return nil, err
 	}
+	realmJSON, err := box.open(realmJSON)
+	if err != nil {
+		return nil, err
+	}
+	if sessionJSON, err = box.open(sessionJSON); err != nil {
+		return nil, err
+	}
 	realm, err := types.CreateAuthRealm(realmID, realmType, realmJSON)
 	if err != nil {
 		return nil, err
@@ -433,16 +644,69 @@ func selectAuthSessionByIDTxn(txn *sql.Tx, realmID, sid string) (types.AuthSessi
 	return session, nil
 }
 
+const selectAuthSessionsSQL = `
+SELECT session_id, auth_sessions.realm_id, user_id, realm_type, realm_json, session_json FROM auth_sessions
+	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
+	ORDER BY auth_sessions.realm_id, user_id
+`
+
+func selectAuthSessionsTxn(txn *sql.Tx, box *secretBox) (sessions []types.AuthSession, err error) {
+	rows, err := txn.Query(selectAuthSessionsSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	// Creating a realm calls Init() which may be expensive, so only do it once per realm.
+	realms := make(map[string]types.AuthRealm)
+	for rows.Next() {
+		var sid string
+		var realmID string
+		var userID id.UserID
+		var realmType string
+		var realmJSON []byte
+		var sessionJSON []byte
+		if err = rows.Scan(&sid, &realmID, &userID, &realmType, &realmJSON, &sessionJSON); err != nil {
+			return
+		}
+		if sessionJSON, err = box.open(sessionJSON); err != nil {
+			return
+		}
+		realm := realms[realmID]
+		if realm == nil {
+			if realmJSON, err = box.open(realmJSON); err != nil {
+				return
+			}
+			if realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON); err != nil {
+				return
+			}
+			realms[realmID] = realm
+		}
+		session := realm.AuthSession(sid, userID, realmID)
+		if session == nil {
+			err = fmt.Errorf("Cannot create session for given realm")
+			return
+		}
+		if err = json.Unmarshal(sessionJSON, session); err != nil {
+			return
+		}
+		sessions = append(sessions, session)
+	}
+	return
+}
+
 const updateAuthSessionSQL = `
 UPDATE auth_sessions SET session_id=$1, session_json=$2, time_updated_ms=$3
 	WHERE realm_id=$4 AND user_id=$5
 `
 
-func updateAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
+func updateAuthSessionTxn(txn *sql.Tx, box *secretBox, now time.Time, session types.AuthSession) error {
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
 		return err
 	}
+	if sessionJSON, err = box.seal(sessionJSON); err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		updateAuthSessionSQL, session.ID(), sessionJSON, t,
@@ -495,3 +759,470 @@ func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) erro
 	_, err = txn.Exec(updateBotOptionsSQL, optsJSON, opts.SetByUserID, t, opts.UserID, opts.RoomID)
 	return err
 }
+
+const insertOutboxMessageSQL = `
+INSERT INTO outbox(
+	message_id, service_id, user_id, room_id, event_type, content_json, attempts,
+	next_attempt_ms, last_error, dead_lettered, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+`
+
+func insertOutboxMessageTxn(txn *sql.Tx, box *secretBox, now time.Time, msg types.OutboxMessage) error {
+	t := now.UnixNano() / 1000000
+	// The content is sent into rooms which may be encrypted, so it mustn't be stored in plaintext
+	contentJSON, err := box.seal(msg.Content)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(
+		insertOutboxMessageSQL, msg.ID, msg.ServiceID, msg.UserID, msg.RoomID, msg.EventType,
+		contentJSON, msg.Attempts, msg.NextAttempt.UnixNano()/1000000, msg.LastError,
+		msg.DeadLettered, t, t,
+	)
+	return err
+}
+
+const updateOutboxMessageSQL = `
+UPDATE outbox SET attempts = $1, next_attempt_ms = $2, last_error = $3, dead_lettered = $4, time_updated_ms = $5
+	WHERE message_id = $6
+`
+
+func updateOutboxMessageTxn(txn *sql.Tx, now time.Time, msg types.OutboxMessage) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(
+		updateOutboxMessageSQL, msg.Attempts, msg.NextAttempt.UnixNano()/1000000, msg.LastError,
+		msg.DeadLettered, t, msg.ID,
+	)
+	return err
+}
+
+const deleteOutboxMessageSQL = `
+DELETE FROM outbox WHERE message_id = $1
+`
+
+func deleteOutboxMessageTxn(txn *sql.Tx, messageID string) error {
+	_, err := txn.Exec(deleteOutboxMessageSQL, messageID)
+	return err
+}
+
+const selectOutboxMessagesSQL = `
+SELECT message_id, service_id, user_id, room_id, event_type, content_json, attempts,
+	next_attempt_ms, last_error, dead_lettered FROM outbox
+	WHERE dead_lettered = $1 ORDER BY user_id, room_id, message_id
+`
+
+func selectOutboxMessagesTxn(txn *sql.Tx, box *secretBox, deadLettered bool) (msgs []types.OutboxMessage, err error) {
+	rows, err := txn.Query(selectOutboxMessagesSQL, deadLettered)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg types.OutboxMessage
+		var contentJSON []byte
+		var nextAttemptMs int64
+		if err = rows.Scan(
+			&msg.ID, &msg.ServiceID, &msg.UserID, &msg.RoomID, &msg.EventType, &contentJSON,
+			&msg.Attempts, &nextAttemptMs, &msg.LastError, &msg.DeadLettered,
+		); err != nil {
+			return
+		}
+		if contentJSON, err = box.open(contentJSON); err != nil {
+			return
+		}
+		msg.Content = json.RawMessage(contentJSON)
+		msg.NextAttempt = time.Unix(0, nextAttemptMs*1000000)
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+const selectOlderOutboxMessageSQL = `
+SELECT message_id FROM outbox
+	WHERE user_id = $1 AND room_id = $2 AND message_id < $3 AND dead_lettered = $4 LIMIT 1
+`
+
+func selectHasOlderOutboxMessageTxn(txn *sql.Tx, userID id.UserID, roomID id.RoomID, messageID string) (bool, error) {
+	var olderID string
+	err := txn.QueryRow(selectOlderOutboxMessageSQL, userID, roomID, messageID, false).Scan(&olderID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+const insertAuditEntrySQL = `
+INSERT INTO audit_log(
+	action, kind, target_id, target_type, user_id, actor, source_ip, old_json, new_json, time_added_ms
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+`
+
+func insertAuditEntryTxn(txn *sql.Tx, box *secretBox, now time.Time, entry api.AuditEntry) error {
+	t := now.UnixNano() / 1000000
+	// Client, realm and session configs contain secrets.
+	oldJSON, err := box.seal(entry.OldConfig)
+	if err != nil {
+		return err
+	}
+	newJSON, err := box.seal(entry.NewConfig)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(
+		insertAuditEntrySQL, entry.Action, entry.Kind, entry.TargetID, entry.TargetType, entry.UserID,
+		entry.Actor, entry.SourceIP, oldJSON, newJSON, t,
+	)
+	return err
+}
+
+const selectAuditEntriesSQL = `
+SELECT audit_id, action, kind, target_id, target_type, user_id, actor, source_ip, old_json, new_json,
+	time_added_ms FROM audit_log WHERE kind = $1 AND target_id = $2 ORDER BY audit_id
+`
+
+const selectAuditEntrySQL = `
+SELECT audit_id, action, kind, target_id, target_type, user_id, actor, source_ip, old_json, new_json,
+	time_added_ms FROM audit_log WHERE audit_id = $1
+`
+
+func selectAuditEntriesTxn(txn *sql.Tx, box *secretBox, kind, targetID string) (entries []api.AuditEntry, err error) {
+	rows, err := txn.Query(selectAuditEntriesSQL, kind, targetID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry api.AuditEntry
+		if entry, err = scanAuditEntry(rows, box); err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	return
+}
+
+func selectAuditEntryTxn(txn *sql.Tx, box *secretBox, auditID int64) (api.AuditEntry, error) {
+	return scanAuditEntry(txn.QueryRow(selectAuditEntrySQL, auditID), box)
+}
+
+func scanAuditEntry(row interface{ Scan(...interface{}) error }, box *secretBox) (entry api.AuditEntry, err error) {
+	var oldJSON, newJSON []byte
+	var timeMs int64
+	if err = row.Scan(
+		&entry.ID, &entry.Action, &entry.Kind, &entry.TargetID, &entry.TargetType, &entry.UserID,
+		&entry.Actor, &entry.SourceIP, &oldJSON, &newJSON, &timeMs,
+	); err != nil {
+		return
+	}
+	if oldJSON, err = box.open(oldJSON); err != nil {
+		return
+	}
+	if newJSON, err = box.open(newJSON); err != nil {
+		return
+	}
+	entry.OldConfig = json.RawMessage(oldJSON)
+	entry.NewConfig = json.RawMessage(newJSON)
+	entry.Time = time.Unix(0, timeMs*1000000)
+	return
+}
+
+const insertAPIKeySQL = `
+INSERT INTO api_keys(name, scope, key_hash, time_added_ms) VALUES ($1, $2, $3, $4)
+`
+
+func insertAPIKeyTxn(txn *sql.Tx, now time.Time, key api.APIKey, keyHash string) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertAPIKeySQL, key.Name, key.Scope, keyHash, t)
+	return err
+}
+
+const selectAPIKeyByHashSQL = `
+SELECT name, scope, time_added_ms FROM api_keys WHERE key_hash = $1
+`
+
+func selectAPIKeyByHashTxn(txn *sql.Tx, keyHash string) (key api.APIKey, err error) {
+	var timeAddedMs int64
+	err = txn.QueryRow(selectAPIKeyByHashSQL, keyHash).Scan(&key.Name, &key.Scope, &timeAddedMs)
+	key.Created = time.Unix(0, timeAddedMs*1000000)
+	return
+}
+
+const selectAPIKeysSQL = `
+SELECT name, scope, time_added_ms FROM api_keys ORDER BY name
+`
+
+func selectAPIKeysTxn(txn *sql.Tx) (keys []api.APIKey, err error) {
+	rows, err := txn.Query(selectAPIKeysSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key api.APIKey
+		var timeAddedMs int64
+		if err = rows.Scan(&key.Name, &key.Scope, &timeAddedMs); err != nil {
+			return
+		}
+		key.Created = time.Unix(0, timeAddedMs*1000000)
+		keys = append(keys, key)
+	}
+	err = rows.Err()
+	return
+}
+
+const deleteAPIKeySQL = `
+DELETE FROM api_keys WHERE name = $1
+`
+
+func deleteAPIKeyTxn(txn *sql.Tx, name string) (bool, error) {
+	res, err := txn.Exec(deleteAPIKeySQL, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const insertCommandResponseSQL = `
+INSERT INTO command_responses(
+	bot_user_id, room_id, command_event_id, sender_id, response_index, response_event_id, time_added_ms
+) VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+func insertCommandResponsesTxn(txn *sql.Tx, now time.Time, botUserID id.UserID, roomID id.RoomID,
+	commandEventID id.EventID, senderID id.UserID, responseEventIDs []id.EventID) error {
+	t := now.UnixNano() / 1000000
+	for i, responseEventID := range responseEventIDs {
+		_, err := txn.Exec(
+			insertCommandResponseSQL, botUserID, roomID, commandEventID, senderID, i, responseEventID, t,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const selectCommandResponsesSQL = `
+SELECT sender_id, response_event_id FROM command_responses
+	WHERE bot_user_id = $1 AND room_id = $2 AND command_event_id = $3 ORDER BY response_index
+`
+
+func selectCommandResponsesTxn(txn *sql.Tx, botUserID id.UserID, roomID id.RoomID,
+	commandEventID id.EventID) (senderID id.UserID, responseEventIDs []id.EventID, err error) {
+	rows, err := txn.Query(selectCommandResponsesSQL, botUserID, roomID, commandEventID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var responseEventID id.EventID
+		if err = rows.Scan(&senderID, &responseEventID); err != nil {
+			return
+		}
+		responseEventIDs = append(responseEventIDs, responseEventID)
+	}
+	err = rows.Err()
+	return
+}
+
+const deleteCommandResponsesSQL = `
+DELETE FROM command_responses WHERE bot_user_id = $1 AND room_id = $2 AND command_event_id = $3
+`
+
+func deleteCommandResponsesTxn(txn *sql.Tx, botUserID id.UserID, roomID id.RoomID, commandEventID id.EventID) error {
+	_, err := txn.Exec(deleteCommandResponsesSQL, botUserID, roomID, commandEventID)
+	return err
+}
+
+const deleteOldCommandResponsesSQL = `
+DELETE FROM command_responses WHERE time_added_ms < $1
+`
+
+func deleteOldCommandResponsesTxn(txn *sql.Tx, before time.Time) error {
+	_, err := txn.Exec(deleteOldCommandResponsesSQL, before.UnixNano()/1000000)
+	return err
+}
+
+const deleteRoomStateEventSQL = `
+DELETE FROM room_state WHERE bot_user_id = $1 AND room_id = $2 AND event_type = $3 AND state_key = $4
+`
+
+const insertRoomStateEventSQL = `
+INSERT INTO room_state(
+	bot_user_id, room_id, event_type, state_key, event_json, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+func upsertRoomStateTxn(txn *sql.Tx, now time.Time, botUserID id.UserID, evt *event.Event) error {
+	if evt.StateKey == nil {
+		return fmt.Errorf("event %s in %s is not a state event", evt.ID, evt.RoomID)
+	}
+	eventJSON, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(deleteRoomStateEventSQL, botUserID, evt.RoomID, evt.Type.Type, *evt.StateKey)
+	if err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(
+		insertRoomStateEventSQL, botUserID, evt.RoomID, evt.Type.Type, *evt.StateKey, string(eventJSON), t,
+	)
+	return err
+}
+
+const selectRoomStateSQL = `
+SELECT event_json FROM room_state WHERE bot_user_id = $1
+`
+
+func selectRoomStateTxn(txn *sql.Tx, botUserID id.UserID) (events []*event.Event, err error) {
+	rows, err := txn.Query(selectRoomStateSQL, botUserID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventJSON string
+		if err = rows.Scan(&eventJSON); err != nil {
+			return
+		}
+		var evt event.Event
+		if err = json.Unmarshal([]byte(eventJSON), &evt); err != nil {
+			return
+		}
+		// Only state events are stored, whatever their type
+		evt.Type.Class = event.StateEventType
+		// The content must be parsed as it would be for events from /sync, or it reads as empty
+		if err = evt.Content.ParseRaw(evt.Type); err != nil {
+			return
+		}
+		events = append(events, &evt)
+	}
+	err = rows.Err()
+	return
+}
+
+const deleteRoomStateSQL = `
+DELETE FROM room_state WHERE bot_user_id = $1
+`
+
+func deleteRoomStateTxn(txn *sql.Tx, botUserID id.UserID) error {
+	_, err := txn.Exec(deleteRoomStateSQL, botUserID)
+	return err
+}
+
+const deleteCrossSigningKeysSQL = `
+DELETE FROM cross_signing_keys WHERE user_id = $1
+`
+
+const insertCrossSigningKeysSQL = `
+INSERT INTO cross_signing_keys(user_id, keys_json, time_added_ms) VALUES ($1, $2, $3)
+`
+
+func upsertCrossSigningKeysTxn(txn *sql.Tx, box *secretBox, now time.Time, keys types.CrossSigningKeys) error {
+	keysJSON, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	if keysJSON, err = box.seal(keysJSON); err != nil {
+		return err
+	}
+	if _, err = txn.Exec(deleteCrossSigningKeysSQL, keys.UserID); err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(insertCrossSigningKeysSQL, keys.UserID, keysJSON, t)
+	return err
+}
+
+const selectCrossSigningKeysSQL = `
+SELECT keys_json FROM cross_signing_keys WHERE user_id = $1
+`
+
+func selectCrossSigningKeysTxn(txn *sql.Tx, box *secretBox, userID id.UserID) (keys types.CrossSigningKeys, err error) {
+	var keysJSON []byte
+	if err = txn.QueryRow(selectCrossSigningKeysSQL, userID).Scan(&keysJSON); err != nil {
+		return
+	}
+	if keysJSON, err = box.open(keysJSON); err != nil {
+		return
+	}
+	err = json.Unmarshal(keysJSON, &keys)
+	return
+}
+
+// The sensitive columns which are encrypted by a secretBox. The first column selected is the value and the
+// remaining columns identify the row, in the same order as the update parameters.
+const (
+	selectClientSecretsSQL       = `SELECT client_json, user_id FROM matrix_clients`
+	updateClientSecretSQL        = `UPDATE matrix_clients SET client_json = $1 WHERE user_id = $2`
+	selectRealmSecretsSQL        = `SELECT realm_json, realm_id FROM auth_realms`
+	updateRealmSecretSQL         = `UPDATE auth_realms SET realm_json = $1 WHERE realm_id = $2`
+	selectSessionSecretsSQL      = `SELECT session_json, realm_id, user_id FROM auth_sessions`
+	updateSessionSecretSQL       = `UPDATE auth_sessions SET session_json = $1 WHERE realm_id = $2 AND user_id = $3`
+	selectAuditOldSecretsSQL     = `SELECT old_json, audit_id FROM audit_log`
+	updateAuditOldSecretSQL      = `UPDATE audit_log SET old_json = $1 WHERE audit_id = $2`
+	selectAuditNewSecretsSQL     = `SELECT new_json, audit_id FROM audit_log`
+	updateAuditNewSecretSQL      = `UPDATE audit_log SET new_json = $1 WHERE audit_id = $2`
+	selectCrossSigningSecretsSQL = `SELECT keys_json, user_id FROM cross_signing_keys`
+	updateCrossSigningSecretSQL  = `UPDATE cross_signing_keys SET keys_json = $1 WHERE user_id = $2`
+	selectOutboxSecretsSQL       = `SELECT content_json, message_id FROM outbox`
+	updateOutboxSecretSQL        = `UPDATE outbox SET content_json = $1 WHERE message_id = $2`
+)
+
+// reencryptSecretsTxn decrypts every value in a sensitive column and encrypts it again with the current
+// key. Returns the number of rows updated.
+func reencryptSecretsTxn(txn *sql.Tx, box *secretBox, selectSQL, updateSQL string) (int, error) {
+	rows, err := txn.Query(selectSQL)
+	if err != nil {
+		return 0, err
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return 0, err
+	}
+	// Read every row before updating any, as sqlite only allows one query at a time.
+	var updates [][]interface{}
+	for rows.Next() {
+		var value []byte
+		keys := make([]string, len(cols)-1)
+		dest := []interface{}{&value}
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if value, err = box.open(value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if value, err = box.seal(value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		args := []interface{}{value}
+		for _, k := range keys {
+			args = append(args, k)
+		}
+		updates = append(updates, args)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	if err = rows.Close(); err != nil {
+		return 0, err
+	}
+	for _, args := range updates {
+		if _, err = txn.Exec(updateSQL, args...); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sealedPrefix marks a column value which has been encrypted by a secretBox. Values without this
+// prefix are plaintext JSON, which allows encryption to be turned on for an existing database.
+const sealedPrefix = "neb-enc:v1:"
+
+// A secretBox encrypts sensitive column values using envelope encryption. Every value is encrypted
+// with its own random data key, and the data key is encrypted with a master key. Sealed values
+// record the ID of the master key used, so old master keys can still decrypt values until they have
+// been re-encrypted with the current key.
+//
+// A nil secretBox stores values as plaintext.
+type secretBox struct {
+	current    string                 // ID of the key to encrypt with, or "" to store plaintext
+	masterKeys map[string]cipher.AEAD // key ID => master key
+}
+
+// newSecretBox creates a secretBox which encrypts with the current key and can decrypt with any of the
+// given keys. Keys MUST be 32 bytes long. If current is nil, values will be stored as plaintext but
+// can still be decrypted.
+func newSecretBox(current []byte, old ...[]byte) (*secretBox, error) {
+	b := &secretBox{
+		masterKeys: make(map[string]cipher.AEAD),
+	}
+	for i, key := range append([][]byte{current}, old...) {
+		if key == nil {
+			continue
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %d must be 32 bytes long, got %d", i, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		keyID := hex.EncodeToString(sum[:4])
+		b.masterKeys[keyID] = aead
+		if i == 0 {
+			b.current = keyID
+		}
+	}
+	return b, nil
+}
+
+// seal encrypts the plaintext with the current master key. Returns the plaintext unchanged if there
+// is no current key.
+func (b *secretBox) seal(plaintext []byte) ([]byte, error) {
+	if b == nil || b.current == "" {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := encrypt(b.masterKeys[b.current], dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := encrypt(dataAEAD, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.RawStdEncoding
+	return []byte(sealedPrefix + b.current + ":" + enc.EncodeToString(wrappedKey) + ":" + enc.EncodeToString(ciphertext)), nil
+}
+
+// open decrypts a value created by seal. Values which were not sealed are returned unchanged.
+func (b *secretBox) open(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(sealedPrefix)) {
+		return value, nil
+	}
+	parts := strings.Split(string(value[len(sealedPrefix):]), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed encrypted value")
+	}
+	if b == nil || b.masterKeys[parts[0]] == nil {
+		return nil, fmt.Errorf("value is encrypted with unknown key %s", parts[0])
+	}
+	enc := base64.RawStdEncoding
+	wrappedKey, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := decrypt(b.masterKeys[parts[0]], wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(dataAEAD, ciphertext)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt returns the nonce followed by the ciphertext.
+func encrypt(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSecretBox(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	plaintext := []byte(`{"AccessToken":"secret"}`)
+
+	oldBox, err := newSecretBox(oldKey)
+	if err != nil {
+		t.Fatalf("Failed to create box: %s", err)
+	}
+	sealed, err := oldBox.seal(plaintext)
+	if err != nil {
+		t.Fatalf("Failed to seal: %s", err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("Sealed value contains the plaintext: %s", sealed)
+	}
+
+	rotatedBox, err := newSecretBox(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("Failed to create box: %s", err)
+	}
+	if opened, err := rotatedBox.open(sealed); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("Failed to open with old key: %s %s", opened, err)
+	}
+	newBox, _ := newSecretBox(newKey)
+	if _, err := newBox.open(sealed); err == nil {
+		t.Errorf("Expected opening with the wrong key to fail")
+	}
+	var nilBox *secretBox
+	if opened, err := nilBox.open(plaintext); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("Expected plaintext to be passed through, got %s %s", opened, err)
+	}
+	if _, err := newSecretBox([]byte("too short")); err == nil {
+		t.Errorf("Expected short key to be rejected")
+	}
+}
+
+func TestReencryptSecrets(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	config := api.ClientConfig{UserID: "@neb:localhost", AccessToken: "secret"}
+	// stored before encryption was turned on
+	if _, err = db.StoreMatrixClientConfig(config); err != nil {
+		t.Fatalf("Failed to store client config: %s", err)
+	}
+
+	rawClientJSON := func() string {
+		var raw string
+		if err := db.db.QueryRow(`SELECT client_json FROM matrix_clients`).Scan(&raw); err != nil {
+			t.Fatalf("Failed to select client_json: %s", err)
+		}
+		return raw
+	}
+
+	key := bytes.Repeat([]byte{1}, 32)
+	if err = db.SetEncryptionKeys(key); err != nil {
+		t.Fatalf("Failed to set keys: %s", err)
+	}
+	if n, err := db.ReencryptSecrets(); err != nil || n != 1 {
+		t.Fatalf("ReencryptSecrets: got %d rows, err %v", n, err)
+	}
+	if raw := rawClientJSON(); !strings.HasPrefix(raw, sealedPrefix) {
+		t.Fatalf("Expected client config to be encrypted, got %s", raw)
+	}
+	if loaded, err := db.LoadMatrixClientConfig(config.UserID); err != nil || loaded.AccessToken != "secret" {
+		t.Errorf("Failed to load encrypted config: %+v %s", loaded, err)
+	}
+
+	// rotate the key
+	if err = db.SetEncryptionKeys(bytes.Repeat([]byte{2}, 32), key); err != nil {
+		t.Fatalf("Failed to set keys: %s", err)
+	}
+	before := rawClientJSON()
+	if _, err = db.ReencryptSecrets(); err != nil {
+		t.Fatalf("ReencryptSecrets failed: %s", err)
+	}
+	if err = db.SetEncryptionKeys(bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatalf("Failed to set keys: %s", err)
+	}
+	if raw := rawClientJSON(); raw == before {
+		t.Errorf("Expected client config to be re-encrypted")
+	}
+	if loaded, err := db.LoadMatrixClientConfig(config.UserID); err != nil || loaded.AccessToken != "secret" {
+		t.Errorf("Failed to load re-encrypted config without the old key: %+v %s", loaded, err)
+	}
+}
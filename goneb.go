@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,14 +9,20 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/matrix-org/dugong"
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/api/handlers"
+	"github.com/matrix-org/go-neb/appservice"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
 	_ "github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/outbox"
 	"github.com/matrix-org/go-neb/polling"
 	_ "github.com/matrix-org/go-neb/realms/github"
 	_ "github.com/matrix-org/go-neb/realms/jira"
@@ -32,6 +39,7 @@ import (
 
 	_ "github.com/matrix-org/go-neb/services/jira"
 	_ "github.com/matrix-org/go-neb/services/rssbot"
+	_ "github.com/matrix-org/go-neb/services/schedule"
 	_ "github.com/matrix-org/go-neb/services/slackapi"
 	_ "github.com/matrix-org/go-neb/services/travisci"
 	_ "github.com/matrix-org/go-neb/services/wikipedia"
@@ -56,12 +64,20 @@ func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigF
 	// The hack that follows gets around this by type asserting all parsed YAML keys as
 	// strings then re-encoding/decoding as JSON. That is:
 	// YAML bytes -> map[interface]interface -> map[string]interface -> JSON bytes -> NEB types
+	//
+	// Secret references are resolved whilst converting to map[string]interface. The YAML
+	// parser throws away tags it doesn't know about, so "!file /path" tags are turned into
+	// "!file /path" strings before parsing.
 
 	// Convert to YAML bytes
 	contents, err := ioutil.ReadFile(configFilePath)
 	if err != nil {
 		return nil, err
 	}
+	contents = fileTagRegexp.ReplaceAllFunc(contents, func(tag []byte) []byte {
+		m := fileTagRegexp.FindSubmatch(tag)
+		return []byte(string(m[1]) + strconv.Quote("!file "+string(m[2])))
+	})
 
 	// Convert to map[interface]interface
 	var cfg map[interface{}]interface{}
@@ -70,7 +86,10 @@ func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigF
 	}
 
 	// Convert to map[string]interface
-	dict := convertKeysToStrings(cfg)
+	dict, err := convertKeysToStrings(cfg, "")
+	if err != nil {
+		return nil, err
+	}
 
 	// Convert to JSON bytes
 	b, err := json.Marshal(dict)
@@ -92,24 +111,82 @@ func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigF
 	return &c, nil
 }
 
-func convertKeysToStrings(iface interface{}) interface{} {
+var (
+	// Matches "!file /path" YAML tags.
+	fileTagRegexp = regexp.MustCompile(`(^|\s)!file[ \t]+(\S+)`)
+	// Matches ${ENV_VAR} references.
+	envVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// convertKeysToStrings converts the keys of all YAML maps to strings and resolves secret references
+// in all string values. The path is the location of iface in the config, and is used in errors.
+func convertKeysToStrings(iface interface{}, path string) (interface{}, error) {
 	obj, isObj := iface.(map[interface{}]interface{})
 	if isObj {
 		strObj := make(map[string]interface{})
 		for k, v := range obj {
-			strObj[k.(string)] = convertKeysToStrings(v) // handle nested objects
+			key := k.(string)
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			val, err := convertKeysToStrings(v, keyPath) // handle nested objects
+			if err != nil {
+				return nil, err
+			}
+			strObj[key] = val
 		}
-		return strObj
+		return strObj, nil
 	}
 
 	arr, isArr := iface.([]interface{})
 	if isArr {
 		for i := range arr {
-			arr[i] = convertKeysToStrings(arr[i]) // handle nested objects
+			val, err := convertKeysToStrings(arr[i], fmt.Sprintf("%s[%d]", path, i)) // handle nested objects
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = val
+		}
+		return arr, nil
+	}
+
+	str, isStr := iface.(string)
+	if isStr {
+		val, err := resolveSecret(str)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return val, nil
+	}
+	return iface, nil // base type like number
+}
+
+// resolveSecret replaces ${ENV_VAR} references in the string with the value of the environment
+// variable. If the string is then of the form "!file /path", it is replaced with the contents of
+// the file, minus any trailing newline.
+func resolveSecret(str string) (string, error) {
+	var err error
+	str = envVarRegexp.ReplaceAllStringFunc(str, func(ref string) string {
+		name := envVarRegexp.FindStringSubmatch(ref)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
 		}
-		return arr
+		return val
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(str, "!file ") {
+		return str, nil
+	}
+	contents, err := ioutil.ReadFile(strings.TrimSpace(strings.TrimPrefix(str, "!file ")))
+	if err != nil {
+		return "", err
 	}
-	return iface // base type like string or number
+	return strings.TrimRight(string(contents), "\r\n"), nil
 }
 
 func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.ConfigureServiceRequest) error {
@@ -152,7 +229,121 @@ func loadDatabase(databaseType, databaseURL, configYAML string) (*database.Servi
 	return db, err
 }
 
-func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
+// isMemoryDatabase returns true if the database is in memory, which is the default when no DATABASE_URL is set.
+func isMemoryDatabase(databaseURL string) bool {
+	return databaseURL == "" || strings.HasPrefix(databaseURL, ":memory:")
+}
+
+// checkMemoryDatabaseLogins returns an error for each client in the config file which can't log in every
+// time Go-NEB starts, as the access tokens it gets by logging in are lost with the in-memory database.
+// Clients which log in with a Password can, but without a DeviceID they get a new device each time.
+func checkMemoryDatabaseLogins(cfg *api.ConfigFile) (errs []error) {
+	for i, c := range cfg.Clients {
+		if c.AccessToken != "" {
+			continue
+		}
+		if c.Password == "" && c.LoginToken != "" {
+			errs = append(errs, fmt.Errorf(
+				"clients[%d].LoginToken: a LoginToken can only be used once, so it needs a DATABASE_URL to keep the access token in", i,
+			))
+		} else if c.Password != "" && c.DeviceID == "" {
+			log.WithField("user_id", c.UserID).Warn(
+				"Client logs in with a Password but has no DeviceID, so it will have a new device every time Go-NEB starts")
+		}
+	}
+	return
+}
+
+// setEncryptionKeys turns on encryption of secrets in the database if a key has been configured.
+func setEncryptionKeys(db *database.ServiceDB, e envVars) error {
+	var current []byte
+	var old [][]byte
+	var err error
+	if e.DatabaseEncryptionKey != "" {
+		if current, err = base64.StdEncoding.DecodeString(e.DatabaseEncryptionKey); err != nil {
+			return fmt.Errorf("DATABASE_ENCRYPTION_KEY is not valid base64: %s", err)
+		}
+	}
+	if e.DatabaseEncryptionOldKeys != "" {
+		for i, k := range strings.Split(e.DatabaseEncryptionOldKeys, ",") {
+			key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(k))
+			if err != nil {
+				return fmt.Errorf("DATABASE_ENCRYPTION_OLD_KEYS[%d] is not valid base64: %s", i, err)
+			}
+			old = append(old, key)
+		}
+	}
+	if current == nil && old == nil {
+		return nil
+	}
+	return db.SetEncryptionKeys(current, old...)
+}
+
+// reencryptSecrets re-encrypts every secret in the database with the current key, e.g. after rotating
+// DATABASE_ENCRYPTION_KEY. Returns the exit code for the process.
+func reencryptSecrets(e envVars) int {
+	db, err := loadDatabase(e.DatabaseType, e.DatabaseURL, e.ConfigFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %s\n", err)
+		return 1
+	}
+	if err = setEncryptionKeys(db, e); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	n, err := db.ReencryptSecrets()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to re-encrypt secrets: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Re-encrypted %d rows\n", n)
+	return 0
+}
+
+// createAPIKey creates an API key for the admin API and prints its token. Returns the exit code for
+// the process.
+func createAPIKey(e envVars, name, scope string) int {
+	if !api.IsValidScope(scope) {
+		fmt.Fprintf(os.Stderr, "Scope must be %q, %q or %q\n", api.ScopeRead, api.ScopeServices, api.ScopeAdmin)
+		return 1
+	}
+	db, err := loadDatabase(e.DatabaseType, e.DatabaseURL, e.ConfigFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %s\n", err)
+		return 1
+	}
+	token, err := handlers.GenerateAPIKey(db, name, scope)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create API key: %s\n", err)
+		return 1
+	}
+	fmt.Println(token)
+	return 0
+}
+
+// generateRegistration writes an application service registration for Go-NEB at BASE_URL, owning the
+// users matching userRegex. Returns the exit code for the process.
+func generateRegistration(e envVars, path, userRegex string) int {
+	if e.BaseURL == "" {
+		fmt.Fprintln(os.Stderr, "BASE_URL must be set to the URL the homeserver can reach Go-NEB on")
+		return 1
+	}
+	reg, err := appservice.NewRegistration(e.BaseURL, userRegex)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate registration: %s\n", err)
+		return 1
+	}
+	if err := reg.Save(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write registration: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Wrote %s. Add it to the homeserver's app_service_config_files and set APPSERVICE_REGISTRATION=%s\n", path, path)
+	return 0
+}
+
+// setup starts Go-NEB and adds its HTTP handlers to the muxes. The admin API is added to adminMux,
+// which may be the same as mux.
+func setup(e envVars, mux, adminMux *http.ServeMux, matrixClient *http.Client) {
 	err := types.BaseURL(e.BaseURL)
 	if err != nil {
 		log.WithError(err).Panic("Failed to get base url")
@@ -162,6 +353,9 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	if err != nil {
 		log.WithError(err).Panic("Failed to open database")
 	}
+	if err = setEncryptionKeys(db, e); err != nil {
+		log.WithError(err).Panic("Failed to set database encryption keys")
+	}
 
 	// Populate the database from the config file if one was supplied.
 	var cfg *api.ConfigFile
@@ -169,6 +363,16 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 		if cfg, err = loadFromConfig(db, e.ConfigFile); err != nil {
 			log.WithError(err).WithField("config_file", e.ConfigFile).Panic("Failed to load config file")
 		}
+		errs := handlers.ValidateConfigFile(cfg)
+		if isMemoryDatabase(e.DatabaseURL) {
+			errs = append(errs, checkMemoryDatabaseLogins(cfg)...)
+		}
+		if len(errs) > 0 {
+			for _, err := range errs {
+				log.WithError(err).WithField("config_file", e.ConfigFile).Error("Invalid config")
+			}
+			log.WithField("config_file", e.ConfigFile).Panic("Config file is invalid")
+		}
 		if err := db.InsertFromConfig(cfg); err != nil {
 			log.WithError(err).Panic("Failed to persist config data into in-memory DB")
 		}
@@ -178,6 +382,18 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	}
 
 	matrixClients := clients.New(db, matrixClient)
+	var registration *appservice.Registration
+	if e.AppServiceRegistration != "" {
+		if registration, err = appservice.Load(e.AppServiceRegistration); err != nil {
+			log.WithError(err).WithField("registration", e.AppServiceRegistration).Panic("Failed to load application service registration")
+		}
+		matrixClients.SetAppService(registration)
+	}
+	if isMemoryDatabase(e.DatabaseURL) {
+		matrixClients.SetEphemeralDatabase()
+	}
+	// Messages from services are queued so that they are retried if the homeserver is unavailable
+	matrixClients.SetOutbox(outbox.NewUserClient)
 	if err := matrixClients.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start up clients")
 	}
@@ -190,7 +406,43 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	rh := &handlers.RealmRedirect{db}
 	mux.HandleFunc("/realms/redirects/", prometheus.InstrumentHandlerFunc("realmRedirectHandler", util.Protect(rh.Handle)))
 
-	mux.Handle("/verifySAS", prometheus.InstrumentHandler("verifySAS", util.MakeJSONAPI(&handlers.VerifySAS{matrixClients})))
+	// The homeserver pushes events for application service clients, authenticated with the hs_token.
+	if registration != nil {
+		txnHandler := prometheus.InstrumentHandler("appServiceTransaction", util.MakeJSONAPI(handlers.NewAppServiceTransaction(registration, matrixClients)))
+		userHandler := prometheus.InstrumentHandler("appServiceUser", util.MakeJSONAPI(&handlers.AppServiceUser{registration, matrixClients}))
+		mux.Handle("/_matrix/app/v1/transactions/", txnHandler)
+		mux.Handle("/_matrix/app/v1/users/", userHandler)
+		// Older homeservers don't use the /_matrix/app/v1 prefix
+		mux.Handle("/transactions/", txnHandler)
+		mux.Handle("/users/", userHandler)
+	}
+
+	// Admin paths need an API key with the given scope, and may be served on a separate address.
+	auth := handlers.NewAdminAuth(db, e.AdminAPIToken)
+	if e.AdminAPIAllowUnauthenticated == "true" {
+		auth.AllowUnauthenticated()
+	}
+	if hasCredentials, err := auth.HasCredentials(); err != nil {
+		log.WithError(err).Panic("Failed to load API keys")
+	} else if !hasCredentials && e.AdminAPIAllowUnauthenticated == "true" {
+		log.Warn("The admin API is open to everyone: set ADMIN_API_TOKEN or create an API key with 'go-neb create-api-key'")
+	} else if !hasCredentials {
+		log.Warn("The admin API is disabled: set ADMIN_API_TOKEN or create an API key with 'go-neb create-api-key'")
+	}
+	handleAdmin := func(path, name, scope string, h util.JSONRequestHandler) {
+		adminMux.Handle(path, prometheus.InstrumentHandler(name, util.MakeJSONAPI(auth.Protect(scope, h))))
+	}
+
+	// Validating config has no side effects, so is available even when using a config file.
+	handleAdmin("/admin/validateConfig", "validateConfig", api.ScopeRead, &handlers.ValidateConfig{})
+	// Client health is needed for monitoring whichever way the clients are configured.
+	handleAdmin("/admin/clientStatus", "clientStatus", api.ScopeRead, &handlers.ClientStatus{matrixClients})
+
+	handleAdmin("/admin/createAPIKey", "createAPIKey", api.ScopeAdmin, &handlers.CreateAPIKey{db})
+	handleAdmin("/admin/listAPIKeys", "listAPIKeys", api.ScopeAdmin, &handlers.ListAPIKeys{db})
+	handleAdmin("/admin/revokeAPIKey", "revokeAPIKey", api.ScopeAdmin, &handlers.RevokeAPIKey{db})
+	// Verifying a device makes the bot trust it with encrypted messages.
+	handleAdmin("/verifySAS", "verifySAS", api.ScopeAdmin, &handlers.VerifySAS{matrixClients})
 
 	// Read exclusively from the config file if one was supplied.
 	// Otherwise, add HTTP listeners for new Services/Sessions/Clients/etc.
@@ -200,19 +452,43 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 		}
 
 		log.Info("Inserted ", len(cfg.Services), " services")
+
+		reloader := newConfigReloader(db, matrixClients, e.ConfigFile, cfg)
+		go reloader.watchSignals()
+		if e.ConfigWatchInterval != "" {
+			interval, err := time.ParseDuration(e.ConfigWatchInterval)
+			if err != nil || interval <= 0 {
+				log.WithField("config_watch_interval", e.ConfigWatchInterval).Panic("Invalid CONFIG_WATCH_INTERVAL")
+			}
+			go reloader.watchFile(interval)
+		}
 	} else {
-		mux.Handle("/admin/getService", prometheus.InstrumentHandler("getService", util.MakeJSONAPI(&handlers.GetService{db})))
-		mux.Handle("/admin/getSession", prometheus.InstrumentHandler("getSession", util.MakeJSONAPI(&handlers.GetSession{db})))
-		mux.Handle("/admin/configureClient", prometheus.InstrumentHandler("configureClient", util.MakeJSONAPI(&handlers.ConfigureClient{matrixClients})))
-		mux.Handle("/admin/configureService", prometheus.InstrumentHandler("configureService", util.MakeJSONAPI(handlers.NewConfigureService(db, matrixClients))))
-		mux.Handle("/admin/configureAuthRealm", prometheus.InstrumentHandler("configureAuthRealm", util.MakeJSONAPI(&handlers.ConfigureAuthRealm{db})))
-		mux.Handle("/admin/requestAuthSession", prometheus.InstrumentHandler("requestAuthSession", util.MakeJSONAPI(&handlers.RequestAuthSession{db})))
-		mux.Handle("/admin/removeAuthSession", prometheus.InstrumentHandler("removeAuthSession", util.MakeJSONAPI(&handlers.RemoveAuthSession{db})))
+		handleAdmin("/admin/getService", "getService", api.ScopeRead, &handlers.GetService{db})
+		// Sessions contain third party access tokens
+		handleAdmin("/admin/getSession", "getSession", api.ScopeAdmin, &handlers.GetSession{db})
+		handleAdmin("/admin/configureClient", "configureClient", api.ScopeAdmin, &handlers.ConfigureClient{db, matrixClients})
+		configureService := handlers.NewConfigureService(db, matrixClients)
+		handleAdmin("/admin/configureService", "configureService", api.ScopeServices, configureService)
+		handleAdmin("/admin/deleteService", "deleteService", api.ScopeServices, handlers.NewDeleteService(db, matrixClients, configureService))
+		handleAdmin("/admin/serviceHistory", "serviceHistory", api.ScopeRead, &handlers.ServiceHistory{db})
+		handleAdmin("/admin/rollbackService", "rollbackService", api.ScopeServices, handlers.NewRollbackService(db, configureService))
+		handleAdmin("/admin/listServices", "listServices", api.ScopeRead, &handlers.ListServices{db})
+		handleAdmin("/admin/listClients", "listClients", api.ScopeRead, &handlers.ListClients{db})
+		handleAdmin("/admin/removeClient", "removeClient", api.ScopeAdmin, &handlers.RemoveClient{db, matrixClients})
+		handleAdmin("/admin/listRealms", "listRealms", api.ScopeRead, &handlers.ListRealms{db})
+		handleAdmin("/admin/listSessions", "listSessions", api.ScopeRead, &handlers.ListSessions{db})
+		handleAdmin("/admin/configureAuthRealm", "configureAuthRealm", api.ScopeAdmin, &handlers.ConfigureAuthRealm{db})
+		handleAdmin("/admin/requestAuthSession", "requestAuthSession", api.ScopeAdmin, &handlers.RequestAuthSession{db})
+		handleAdmin("/admin/removeAuthSession", "removeAuthSession", api.ScopeAdmin, &handlers.RemoveAuthSession{db})
 	}
 	polling.SetClients(matrixClients)
 	if err := polling.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start polling")
 	}
+	outbox.SetClients(matrixClients)
+	if err := outbox.Start(); err != nil {
+		log.WithError(err).Panic("Failed to start outbox")
+	}
 }
 
 type envVars struct {
@@ -222,9 +498,53 @@ type envVars struct {
 	BaseURL      string
 	LogDir       string
 	ConfigFile   string
+	// How often to check the config file for changes, e.g. "30s". Empty to only reload on SIGHUP.
+	ConfigWatchInterval string
+	// The base64 encoded 32 byte key to encrypt secrets in the database with. Empty to store them unencrypted.
+	DatabaseEncryptionKey string
+	// Comma separated base64 encoded keys which secrets may have previously been encrypted with.
+	DatabaseEncryptionOldKeys string
+	// The address to serve the admin API on. Empty to serve it on BindAddress.
+	AdminBindAddress string
+	// A shared secret bearer token with full access to the admin API. Empty to only allow API keys.
+	AdminAPIToken string
+	// "true" to allow requests to the admin API without a token while there is no AdminAPIToken and
+	// no API keys, as older versions of Go-NEB did.
+	AdminAPIAllowUnauthenticated string
+	// The path to an application service registration file. Empty to not be an application service.
+	AppServiceRegistration string
+}
+
+// validateConfig checks the config file given in the arguments to "go-neb validate" without contacting
+// Matrix or any third party, printing every problem found. Returns the exit code for the process.
+func validateConfig(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: go-neb validate <config.yaml>")
+		return 2
+	}
+	configFilePath := args[0]
+	cfg, err := loadFromConfig(nil, configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFilePath, err)
+		return 1
+	}
+	errs := handlers.ValidateConfigFile(cfg)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFilePath, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: OK\n", configFilePath)
+	return 0
 }
 
 func main() {
+	// go-neb validate <config.yaml>
+	if len(os.Args) >= 2 && os.Args[1] == "validate" {
+		os.Exit(validateConfig(os.Args[2:]))
+	}
+
 	e := envVars{
 		BindAddress:  os.Getenv("BIND_ADDRESS"),
 		DatabaseType: os.Getenv("DATABASE_TYPE"),
@@ -232,6 +552,30 @@ func main() {
 		BaseURL:      os.Getenv("BASE_URL"),
 		LogDir:       os.Getenv("LOG_DIR"),
 		ConfigFile:   os.Getenv("CONFIG_FILE"),
+
+		ConfigWatchInterval:       os.Getenv("CONFIG_WATCH_INTERVAL"),
+		DatabaseEncryptionKey:     os.Getenv("DATABASE_ENCRYPTION_KEY"),
+		DatabaseEncryptionOldKeys: os.Getenv("DATABASE_ENCRYPTION_OLD_KEYS"),
+		AdminBindAddress:          os.Getenv("ADMIN_BIND_ADDRESS"),
+		AdminAPIToken:             os.Getenv("ADMIN_API_TOKEN"),
+		AppServiceRegistration:    os.Getenv("APPSERVICE_REGISTRATION"),
+
+		AdminAPIAllowUnauthenticated: os.Getenv("ADMIN_API_ALLOW_UNAUTHENTICATED"),
+	}
+
+	// go-neb reencrypt-secrets
+	if len(os.Args) == 2 && os.Args[1] == "reencrypt-secrets" {
+		os.Exit(reencryptSecrets(e))
+	}
+
+	// go-neb create-api-key <name> <scope>
+	if len(os.Args) == 4 && os.Args[1] == "create-api-key" {
+		os.Exit(createAPIKey(e, os.Args[2], os.Args[3]))
+	}
+
+	// go-neb generate-registration <registration.yaml> <user regex>
+	if len(os.Args) == 4 && os.Args[1] == "generate-registration" {
+		os.Exit(generateRegistration(e, os.Args[2], os.Args[3]))
 	}
 
 	if e.LogDir != "" {
@@ -247,8 +591,28 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Infof("Go-NEB (%+v)", e)
+	// Don't log the encryption keys or the admin secret
+	loggedEnv := e
+	if loggedEnv.AdminAPIToken != "" {
+		loggedEnv.AdminAPIToken = "<redacted>"
+	}
+	if loggedEnv.DatabaseEncryptionKey != "" {
+		loggedEnv.DatabaseEncryptionKey = "<redacted>"
+	}
+	if loggedEnv.DatabaseEncryptionOldKeys != "" {
+		loggedEnv.DatabaseEncryptionOldKeys = "<redacted>"
+	}
+	log.Infof("Go-NEB (%+v)", loggedEnv)
 
-	setup(e, http.DefaultServeMux, http.DefaultClient)
+	adminMux := http.DefaultServeMux
+	if e.AdminBindAddress != "" {
+		adminMux = http.NewServeMux()
+	}
+	setup(e, http.DefaultServeMux, adminMux, http.DefaultClient)
+	if e.AdminBindAddress != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(e.AdminBindAddress, adminMux))
+		}()
+	}
 	log.Fatal(http.ListenAndServe(e.BindAddress, nil))
 }
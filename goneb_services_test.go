@@ -17,14 +17,18 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+// adminToken authenticates the admin API requests made by the tests.
+const adminToken = "triforce"
+
 func setupMockServer() (*http.ServeMux, *matrixTripper, *httptest.ResponseRecorder, chan string) {
 	mux := http.NewServeMux()
 	mxTripper := newMatrixTripper()
 	setup(envVars{
-		BaseURL:      "http://go.neb",
-		DatabaseType: "sqlite3",
-		DatabaseURL:  ":memory:",
-	}, mux, &http.Client{
+		BaseURL:       "http://go.neb",
+		DatabaseType:  "sqlite3",
+		DatabaseURL:   ":memory:",
+		AdminAPIToken: adminToken,
+	}, mux, mux, &http.Client{
 		Transport: mxTripper,
 	})
 
@@ -32,6 +36,11 @@ func setupMockServer() (*http.ServeMux, *matrixTripper, *httptest.ResponseRecord
 	mockWriter := httptest.NewRecorder()
 	reqChan := make(chan string)
 	mxTripper.HandlePOSTFilter("@link:hyrule")
+	mxTripper.Handle("GET", "/_matrix/client/r0/account/whoami",
+		func(req *http.Request) (*http.Response, error) {
+			return newResponse(200, `{"user_id":"@link:hyrule"}`), nil
+		},
+	)
 	mxTripper.Handle("GET", "/_matrix/client/r0/sync",
 		func(req *http.Request) (*http.Response, error) {
 			if _, ok := req.URL.Query()["since"]; !ok {
@@ -55,6 +64,7 @@ func TestConfigureClient(t *testing.T) {
 		"Sync":true,
 		"AutoJoinRooms":true
 	}`))
+	mockReq.Header.Set("Authorization", "Bearer "+adminToken)
 	mux.ServeHTTP(mockWriter, mockReq)
 	expectCode := 200
 	if mockWriter.Code != expectCode {
@@ -93,6 +103,7 @@ func TestRespondToEcho(t *testing.T) {
 		"Sync":true,
 		"AutoJoinRooms":true
 	}`))
+	clientConfigReq.Header.Set("Authorization", "Bearer "+adminToken)
 	mux.ServeHTTP(mockWriter, clientConfigReq)
 
 	// configure the echo service
@@ -103,6 +114,7 @@ func TestRespondToEcho(t *testing.T) {
 		"UserID": "@link:hyrule",
 		"Config": {}
 	}`))
+	serviceConfigReq.Header.Set("Authorization", "Bearer "+adminToken)
 	mux.ServeHTTP(mockWriter, serviceConfigReq)
 
 	// send neb an invite to a room
@@ -215,6 +227,7 @@ func TestEncryptedRespondToEcho(t *testing.T) {
 		"Sync":true,
 		"AutoJoinRooms":true
 	}`))
+	clientConfigReq.Header.Set("Authorization", "Bearer "+adminToken)
 	mux.ServeHTTP(mockWriter, clientConfigReq)
 
 	// configure the echo service
@@ -225,6 +238,7 @@ func TestEncryptedRespondToEcho(t *testing.T) {
 		"UserID": "@link:hyrule",
 		"Config": {}
 	}`))
+	serviceConfigReq.Header.Set("Authorization", "Bearer "+adminToken)
 	mux.ServeHTTP(mockWriter, serviceConfigReq)
 
 	// send neb an invite to a room
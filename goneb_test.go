@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+)
+
+func TestLoadFromConfigSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-neb-config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretPath := filepath.Join(dir, "giphy_key")
+	if err := ioutil.WriteFile(secretPath, []byte("file_secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write secret: %s", err)
+	}
+	os.Setenv("TEST_NEB_ACCESS_TOKEN", "env_secret")
+	defer os.Unsetenv("TEST_NEB_ACCESS_TOKEN")
+	os.Setenv("TEST_NEB_SECRET_DIR", dir)
+	defer os.Unsetenv("TEST_NEB_SECRET_DIR")
+
+	configPath := filepath.Join(dir, "config.yaml")
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+			t.Fatalf("Failed to write config: %s", err)
+		}
+	}
+
+	writeConfig(`
+clients:
+  - UserID: "@goneb:localhost"
+    AccessToken: "${TEST_NEB_ACCESS_TOKEN}"
+    HomeserverURL: "http://localhost:8008"
+services:
+  - ID: "giphy_service"
+    Type: "giphy"
+    UserID: "@goneb:localhost"
+    Config:
+      api_key: !file ` + secretPath + `
+      other_key: "!file ${TEST_NEB_SECRET_DIR}/giphy_key"
+      literal: "no $secrets here"
+`)
+	cfg, err := loadFromConfig(nil, configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+	if cfg.Clients[0].AccessToken != "env_secret" {
+		t.Errorf("AccessToken: got %q, want %q", cfg.Clients[0].AccessToken, "env_secret")
+	}
+	var srvConfig map[string]string
+	if err := json.Unmarshal(cfg.Services[0].Config, &srvConfig); err != nil {
+		t.Fatalf("Failed to unmarshal service config: %s", err)
+	}
+	want := map[string]string{"api_key": "file_secret", "other_key": "file_secret", "literal": "no $secrets here"}
+	for k, v := range want {
+		if srvConfig[k] != v {
+			t.Errorf("%s: got %q, want %q", k, srvConfig[k], v)
+		}
+	}
+
+	writeConfig(`
+clients:
+  - UserID: "@goneb:localhost"
+    AccessToken: "${TEST_NEB_NOT_SET}"
+services: []
+`)
+	_, err = loadFromConfig(nil, configPath)
+	if err == nil || !strings.Contains(err.Error(), "clients[0].AccessToken") {
+		t.Errorf("Expected an error for an unset environment variable with its path, got %v", err)
+	}
+}
+
+func TestCheckMemoryDatabaseLogins(t *testing.T) {
+	cfg := &api.ConfigFile{Clients: []api.ClientConfig{
+		{UserID: "@token:hs", AccessToken: "token"},
+		{UserID: "@password:hs", Password: "hunter2"},
+		{UserID: "@sso:hs", LoginToken: "single_use"},
+		{UserID: "@sso_logged_in:hs", LoginToken: "single_use", AccessToken: "token"},
+	}}
+	errs := checkMemoryDatabaseLogins(cfg)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "clients[2].LoginToken") {
+		t.Errorf("Expected only the LoginToken client to be rejected, got %v", errs)
+	}
+}
+
+func TestValidateConfigArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-neb-config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(configPath, []byte(`
+clients:
+  - UserID: "@goneb:localhost"
+    AccessToken: "token"
+    HomeserverURL: "http://localhost:8008"
+services:
+  - ID: "echo_service"
+    Type: "echo"
+    UserID: "@goneb:localhost"
+    Config: {}
+`), 0600); err != nil {
+		t.Fatalf("Failed to write config: %s", err)
+	}
+
+	testCases := []struct {
+		args []string
+		want int
+	}{
+		{nil, 2},
+		{[]string{configPath, "extra"}, 2},
+		{[]string{filepath.Join(dir, "missing.yaml")}, 1},
+		{[]string{configPath}, 0},
+	}
+	for _, tc := range testCases {
+		if got := validateConfig(tc.args); got != tc.want {
+			t.Errorf("validate %v: got exit code %d, want %d", tc.args, got, tc.want)
+		}
+	}
+}
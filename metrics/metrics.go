@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -11,6 +13,10 @@ type Status string
 const (
 	StatusSuccess = "success"
 	StatusFailure = "failure"
+	// The sender was not allowed to run the command
+	StatusForbidden = "forbidden"
+	// The command's arguments did not match what it takes
+	StatusInvalid = "invalid"
 )
 
 var (
@@ -30,6 +36,34 @@ var (
 		Name: "goneb_auth_session_total",
 		Help: "The total number of successful /requestAuthSession requests",
 	}, []string{"realm_type"})
+	outboxCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_outbox_deliveries_total",
+		Help: "The total number of attempts to deliver queued outbox messages",
+	}, []string{"status"})
+	rateLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_rate_limited_total",
+		Help: "The total number of commands, expansions and reactions dropped because the sender was rate limited",
+	}, []string{"service_type", "kind"})
+	reactionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_reactions_total",
+		Help: "The number of reactions to bot messages handled by services",
+	}, []string{"service_type", "status"})
+	rateLimitBucketsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "goneb_rate_limit_buckets",
+		Help: "The number of sender, room and service type combinations being rate limited",
+	})
+	clientSyncStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goneb_client_sync_state",
+		Help: "The state of each client's /sync stream: 1 for the current state and 0 for the others",
+	}, []string{"user_id", "state"})
+	clientLastSyncGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goneb_client_last_sync_timestamp_seconds",
+		Help: "The Unix time of each client's last successful /sync request",
+	}, []string{"user_id"})
+	clientSyncFailuresGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goneb_client_sync_failures",
+		Help: "The number of /sync requests which have failed in a row for each client",
+	}, []string{"user_id"})
 )
 
 // IncrementCommand increments the pling command counter
@@ -52,9 +86,66 @@ func IncrementAuthSession(realmType string) {
 	authSessionCounter.With(prometheus.Labels{"realm_type": realmType}).Inc()
 }
 
+// IncrementOutbox increments the outbox delivery attempt counter
+func IncrementOutbox(st Status) {
+	outboxCounter.With(prometheus.Labels{"status": string(st)}).Inc()
+}
+
+// IncrementRateLimited increments the rate limited counter. The kind is "command", "expansion" or "reaction".
+func IncrementRateLimited(serviceType, kind string) {
+	rateLimitedCounter.With(prometheus.Labels{"service_type": serviceType, "kind": kind}).Inc()
+}
+
+// IncrementReaction increments the reaction counter
+func IncrementReaction(serviceType string, st Status) {
+	reactionCounter.With(prometheus.Labels{"service_type": serviceType, "status": string(st)}).Inc()
+}
+
+// SetRateLimitBuckets sets the number of rate limit buckets being tracked
+func SetRateLimitBuckets(n int) {
+	rateLimitBucketsGauge.Set(float64(n))
+}
+
+// SetClientSyncState sets the state of a client's /sync stream. The state is one of the given states.
+func SetClientSyncState(userID, state string, states []string) {
+	for _, st := range states {
+		v := 0.0
+		if st == state {
+			v = 1
+		}
+		clientSyncStateGauge.With(prometheus.Labels{"user_id": userID, "state": st}).Set(v)
+	}
+}
+
+// SetClientLastSync sets the time of a client's last successful /sync request
+func SetClientLastSync(userID string, t time.Time) {
+	clientLastSyncGauge.With(prometheus.Labels{"user_id": userID}).Set(float64(t.UnixNano()) / 1e9)
+}
+
+// SetClientSyncFailures sets the number of /sync requests which have failed in a row for a client
+func SetClientSyncFailures(userID string, n int) {
+	clientSyncFailuresGauge.With(prometheus.Labels{"user_id": userID}).Set(float64(n))
+}
+
+// RemoveClientSync stops reporting the /sync stream of a client which has stopped
+func RemoveClientSync(userID string, states []string) {
+	for _, st := range states {
+		clientSyncStateGauge.Delete(prometheus.Labels{"user_id": userID, "state": st})
+	}
+	clientLastSyncGauge.Delete(prometheus.Labels{"user_id": userID})
+	clientSyncFailuresGauge.Delete(prometheus.Labels{"user_id": userID})
+}
+
 func init() {
 	prometheus.MustRegister(cmdCounter)
 	prometheus.MustRegister(configureServicesCounter)
 	prometheus.MustRegister(webhookCounter)
 	prometheus.MustRegister(authSessionCounter)
+	prometheus.MustRegister(outboxCounter)
+	prometheus.MustRegister(rateLimitedCounter)
+	prometheus.MustRegister(rateLimitBucketsGauge)
+	prometheus.MustRegister(reactionCounter)
+	prometheus.MustRegister(clientSyncStateGauge)
+	prometheus.MustRegister(clientLastSyncGauge)
+	prometheus.MustRegister(clientSyncFailuresGauge)
 }
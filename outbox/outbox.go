@@ -0,0 +1,316 @@
+// Package outbox implements a persistent, retrying queue for messages which services send into Matrix.
+//
+// Messages are stored in the database before any attempt is made to send them, so they are not lost if
+// the homeserver is unavailable. Delivery is retried with exponential backoff until it succeeds or the
+// message has failed MaxAttempts times, at which point it is dead-lettered and left in the database for
+// inspection. Messages for the same room are always delivered in the order they were queued. A message is
+// sent as soon as it has been stored, unless earlier messages for its room are still waiting.
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MaxAttempts is the number of failed delivery attempts after which a message is dead-lettered.
+const MaxAttempts = 10
+
+const (
+	// The delay before the first retry. Each subsequent retry doubles the delay, up to maxBackoff.
+	minBackoff = 2 * time.Second
+	maxBackoff = 10 * time.Minute
+	// How long to wait before re-checking the outbox when there is nothing scheduled.
+	idleInterval = time.Minute
+)
+
+var (
+	loadClient func(userID id.UserID) (types.MatrixClient, error)
+	wake       = make(chan struct{}, 1)
+
+	idMutex sync.Mutex
+	lastID  int64
+
+	roomLocksMutex sync.Mutex
+	roomLocks      = make(map[string]*roomLock) // user_id + room_id => lock
+)
+
+type roomLock struct {
+	sync.Mutex
+	users int // the number of goroutines holding or waiting for the lock
+}
+
+// SetClients sets a pool of clients to deliver queued messages with.
+func SetClients(clis *clients.Clients) {
+	loadClient = func(userID id.UserID) (types.MatrixClient, error) {
+		cli, err := clis.Client(userID)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	}
+}
+
+// Start delivering queued messages, including any left over from a previous run.
+func Start() error {
+	if loadClient == nil {
+		return fmt.Errorf("outbox: SetClients must be called before Start")
+	}
+	go deliveryLoop()
+	return nil
+}
+
+// Queue persists a message event to be sent into a room as the given service's user, and wakes up the
+// delivery loop. Returns the ID of the queued message.
+func Queue(service types.Service, roomID id.RoomID, eventType mevt.Type, content interface{}) (string, error) {
+	msg, err := queue(service.ServiceID(), service.ServiceUserID(), roomID, eventType, content)
+	if err != nil {
+		return "", err
+	}
+	wakeDeliveryLoop()
+	return msg.ID, nil
+}
+
+func queue(serviceID string, userID id.UserID, roomID id.RoomID, eventType mevt.Type, content interface{}) (types.OutboxMessage, error) {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return types.OutboxMessage{}, err
+	}
+	msg := types.OutboxMessage{
+		ID:          nextMessageID(),
+		ServiceID:   serviceID,
+		UserID:      userID,
+		RoomID:      roomID,
+		EventType:   eventType.Type,
+		Content:     contentJSON,
+		NextAttempt: time.Now(),
+	}
+	return msg, database.GetServiceDB().QueueOutboxMessage(msg)
+}
+
+func wakeDeliveryLoop() {
+	select {
+	case wake <- struct{}{}:
+	default: // the delivery loop has already been woken up
+	}
+}
+
+// Client wraps a MatrixClient so that message events are queued in the outbox rather than sent directly.
+// All other calls are passed through to the wrapped client.
+type Client struct {
+	types.MatrixClient
+	serviceID string
+	userID    id.UserID
+}
+
+// NewClient returns a Client which queues message events on behalf of the given service.
+func NewClient(service types.Service, cli types.MatrixClient) *Client {
+	return &Client{cli, service.ServiceID(), service.ServiceUserID()}
+}
+
+// NewUserClient returns a Client which queues message events sent as the given user. The service ID is
+// recorded with each message, and is empty for messages which don't come from a single service, such as
+// command responses. It is a clients.OutboxFunc.
+func NewUserClient(serviceID string, userID id.UserID, cli types.MatrixClient) types.MatrixClient {
+	return &Client{cli, serviceID, userID}
+}
+
+// SendMessageEvent queues the event, then sends it straight away with the wrapped client unless earlier
+// messages for the room are still waiting to be delivered. If it is sent, the response contains its event ID.
+// Otherwise it is left in the outbox to be retried, and the response has an empty event ID, as the event
+// does not exist yet. Any extra request parameters are ignored.
+func (c *Client) SendMessageEvent(roomID id.RoomID, eventType mevt.Type, contentJSON interface{},
+	extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+
+	msg, err := queue(c.serviceID, c.userID, roomID, eventType, contentJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &mautrix.RespSendEvent{EventID: deliverNow(msg, c.MatrixClient)}, nil
+}
+
+// deliverNow sends a message which has just been queued, if it is at the head of its room's queue. Returns
+// the event ID, or an empty ID if the message has been left for the delivery loop.
+func deliverNow(msg types.OutboxMessage, cli types.MatrixClient) id.EventID {
+	unlock := lockRoom(msg.UserID, msg.RoomID)
+	defer unlock()
+	older, err := database.GetServiceDB().HasOlderOutboxMessage(msg.UserID, msg.RoomID, msg.ID)
+	if err != nil {
+		log.WithError(err).WithField("message_id", msg.ID).Error("Failed to check for older outbox messages")
+	}
+	if err != nil || older {
+		wakeDeliveryLoop()
+		return ""
+	}
+	eventID, err := deliver(&msg, time.Now(), func(id.UserID) (types.MatrixClient, error) {
+		return cli, nil
+	})
+	if err != nil {
+		// Make sure the delivery loop knows when to retry it
+		wakeDeliveryLoop()
+	}
+	return eventID
+}
+
+// lockRoom stops messages to the same room being delivered by deliverNow and the delivery loop at once.
+// Returns the function to unlock the room.
+func lockRoom(userID id.UserID, roomID id.RoomID) func() {
+	key := userID.String() + " " + roomID.String()
+	roomLocksMutex.Lock()
+	l, ok := roomLocks[key]
+	if !ok {
+		l = &roomLock{}
+		roomLocks[key] = l
+	}
+	l.users++
+	roomLocksMutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		roomLocksMutex.Lock()
+		if l.users--; l.users == 0 {
+			delete(roomLocks, key)
+		}
+		roomLocksMutex.Unlock()
+	}
+}
+
+// nextMessageID returns a new message ID. IDs are zero-padded timestamps so that they sort in the order
+// they were created, even across restarts.
+func nextMessageID() string {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	ts := time.Now().UnixNano()
+	if ts <= lastID {
+		ts = lastID + 1
+	}
+	lastID = ts
+	return fmt.Sprintf("neb_outbox_%020d", ts)
+}
+
+// deliveryLoop delivers queued messages forever. Call this as a goroutine!
+func deliveryLoop() {
+	for {
+		wait := idleInterval
+		if next := deliverDue(time.Now()); !next.IsZero() {
+			wait = time.Until(next)
+		}
+		select {
+		case <-wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliverDue attempts to send every message which is due, stopping at the first message in each room
+// which cannot be sent yet so that room ordering is preserved. Returns the time when a message is next
+// due to be retried, or the zero time if nothing is waiting to be retried.
+func deliverDue(now time.Time) (next time.Time) {
+	msgs, err := database.GetServiceDB().LoadOutboxMessages(false)
+	if err != nil {
+		log.WithError(err).Error("Failed to load outbox messages")
+		return now.Add(minBackoff)
+	}
+
+	blockedRooms := make(map[string]bool) // user_id + room_id => true
+	for _, msg := range msgs {
+		key := msg.UserID.String() + " " + msg.RoomID.String()
+		if blockedRooms[key] {
+			continue
+		}
+		if msg.NextAttempt.After(now) {
+			blockedRooms[key] = true
+			next = earliest(next, msg.NextAttempt)
+			continue
+		}
+		if err := deliverQueued(&msg, now); err != nil {
+			if msg.DeadLettered {
+				// let the next message for this room through
+				continue
+			}
+			blockedRooms[key] = true
+			next = earliest(next, msg.NextAttempt)
+		}
+	}
+	return
+}
+
+// deliverQueued sends a message with the client for its user. If deliverNow is sending a message to the
+// same room at the same time, the message may be sent twice, but the homeserver ignores the second
+// attempt as it has the same transaction ID.
+func deliverQueued(msg *types.OutboxMessage, now time.Time) error {
+	unlock := lockRoom(msg.UserID, msg.RoomID)
+	defer unlock()
+	_, err := deliver(msg, now, loadClient)
+	return err
+}
+
+// deliver sends a single message, and returns its event ID. On failure, the message is updated with its
+// next retry time or dead-lettered, and the error is returned.
+func deliver(msg *types.OutboxMessage, now time.Time, load func(id.UserID) (types.MatrixClient, error)) (id.EventID, error) {
+	logger := log.WithFields(log.Fields{
+		"message_id": msg.ID,
+		"service_id": msg.ServiceID,
+		"user_id":    msg.UserID,
+		"room_id":    msg.RoomID,
+		"attempts":   msg.Attempts,
+	})
+	var resp *mautrix.RespSendEvent
+	cli, err := load(msg.UserID)
+	if err == nil {
+		evType := mevt.Type{Type: msg.EventType, Class: mevt.MessageEventType}
+		resp, err = cli.SendMessageEvent(msg.RoomID, evType, msg.Content, mautrix.ReqSendEvent{TransactionID: msg.ID})
+	}
+	if err == nil {
+		metrics.IncrementOutbox(metrics.StatusSuccess)
+		if err := database.GetServiceDB().DeleteOutboxMessage(msg.ID); err != nil {
+			logger.WithError(err).Error("Failed to remove delivered message from the outbox")
+		}
+		return resp.EventID, nil
+	}
+
+	metrics.IncrementOutbox(metrics.StatusFailure)
+	msg.Attempts++
+	msg.LastError = err.Error()
+	if msg.Attempts >= MaxAttempts {
+		msg.DeadLettered = true
+		logger.WithError(err).Error("Failed to deliver message, dead-lettering")
+	} else {
+		msg.NextAttempt = now.Add(backoff(msg.Attempts))
+		logger.WithError(err).WithField("next_attempt", msg.NextAttempt).Warn("Failed to deliver message, will retry")
+	}
+	if dbErr := database.GetServiceDB().UpdateOutboxMessage(*msg); dbErr != nil {
+		logger.WithError(dbErr).Error("Failed to update outbox message")
+	}
+	return "", err
+}
+
+// backoff returns how long to wait before retrying a message which has failed the given number of times.
+func backoff(attempts int) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,205 @@
+package outbox
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type MockStore struct {
+	database.NopStorage
+	msgs map[string]types.OutboxMessage
+}
+
+func (d *MockStore) QueueOutboxMessage(msg types.OutboxMessage) error {
+	d.msgs[msg.ID] = msg
+	return nil
+}
+
+func (d *MockStore) UpdateOutboxMessage(msg types.OutboxMessage) error {
+	d.msgs[msg.ID] = msg
+	return nil
+}
+
+func (d *MockStore) DeleteOutboxMessage(messageID string) error {
+	delete(d.msgs, messageID)
+	return nil
+}
+
+func (d *MockStore) LoadOutboxMessages(deadLettered bool) (msgs []types.OutboxMessage, err error) {
+	for _, msg := range d.msgs {
+		if msg.DeadLettered == deadLettered {
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].RoomID < msgs[j].RoomID || (msgs[i].RoomID == msgs[j].RoomID && msgs[i].ID < msgs[j].ID)
+	})
+	return
+}
+
+func (d *MockStore) HasOlderOutboxMessage(userID id.UserID, roomID id.RoomID, messageID string) (bool, error) {
+	for _, msg := range d.msgs {
+		if msg.UserID == userID && msg.RoomID == roomID && msg.ID < messageID && !msg.DeadLettered {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type MockClient struct {
+	types.MatrixClient
+	down map[id.RoomID]bool
+	sent map[id.RoomID][]string
+}
+
+func (c *MockClient) SendMessageEvent(roomID id.RoomID, eventType mevt.Type, content interface{},
+	extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+	if c.down[roomID] {
+		return nil, fmt.Errorf("homeserver is down")
+	}
+	c.sent[roomID] = append(c.sent[roomID], extra[0].TransactionID)
+	return &mautrix.RespSendEvent{EventID: id.EventID("$" + extra[0].TransactionID)}, nil
+}
+
+func TestDelivery(t *testing.T) {
+	store := &MockStore{msgs: make(map[string]types.OutboxMessage)}
+	database.SetServiceDB(store)
+	cli := &MockClient{
+		down: map[id.RoomID]bool{"!down:localhost": true},
+		sent: make(map[id.RoomID][]string),
+	}
+	loadClient = func(userID id.UserID) (types.MatrixClient, error) {
+		return cli, nil
+	}
+	srv := types.NewDefaultService("service_id", "@neb:localhost", "test")
+
+	var upIDs, downIDs []string
+	for i := 0; i < 3; i++ {
+		msgID, err := Queue(&srv, "!up:localhost", mevt.EventMessage, map[string]string{"body": "up"})
+		if err != nil {
+			t.Fatalf("Failed to queue message: %s", err)
+		}
+		upIDs = append(upIDs, msgID)
+		msgID, err = Queue(&srv, "!down:localhost", mevt.EventMessage, map[string]string{"body": "down"})
+		if err != nil {
+			t.Fatalf("Failed to queue message: %s", err)
+		}
+		downIDs = append(downIDs, msgID)
+	}
+
+	now := time.Now()
+	next := deliverDue(now)
+	if len(cli.sent["!up:localhost"]) != 3 {
+		t.Fatalf("Expected 3 messages to be delivered, got %d", len(cli.sent["!up:localhost"]))
+	}
+	for i, msgID := range cli.sent["!up:localhost"] {
+		if msgID != upIDs[i] {
+			t.Errorf("Message %d delivered out of order: got %s want %s", i, msgID, upIDs[i])
+		}
+	}
+	if !next.Equal(now.Add(minBackoff)) {
+		t.Errorf("Wrong next attempt time: got %s want %s", next, now.Add(minBackoff))
+	}
+	// only the first message in the room which is down should have been tried
+	if store.msgs[downIDs[0]].Attempts != 1 || store.msgs[downIDs[1]].Attempts != 0 {
+		t.Errorf("Expected only the head of the room to be attempted")
+	}
+
+	// Nothing is due until the backoff expires
+	deliverDue(now.Add(minBackoff / 2))
+	if store.msgs[downIDs[0]].Attempts != 1 {
+		t.Errorf("Message was retried before its backoff expired")
+	}
+
+	for i := 1; i < MaxAttempts; i++ {
+		now = store.msgs[downIDs[0]].NextAttempt
+		deliverDue(now)
+	}
+	if !store.msgs[downIDs[0]].DeadLettered {
+		t.Fatalf("Expected message to be dead-lettered after %d attempts", MaxAttempts)
+	}
+	if store.msgs[downIDs[1]].Attempts != 1 {
+		t.Errorf("Expected next message in the room to be attempted after dead-lettering the head")
+	}
+
+	cli.down["!down:localhost"] = false
+	deliverDue(store.msgs[downIDs[1]].NextAttempt)
+	if len(cli.sent["!down:localhost"]) != 2 {
+		t.Fatalf("Expected 2 messages to be delivered, got %d", len(cli.sent["!down:localhost"]))
+	}
+	if len(store.msgs) != 1 {
+		t.Errorf("Expected only the dead-lettered message to remain, got %d", len(store.msgs))
+	}
+}
+
+func TestClientSendMessageEvent(t *testing.T) {
+	store := &MockStore{msgs: make(map[string]types.OutboxMessage)}
+	database.SetServiceDB(store)
+	mockCli := &MockClient{
+		down: make(map[id.RoomID]bool),
+		sent: make(map[id.RoomID][]string),
+	}
+	loadClient = func(userID id.UserID) (types.MatrixClient, error) {
+		return mockCli, nil
+	}
+	srv := types.NewDefaultService("service_id", "@neb:localhost", "test")
+	cli := NewClient(&srv, mockCli)
+	send := func(roomID id.RoomID) id.EventID {
+		resp, err := cli.SendMessageEvent(roomID, mevt.EventMessage, map[string]string{"body": "hi"})
+		if err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		return resp.EventID
+	}
+
+	// Sent straight away, with the event ID from the homeserver
+	if eventID := send("!room:localhost"); len(mockCli.sent["!room:localhost"]) != 1 ||
+		eventID != id.EventID("$"+mockCli.sent["!room:localhost"][0]) {
+		t.Errorf("Expected the message to be delivered immediately, got event ID %q", eventID)
+	}
+	if len(store.msgs) != 0 {
+		t.Errorf("Expected the delivered message to be removed from the outbox, got %d", len(store.msgs))
+	}
+
+	// Left in the outbox when the homeserver is down, and anything after it waits its turn
+	mockCli.down["!room:localhost"] = true
+	if eventID := send("!room:localhost"); eventID != "" {
+		t.Errorf("Expected an empty event ID for an undelivered message, got %q", eventID)
+	}
+	mockCli.down["!room:localhost"] = false
+	if eventID := send("!room:localhost"); eventID != "" || len(mockCli.sent["!room:localhost"]) != 1 {
+		t.Errorf("Expected the message to be queued behind the undelivered one, got event ID %q", eventID)
+	}
+	if eventID := send("!other:localhost"); eventID == "" {
+		t.Errorf("Expected a message for another room to be delivered immediately")
+	}
+	if len(store.msgs) != 2 {
+		t.Fatalf("Expected 2 messages to be queued, got %d", len(store.msgs))
+	}
+
+	deliverDue(time.Now().Add(minBackoff))
+	if len(mockCli.sent["!room:localhost"]) != 3 || len(store.msgs) != 0 {
+		t.Errorf("Expected the queued messages to be delivered, got %d sent and %d queued",
+			len(mockCli.sent["!room:localhost"]), len(store.msgs))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if backoff(1) != minBackoff {
+		t.Errorf("backoff(1) = %s, want %s", backoff(1), minBackoff)
+	}
+	if backoff(3) != 4*minBackoff {
+		t.Errorf("backoff(3) = %s, want %s", backoff(3), 4*minBackoff)
+	}
+	if backoff(100) != maxBackoff {
+		t.Errorf("backoff(100) = %s, want %s", backoff(100), maxBackoff)
+	}
+}
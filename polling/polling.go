@@ -7,6 +7,7 @@ import (
 
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/outbox"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 )
@@ -97,7 +98,7 @@ func pollLoop(service types.Service, ts int64) {
 	}
 	for {
 		logger.Info("OnPoll")
-		nextTime := poller.OnPoll(cli)
+		nextTime := poller.OnPoll(outbox.NewClient(service, cli))
 		if pollTimeChanged(service, ts) {
 			logger.Info("Terminating poll.")
 			break
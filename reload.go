@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/api/handlers"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// configReloader re-reads the config file and applies the differences to the running process, so that
+// config changes do not require a restart which would drop sync state.
+type configReloader struct {
+	db        *database.ServiceDB
+	clients   *clients.Clients
+	configure *handlers.ConfigureService
+	path      string
+
+	mu      sync.Mutex
+	applied *api.ConfigFile // the config which is currently running
+	modTime time.Time
+}
+
+func newConfigReloader(db *database.ServiceDB, clis *clients.Clients, path string, applied *api.ConfigFile) *configReloader {
+	r := &configReloader{
+		db:        db,
+		clients:   clis,
+		configure: handlers.NewConfigureService(db, clis),
+		path:      path,
+		applied:   applied,
+	}
+	if fi, err := os.Stat(path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+	return r
+}
+
+// watchSignals reloads the config whenever the process receives SIGHUP. Does not return, so call
+// this as a goroutine!
+func (r *configReloader) watchSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		log.WithField("config_file", r.path).Info("Received SIGHUP, reloading config file")
+		if err := r.reload(); err != nil {
+			log.WithError(err).WithField("config_file", r.path).Error("Failed to reload config file")
+		}
+	}
+}
+
+// watchFile reloads the config whenever the modification time of the config file changes. Does not
+// return, so call this as a goroutine!
+func (r *configReloader) watchFile(interval time.Duration) {
+	for range time.Tick(interval) {
+		fi, err := os.Stat(r.path)
+		if err != nil {
+			log.WithError(err).WithField("config_file", r.path).Warn("Failed to stat config file")
+			continue
+		}
+		r.mu.Lock()
+		changed := !fi.ModTime().Equal(r.modTime)
+		r.mu.Unlock()
+		if !changed {
+			continue
+		}
+		log.WithField("config_file", r.path).Info("Config file changed, reloading")
+		if err := r.reload(); err != nil {
+			log.WithError(err).WithField("config_file", r.path).Error("Failed to reload config file")
+		}
+	}
+}
+
+// reload loads the config file and applies it. If the file cannot be loaded, nothing is changed. If
+// individual services fail to be configured they are left as they were and an error is returned once
+// everything else has been applied.
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if fi, err := os.Stat(r.path); err == nil {
+		// Remember this even if the load fails so a broken file isn't retried until it changes again.
+		r.modTime = fi.ModTime()
+	}
+	cfg, err := loadFromConfig(r.db, r.path)
+	if err != nil {
+		return err
+	}
+	if errs := handlers.ValidateConfigFile(cfg); len(errs) > 0 {
+		for _, err := range errs {
+			log.WithError(err).WithField("config_file", r.path).Error("Invalid config")
+		}
+		return fmt.Errorf("config file is invalid: %d error(s)", len(errs))
+	}
+
+	if err := r.updateClients(cfg.Clients); err != nil {
+		return err
+	}
+	if err := r.db.InsertFromConfig(cfg); err != nil {
+		return err
+	}
+	r.removeSessions(cfg.Sessions)
+	r.removeRealms(cfg.Realms)
+
+	services, failed := r.updateServices(cfg.Services)
+	r.removeClients(cfg.Clients)
+	// Services which failed keep running with their old config, so remember that rather than
+	// the new one, otherwise they wouldn't be retried on the next reload.
+	applied := *cfg
+	applied.Services = services
+	r.applied = &applied
+
+	log.WithFields(log.Fields{
+		"clients":  len(cfg.Clients),
+		"realms":   len(cfg.Realms),
+		"sessions": len(cfg.Sessions),
+		"services": len(cfg.Services),
+	}).Info("Reloaded config file")
+	if failed > 0 {
+		return fmt.Errorf("%d service(s) failed to update", failed)
+	}
+	return nil
+}
+
+// updateClients updates clients whose config has changed, restarting their /sync streams.
+func (r *configReloader) updateClients(cfgs []api.ClientConfig) error {
+	stored, err := r.db.LoadMatrixClientConfigs()
+	if err != nil {
+		return err
+	}
+	for _, c := range changedClients(stored, cfgs) {
+		log.WithField("user_id", c.UserID).Info("Updating client")
+		if _, err := r.clients.Update(c); err != nil {
+			return fmt.Errorf("config: Client %s : %s", c.UserID, err)
+		}
+	}
+	return nil
+}
+
+// changedClients returns the client configs which are new or differ from the stored configs.
+func changedClients(stored, cfgs []api.ClientConfig) (changed []api.ClientConfig) {
+	storedByUserID := make(map[id.UserID]api.ClientConfig)
+	for _, c := range stored {
+		storedByUserID[c.UserID] = c
+	}
+	for _, c := range cfgs {
+		old, ok := storedByUserID[c.UserID]
+		c.KeepLogin(old)
+		if ok && reflect.DeepEqual(old, c) {
+			continue
+		}
+		changed = append(changed, c)
+	}
+	return
+}
+
+// removeClients stops and removes clients which are no longer in the config. Clients which are still
+// in use by a service are kept.
+func (r *configReloader) removeClients(cfgs []api.ClientConfig) {
+	for _, c := range removedClients(r.applied.Clients, cfgs) {
+		logger := log.WithField("user_id", c.UserID)
+		srvs, err := r.db.LoadServicesForUser(c.UserID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to load services for client")
+			continue
+		}
+		if len(srvs) > 0 {
+			logger.Warn("Not removing client as it is still in use by services")
+			continue
+		}
+		logger.Info("Removing client")
+		if err := r.clients.Remove(c.UserID); err != nil {
+			logger.WithError(err).Error("Failed to remove client")
+		}
+	}
+}
+
+// removedClients returns the applied client configs which are no longer in the config.
+func removedClients(applied, cfgs []api.ClientConfig) (removed []api.ClientConfig) {
+	keep := make(map[id.UserID]bool)
+	for _, c := range cfgs {
+		keep[c.UserID] = true
+	}
+	for _, c := range applied {
+		if !keep[c.UserID] {
+			removed = append(removed, c)
+		}
+	}
+	return
+}
+
+// removeSessions removes auth sessions which are no longer in the config.
+func (r *configReloader) removeSessions(cfgs []api.Session) {
+	for _, s := range removedSessions(r.applied.Sessions, cfgs) {
+		if err := r.db.RemoveAuthSession(s.RealmID, s.UserID); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"realm_id": s.RealmID,
+				"user_id":  s.UserID,
+			}).Error("Failed to remove auth session")
+		}
+	}
+}
+
+// removedSessions returns the applied sessions which are no longer in the config.
+func removedSessions(applied, cfgs []api.Session) (removed []api.Session) {
+	keep := make(map[string]bool) // realm_id + user_id => true
+	for _, s := range cfgs {
+		keep[s.RealmID+" "+s.UserID.String()] = true
+	}
+	for _, s := range applied {
+		if !keep[s.RealmID+" "+s.UserID.String()] {
+			removed = append(removed, s)
+		}
+	}
+	return
+}
+
+// removeRealms removes auth realms which are no longer in the config, along with their sessions.
+func (r *configReloader) removeRealms(cfgs []api.ConfigureAuthRealmRequest) {
+	for _, realm := range removedRealms(r.applied.Realms, cfgs) {
+		logger := log.WithField("realm_id", realm.ID)
+		logger.Info("Removing auth realm")
+		if err := r.db.DeleteAuthRealm(realm.ID); err != nil {
+			logger.WithError(err).Error("Failed to remove auth realm")
+		}
+	}
+}
+
+// removedRealms returns the applied realm configs which are no longer in the config.
+func removedRealms(applied, cfgs []api.ConfigureAuthRealmRequest) (removed []api.ConfigureAuthRealmRequest) {
+	keep := make(map[string]bool)
+	for _, realm := range cfgs {
+		keep[realm.ID] = true
+	}
+	for _, realm := range applied {
+		if !keep[realm.ID] {
+			removed = append(removed, realm)
+		}
+	}
+	return
+}
+
+// updateServices registers services which are new or have changed, and tears down services which
+// are no longer in the config. Returns the service configs which are now running and the number of
+// services which failed to be updated.
+func (r *configReloader) updateServices(reqs []api.ConfigureServiceRequest) (running []api.ConfigureServiceRequest, failed int) {
+	diff := diffServices(r.applied.Services, reqs)
+	running = diff.unchanged
+	for i, s := range diff.changed {
+		prev, existed := diff.previous[s.ID]
+		if err := r.configureService(s); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"service_id": s.ID,
+				"index":      i,
+			}).Error("Failed to update service")
+			failed++
+			if existed {
+				running = append(running, prev)
+			}
+			continue
+		}
+		running = append(running, s)
+	}
+
+	for _, s := range diff.removed {
+		logger := log.WithFields(log.Fields{
+			"service_id":   s.ID,
+			"service_type": s.Type,
+		})
+		old, err := r.db.LoadService(s.ID)
+		if err != nil {
+			// It may have deleted itself in PostRegister
+			logger.WithError(err).Warn("Failed to load removed service")
+			continue
+		}
+		logger.Info("Removing service")
+		handlers.TeardownService(old, r.clients)
+		if err := r.db.DeleteService(s.ID); err != nil {
+			logger.WithError(err).Error("Failed to delete service")
+			failed++
+			running = append(running, s)
+		}
+	}
+	return
+}
+
+// serviceDiff is how the services in a new config differ from the applied ones.
+type serviceDiff struct {
+	unchanged []api.ConfigureServiceRequest
+	// New services, and services whose config has changed.
+	changed []api.ConfigureServiceRequest
+	// The applied configs of changed services which were already running, by service ID.
+	previous map[string]api.ConfigureServiceRequest
+	removed  []api.ConfigureServiceRequest
+}
+
+// diffServices compares the services in the config with the applied ones.
+func diffServices(applied, reqs []api.ConfigureServiceRequest) serviceDiff {
+	diff := serviceDiff{previous: make(map[string]api.ConfigureServiceRequest)}
+	appliedByID := make(map[string]api.ConfigureServiceRequest)
+	for _, s := range applied {
+		appliedByID[s.ID] = s
+	}
+	keep := make(map[string]bool)
+	for _, s := range reqs {
+		keep[s.ID] = true
+		prev, existed := appliedByID[s.ID]
+		if existed && reflect.DeepEqual(prev, s) {
+			diff.unchanged = append(diff.unchanged, s)
+			continue
+		}
+		if existed {
+			diff.previous[s.ID] = prev
+		}
+		diff.changed = append(diff.changed, s)
+	}
+	for _, s := range applied {
+		if !keep[s.ID] {
+			diff.removed = append(diff.removed, s)
+		}
+	}
+	return diff
+}
+
+// configFileActor is the actor recorded in the audit log for changes made by reloading the config file.
+const configFileActor = "config-file"
+
+// configureService registers and stores a new or changed service, in the same way as /configureService.
+func (r *configReloader) configureService(s api.ConfigureServiceRequest) error {
+	if err := s.Check(); err != nil {
+		return err
+	}
+	service, err := types.CreateService(s.ID, s.Type, s.UserID, s.Config)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"service_id":   s.ID,
+		"service_type": s.Type,
+	}).Info("Updating service")
+	_, err = r.configure.Apply(service, "reloadConfig", configFileActor, "")
+	return err
+}
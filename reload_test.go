@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+)
+
+func TestConfigReloadChangedClients(t *testing.T) {
+	stored := []api.ClientConfig{
+		{UserID: "@a:hs", HomeserverURL: "https://hs", AccessToken: "a_token"},
+		{UserID: "@b:hs", HomeserverURL: "https://hs", Password: "b_pass", DeviceID: "B", AccessToken: "b_token"},
+	}
+	testCases := []struct {
+		name string
+		cfgs []api.ClientConfig
+		want string
+	}{
+		{"unchanged", []api.ClientConfig{
+			{UserID: "@a:hs", HomeserverURL: "https://hs", AccessToken: "a_token"},
+		}, ""},
+		{"added", []api.ClientConfig{
+			{UserID: "@a:hs", HomeserverURL: "https://hs", AccessToken: "a_token"},
+			{UserID: "@c:hs", HomeserverURL: "https://hs", AccessToken: "c_token"},
+		}, "@c:hs"},
+		{"updated", []api.ClientConfig{
+			{UserID: "@a:hs", HomeserverURL: "https://hs", AccessToken: "a_token", Sync: true},
+		}, "@a:hs"},
+		{"same password keeps its login", []api.ClientConfig{
+			{UserID: "@b:hs", HomeserverURL: "https://hs", Password: "b_pass"},
+		}, ""},
+		{"new password logs in again", []api.ClientConfig{
+			{UserID: "@b:hs", HomeserverURL: "https://hs", Password: "new_pass"},
+		}, "@b:hs"},
+		{"removed", nil, ""},
+	}
+	for _, tc := range testCases {
+		var got []string
+		for _, c := range changedClients(stored, tc.cfgs) {
+			got = append(got, c.UserID.String())
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("%s: got changed clients %v, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConfigReloadRemovedClients(t *testing.T) {
+	applied := []api.ClientConfig{
+		{UserID: "@a:hs", HomeserverURL: "https://hs", AccessToken: "a_token"},
+		{UserID: "@b:hs", HomeserverURL: "https://hs", AccessToken: "b_token"},
+	}
+	testCases := []struct {
+		name string
+		cfgs []api.ClientConfig
+		want string
+	}{
+		{"unchanged", applied, ""},
+		{"added", append(applied, api.ClientConfig{UserID: "@c:hs"}), ""},
+		{"updated", []api.ClientConfig{
+			{UserID: "@a:hs", HomeserverURL: "https://other", AccessToken: "a_token"},
+			{UserID: "@b:hs", HomeserverURL: "https://hs", AccessToken: "new_token"},
+		}, ""},
+		{"removed", []api.ClientConfig{applied[1]}, "@a:hs"},
+		{"all removed", nil, "@a:hs,@b:hs"},
+	}
+	for _, tc := range testCases {
+		var got []string
+		for _, c := range removedClients(applied, tc.cfgs) {
+			got = append(got, c.UserID.String())
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("%s: got removed clients %v, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConfigReloadRemovedSessions(t *testing.T) {
+	applied := []api.Session{
+		{SessionID: "1", RealmID: "github", UserID: "@a:hs", Config: json.RawMessage(`{}`)},
+		{SessionID: "2", RealmID: "github", UserID: "@b:hs", Config: json.RawMessage(`{}`)},
+		{SessionID: "3", RealmID: "jira", UserID: "@a:hs", Config: json.RawMessage(`{}`)},
+	}
+	testCases := []struct {
+		name string
+		cfgs []api.Session
+		want string
+	}{
+		{"unchanged", applied, ""},
+		{"added", append(applied, api.Session{SessionID: "4", RealmID: "jira", UserID: "@b:hs"}), ""},
+		{"updated", []api.Session{
+			{SessionID: "5", RealmID: "github", UserID: "@a:hs", Config: json.RawMessage(`{"new":true}`)},
+			applied[1], applied[2],
+		}, ""},
+		{"removed", []api.Session{applied[0], applied[2]}, "2"},
+		{"removed from one realm", []api.Session{applied[1], applied[2]}, "1"},
+		{"all removed", nil, "1,2,3"},
+	}
+	for _, tc := range testCases {
+		var got []string
+		for _, s := range removedSessions(applied, tc.cfgs) {
+			got = append(got, s.SessionID)
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("%s: got removed sessions %v, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConfigReloadRemovedRealms(t *testing.T) {
+	applied := []api.ConfigureAuthRealmRequest{
+		{ID: "github", Type: "github", Config: json.RawMessage(`{}`)},
+		{ID: "jira", Type: "jira", Config: json.RawMessage(`{}`)},
+	}
+	testCases := []struct {
+		name string
+		cfgs []api.ConfigureAuthRealmRequest
+		want string
+	}{
+		{"unchanged", applied, ""},
+		{"added", append(applied, api.ConfigureAuthRealmRequest{ID: "new", Type: "github"}), ""},
+		{"updated", []api.ConfigureAuthRealmRequest{
+			{ID: "github", Type: "github", Config: json.RawMessage(`{"new":true}`)},
+			applied[1],
+		}, ""},
+		{"removed", []api.ConfigureAuthRealmRequest{applied[1]}, "github"},
+		{"all removed", nil, "github,jira"},
+	}
+	for _, tc := range testCases {
+		var got []string
+		for _, realm := range removedRealms(applied, tc.cfgs) {
+			got = append(got, realm.ID)
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("%s: got removed realms %v, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConfigReloadDiffServices(t *testing.T) {
+	applied := []api.ConfigureServiceRequest{
+		{ID: "echo", Type: "echo", UserID: "@a:hs", Config: json.RawMessage(`{}`)},
+		{ID: "rss", Type: "rssbot", UserID: "@a:hs", Config: json.RawMessage(`{"feeds":{}}`)},
+	}
+	testCases := []struct {
+		name          string
+		reqs          []api.ConfigureServiceRequest
+		wantUnchanged string
+		wantChanged   string
+		wantPrevious  string
+		wantRemoved   string
+	}{
+		{"unchanged", applied, "echo,rss", "", "", ""},
+		{"added", append(applied, api.ConfigureServiceRequest{ID: "new", Type: "echo", UserID: "@b:hs"}),
+			"echo,rss", "new", "", ""},
+		{"updated config", []api.ConfigureServiceRequest{
+			applied[0],
+			{ID: "rss", Type: "rssbot", UserID: "@a:hs", Config: json.RawMessage(`{"feeds":{"x":{}}}`)},
+		}, "echo", "rss", "rss", ""},
+		{"updated user", []api.ConfigureServiceRequest{
+			{ID: "echo", Type: "echo", UserID: "@b:hs", Config: json.RawMessage(`{}`)},
+			applied[1],
+		}, "rss", "echo", "echo", ""},
+		{"removed", []api.ConfigureServiceRequest{applied[1]}, "rss", "", "", "echo"},
+		{"all removed", nil, "", "", "", "echo,rss"},
+	}
+	ids := func(srvs []api.ConfigureServiceRequest) string {
+		var s []string
+		for _, srv := range srvs {
+			s = append(s, srv.ID)
+		}
+		return strings.Join(s, ",")
+	}
+	for _, tc := range testCases {
+		diff := diffServices(applied, tc.reqs)
+		var previous []api.ConfigureServiceRequest
+		for _, s := range diff.changed {
+			if prev, ok := diff.previous[s.ID]; ok {
+				previous = append(previous, prev)
+			}
+		}
+		if got := ids(diff.unchanged); got != tc.wantUnchanged {
+			t.Errorf("%s: got unchanged services %q, want %q", tc.name, got, tc.wantUnchanged)
+		}
+		if got := ids(diff.changed); got != tc.wantChanged {
+			t.Errorf("%s: got changed services %q, want %q", tc.name, got, tc.wantChanged)
+		}
+		if got := ids(previous); got != tc.wantPrevious {
+			t.Errorf("%s: got previously running services %q, want %q", tc.name, got, tc.wantPrevious)
+		}
+		if got := ids(diff.removed); got != tc.wantRemoved {
+			t.Errorf("%s: got removed services %q, want %q", tc.name, got, tc.wantRemoved)
+		}
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	html "html/template"
 	"net/http"
+	"sort"
 	"strings"
 	text "text/template"
+	"time"
 
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/types"
@@ -20,6 +22,17 @@ import (
 // ServiceType of the Alertmanager service.
 const ServiceType = "alertmanager"
 
+// The reaction which silences the alerts in a notification.
+const silenceKey = "✅"
+
+// The key in notifications which holds what to silence when someone reacts with silenceKey.
+const silenceContentKey = "org.matrix.go_neb.alertmanager.silence"
+
+// The default length of silences created by reactions.
+const defaultSilenceDuration = time.Hour
+
+var httpClient = &http.Client{}
+
 // Service contains the Config fields for the Alertmanager service.
 //
 // This service will send notifications into a Matrix room when Alertmanager sends
@@ -32,6 +45,10 @@ const ServiceType = "alertmanager"
 //
 // You can set msg_type to either m.text or m.notice
 //
+// If alertmanager_url is set, notifications of firing alerts get a ✅ reaction. Operators in the
+// room can react with ✅ to silence the alerts in the notification for silence_duration, which
+// defaults to 1h.
+//
 // Example JSON request:
 //    {
 //        rooms: {
@@ -40,7 +57,13 @@ const ServiceType = "alertmanager"
 //                "html_template": "your html template goes here",
 //                "msg_type": "m.text"
 //            },
-//        }
+//        },
+//        "verification": {
+//            "method": "bearer",
+//            "secret": "the bearer_token from alertmanager's http_config"
+//        },
+//        "alertmanager_url": "https://alertmanager.example.com",
+//        "silence_duration": "2h"
 //    }
 type Service struct {
 	types.DefaultService
@@ -53,6 +76,43 @@ type Service struct {
 		HTMLTemplate string           `json:"html_template"`
 		MsgType      mevt.MessageType `json:"msg_type"`
 	} `json:"rooms"`
+	// Optional. How to verify that incoming webhook requests come from Alertmanager. Alertmanager can
+	// be configured to send a bearer token with the "bearer_token" option in its http_config.
+	Verification *types.WebhookVerification `json:"verification,omitempty"`
+	// Optional. The URL of the Alertmanager API, used to create silences when users react to notifications.
+	AlertmanagerURL string `json:"alertmanager_url,omitempty"`
+	// Optional. How long silences created by reactions last, e.g. "2h". Defaults to 1h.
+	SilenceDuration string `json:"silence_duration,omitempty"`
+}
+
+// notificationContent is a notification with the labels to silence if someone reacts to it.
+type notificationContent struct {
+	mevt.MessageEventContent
+	Silence *silenceMarker `json:"org.matrix.go_neb.alertmanager.silence,omitempty"`
+}
+
+// silenceMarker is what to silence when someone reacts to a notification.
+type silenceMarker struct {
+	// The service which sent the notification, in case a bot has more than one Alertmanager service.
+	ServiceID string            `json:"service_id"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// silenceMatcher is a matcher of a silence in the Alertmanager v2 API.
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+// postableSilence is a new silence in the Alertmanager v2 API.
+type postableSilence struct {
+	Matchers  []silenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	CreatedBy string           `json:"createdBy"`
+	Comment   string           `json:"comment"`
 }
 
 // WebhookNotification is the payload from Alertmanager
@@ -98,8 +158,17 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		alert.SilenceURL = fmt.Sprintf("%s#silences/new?filter={%s}", notif.ExternalURL, strings.Join(filters, ","))
 	}
 
+	// Only offer to silence firing alerts, by the labels they all share
+	var silence *silenceMarker
+	if s.AlertmanagerURL != "" && notif.Status == "firing" && len(notif.CommonLabels) > 0 {
+		silence = &silenceMarker{
+			ServiceID: s.ServiceID(),
+			Labels:    notif.CommonLabels,
+		}
+	}
+
 	for roomID, templates := range s.Rooms {
-		var msg interface{}
+		var msg mevt.MessageEventContent
 		// we don't check whether the templates parse because we already did when storing them in the db
 		textTemplate, _ := text.New("textTemplate").Parse(templates.TextTemplate)
 		var bodyBuffer bytes.Buffer
@@ -134,17 +203,132 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 			"message": msg,
 			"room_id": roomID,
 		}).Print("Sending Alertmanager notification to room")
-		if _, e := cli.SendMessageEvent(roomID, mevt.EventMessage, msg); e != nil {
+		resp, e := cli.SendMessageEvent(roomID, mevt.EventMessage, notificationContent{msg, silence})
+		if e != nil {
 			log.WithError(e).WithField("room_id", roomID).Print(
 				"Failed to send Alertmanager notification to room.")
+			continue
+		}
+		if silence != nil && resp.EventID == "" {
+			// The homeserver is unavailable, so the notification was left in the outbox to be retried
+			log.WithField("room_id", roomID).Print(
+				"Alertmanager notification was queued, not adding silence reaction.")
+		} else if silence != nil {
+			if e = types.AddReactionButtons(cli, roomID, resp.EventID, silenceKey); e != nil {
+				log.WithError(e).WithField("room_id", roomID).Print(
+					"Failed to add silence reaction to Alertmanager notification.")
+			}
 		}
 	}
 	w.WriteHeader(200)
 }
 
+// Reactions returns the reaction which silences the alerts in a notification.
+func (s *Service) Reactions(cli types.MatrixClient) []types.Reaction {
+	return []types.Reaction{
+		{
+			Keys: []string{silenceKey},
+			Help: "Silence the alerts in a notification",
+			Role: types.RoleOperator,
+			React: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, key string, target *mevt.Event) (interface{}, error) {
+				return s.silence(userID, target)
+			},
+		},
+	}
+}
+
+// silence creates a silence for the alerts in a notification, if it is one of this service's.
+func (s *Service) silence(userID id.UserID, target *mevt.Event) (interface{}, error) {
+	if s.AlertmanagerURL == "" {
+		return nil, nil
+	}
+	raw, ok := target.Content.Raw[silenceContentKey]
+	if !ok {
+		return nil, nil
+	}
+	var marker silenceMarker
+	b, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(b, &marker)
+	}
+	if err != nil || marker.ServiceID != s.ServiceID() || len(marker.Labels) == 0 {
+		return nil, nil
+	}
+
+	duration := defaultSilenceDuration
+	if s.SilenceDuration != "" {
+		// Checked by ValidateConfig
+		duration, _ = time.ParseDuration(s.SilenceDuration)
+	}
+	now := time.Now().UTC()
+	silence := postableSilence{
+		StartsAt:  now,
+		EndsAt:    now.Add(duration),
+		CreatedBy: userID.String(),
+		Comment:   fmt.Sprintf("Silenced by %s reacting to a notification in Matrix", userID),
+	}
+	var filters []string
+	for name, value := range marker.Labels {
+		silence.Matchers = append(silence.Matchers, silenceMatcher{Name: name, Value: value, IsEqual: true})
+		filters = append(filters, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Slice(silence.Matchers, func(i, j int) bool {
+		return silence.Matchers[i].Name < silence.Matchers[j].Name
+	})
+	sort.Strings(filters)
+
+	body, err := json.Marshal(silence)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient.Post(strings.TrimSuffix(s.AlertmanagerURL, "/")+"/api/v2/silences", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create silence: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Failed to create silence: Alertmanager returned HTTP %d", res.StatusCode)
+	}
+	var created struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&created); err != nil {
+		return nil, fmt.Errorf("Failed to create silence: %s", err)
+	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body: fmt.Sprintf("Silenced {%s} for %s (silence %s)",
+			strings.Join(filters, ", "), duration, created.SilenceID),
+	}, nil
+}
+
+// WebhookVerification returns how to verify incoming webhook requests, if at all.
+func (s *Service) WebhookVerification() *types.WebhookVerification {
+	return s.Verification
+}
+
 // Register makes sure the Config information supplied is valid.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
 	s.WebhookURL = s.webhookEndpointURL
+	if err := s.ValidateConfig(); err != nil {
+		return err
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// ValidateConfig checks the verification config and that the templates for each room parse.
+func (s *Service) ValidateConfig() error {
+	if s.Verification != nil {
+		if err := s.Verification.Check(); err != nil {
+			return err
+		}
+	}
+	if s.SilenceDuration != "" {
+		if d, err := time.ParseDuration(s.SilenceDuration); err != nil || d <= 0 {
+			return fmt.Errorf("silence_duration must be a positive duration like 2h")
+		}
+	}
 	for _, templates := range s.Rooms {
 		// validate that we have at least a plain text template
 		if templates.TextTemplate == "" {
@@ -169,7 +353,6 @@ func (s *Service) Register(oldService types.Service, client types.MatrixClient)
 			return fmt.Errorf("msg_type is neither 'm.notice' nor 'm.text'")
 		}
 	}
-	s.joinRooms(client)
 	return nil
 }
 
@@ -11,8 +11,10 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/outbox"
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
@@ -183,3 +185,101 @@ func checkSilenceLine(t *testing.T, line string, expectedKeys map[string]string)
 		t.Errorf("number of filter fields got %d, want %d", matched, len(expectedKeys))
 	}
 }
+
+func TestSilenceReaction(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var silence postableSilence
+	alertmanager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v2/silences" {
+			t.Errorf("Unexpected Alertmanager request to %s", req.URL.Path)
+		}
+		json.NewDecoder(req.Body).Decode(&silence)
+		w.Write([]byte(`{"silenceID":"abc123"}`))
+	}))
+	defer alertmanager.Close()
+
+	// Keep the raw content of messages and reactions the bot sends
+	var sent []map[string]interface{}
+	var paths []string
+	homeserverDown := false
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if homeserverDown {
+			paths = append(paths, req.URL.Path)
+			return &http.Response{
+				StatusCode: 502,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		sent = append(sent, content)
+		paths = append(paths, req.URL.Path)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$notification:hs"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", "alertmanager", "@neb:hs", []byte(fmt.Sprintf(`{
+		"rooms":{ "!testroom:id" : { "text_template": "{{.Status}}", "msg_type": "m.text" }},
+		"alertmanager_url": %q,
+		"silence_duration": "2h"
+	}`, alertmanager.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notify := func() {
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(`{
+			"status": "firing",
+			"commonLabels": {"alertname": "DiskFull", "instance": "db1"},
+			"alerts": [{"status": "firing", "labels": {"alertname": "DiskFull", "instance": "db1"}}]
+		}`))
+		// Webhook handlers are given a client which sends through the outbox
+		srv.OnReceiveWebhook(httptest.NewRecorder(), req, outbox.NewClient(srv, matrixCli))
+	}
+	notify()
+
+	if len(sent) != 2 || !strings.Contains(paths[1], "/send/m.reaction/") {
+		t.Fatalf("Expected a notification and a reaction, got %v", paths)
+	}
+	relatesTo, _ := sent[1]["m.relates_to"].(map[string]interface{})
+	if relatesTo["key"] != silenceKey || relatesTo["event_id"] != "$notification:hs" {
+		t.Errorf("Expected a %s reaction to the notification, got %v", silenceKey, sent[1])
+	}
+
+	target := &mevt.Event{Sender: "@neb:hs", Content: mevt.Content{Raw: sent[0]}}
+	reaction := srv.(types.ReactionHandler).Reactions(matrixCli)[0]
+	content, err := reaction.React("!testroom:id", "$reaction:hs", "@alice:hs", silenceKey, target)
+	if err != nil {
+		t.Fatalf("Failed to silence: %s", err)
+	}
+	want := `Silenced {alertname="DiskFull", instance="db1"} for 2h0m0s (silence abc123)`
+	if msg, ok := content.(mevt.MessageEventContent); !ok || msg.Body != want {
+		t.Errorf("Expected %q, got %v", want, content)
+	}
+	if len(silence.Matchers) != 2 || silence.Matchers[0] != (silenceMatcher{"alertname", "DiskFull", false, true}) ||
+		silence.CreatedBy != "@alice:hs" || silence.EndsAt.Sub(silence.StartsAt) != 2*time.Hour {
+		t.Errorf("Unexpected silence %+v", silence)
+	}
+
+	// Messages without a silence aren't handled
+	content, err = reaction.React("!testroom:id", "$reaction:hs", "@alice:hs", silenceKey, &mevt.Event{Sender: "@neb:hs"})
+	if content != nil || err != nil {
+		t.Errorf("Expected other messages to be ignored, got %v %v", content, err)
+	}
+
+	// Notifications left in the outbox have no event ID to react to
+	homeserverDown = true
+	paths = nil
+	notify()
+	if len(paths) != 1 || strings.Contains(paths[0], "/send/m.reaction/") {
+		t.Errorf("Expected only the notification to be attempted, got %v", paths)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/outbox"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix"
@@ -274,53 +275,57 @@ func (s *Service) cmdForwardRoomKey(botClient *clients.BotClient, roomID id.Room
 //    !forward_me_room_key	Asks the bot to forward a room key to the sender
 // This service can be used for testing other clients by writing the commands above in a room where this service is enabled.
 func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	// Messages are sent through the outbox, but the commands need the crypto state of the client itself
+	if queued, ok := cli.(*outbox.Client); ok {
+		cli = queued.MatrixClient
+	}
 	botClient := cli.(*clients.BotClient)
 	return []types.Command{
 		{
 			Path: []string{"crypto_help"},
-			Command: func(roomID id.RoomID, userID id.UserID, arguments []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (interface{}, error) {
 				return s.cmdCryptoHelp(roomID)
 			},
 		},
 		{
 			Path: []string{"crypto_challenge"},
-			Command: func(roomID id.RoomID, userID id.UserID, arguments []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (interface{}, error) {
 				return s.cmdCryptoChallenge(roomID, arguments)
 			},
 		},
 		{
 			Path: []string{"crypto_response"},
-			Command: func(roomID id.RoomID, userID id.UserID, arguments []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (interface{}, error) {
 				return s.cmdCryptoResponse(userID, roomID, arguments)
 			},
 		},
 		{
 			Path: []string{"crypto_new_session"},
-			Command: func(roomID id.RoomID, userID id.UserID, arguments []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (interface{}, error) {
 				return s.cmdCryptoNewSession(botClient, roomID)
 			},
 		},
 		{
 			Path: []string{"sas_verify_me"},
-			Command: func(roomID id.RoomID, userID id.UserID, arguments []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (interface{}, error) {
 				return s.cmdSASVerifyMe(botClient, roomID, userID, arguments)
 			},
 		},
 		{
 			Path: []string{"sas_decimal_code"},
-			Command: func(roomID id.RoomID, userID id.UserID, arguments []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (interface{}, error) {
 				return s.cmdSASVerifyDecimalCode(botClient, roomID, userID, arguments)
 			},
 		},
 		{
 			Path: []string{"request_my_room_key"},
-			Command: func(roomID id.RoomID, userID id.UserID, arguments []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (interface{}, error) {
 				return s.cmdRequestRoomKey(botClient, roomID, userID, arguments)
 			},
 		},
 		{
 			Path: []string{"forward_me_room_key"},
-			Command: func(roomID id.RoomID, userID id.UserID, arguments []string) (interface{}, error) {
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (interface{}, error) {
 				return s.cmdForwardRoomKey(botClient, roomID, userID, arguments)
 			},
 		},
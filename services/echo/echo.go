@@ -23,8 +23,10 @@ type Service struct {
 func (e *Service) Commands(cli types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
-			Path: []string{"echo"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Path:      []string{"echo"},
+			Arguments: []string{"message"},
+			Help:      "Repeat the message",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				return &mevt.MessageEventContent{
 					MsgType: mevt.MsgNotice,
 					Body:    strings.Join(args, " "),
@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
@@ -64,16 +63,16 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		types.Command{
 			Path: []string{"giphy"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
-				return s.cmdGiphy(client, roomID, userID, args)
+			Args: []types.Arg{{Name: "query", Variadic: true}},
+			Help: "Search for a GIF",
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+				return s.cmdGiphy(client, roomID, userID, args.String("query"))
 			},
 		},
 	}
 }
 
-func (s *Service) cmdGiphy(client types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
-	// only 1 arg which is the text to search for.
-	query := strings.Join(args, " ")
+func (s *Service) cmdGiphy(client types.MatrixClient, roomID id.RoomID, userID id.UserID, query string) (interface{}, error) {
 	gifResult, err := s.searchGiphy(query)
 	if err != nil {
 		return nil, err
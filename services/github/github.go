@@ -7,6 +7,7 @@ package github
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -92,18 +93,10 @@ func (s *Service) requireGithubClientFor(userID id.UserID) (cli *gogithub.Client
 }
 
 const numberGithubSearchSummaries = 3
-const cmdGithubSearchUsage = `!github search "search query"`
 
-func (s *Service) cmdGithubSearch(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+func (s *Service) cmdGithubSearch(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 	cli := s.githubClientFor(userID, true)
-	if len(args) < 2 {
-		return &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Usage: " + cmdGithubSearchUsage,
-		}, nil
-	}
-
-	query := strings.Join(args, " ")
+	query := args.String("query")
 	searchResult, res, err := cli.Search.Issues(context.Background(), query, nil)
 
 	if err != nil {
@@ -147,66 +140,102 @@ func (s *Service) cmdGithubSearch(roomID id.RoomID, userID id.UserID, args []str
 	}, nil
 }
 
-const cmdGithubCreateUsage = `!github create [owner/repo] "issue title" "description"`
-
-func (s *Service) cmdGithubCreate(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+func (s *Service) cmdGithubCreate(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 	cli, resp, err := s.requireGithubClientFor(userID)
 	if cli == nil {
 		return resp, err
 	}
-	if len(args) == 0 {
-		return &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Usage: " + cmdGithubCreateUsage,
-		}, nil
-	}
 
-	// We expect the args to look like:
-	// [ "owner/repo", "title text", "desc text" ]
-	// They can omit the owner/repo if there is a default one set.
-	// Look for a default if the first arg doesn't look like an owner/repo
-	ownerRepoGroups := ownerRepoRegex.FindStringSubmatch(args[0])
-
-	if len(ownerRepoGroups) == 0 {
-		// look for a default repo
-		defaultRepo := s.defaultRepo(roomID)
-		if defaultRepo == "" {
+	// The repo can be omitted if there is a default one set.
+	repo := args.String("repo")
+	if repo == "" {
+		if repo = s.defaultRepo(roomID); repo == "" {
 			return &mevt.MessageEventContent{
 				MsgType: mevt.MsgNotice,
-				Body:    "Need to specify repo. Usage: " + cmdGithubCreateUsage,
+				Body:    "Need to specify repo, or set a default repo for the room",
 			}, nil
 		}
-		// default repo should pass the regexp
-		ownerRepoGroups = ownerRepoRegex.FindStringSubmatch(defaultRepo)
-		if len(ownerRepoGroups) == 0 {
-			return &mevt.MessageEventContent{
-				MsgType: mevt.MsgNotice, Body: "Malformed default repo. Usage: " + cmdGithubCreateUsage}, nil
-		}
+	}
+	ownerRepoGroups := ownerRepoRegex.FindStringSubmatch(repo)
+	if len(ownerRepoGroups) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice, Body: "Malformed repo " + repo}, nil
+	}
 
-		// insert the default as the first arg to reuse the same indices
-		args = append([]string{defaultRepo}, args...)
-		// continue through now that ownerRepoGroups has matching groups
+	title := args.String("title")
+	req := &gogithub.IssueRequest{Title: &title}
+	if args.Has("description") {
+		desc := args.String("description")
+		req.Body = &desc
 	}
+	if args.Has("labels") {
+		var labels []string
+		for _, label := range strings.Split(args.String("labels"), ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				labels = append(labels, label)
+			}
+		}
+		req.Labels = &labels
+	}
+	return createIssue(cli, ownerRepoGroups[1], ownerRepoGroups[2], req)
+}
 
-	var (
-		title *string
-		desc  *string
+// createIssueDialog asks for the repository (if the room has no default), title, description and
+// labels of a new issue, for when !github create is sent on its own.
+func (s *Service) createIssueDialog(roomID id.RoomID, userID id.UserID) *types.Dialog {
+	if s.githubClientFor(userID, false) == nil {
+		return nil // cmdGithubCreate will ask them to log in
+	}
+	var questions []types.Question
+	defaultRepo := s.defaultRepo(roomID)
+	if defaultRepo == "" {
+		questions = append(questions, types.Question{
+			Arg:    types.Arg{Name: "repo"},
+			Prompt: "Which repository should the issue be created in, e.g. owner/repo?",
+			Validate: func(answer interface{}) error {
+				if !ownerRepoRegex.MatchString(answer.(string)) {
+					return fmt.Errorf("repo must look like owner/repo")
+				}
+				return nil
+			},
+		})
+	}
+	questions = append(questions,
+		types.Question{Arg: types.Arg{Name: "title"}, Prompt: "What should the issue be called?"},
+		types.Question{Arg: types.Arg{Name: "description", Optional: true}, Prompt: "How would you describe it?"},
+		types.Question{Arg: types.Arg{Name: "labels", Optional: true, Variadic: true}, Prompt: "Which labels should it have?"},
 	)
-
-	if len(args) == 2 {
-		title = &args[1]
-	} else if len(args) == 3 {
-		title = &args[1]
-		desc = &args[2]
-	} else { // > 3 args is probably a title without quote marks
-		joinedTitle := strings.Join(args[1:], " ")
-		title = &joinedTitle
+	return &types.Dialog{
+		Questions: questions,
+		Done: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, answers *types.ParsedArgs) (interface{}, error) {
+			cli, resp, err := s.requireGithubClientFor(userID)
+			if cli == nil {
+				return resp, err
+			}
+			repo := answers.String("repo")
+			if repo == "" {
+				repo = defaultRepo
+			}
+			ownerRepoGroups := ownerRepoRegex.FindStringSubmatch(repo)
+			if len(ownerRepoGroups) == 0 {
+				return nil, fmt.Errorf("Malformed repo %s", repo)
+			}
+			title := answers.String("title")
+			req := &gogithub.IssueRequest{Title: &title}
+			if answers.Has("description") {
+				desc := answers.String("description")
+				req.Body = &desc
+			}
+			if labels := answers.Strings("labels"); len(labels) > 0 {
+				req.Labels = &labels
+			}
+			return createIssue(cli, ownerRepoGroups[1], ownerRepoGroups[2], req)
+		},
 	}
+}
 
-	issue, res, err := cli.Issues.Create(context.Background(), ownerRepoGroups[1], ownerRepoGroups[2], &gogithub.IssueRequest{
-		Title: title,
-		Body:  desc,
-	})
+func createIssue(cli *gogithub.Client, owner, repo string, req *gogithub.IssueRequest) (interface{}, error) {
+	issue, res, err := cli.Issues.Create(context.Background(), owner, repo, req)
 	if err != nil {
 		log.WithField("err", err).Print("Failed to create issue")
 		if res == nil {
@@ -250,80 +279,112 @@ var cmdGithubReactAliases = map[string]string{
 	"🎉":      "hooray",
 }
 
-const cmdGithubReactUsage = `!github react [owner/repo]#issue (+1|👍|-1|:-1:|laugh|:smile:|confused|uncertain|heart|❤|hooray|:tada:)`
+// The reactions shown in usage messages. Any of cmdGithubReactAliases can be used.
+var cmdGithubReactValues = []string{"+1", "👍", "-1", ":-1:", "laugh", ":smile:", "confused", "uncertain", "heart", "❤", "hooray", ":tada:"}
+
+// The Matrix reactions to issue expansions which are copied to the issue on Github.
+var issueReactionKeys = []string{"👍", "👎", "😄", "😕", "❤", "❤️", "🎉"}
+
+// The key in issue expansions which holds the issue, so that reactions to them can be copied to it.
+const issueContentKey = "org.matrix.go_neb.github.issue"
+
+// issueContent is an issue expansion along with the issue it expands.
+type issueContent struct {
+	mevt.MessageEventContent
+	Issue *issueMarker `json:"org.matrix.go_neb.github.issue,omitempty"`
+}
+
+type issueMarker struct {
+	Owner  string `json:"owner"`
+	Repo   string `json:"repo"`
+	Number int    `json:"number"`
+}
 
-func (s *Service) cmdGithubReact(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+func (s *Service) cmdGithubReact(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 	cli, resp, err := s.requireGithubClientFor(userID)
 	if cli == nil {
 		return resp, err
 	}
-	if len(args) < 2 {
-		return &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice, Body: "Usage: " + cmdGithubReactUsage,
-		}, nil
-	}
 
-	reaction, ok := cmdGithubReactAliases[args[1]]
+	reaction, ok := cmdGithubReactAliases[args.String("reaction")]
 	if !ok {
 		return &mevt.MessageEventContent{
 			MsgType: mevt.MsgNotice,
-			Body:    "Invalid reaction. Usage: " + cmdGithubReactUsage,
+			Body:    "Invalid reaction. Use one of: " + strings.Join(cmdGithubReactValues, " "),
 		}, nil
 	}
 
-	// get owner,repo,issue,resp out of args[0]
-	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubReactUsage)
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args.IssueRef("issue"), roomID)
 	if resp != nil {
 		return resp, nil
 	}
 
-	_, res, err := cli.Reactions.CreateIssueReaction(context.Background(), owner, repo, issueNum, reaction)
-
-	if err != nil {
-		log.WithField("err", err).Print("Failed to react to issue")
-		if res == nil {
-			return nil, fmt.Errorf("Failed to react to issue. Failed to connect to Github")
-		}
-		return nil, fmt.Errorf("Failed to react to issue. HTTP %d", res.StatusCode)
+	if err = reactToIssue(cli, owner, repo, issueNum, reaction); err != nil {
+		return nil, err
 	}
 
 	return mevt.MessageEventContent{
 		MsgType: mevt.MsgNotice,
-		Body:    fmt.Sprintf("Reacted to issue with: %s", args[1]),
+		Body:    fmt.Sprintf("Reacted to issue with: %s", args.String("reaction")),
 	}, nil
 }
 
-const cmdGithubCommentUsage = `!github comment [owner/repo]#issue "comment text"`
+// reactOnIssueExpansion copies a Matrix reaction to an issue expansion onto the issue.
+func (s *Service) reactOnIssueExpansion(userID id.UserID, key string, target *mevt.Event) (interface{}, error) {
+	raw, ok := target.Content.Raw[issueContentKey]
+	if !ok {
+		return nil, nil
+	}
+	var issue issueMarker
+	b, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(b, &issue)
+	}
+	if err != nil || issue.Owner == "" || issue.Repo == "" {
+		return nil, nil
+	}
 
-func (s *Service) cmdGithubComment(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 	cli, resp, err := s.requireGithubClientFor(userID)
 	if cli == nil {
 		return resp, err
 	}
-	if len(args) == 0 {
-		return &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Usage: " + cmdGithubCommentUsage,
-		}, nil
+	if err = reactToIssue(cli, issue.Owner, issue.Repo, issue.Number, cmdGithubReactAliases[key]); err != nil {
+		return nil, err
 	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Reacted to %s/%s#%d with: %s", issue.Owner, issue.Repo, issue.Number, key),
+	}, nil
+}
 
-	// get owner,repo,issue,resp out of args[0]
-	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubCommentUsage)
-	if resp != nil {
-		return resp, nil
+func reactToIssue(cli *gogithub.Client, owner, repo string, issueNum int, reaction string) error {
+	_, res, err := cli.Reactions.CreateIssueReaction(context.Background(), owner, repo, issueNum, reaction)
+
+	if err != nil {
+		log.WithField("err", err).Print("Failed to react to issue")
+		if res == nil {
+			return fmt.Errorf("Failed to react to issue. Failed to connect to Github")
+		}
+		return fmt.Errorf("Failed to react to issue. HTTP %d", res.StatusCode)
 	}
+	return nil
+}
 
-	var comment *string
+func (s *Service) cmdGithubComment(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(userID)
+	if cli == nil {
+		return resp, err
+	}
 
-	if len(args) == 2 {
-		comment = &args[1]
-	} else { // > 2 args is probably a comment without quote marks
-		joinedComment := strings.Join(args[1:], " ")
-		comment = &joinedComment
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args.IssueRef("issue"), roomID)
+	if resp != nil {
+		return resp, nil
 	}
 
+	comment := args.String("comment")
+
 	issueComment, res, err := cli.Issues.CreateComment(context.Background(), owner, repo, issueNum, &gogithub.IssueComment{
-		Body: comment,
+		Body: &comment,
 	})
 
 	if err != nil {
@@ -340,32 +401,18 @@ func (s *Service) cmdGithubComment(roomID id.RoomID, userID id.UserID, args []st
 	}, nil
 }
 
-const cmdGithubAssignUsage = `!github assign [owner/repo]#issue username [username] [...]`
-
-func (s *Service) cmdGithubAssign(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+func (s *Service) cmdGithubAssign(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 	cli, resp, err := s.requireGithubClientFor(userID)
 	if cli == nil {
 		return resp, err
 	}
-	if len(args) < 1 {
-		return &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Usage: " + cmdGithubAssignUsage,
-		}, nil
-	} else if len(args) < 2 {
-		return &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Needs at least one username. Usage: " + cmdGithubAssignUsage,
-		}, nil
-	}
 
-	// get owner,repo,issue,resp out of args[0]
-	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubAssignUsage)
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args.IssueRef("issue"), roomID)
 	if resp != nil {
 		return resp, nil
 	}
 
-	issue, res, err := cli.Issues.AddAssignees(context.Background(), owner, repo, issueNum, args[1:])
+	issue, res, err := cli.Issues.AddAssignees(context.Background(), owner, repo, issueNum, args.Strings("username"))
 
 	if err != nil {
 		log.WithField("err", err).Print("Failed to add issue assignees")
@@ -381,20 +428,13 @@ func (s *Service) cmdGithubAssign(roomID id.RoomID, userID id.UserID, args []str
 	}, nil
 }
 
-func (s *Service) githubIssueCloseReopen(roomID id.RoomID, userID id.UserID, args []string, state, verb, help string) (interface{}, error) {
+func (s *Service) githubIssueCloseReopen(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs, state, verb string) (interface{}, error) {
 	cli, resp, err := s.requireGithubClientFor(userID)
 	if cli == nil {
 		return resp, err
 	}
-	if len(args) == 0 {
-		return &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Usage: " + help,
-		}, nil
-	}
 
-	// get owner,repo,issue,resp out of args[0]
-	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, help)
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args.IssueRef("issue"), roomID)
 	if resp != nil {
 		return resp, nil
 	}
@@ -417,52 +457,25 @@ func (s *Service) githubIssueCloseReopen(roomID id.RoomID, userID id.UserID, arg
 	}, nil
 }
 
-const cmdGithubCloseUsage = `!github close [owner/repo]#issue`
-
-func (s *Service) cmdGithubClose(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
-	return s.githubIssueCloseReopen(roomID, userID, args, "closed", "close", cmdGithubCloseUsage)
+func (s *Service) cmdGithubClose(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+	return s.githubIssueCloseReopen(roomID, userID, args, "closed", "close")
 }
 
-const cmdGithubReopenUsage = `!github reopen [owner/repo]#issue`
-
-func (s *Service) cmdGithubReopen(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
-	return s.githubIssueCloseReopen(roomID, userID, args, "open", "open", cmdGithubCloseUsage)
+func (s *Service) cmdGithubReopen(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+	return s.githubIssueCloseReopen(roomID, userID, args, "open", "open")
 }
 
-func (s *Service) getIssueDetailsFor(input string, roomID id.RoomID, usage string) (owner, repo string, issueNum int, resp interface{}) {
-	// We expect the input to look like:
-	// "[owner/repo]#issue"
-	// They can omit the owner/repo if there is a default one set.
-	// Look for a default if the first arg is just an issue number
-	ownerRepoIssueGroups := ownerRepoIssueRegexAnchored.FindStringSubmatch(input)
-
-	if len(ownerRepoIssueGroups) != 5 {
-		resp = &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Usage: " + usage,
-		}
-		return
-	}
-
-	owner = ownerRepoIssueGroups[2]
-	repo = ownerRepoIssueGroups[3]
-
-	var err error
-	if issueNum, err = strconv.Atoi(ownerRepoIssueGroups[4]); err != nil {
-		resp = &mevt.MessageEventContent{
-			MsgType: mevt.MsgNotice,
-			Body:    "Malformed issue number. Usage: " + usage,
-		}
-		return
-	}
-
-	if ownerRepoIssueGroups[1] == "" {
+// getIssueDetailsFor returns the owner, repo and number of an issue reference, using the
+// default repository for the room if the reference is just an issue number.
+func (s *Service) getIssueDetailsFor(ref types.IssueRef, roomID id.RoomID) (owner, repo string, issueNum int, resp interface{}) {
+	owner, repo, issueNum = ref.Owner, ref.Repo, ref.Number
+	if owner == "" {
 		// issue only match, this only works if there is a default repo
 		defaultRepo := s.defaultRepo(roomID)
 		if defaultRepo == "" {
 			resp = &mevt.MessageEventContent{
 				MsgType: mevt.MsgNotice,
-				Body:    "Need to specify repo. Usage: " + usage,
+				Body:    "Need to specify repo, e.g. owner/repo#12, or set a default repo for the room.",
 			}
 			return
 		}
@@ -471,7 +484,7 @@ func (s *Service) getIssueDetailsFor(input string, roomID id.RoomID, usage strin
 		if len(segs) != 2 {
 			resp = &mevt.MessageEventContent{
 				MsgType: mevt.MsgNotice,
-				Body:    "Malformed default repo. Usage: " + usage,
+				Body:    "Malformed default repo: " + defaultRepo,
 			}
 			return
 		}
@@ -495,9 +508,12 @@ func (s *Service) expandIssue(roomID id.RoomID, userID id.UserID, owner, repo st
 		return nil
 	}
 
-	return &mevt.MessageEventContent{
-		MsgType: mevt.MsgNotice,
-		Body:    fmt.Sprintf("%s : %s", *i.HTMLURL, *i.Title),
+	return &issueContent{
+		MessageEventContent: mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("%s : %s", *i.HTMLURL, *i.Title),
+		},
+		Issue: &issueMarker{owner, repo, issueNum},
 	}
 }
 
@@ -554,77 +570,120 @@ func (s *Service) expandCommit(roomID id.RoomID, userID id.UserID, owner, repo,
 }
 
 // Commands supported:
-//    !github create owner/repo "issue title" "optional issue description"
+//    !github create [owner/repo] "issue title" ["issue description"] [--labels bug,help]
 // Responds with the outcome of the issue creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
-// is no link, it will return a Starter Link instead.
+// is no link, it will return a Starter Link instead. Sending "!github create" on its
+// own asks for the repository, title, description and labels one message at a time.
 //    !github comment [owner/repo]#issue "comment"
 // Responds with the outcome of the issue comment creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
 // is no link, it will return a Starter Link instead.
+//
+// The assign, close and reopen commands also need the "operator" role in the room.
 func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	issueArg := types.Arg{Name: "issue", Type: types.ArgIssueRef, Help: "The issue, or just #issue in rooms with a default repo"}
 	return []types.Command{
 		{
 			Path: []string{"github", "search"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Args: []types.Arg{{Name: "query", Variadic: true}},
+			Help: "Search for issues and pull requests",
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 				return s.cmdGithubSearch(roomID, userID, args)
 			},
 		},
 		{
 			Path: []string{"github", "create"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Args: []types.Arg{
+				{Name: "repo", Type: types.ArgRepo, Optional: true, Help: "Defaults to the room's default repo"},
+				{Name: "title", Help: "The title of the issue, in quotes if it has spaces"},
+				{Name: "description", Optional: true},
+				{Name: "labels", Flag: true, Optional: true, Help: "Labels to add, separated by commas"},
+			},
+			Help: "Create an issue, or send on its own to be asked for the details",
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 				return s.cmdGithubCreate(roomID, userID, args)
 			},
+			Dialog: func(roomID id.RoomID, eventID id.EventID, userID id.UserID) *types.Dialog {
+				return s.createIssueDialog(roomID, userID)
+			},
 		},
 		{
 			Path: []string{"github", "react"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Args: []types.Arg{issueArg, {Name: "reaction", Help: "One of " + strings.Join(cmdGithubReactValues, " ")}},
+			Help: "React to an issue, e.g. with +1, laugh or heart",
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 				return s.cmdGithubReact(roomID, userID, args)
 			},
 		},
 		{
 			Path: []string{"github", "comment"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Args: []types.Arg{issueArg, {Name: "comment", Variadic: true}},
+			Help: "Comment on an issue",
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 				return s.cmdGithubComment(roomID, userID, args)
 			},
 		},
 		{
 			Path: []string{"github", "assign"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Args: []types.Arg{issueArg, {Name: "username", Variadic: true}},
+			Help: "Assign users to an issue",
+			Role: types.RoleOperator,
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 				return s.cmdGithubAssign(roomID, userID, args)
 			},
 		},
 		{
 			Path: []string{"github", "close"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Args: []types.Arg{issueArg},
+			Help: "Close an issue",
+			Role: types.RoleOperator,
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 				return s.cmdGithubClose(roomID, userID, args)
 			},
 		},
 		{
 			Path: []string{"github", "reopen"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Args: []types.Arg{issueArg},
+			Help: "Reopen an issue",
+			Role: types.RoleOperator,
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 				return s.cmdGithubReopen(roomID, userID, args)
 			},
 		},
 		{
 			Path: []string{"github", "help"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Help: "Show usage for the GitHub commands",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
+				var usages []string
+				for _, cmd := range s.Commands(cli) {
+					if cmd.Path[1] != "help" {
+						usages = append(usages, cmd.Usage())
+					}
+				}
 				return &mevt.MessageEventContent{
 					MsgType: mevt.MsgNotice,
-					Body: strings.Join([]string{
-						cmdGithubCreateUsage,
-						cmdGithubReactUsage,
-						cmdGithubCommentUsage,
-						cmdGithubAssignUsage,
-						cmdGithubCloseUsage,
-						cmdGithubReopenUsage,
-					}, "\n"),
+					Body:    strings.Join(usages, "\n"),
 				}, nil
 			},
 		},
 	}
 }
 
+// Reactions copies reactions to issue expansions onto the issue, e.g. reacting with 👍 to an
+// expansion of owner/repo#12 adds a +1 to the issue as the user who reacted.
+func (s *Service) Reactions(cli types.MatrixClient) []types.Reaction {
+	return []types.Reaction{
+		{
+			Keys: issueReactionKeys,
+			Help: "React to the issue on Github",
+			React: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, key string, target *mevt.Event) (interface{}, error) {
+				return s.reactOnIssueExpansion(userID, key, target)
+			},
+		},
+	}
+}
+
 // Expansions expands strings of the form:
 //   owner/repo#12
 // Where #12 is an issue number or pull request. If there is a default repository set on the room,
@@ -635,7 +694,8 @@ func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
 	return []types.Expansion{
 		types.Expansion{
 			Regexp: ownerRepoIssueRegex,
-			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+			Help:   "Issues and pull requests, e.g. owner/repo#12, or #12 in rooms with a default repository",
+			Expand: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, matchingGroups []string) interface{} {
 				// There's an optional group in the regex so matchingGroups can look like:
 				// [foo/bar#55 foo bar 55]
 				// [#55                55]
@@ -677,7 +737,8 @@ func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
 		},
 		types.Expansion{
 			Regexp: ownerRepoCommitRegex,
-			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+			Help:   "Commits, e.g. owner/repo@a123, or @a123 in rooms with a default repository",
+			Expand: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, matchingGroups []string) interface{} {
 				// There's an optional group in the regex so matchingGroups can look like:
 				// [foo/bar@a123 foo bar a123]
 				// [@a123                a123]
@@ -716,11 +777,19 @@ func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
 	}
 }
 
-// Register makes sure that the given realm ID maps to a github realm.
-func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+// ValidateConfig checks that a realm ID has been given.
+func (s *Service) ValidateConfig() error {
 	if s.RealmID == "" {
 		return fmt.Errorf("RealmID is required")
 	}
+	return nil
+}
+
+// Register makes sure that the given realm ID maps to a github realm.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if err := s.ValidateConfig(); err != nil {
+		return err
+	}
 	// check realm exists
 	realm, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
 	if err != nil {
@@ -135,6 +135,14 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 	w.WriteHeader(200)
 }
 
+// ValidateConfig checks that a realm and client user ID have been given.
+func (s *WebhookService) ValidateConfig() error {
+	if s.RealmID == "" || s.ClientUserID == "" {
+		return fmt.Errorf("RealmID and ClientUserID is required")
+	}
+	return nil
+}
+
 // Register will create webhooks for the repos specified in Rooms
 //
 // The hooks made are a delta between the old service and the current configuration. If all webhooks are made,
@@ -146,8 +154,8 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 // Hooks can get out of sync if a user manually deletes a hook in the Github UI. In this case, toggling the repo configuration will
 // force NEB to recreate the hook.
 func (s *WebhookService) Register(oldService types.Service, client types.MatrixClient) error {
-	if s.RealmID == "" || s.ClientUserID == "" {
-		return fmt.Errorf("RealmID and ClientUserID is required")
+	if err := s.ValidateConfig(); err != nil {
+		return err
 	}
 	realm, err := s.loadRealm()
 	if err != nil {
@@ -251,6 +259,24 @@ func (s *WebhookService) PostRegister(oldService types.Service) {
 	}
 }
 
+// Deregister removes the webhooks for every repository this service tracks. All hooks are attempted
+// even if one fails to be removed, and the first error is returned.
+func (s *WebhookService) Deregister(client types.MatrixClient) (err error) {
+	for _, r := range s.repoList() {
+		segs := strings.Split(r, "/")
+		if hookErr := s.deleteHook(segs[0], segs[1]); hookErr != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: hookErr,
+				"repo":       r,
+			}).Warn("Failed to remove webhook")
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+	return
+}
+
 func (s *WebhookService) joinWebhookRooms(client types.MatrixClient) error {
 	for roomID := range s.Rooms {
 		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
@@ -72,20 +72,24 @@ type Service struct {
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
-			Path: []string{"google", "image"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Path:      []string{"google", "image"},
+			Arguments: []string{"search text"},
+			Help:      "Search for an image",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				return s.cmdGoogleImgSearch(client, roomID, userID, args)
 			},
 		},
 		{
 			Path: []string{"google", "help"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Help: "Show usage for the Google commands",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				return usageMessage(), nil
 			},
 		},
 		{
 			Path: []string{"google"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Help: "Show usage for the Google commands",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				return usageMessage(), nil
 			},
 		},
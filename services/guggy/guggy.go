@@ -53,8 +53,10 @@ type Service struct {
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
-			Path: []string{"guggy"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Path:      []string{"guggy"},
+			Arguments: []string{"text"},
+			Help:      "Find a GIF with the text as a caption",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				return s.cmdGuggy(client, roomID, userID, args)
 			},
 		},
@@ -119,13 +119,16 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
 			Path: []string{"imgur", "help"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Help: "Show usage for the Imgur command",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				return usageMessage(), nil
 			},
 		},
 		{
-			Path: []string{"imgur"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Path:      []string{"imgur"},
+			Arguments: []string{"search text"},
+			Help:      "Search for an image",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				return s.cmdImgSearch(client, roomID, userID, args)
 			},
 		},
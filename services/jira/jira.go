@@ -71,11 +71,30 @@ type Service struct {
 			}
 		}
 	}
+	// Optional. How to verify that incoming webhook requests come from JIRA. JIRA can be configured
+	// to sign webhook requests with a shared secret using "hmac-sha256" and the "X-Hub-Signature" header.
+	Verification *types.WebhookVerification
+}
+
+// WebhookVerification returns how to verify incoming webhook requests, if at all.
+func (s *Service) WebhookVerification() *types.WebhookVerification {
+	return s.Verification
+}
+
+// ValidateConfig checks the verification config, if any.
+func (s *Service) ValidateConfig() error {
+	if s.Verification != nil {
+		return s.Verification.Check()
+	}
+	return nil
 }
 
 // Register ensures that the given realm IDs are valid JIRA realms and registers webhooks
 // with those JIRA endpoints.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if err := s.ValidateConfig(); err != nil {
+		return err
+	}
 	// We only ever make 1 JIRA webhook which listens for all projects and then filter
 	// on receive. So we simply need to know if we need to make a webhook or not. We
 	// need to do this for each unique realm.
@@ -96,25 +115,73 @@ func (s *Service) Register(oldService types.Service, client types.MatrixClient)
 	return nil
 }
 
-func (s *Service) cmdJiraCreate(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
-	// E.g jira create PROJ "Issue title" "Issue desc"
-	if len(args) <= 1 {
-		return nil, errors.New("Missing project key (e.g 'ABC') and/or title")
+// Deregister removes the webhook for this service from each JIRA installation it tracks. All hooks are
+// attempted even if one fails to be removed, and the first error is returned.
+func (s *Service) Deregister(client types.MatrixClient) (err error) {
+	for realmID := range projectsAndRealmsToTrack(s) {
+		if hookErr := s.unregisterHook(realmID); hookErr != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: hookErr,
+				"realm_id":   realmID,
+			}).Warn("Failed to remove webhook")
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+	return
+}
+
+func (s *Service) unregisterHook(realmID string) error {
+	realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+	if err != nil {
+		return err
+	}
+	jrealm, ok := realm.(*jira.Realm)
+	if !ok {
+		return errors.New("Realm ID doesn't map to a JIRA realm")
 	}
+	return webhook.UnregisterHook(jrealm, s.ClientUserID, s.webhookEndpointURL)
+}
 
-	if !projectKeyRegex.MatchString(args[0]) {
+func (s *Service) cmdJiraCreate(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+	// E.g jira create PROJ "Issue title" "Issue desc" --type Task
+	if !projectKeyRegex.MatchString(args.String("project")) {
 		return nil, errors.New("Project key must only contain A-Z")
 	}
+	return s.createIssue(userID, args.String("project"), args.String("title"), args.String("description"), args.String("type"))
+}
 
-	pkey := strings.ToUpper(args[0]) // REST API complains if they are not ALL CAPS
+// createIssueDialog asks for the project key, title and description of a new issue, for when
+// !jira create is sent on its own.
+func (s *Service) createIssueDialog() *types.Dialog {
+	return &types.Dialog{
+		Questions: []types.Question{
+			{
+				Arg:    types.Arg{Name: "project"},
+				Prompt: "Which project should the issue be created in, e.g. ABC?",
+				Validate: func(answer interface{}) error {
+					if !projectKeyRegex.MatchString(answer.(string)) {
+						return errors.New("Project key must only contain A-Z")
+					}
+					return nil
+				},
+			},
+			{Arg: types.Arg{Name: "title"}, Prompt: "What should the issue be called?"},
+			{Arg: types.Arg{Name: "description", Optional: true}, Prompt: "How would you describe it?"},
+		},
+		Done: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, answers *types.ParsedArgs) (interface{}, error) {
+			return s.createIssue(userID, answers.String("project"), answers.String("title"), answers.String("description"), "")
+		},
+	}
+}
 
-	title := args[1]
-	desc := ""
-	if len(args) == 3 {
-		desc = args[2]
-	} else if len(args) > 3 { // > 3 args is probably a title without quote marks
-		joinedTitle := strings.Join(args[1:], " ")
-		title = joinedTitle
+// createIssue creates an issue of the given type, or a Bug if issueType is empty.
+func (s *Service) createIssue(userID id.UserID, projectKey, title, desc, issueType string) (interface{}, error) {
+	pkey := strings.ToUpper(projectKey) // REST API complains if they are not ALL CAPS
+	if issueType == "" {
+		// FIXME: This may vary depending on the JIRA install!
+		issueType = "Bug"
 	}
 
 	r, err := s.projectToRealm(userID, pkey)
@@ -133,9 +200,8 @@ func (s *Service) cmdJiraCreate(roomID id.RoomID, userID id.UserID, args []strin
 			Project: gojira.Project{
 				Key: pkey,
 			},
-			// FIXME: This may vary depending on the JIRA install!
 			Type: gojira.IssueType{
-				Name: "Bug",
+				Name: issueType,
 			},
 		},
 	}
@@ -233,21 +299,34 @@ func (s *Service) expandIssue(roomID id.RoomID, userID id.UserID, issueKeyGroups
 }
 
 // Commands supported:
-//    !jira create KEY "issue title" "optional issue description"
+//    !jira create KEY "issue title" ["issue description"] [--type Task]
 // Responds with the outcome of the issue creation request. This command requires
 // a JIRA account to be linked to the Matrix user ID issuing the command. It also
 // requires there to be a project with the given project key (e.g. "KEY") to exist
 // on the linked JIRA account. If there are multiple JIRA accounts which contain the
 // same project key, which project is chosen is undefined. If there
 // is no JIRA account linked to the Matrix user ID, it will return a Starter Link
-// if there is a known public project with that project key.
+// if there is a known public project with that project key. The sender also needs the
+// "operator" role in the room. Sending "!jira create" on its own asks for the project key,
+// title and description one message at a time.
 func (s *Service) Commands(cli types.MatrixClient) []types.Command {
 	return []types.Command{
 		types.Command{
 			Path: []string{"jira", "create"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Args: []types.Arg{
+				{Name: "project", Help: "The project key, e.g. ABC"},
+				{Name: "title", Help: "The title of the issue, in quotes if it has spaces"},
+				{Name: "description", Optional: true},
+				{Name: "type", Flag: true, Optional: true, Help: "The issue type. Defaults to Bug"},
+			},
+			Help: "Create an issue in the JIRA project with this key, or send on its own to be asked for the details",
+			Role: types.RoleOperator,
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
 				return s.cmdJiraCreate(roomID, userID, args)
 			},
+			Dialog: func(roomID id.RoomID, eventID id.EventID, userID id.UserID) *types.Dialog {
+				return s.createIssueDialog()
+			},
 		},
 	}
 }
@@ -262,7 +341,8 @@ func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
 	return []types.Expansion{
 		{
 			Regexp: issueKeyRegex,
-			Expand: func(roomID id.RoomID, userID id.UserID, issueKeyGroups []string) interface{} {
+			Help:   "JIRA issues, e.g. KEY-12",
+			Expand: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, issueKeyGroups []string) interface{} {
 				return s.expandIssue(roomID, userID, issueKeyGroups)
 			},
 		},
@@ -0,0 +1,118 @@
+package jira
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/jira"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type realmStore struct {
+	database.NopStorage
+	realms   map[string]types.AuthRealm
+	sessions map[string]types.AuthSession
+}
+
+func (s *realmStore) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	r, ok := s.realms[realmID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return r, nil
+}
+
+func (s *realmStore) LoadAuthSessionByUser(realmID string, userID id.UserID) (types.AuthSession, error) {
+	sess, ok := s.sessions[realmID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return sess, nil
+}
+
+func TestDeregisterRemovesEveryHook(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	srv, err := types.CreateService("jira-id", ServiceType, "@bot:hs", []byte(`{
+		"ClientUserID": "@alice:hs",
+		"Rooms": {"!room:hs": {"Realms": {
+			"missing": {"Projects": {"ABC": {"Track": true}}},
+			"no_session": {"Projects": {"ABC": {"Track": true}}},
+			"good": {"Projects": {"ABC": {"Track": true}}}
+		}}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to create service: %s", err)
+	}
+	jiraSrv := srv.(*Service)
+
+	var mu sync.Mutex
+	var deleted []string
+	var jiraServer *httptest.Server
+	jiraServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/rest/webhooks/1.0/webhook":
+			json.NewEncoder(w).Encode([]jiraWebhookJSON{{
+				URL:  jiraSrv.webhookEndpointURL,
+				Self: jiraServer.URL + "/rest/webhooks/1.0/webhook/1",
+			}})
+		case req.Method == "DELETE":
+			mu.Lock()
+			deleted = append(deleted, req.URL.Path)
+			mu.Unlock()
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer jiraServer.Close()
+
+	store := &realmStore{
+		realms:   make(map[string]types.AuthRealm),
+		sessions: make(map[string]types.AuthSession),
+	}
+	for _, realmID := range []string{"no_session", "good"} {
+		realm, err := types.CreateAuthRealm(realmID, "jira", []byte(fmt.Sprintf(
+			`{"JIRAEndpoint":%q,"ConsumerKey":"neb","PrivateKeyPEM":%q}`, jiraServer.URL, keyPEM,
+		)))
+		if err != nil {
+			t.Fatalf("Failed to create realm: %s", err)
+		}
+		store.realms[realmID] = realm
+	}
+	sess := store.realms["good"].AuthSession("session", "@alice:hs", "good").(*jira.Session)
+	sess.AccessToken = "token"
+	sess.AccessSecret = "secret"
+	store.sessions["good"] = sess
+	database.SetServiceDB(store)
+
+	err = jiraSrv.Deregister(nil)
+	if err == nil {
+		t.Errorf("Expected an error for the realms which failed")
+	}
+	if strings.Join(deleted, ",") != "/rest/webhooks/1.0/webhook/1" {
+		t.Errorf("Expected the hook to be removed from the good realm, got DELETEs %v", deleted)
+	}
+}
+
+// jiraWebhookJSON is the part of a JIRA webhook which Go-NEB reads.
+type jiraWebhookJSON struct {
+	URL  string `json:"url"`
+	Self string `json:"self"`
+}
@@ -21,7 +21,8 @@ type jiraWebhook struct {
 	Filter  string   `json:"jqlFilter"`
 	Exclude bool     `json:"excludeIssueDetails"`
 	// These fields are populated on GET
-	Enabled bool `json:"enabled"`
+	Enabled bool   `json:"enabled"`
+	Self    string `json:"self"`
 }
 
 // Event represents an incoming JIRA webhook event
@@ -100,6 +101,31 @@ func RegisterHook(jrealm *jira.Realm, projects []string, userID id.UserID, webho
 	return createWebhook(jrealm, webhookEndpointURL, userID)
 }
 
+// UnregisterHook deletes the webhook for the given endpoint from the remote JIRA installation, if it
+// exists. The user must be a JIRA admin to do this.
+func UnregisterHook(jrealm *jira.Realm, userID id.UserID, webhookEndpointURL string) error {
+	logger := log.WithFields(log.Fields{
+		"realm_id": jrealm.ID(),
+		"jira_url": jrealm.JIRAEndpoint,
+		"user_id":  userID,
+	})
+	cli, err := jrealm.JIRAClient(userID, false)
+	if err != nil {
+		logger.WithError(err).Print("No JIRA client exists")
+		return err
+	}
+	wh, _, err := getWebhook(cli, webhookEndpointURL)
+	if err != nil {
+		logger.WithError(err).Print("Failed to GET webhook")
+		return err
+	}
+	if wh == nil {
+		logger.Print("No webhook to remove")
+		return nil
+	}
+	return deleteWebhook(cli, wh)
+}
+
 // OnReceiveRequest is called when JIRA hits NEB with an update.
 // Returns the project key and webhook event, or an error.
 func OnReceiveRequest(req *http.Request) (string, *Event, *util.JSONResponse) {
@@ -156,6 +182,26 @@ func createWebhook(jrealm *jira.Realm, webhookEndpointURL string, userID id.User
 	return err
 }
 
+func deleteWebhook(cli *gojira.Client, wh *jiraWebhook) error {
+	// "self" is the absolute URL of the webhook resource, which resolves to itself.
+	req, err := cli.NewRequest("DELETE", wh.Self, nil)
+	if err != nil {
+		return err
+	}
+	res, err := cli.Do(req, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Deleting webhook returned HTTP %d", res.StatusCode)
+	}
+	log.WithFields(log.Fields{
+		"status_code": res.StatusCode,
+		"webhook":     wh.Self,
+	}).Print("Deleted webhook")
+	return nil
+}
+
 // Get an existing JIRA webhook. Returns the hook if it exists, or an error along with a bool
 // which indicates if the request to retrieve the hook is not 2xx. If it is not 2xx, it is
 // forbidden (different JIRA deployments return different codes ranging from 401/403/404/500).
@@ -100,6 +100,16 @@ type Service struct {
 	} `json:"feeds"`
 }
 
+// ValidateConfig checks that every feed has a room to send updates to. It does not fetch the feeds.
+func (s *Service) ValidateConfig() error {
+	for feedURL, feedInfo := range s.Feeds {
+		if len(feedInfo.Rooms) == 0 {
+			return fmt.Errorf("Feed %s has no rooms to send updates to", feedURL)
+		}
+	}
+	return nil
+}
+
 // Register will check the liveness of each RSS feed given. If all feeds check out okay, no error is returned.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
 	if len(s.Feeds) == 0 {
@@ -116,14 +126,14 @@ func (s *Service) Register(oldService types.Service, client types.MatrixClient)
 		}
 		return nil
 	}
+	if err := s.ValidateConfig(); err != nil {
+		return err
+	}
 	// Make sure we can parse the feed
-	for feedURL, feedInfo := range s.Feeds {
+	for feedURL := range s.Feeds {
 		if _, err := readFeed(feedURL); err != nil {
 			return fmt.Errorf("Failed to read URL %s: %s", feedURL, err.Error())
 		}
-		if len(feedInfo.Rooms) == 0 {
-			return fmt.Errorf("Feed %s has no rooms to send updates to", feedURL)
-		}
 	}
 
 	s.joinRooms(client)
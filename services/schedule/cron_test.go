@@ -0,0 +1,58 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Sunday
+	from := time.Date(2026, time.October, 18, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, time.October, 18, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, time.October, 18, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * MON", time.Date(2026, time.October, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2026, time.October, 19, 9, 0, 0, 0, time.UTC)},
+		{"30 10 * * 0", time.Date(2026, time.October, 25, 10, 30, 0, 0, time.UTC)},
+		{"30 10 * * 7", time.Date(2026, time.October, 25, 10, 30, 0, 0, time.UTC)},
+		{"0 0 1 JAN *", time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"5/20 12 * * *", time.Date(2026, time.October, 18, 12, 5, 0, 0, time.UTC)},
+		{"0 8,17 * * *", time.Date(2026, time.October, 18, 17, 0, 0, 0, time.UTC)},
+		// Day of month or day of week when both are restricted
+		{"0 0 1 * FRI", time.Date(2026, time.October, 23, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		cron, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", test.expr, err)
+			continue
+		}
+		if got := cron.next(from); !got.Equal(test.want) {
+			t.Errorf("next(%q): got %s, want %s", test.expr, got, test.want)
+		}
+	}
+
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("No time zone data")
+	}
+	cron, _ := parseCron("0 9 * * *")
+	want := time.Date(2026, time.October, 19, 8, 0, 0, 0, time.UTC) // BST is UTC+1
+	if got := cron.next(from.In(london)); !got.Equal(want) {
+		t.Errorf("next in London: got %s, want %s", got.UTC(), want)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * FUN", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q): expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+// Package schedule implements a Service which sends messages into rooms at scheduled times.
+package schedule
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Schedule service
+const ServiceType = "schedule"
+
+// How late a recurring message can be sent, e.g. after Go-NEB was restarted. Later runs are
+// skipped rather than sending a stand-up reminder in the afternoon. Reminders are always sent.
+const missedRunGrace = 10 * time.Minute
+
+// The longest a reminder can be set for.
+const maxReminderDelay = 366 * 24 * time.Hour
+
+// How many reminders each user can have waiting at once.
+const maxRemindersPerUser = 10
+
+// Schedules are changed by both commands and polls, which work on different copies of the service,
+// so changes are made to the latest copy in the database while holding this lock.
+var schedulesMutex sync.Mutex
+
+// Schedule is a message to send into a room, either repeatedly on a cron expression or once at a
+// given time.
+type Schedule struct {
+	// The room to send the message to.
+	RoomID id.RoomID `json:"room_id"`
+	// A cron expression of the form "minute hour day-of-month month day-of-week", e.g. "0 9 * * MON-FRI"
+	// for 9am every weekday. Either this or AtMs must be set.
+	Cron string `json:"cron,omitempty"`
+	// When to send the message once, in milliseconds since the epoch.
+	AtMs int64 `json:"at_ms,omitempty"`
+	// A text/template for the message. It is given the RoomID and CreatedBy of the schedule, along
+	// with Now, the time it is sent.
+	Template string `json:"template,omitempty"`
+	// The message to send as it is, instead of a Template. Schedules added with commands use this, so
+	// that users can't run templates.
+	Text string `json:"text,omitempty"`
+	// Optional. m.text or m.notice. Defaults to m.notice.
+	MsgType mevt.MessageType `json:"msg_type,omitempty"`
+	// The user who added the schedule, if it was added with a command.
+	CreatedBy id.UserID `json:"created_by,omitempty"`
+	// When the message will next be sent, in milliseconds since the epoch. Populated by Go-NEB.
+	NextRunMs int64 `json:"next_run_ms,omitempty"`
+}
+
+// templateData is what the template of a schedule is given.
+type templateData struct {
+	RoomID    id.RoomID
+	CreatedBy id.UserID
+	Now       time.Time
+}
+
+// Service contains the Config fields for the Schedule service.
+//
+// This service sends messages into rooms at scheduled times. Schedules can be given in the
+// config, or added with commands:
+//   !schedule add "0 9 * * MON" Stand-up time!
+//   !remind me in 2h Check the deploy
+// Schedules added with commands are stored in the config, so configuring the service again
+// replaces them.
+//
+// Example JSON request:
+//   {
+//       "time_zone": "Europe/London",
+//       "schedules": {
+//           "standup": {
+//               "room_id": "!qmElAGdFYCHoCJuaNt:localhost",
+//               "cron": "0 9 * * MON-FRI",
+//               "template": "Stand-up time! It's {{.Now.Format \"Monday\"}}."
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. The time zone of cron expressions, e.g. "Europe/London". Defaults to UTC.
+	TimeZone string `json:"time_zone,omitempty"`
+	// A map of schedule IDs to schedules. Schedules added with commands have numeric IDs.
+	Schedules map[string]*Schedule `json:"schedules"`
+}
+
+// location returns the time zone of cron expressions.
+func (s *Service) location() *time.Location {
+	if s.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil { // Checked in Register
+		return time.UTC
+	}
+	return loc
+}
+
+// Register makes sure that the schedules are valid and joins their rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return fmt.Errorf("Unknown time_zone %q", s.TimeZone)
+	}
+	for scheduleID, sched := range s.Schedules {
+		if err := sched.check(); err != nil {
+			return fmt.Errorf("Schedule %s: %s", scheduleID, err)
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// check returns an error if the schedule is invalid.
+func (sched *Schedule) check() error {
+	if sched.RoomID == "" {
+		return fmt.Errorf("Missing room_id")
+	}
+	if (sched.Cron == "") == (sched.AtMs == 0) {
+		return fmt.Errorf("Exactly one of cron or at_ms must be set")
+	}
+	if sched.Cron != "" {
+		if _, err := parseCron(sched.Cron); err != nil {
+			return err
+		}
+	}
+	if sched.MsgType != "" && sched.MsgType != mevt.MsgNotice && sched.MsgType != mevt.MsgText {
+		return fmt.Errorf("msg_type is neither 'm.notice' nor 'm.text'")
+	}
+	if sched.Template != "" && sched.Text != "" {
+		return fmt.Errorf("Only one of template or text can be set")
+	}
+	if _, err := template.New("schedule").Parse(sched.Template); err != nil {
+		return fmt.Errorf("template is invalid: %s", err)
+	}
+	return nil
+}
+
+// next returns when the schedule should next run after t, or the zero time if it shouldn't.
+func (sched *Schedule) next(t time.Time, loc *time.Location) time.Time {
+	if sched.Cron == "" {
+		return fromMs(sched.AtMs)
+	}
+	cron, err := parseCron(sched.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	return cron.next(t.In(loc))
+}
+
+// message renders the template of the schedule, or returns its text.
+func (sched *Schedule) message(now time.Time) (*mevt.MessageEventContent, error) {
+	msgType := sched.MsgType
+	if msgType == "" {
+		msgType = mevt.MsgNotice
+	}
+	if sched.Text != "" {
+		return &mevt.MessageEventContent{MsgType: msgType, Body: sched.Text}, nil
+	}
+	tmpl, err := template.New("schedule").Parse(sched.Template)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	if err = tmpl.Execute(&body, templateData{sched.RoomID, sched.CreatedBy, now}); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{MsgType: msgType, Body: body.String()}, nil
+}
+
+// OnPoll sends the messages which are due, then waits until the next minute. Polling every
+// minute picks up schedules added by commands, which the poller's copy of the service can't see.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	now := time.Now()
+	err := s.update(func(latest *Service) error {
+		loc := latest.location()
+		for scheduleID, sched := range latest.Schedules {
+			if sched.NextRunMs == 0 {
+				sched.NextRunMs = toMs(sched.next(now, loc))
+			}
+			if sched.NextRunMs == 0 || now.Before(fromMs(sched.NextRunMs)) {
+				continue
+			}
+			if late := now.Sub(fromMs(sched.NextRunMs)); sched.Cron == "" || late < missedRunGrace {
+				latest.send(cli, scheduleID, sched, now)
+			} else {
+				logger.WithFields(log.Fields{
+					"schedule_id": scheduleID,
+					"late":        late,
+				}).Warn("Skipping missed run of schedule")
+			}
+			if sched.Cron == "" {
+				delete(latest.Schedules, scheduleID)
+				continue
+			}
+			sched.NextRunMs = toMs(sched.next(now, loc))
+		}
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to persist schedules")
+	}
+	return now.Truncate(time.Minute).Add(time.Minute)
+}
+
+func (s *Service) send(cli types.MatrixClient, scheduleID string, sched *Schedule, now time.Time) {
+	logger := log.WithFields(log.Fields{
+		"service_id":  s.ServiceID(),
+		"schedule_id": scheduleID,
+		"room_id":     sched.RoomID,
+	})
+	msg, err := sched.message(now)
+	if err != nil {
+		logger.WithError(err).Error("Failed to render scheduled message")
+		return
+	}
+	logger.Info("Sending scheduled message")
+	if _, err = cli.SendMessageEvent(sched.RoomID, mevt.EventMessage, msg); err != nil {
+		logger.WithError(err).Error("Failed to send scheduled message")
+	}
+}
+
+// update makes a change to the latest schedules in the database and stores them.
+func (s *Service) update(change func(latest *Service) error) error {
+	schedulesMutex.Lock()
+	defer schedulesMutex.Unlock()
+
+	latest := s
+	srv, err := database.GetServiceDB().LoadService(s.ServiceID())
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Warn("Failed to load latest schedules")
+	} else if l, ok := srv.(*Service); ok {
+		latest = l
+	}
+	if latest.Schedules == nil {
+		latest.Schedules = make(map[string]*Schedule)
+	}
+	if err = change(latest); err != nil {
+		return err
+	}
+	s.TimeZone = latest.TimeZone
+	s.Schedules = latest.Schedules
+	_, err = database.GetServiceDB().StoreService(latest)
+	return err
+}
+
+// add adds a schedule and returns its ID.
+func (s *Service) add(sched *Schedule) (scheduleID string, err error) {
+	if err = sched.check(); err != nil {
+		return "", err
+	}
+	err = s.update(func(latest *Service) error {
+		sched.NextRunMs = toMs(sched.next(time.Now(), latest.location()))
+		if sched.NextRunMs == 0 {
+			return fmt.Errorf("%s never happens", sched.Cron)
+		}
+		if sched.AtMs != 0 && sched.CreatedBy != "" {
+			reminders := 0
+			for _, existing := range latest.Schedules {
+				if existing.AtMs != 0 && existing.CreatedBy == sched.CreatedBy {
+					reminders++
+				}
+			}
+			if reminders >= maxRemindersPerUser {
+				return fmt.Errorf("You can only have %d reminders waiting at once", maxRemindersPerUser)
+			}
+		}
+		// Numeric IDs are easier to type in !schedule remove
+		n := 1
+		for existing := range latest.Schedules {
+			if i, err := strconv.Atoi(existing); err == nil && i >= n {
+				n = i + 1
+			}
+		}
+		scheduleID = strconv.Itoa(n)
+		latest.Schedules[scheduleID] = sched
+		return nil
+	})
+	return
+}
+
+func (s *Service) cmdScheduleAdd(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+	sched := &Schedule{
+		RoomID:    roomID,
+		Cron:      args.String("cron"),
+		Text:      args.String("message"),
+		CreatedBy: userID,
+	}
+	scheduleID, err := s.add(sched)
+	if err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Added schedule %s. It will next run at %s", scheduleID, s.formatTime(sched.NextRunMs)),
+	}, nil
+}
+
+func (s *Service) cmdScheduleList(roomID id.RoomID) (interface{}, error) {
+	var ids []string
+	for scheduleID, sched := range s.Schedules {
+		if sched.RoomID == roomID {
+			ids = append(ids, scheduleID)
+		}
+	}
+	if len(ids) == 0 {
+		return &mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "There are no schedules in this room."}, nil
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return s.Schedules[ids[i]].NextRunMs < s.Schedules[ids[j]].NextRunMs
+	})
+	lines := []string{"Schedules:"}
+	for _, scheduleID := range ids {
+		sched := s.Schedules[scheduleID]
+		when := "once"
+		if sched.Cron != "" {
+			when = fmt.Sprintf("%q", sched.Cron)
+		}
+		msg := sched.Template
+		if sched.Text != "" {
+			msg = sched.Text
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s, next at %s - %s", scheduleID, when, s.formatTime(sched.NextRunMs), msg))
+	}
+	return &mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: strings.Join(lines, "\n")}, nil
+}
+
+func (s *Service) cmdScheduleRemove(roomID id.RoomID, args *types.ParsedArgs) (interface{}, error) {
+	scheduleID := args.String("id")
+	err := s.update(func(latest *Service) error {
+		sched, ok := latest.Schedules[scheduleID]
+		if !ok || sched.RoomID != roomID {
+			return fmt.Errorf("There is no schedule %s in this room", scheduleID)
+		}
+		delete(latest.Schedules, scheduleID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Removed schedule " + scheduleID}, nil
+}
+
+func (s *Service) cmdRemind(roomID id.RoomID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+	delay, err := parseDelay(args.String("delay"))
+	if err != nil {
+		return nil, err
+	}
+	// Mention the user so that they are notified, unless the reminder is for the room
+	text := args.String("message")
+	if args.String("who") == "me" {
+		text = userID.String() + ": " + text
+	}
+	sched := &Schedule{
+		RoomID:    roomID,
+		AtMs:      toMs(time.Now().Add(delay)),
+		Text:      text,
+		MsgType:   mevt.MsgText,
+		CreatedBy: userID,
+	}
+	if _, err = s.add(sched); err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("OK, I'll remind %s at %s", map[string]string{"me": "you", "room": "the room"}[args.String("who")], s.formatTime(sched.AtMs)),
+	}, nil
+}
+
+// parseDelay parses how long until a reminder, e.g. "90m", "2h" or "3d".
+func parseDelay(s string) (time.Duration, error) {
+	var delay time.Duration
+	var err error
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n int
+		n, err = strconv.Atoi(days)
+		delay = time.Duration(n) * 24 * time.Hour
+	} else {
+		delay, err = time.ParseDuration(s)
+	}
+	if err != nil || delay <= 0 {
+		return 0, fmt.Errorf("delay must look like 30m, 2h or 3d")
+	}
+	if delay > maxReminderDelay {
+		return 0, fmt.Errorf("Reminders can be set for at most a year")
+	}
+	return delay, nil
+}
+
+func (s *Service) formatTime(ms int64) string {
+	return fromMs(ms).In(s.location()).Format("Mon 2 Jan 2006 15:04 MST")
+}
+
+// Commands supported:
+//    !schedule add "cron expression" message
+// Sends the message into the room on the cron expression, e.g. "0 9 * * MON" for 9am every
+// Monday. Needs the "operator" role in the room.
+//    !schedule list
+// Lists the schedules for the room.
+//    !schedule remove ID
+// Removes a schedule from the room. Needs the "operator" role in the room.
+//    !remind (me|room) in 2h message
+// Sends the message into the room once after the delay, mentioning the sender if it is for them.
+// Needs the "operator" role in the room, and each user can have 10 reminders waiting.
+//
+// The messages of commands are sent as they are, while schedules in the config can use templates.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"schedule", "add"},
+			Args: []types.Arg{
+				{Name: "cron", Help: `A cron expression, e.g. "0 9 * * MON-FRI"`},
+				{Name: "message", Variadic: true},
+			},
+			Help: "Send a message into this room on a cron expression",
+			Role: types.RoleOperator,
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+				return s.cmdScheduleAdd(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"schedule", "list"},
+			Help: "List the schedules in this room",
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+				return s.cmdScheduleList(roomID)
+			},
+		},
+		{
+			Path: []string{"schedule", "remove"},
+			Args: []types.Arg{{Name: "id"}},
+			Help: "Remove a schedule from this room",
+			Role: types.RoleOperator,
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+				return s.cmdScheduleRemove(roomID, args)
+			},
+		},
+		{
+			Path: []string{"remind"},
+			Args: []types.Arg{
+				{Name: "who", Type: types.ArgEnum, Values: []string{"me", "room"}},
+				{Name: "in", Type: types.ArgEnum, Values: []string{"in"}},
+				{Name: "delay", Help: "e.g. 30m, 2h or 3d"},
+				{Name: "message", Variadic: true},
+			},
+			Help: "Send a reminder into this room after a delay",
+			Role: types.RoleOperator,
+			Run: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *types.ParsedArgs) (interface{}, error) {
+				return s.cmdRemind(roomID, userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	roomSet := make(map[id.RoomID]bool)
+	for _, sched := range s.Schedules {
+		roomSet[sched.RoomID] = true
+	}
+	for roomID := range roomSet {
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func toMs(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMs(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
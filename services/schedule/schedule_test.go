@@ -0,0 +1,184 @@
+package schedule
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func runCommand(t *testing.T, srv types.Service, userID id.UserID, args ...string) string {
+	for _, cmd := range srv.Commands(nil) {
+		if !cmd.Matches(args) {
+			continue
+		}
+		parsed, err := types.ParseArgs(cmd.Args, args[len(cmd.Path):])
+		if err != nil {
+			t.Fatalf("%v: %s", args, err)
+		}
+		content, err := cmd.Run("!room:hs", "$event:hs", userID, parsed)
+		if err != nil {
+			return err.Error()
+		}
+		return content.(*mevt.MessageEventContent).Body
+	}
+	t.Fatalf("No command matches %v", args)
+	return ""
+}
+
+func TestScheduleCommands(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := srv.(*Service)
+
+	if got := runCommand(t, srv, "@alice:hs", "schedule", "add", "0 9 * * MON", "Stand-up", "time!"); !strings.HasPrefix(got, "Added schedule 1. It will next run at Mon") {
+		t.Errorf("Unexpected add response %q", got)
+	}
+	if got := runCommand(t, srv, "@alice:hs", "schedule", "add", "0 9 * *", "Nope"); !strings.HasPrefix(got, "A cron expression needs 5 fields") {
+		t.Errorf("Expected a bad cron expression to be refused, got %q", got)
+	}
+	if got := runCommand(t, srv, "@alice:hs", "remind", "me", "in", "2h", "Check", "the", "deploy"); !strings.HasPrefix(got, "OK, I'll remind you at") {
+		t.Errorf("Unexpected remind response %q", got)
+	}
+	if got := runCommand(t, srv, "@alice:hs", "remind", "room", "in", "soon", "Lunch"); got != "delay must look like 30m, 2h or 3d" {
+		t.Errorf("Expected a bad delay to be refused, got %q", got)
+	}
+
+	reminder := s.Schedules["2"]
+	if reminder == nil || reminder.Text != "@alice:hs: Check the deploy" || reminder.Cron != "" {
+		t.Fatalf("Expected the reminder to be stored, got %+v", s.Schedules)
+	}
+	if s.Schedules["1"].Cron != "0 9 * * MON" || s.Schedules["1"].Text != "Stand-up time!" {
+		t.Errorf("Expected the schedule to be stored, got %+v", s.Schedules["1"])
+	}
+
+	list := runCommand(t, srv, "@alice:hs", "schedule", "list")
+	if lines := strings.Split(list, "\n"); len(lines) != 3 || !strings.HasPrefix(lines[1], "2: once") {
+		t.Errorf("Expected the reminder to be listed first, got %q", list)
+	}
+
+	if got := runCommand(t, srv, "@alice:hs", "schedule", "remove", "1"); got != "Removed schedule 1" {
+		t.Errorf("Unexpected remove response %q", got)
+	}
+	if got := runCommand(t, srv, "@alice:hs", "schedule", "remove", "1"); got != "There is no schedule 1 in this room" {
+		t.Errorf("Expected removing twice to fail, got %q", got)
+	}
+}
+
+func TestCommandMessagesAreNotTemplates(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := srv.(*Service)
+
+	runCommand(t, srv, "@alice:hs", "schedule", "add", "0 9 * * MON", "{{.CreatedBy}}", "{{")
+	runCommand(t, srv, "@alice:hs", "remind", "room", "in", "2h", `{{printf "%s" "hi"}}`)
+	for scheduleID, want := range map[string]string{"1": "{{.CreatedBy}} {{", "2": `{{printf "%s" "hi"}}`} {
+		sched := s.Schedules[scheduleID]
+		if sched == nil {
+			t.Fatalf("Expected schedule %s to be added, got %+v", scheduleID, s.Schedules)
+		}
+		if msg, err := sched.message(time.Now()); err != nil || msg.Body != want {
+			t.Errorf("Schedule %s: got %v (%v), want %q", scheduleID, msg, err, want)
+		}
+	}
+}
+
+func TestRemindLimits(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range srv.Commands(nil) {
+		if cmd.Path[0] == "remind" && cmd.Role != types.RoleOperator {
+			t.Errorf("Expected !remind to need the operator role, got %q", cmd.Role)
+		}
+	}
+
+	for i := 0; i < maxRemindersPerUser; i++ {
+		if got := runCommand(t, srv, "@alice:hs", "remind", "me", "in", "2h", "Hi"); !strings.HasPrefix(got, "OK") {
+			t.Fatalf("Failed to add reminder %d: %s", i, got)
+		}
+	}
+	if got := runCommand(t, srv, "@alice:hs", "remind", "me", "in", "2h", "Hi"); got != "You can only have 10 reminders waiting at once" {
+		t.Errorf("Expected too many reminders to be refused, got %q", got)
+	}
+	if got := runCommand(t, srv, "@bob:hs", "remind", "me", "in", "2h", "Hi"); !strings.HasPrefix(got, "OK") {
+		t.Errorf("Expected other users to be able to add reminders, got %q", got)
+	}
+}
+
+func TestOnPoll(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var sent []mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var msg mevt.MessageEventContent
+		json.NewDecoder(req.Body).Decode(&msg)
+		sent = append(sent, msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	now := time.Now()
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{
+		"schedules": {
+			"due": {"room_id": "!room:hs", "cron": "* * * * *", "template": "Sent by {{.CreatedBy}}", "created_by": "@alice:hs"},
+			"missed": {"room_id": "!room:hs", "cron": "0 9 * * *", "template": "Too late"},
+			"reminder": {"room_id": "!room:hs", "template": "Reminder", "msg_type": "m.text"},
+			"later": {"room_id": "!room:hs", "template": "Not yet"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := srv.(*Service)
+	s.Schedules["due"].NextRunMs = toMs(now.Add(-time.Minute))
+	s.Schedules["missed"].NextRunMs = toMs(now.Add(-time.Hour))
+	s.Schedules["reminder"].AtMs = toMs(now.Add(-time.Hour))
+	s.Schedules["later"].AtMs = toMs(now.Add(time.Hour))
+
+	next := s.OnPoll(matrixCli)
+	if next.Sub(now) > time.Minute || next.Second() != 0 {
+		t.Errorf("Expected to poll again at the start of the next minute, got %s", next)
+	}
+
+	var bodies []string
+	for _, msg := range sent {
+		bodies = append(bodies, string(msg.MsgType)+" "+msg.Body)
+	}
+	if len(bodies) != 2 || !(bodies[0] == "m.notice Sent by @alice:hs" || bodies[1] == "m.notice Sent by @alice:hs") ||
+		!(bodies[0] == "m.text Reminder" || bodies[1] == "m.text Reminder") {
+		t.Errorf("Expected the due schedule and late reminder to be sent, got %v", bodies)
+	}
+	if _, ok := s.Schedules["reminder"]; ok {
+		t.Errorf("Expected the reminder to be removed once sent")
+	}
+	if !fromMs(s.Schedules["due"].NextRunMs).After(now) || !fromMs(s.Schedules["missed"].NextRunMs).After(now) {
+		t.Errorf("Expected recurring schedules to move to their next run")
+	}
+	if _, ok := s.Schedules["later"]; !ok {
+		t.Errorf("Expected the later reminder to be kept")
+	}
+}
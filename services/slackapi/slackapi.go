@@ -21,7 +21,11 @@ const ServiceType = "slackapi"
 // Example JSON request:
 // {
 //   "room_id": "!someroomid:some.domain.com",
-//   "message_type": "m.text"
+//   "message_type": "m.text",
+//   "verification": {
+//     "method": "slack",
+//     "secret": "your slack app signing secret"
+//   }
 // }
 type Service struct {
 	types.DefaultService
@@ -30,6 +34,8 @@ type Service struct {
 	WebhookURL  string            `json:"webhook_url"`
 	RoomID      id.RoomID         `json:"room_id"`
 	MessageType event.MessageType `json:"message_type"`
+	// Optional. How to verify that incoming webhook requests come from Slack, e.g. with a Slack signing secret.
+	Verification *types.WebhookVerification `json:"verification,omitempty"`
 }
 
 // OnReceiveWebhook receives requests from a slack outgoing webhook and possibly sends requests
@@ -70,9 +76,25 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	w.WriteHeader(200)
 }
 
+// WebhookVerification returns how to verify incoming webhook requests, if at all.
+func (s *Service) WebhookVerification() *types.WebhookVerification {
+	return s.Verification
+}
+
+// ValidateConfig checks the verification config, if any.
+func (s *Service) ValidateConfig() error {
+	if s.Verification != nil {
+		return s.Verification.Check()
+	}
+	return nil
+}
+
 // Register joins the configured room and sets the public WebhookURL
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
 	s.WebhookURL = s.webhookEndpointURL
+	if err := s.ValidateConfig(); err != nil {
+		return err
+	}
 	if _, err := client.JoinRoom(s.RoomID.String(), "", nil); err != nil {
 		log.WithFields(log.Fields{
 			log.ErrorKey: err,
@@ -244,6 +244,15 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 // Register makes sure the Config information supplied is valid.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
 	s.WebhookURL = s.webhookEndpointURL
+	if err := s.ValidateConfig(); err != nil {
+		return err
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// ValidateConfig checks that every repository is a valid "owner/repo" name.
+func (s *Service) ValidateConfig() error {
 	for _, roomData := range s.Rooms {
 		for repo := range roomData.Repos {
 			match := ownerRepoRegex.FindStringSubmatch(repo)
@@ -252,7 +261,6 @@ func (s *Service) Register(oldService types.Service, client types.MatrixClient)
 			}
 		}
 	}
-	s.joinRooms(client)
 	return nil
 }
 
@@ -53,8 +53,10 @@ type Service struct {
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
-			Path: []string{"wikipedia"},
-			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			Path:      []string{"wikipedia"},
+			Arguments: []string{"search text"},
+			Help:      "Search for an article and show its extract",
+			Command: func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args []string) (interface{}, error) {
 				return s.cmdWikipediaSearch(client, roomID, userID, args)
 			},
 		},
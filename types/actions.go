@@ -1,9 +1,11 @@
 package types
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -11,20 +13,111 @@ import (
 // followed by a list of strings that name the command, followed by a list of argument
 // strings. The argument strings may be quoted using '\"' and '\'' in the same way
 // that they are quoted in the unix shell.
+//
+// Command is called with the room, event ID and sender of the message which ran the command.
+// Commands can declare their arguments with Args. The arguments are then checked before the
+// command runs, and the sender is shown the usage of the command if they don't match. Commands
+// with a Dialog ask the sender for their arguments one at a time if none are given.
 type Command struct {
-	Path      []string
+	Path []string
+	// The arguments after the path, as shown by !help e.g. "owner/repo#issue" or "[username]".
+	// Ignored if Args is set.
 	Arguments []string
-	Help      string
-	Command   func(roomID id.RoomID, userID id.UserID, arguments []string) (content interface{}, err error)
+	// The arguments the command takes.
+	Args []Arg
+	// A one line description of the command, shown by !help.
+	Help string
+	// The role the sender needs in the room to run this command. Defaults to RoleAnyone.
+	Role    string
+	Command func(roomID id.RoomID, eventID id.EventID, userID id.UserID, arguments []string) (content interface{}, err error)
+	// Run is called instead of Command with the arguments parsed using Args.
+	Run func(roomID id.RoomID, eventID id.EventID, userID id.UserID, args *ParsedArgs) (content interface{}, err error)
+	// Optional. Called instead of Command or Run when the command is given no arguments, to
+	// start a Dialog which asks for them.
+	Dialog func(roomID id.RoomID, eventID id.EventID, userID id.UserID) *Dialog
 }
 
+// The roles which a Command can require. Room admins choose who has each role with the "permissions"
+// key in the room's m.room.bot.options. If a role isn't configured for a room it is granted by power level.
+// Each role includes the ones before it.
+const (
+	// Anyone in the room.
+	RoleAnyone = ""
+	// Users who can change things on behalf of the room, e.g. closing issues. Defaults to power level 50.
+	RoleOperator = "operator"
+	// Users who can configure the bot for the room. Defaults to power level 100.
+	RoleAdmin = "admin"
+)
+
 // An Expansion is something that actives when the user sends any message
 // containing a string matching a given pattern. For example an RFC expansion
 // might expand "RFC 6214" into "Adaptation of RFC 1149 for IPv6" and link to
-// the appropriate RFC.
+// the appropriate RFC. Expand is called with the room, event ID and sender of the message.
 type Expansion struct {
 	Regexp *regexp.Regexp
-	Expand func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{}
+	// A one line description of what is expanded, shown by !help. Defaults to the pattern of the Regexp.
+	Help   string
+	Expand func(roomID id.RoomID, eventID id.EventID, userID id.UserID, matchingGroups []string) interface{}
+}
+
+// A Reaction is something that activates when a user reacts to a message sent by the bot with one
+// of the given keys. For example, reacting with ✅ to an alert might silence it. React is called with
+// the room, event ID and sender of the reaction, the key used and the message which was reacted to.
+// It should return nil if the reaction doesn't apply to the message, e.g. because the message was
+// sent by another service.
+type Reaction struct {
+	// The reaction keys which activate this, e.g. "👍".
+	Keys []string
+	// A one line description of what the reaction does, shown by !help.
+	Help string
+	// The role the sender needs in the room to react. Defaults to RoleAnyone.
+	Role  string
+	React func(roomID id.RoomID, eventID id.EventID, userID id.UserID, key string, target *event.Event) (content interface{}, err error)
+}
+
+// Matches if the key is one of the keys of the reaction.
+func (reaction *Reaction) Matches(key string) bool {
+	for _, k := range reaction.Keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// AddReactionButtons reacts to a message with each of the keys, so that users can react with them
+// by clicking on the reaction rather than having to pick it. Returns an error if the event ID is empty,
+// e.g. because the message is still waiting in the outbox.
+func AddReactionButtons(cli MatrixClient, roomID id.RoomID, eventID id.EventID, keys ...string) error {
+	if eventID == "" {
+		return fmt.Errorf("cannot react to a message which has not been sent")
+	}
+	for _, key := range keys {
+		content := &event.ReactionEventContent{
+			RelatesTo: event.RelatesTo{
+				Type:    event.RelAnnotation,
+				EventID: eventID,
+				Key:     key,
+			},
+		}
+		if _, err := cli.SendMessageEvent(roomID, event.EventReaction, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage returns how to use the command, e.g. "!github close [owner/repo]#issue".
+func (command *Command) Usage() string {
+	usage := append([]string{}, command.Path...)
+	if command.Args != nil {
+		for _, a := range command.Args {
+			usage = append(usage, a.usage())
+		}
+	} else {
+		usage = append(usage, command.Arguments...)
+	}
+	return "!" + strings.Join(usage, " ")
 }
 
 // Matches if the arguments start with the path of the command.
@@ -0,0 +1,335 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ArgType is the type of a command argument.
+type ArgType int
+
+// The types of command argument.
+const (
+	// Any string. This is the default.
+	ArgString ArgType = iota
+	// A whole number, e.g. 42.
+	ArgInt
+	// One of the Values of the argument, ignoring case.
+	ArgEnum
+	// A GitHub-style issue reference, e.g. owner/repo#12 or #12.
+	ArgIssueRef
+	// A flag with no value, e.g. --force. Only valid for flags.
+	ArgBool
+	// A GitHub-style repository, e.g. owner/repo.
+	ArgRepo
+)
+
+// Arg describes an argument of a Command. Positional arguments are matched in order, after any
+// flags have been removed. Flags are passed as "--name value" or "--name=value" anywhere after
+// the command path.
+type Arg struct {
+	// The name of the argument, used to look up its value and shown in usage messages.
+	Name string
+	Type ArgType
+	// A one line description of the argument.
+	Help string
+	// True if the argument may be omitted. Optional positional arguments are only matched if
+	// there are enough arguments left for the required ones after it, and the value is valid
+	// for their Type.
+	Optional bool
+	// True if the argument is a flag rather than a positional argument.
+	Flag bool
+	// True if the argument takes all the remaining positional arguments. Only valid for the
+	// last positional argument.
+	Variadic bool
+	// The allowed values of an ArgEnum.
+	Values []string
+}
+
+// IssueRef is a reference to an issue or pull request. Owner and Repo are empty if only the
+// issue number was given, e.g. "#12".
+type IssueRef struct {
+	Owner  string
+	Repo   string
+	Number int
+}
+
+var issueRefRegex = regexp.MustCompile(`^(?:([\w.-]+)/([\w.-]+))?#([0-9]+)$`)
+
+var repoRegex = regexp.MustCompile(`^[\w.-]+/[\w.-]+$`)
+
+// usage returns how the argument is written in a usage message, e.g. "[--repo repo]".
+func (a Arg) usage() string {
+	var u string
+	switch a.Type {
+	case ArgEnum:
+		u = "(" + strings.Join(a.Values, "|") + ")"
+	case ArgIssueRef:
+		u = "[owner/repo]#" + a.Name
+	case ArgRepo:
+		u = "owner/repo"
+	default:
+		u = a.Name
+	}
+	if a.Flag {
+		if a.Type == ArgBool {
+			u = "--" + a.Name
+		} else {
+			u = "--" + a.Name + " " + u
+		}
+	}
+	if a.Variadic {
+		u += "..."
+	}
+	if a.Optional {
+		u = "[" + u + "]"
+	}
+	return u
+}
+
+// parse converts the string value of the argument to its type.
+func (a Arg) parse(value string) (interface{}, error) {
+	switch a.Type {
+	case ArgInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", a.Name)
+		}
+		return n, nil
+	case ArgEnum:
+		for _, v := range a.Values {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("%s must be one of %s", a.Name, strings.Join(a.Values, ", "))
+	case ArgIssueRef:
+		groups := issueRefRegex.FindStringSubmatch(value)
+		if groups == nil {
+			return nil, fmt.Errorf("%s must look like owner/repo#12 or #12", a.Name)
+		}
+		n, err := strconv.Atoi(groups[3])
+		if err != nil {
+			return nil, fmt.Errorf("%s has a malformed issue number", a.Name)
+		}
+		return IssueRef{groups[1], groups[2], n}, nil
+	case ArgBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("--%s must be true or false", a.Name)
+		}
+		return b, nil
+	case ArgRepo:
+		if !repoRegex.MatchString(value) {
+			return nil, fmt.Errorf("%s must look like owner/repo", a.Name)
+		}
+	}
+	return value, nil
+}
+
+// parseVariadic converts the values of a variadic argument to its type. The values of string
+// arguments are returned as a []string, and any others as a []interface{}.
+func (a Arg) parseVariadic(values []string) (interface{}, error) {
+	var strs []string
+	var vs []interface{}
+	for _, value := range values {
+		v, err := a.parse(value)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := v.(string); ok {
+			strs = append(strs, s)
+		}
+		vs = append(vs, v)
+	}
+	if len(strs) == len(vs) {
+		return strs, nil
+	}
+	return vs, nil
+}
+
+// ParsedArgs are the values of a command's arguments, keyed by name.
+type ParsedArgs struct {
+	values map[string]interface{}
+}
+
+// Has returns true if the argument was given.
+func (p *ParsedArgs) Has(name string) bool {
+	_, ok := p.values[name]
+	return ok
+}
+
+// String returns the value of an ArgString, ArgEnum or ArgRepo argument, or "" if it was not given.
+// The values of a variadic argument are joined with spaces.
+func (p *ParsedArgs) String(name string) string {
+	switch v := p.values[name].(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, " ")
+	}
+	return ""
+}
+
+// Strings returns the values of a variadic argument, or nil if it was not given.
+func (p *ParsedArgs) Strings(name string) []string {
+	switch v := p.values[name].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	}
+	return nil
+}
+
+// Values returns the values of a variadic argument of any type, or nil if it was not given.
+func (p *ParsedArgs) Values(name string) []interface{} {
+	switch v := p.values[name].(type) {
+	case []interface{}:
+		return v
+	case []string:
+		vs := make([]interface{}, len(v))
+		for i, s := range v {
+			vs[i] = s
+		}
+		return vs
+	case nil:
+		return nil
+	default:
+		return []interface{}{v}
+	}
+}
+
+// Int returns the value of an ArgInt argument, or 0 if it was not given.
+func (p *ParsedArgs) Int(name string) int {
+	n, _ := p.values[name].(int)
+	return n
+}
+
+// Bool returns the value of an ArgBool flag, or false if it was not given.
+func (p *ParsedArgs) Bool(name string) bool {
+	b, _ := p.values[name].(bool)
+	return b
+}
+
+// IssueRef returns the value of an ArgIssueRef argument, or the zero IssueRef if it was not given.
+func (p *ParsedArgs) IssueRef(name string) IssueRef {
+	ref, _ := p.values[name].(IssueRef)
+	return ref
+}
+
+// ParseArgs checks that the arguments after a command path match the schema and converts them
+// to their types. The error describes what is wrong with the arguments, for use in usage messages.
+func ParseArgs(schema []Arg, arguments []string) (*ParsedArgs, error) {
+	parsed := &ParsedArgs{make(map[string]interface{})}
+	flags := make(map[string]Arg)
+	var positional []Arg
+	for _, a := range schema {
+		if a.Flag {
+			flags[a.Name] = a
+		} else {
+			positional = append(positional, a)
+		}
+	}
+
+	// Pull out the flags. "--" ends the flags, so that positional arguments can start with "--".
+	// Commands without flags take every argument as it is.
+	var values []string
+	for i := 0; i < len(arguments); i++ {
+		arg := arguments[i]
+		if arg == "--" && len(flags) > 0 {
+			values = append(values, arguments[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "--") || len(flags) == 0 {
+			values = append(values, arg)
+			continue
+		}
+		name, value := strings.TrimPrefix(arg, "--"), ""
+		hasValue := false
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+		flag, ok := flags[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown flag --%s", name)
+		}
+		if !hasValue {
+			if flag.Type == ArgBool {
+				value = "true"
+			} else if i+1 < len(arguments) {
+				i++
+				value = arguments[i]
+			} else {
+				return nil, fmt.Errorf("Missing value for --%s", name)
+			}
+		}
+		v, err := flag.parse(value)
+		if err != nil {
+			return nil, err
+		}
+		parsed.values[name] = v
+	}
+	for _, flag := range flags {
+		if !flag.Optional && !parsed.Has(flag.Name) {
+			return nil, fmt.Errorf("Missing --%s", flag.Name)
+		}
+	}
+
+	// If an optional argument is skipped because its value is invalid, but the value doesn't suit
+	// the arguments after it either, the first error is the one to explain.
+	var skipped error
+	fail := func(err error) (*ParsedArgs, error) {
+		if skipped != nil {
+			return nil, skipped
+		}
+		return nil, err
+	}
+	for i, a := range positional {
+		if len(values) == 0 {
+			if !a.Optional {
+				return fail(fmt.Errorf("Missing %s", a.Name))
+			}
+			continue
+		}
+		if a.Optional {
+			required := 0
+			for _, after := range positional[i+1:] {
+				if !after.Optional {
+					required++
+				}
+			}
+			if len(values) <= required {
+				continue
+			}
+			if _, err := a.parse(values[0]); err != nil && !a.Variadic {
+				// The value may be for a later argument
+				if skipped == nil {
+					skipped = err
+				}
+				continue
+			}
+		}
+		if a.Variadic {
+			vs, err := a.parseVariadic(values)
+			if err != nil {
+				return fail(err)
+			}
+			parsed.values[a.Name] = vs
+			values = nil
+			continue
+		}
+		v, err := a.parse(values[0])
+		if err != nil {
+			return fail(err)
+		}
+		parsed.values[a.Name] = v
+		values = values[1:]
+	}
+	if len(values) > 0 {
+		return fail(fmt.Errorf("Too many arguments"))
+	}
+	return parsed, nil
+}
@@ -0,0 +1,127 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	schema := []Arg{
+		{Name: "issue", Type: ArgIssueRef},
+		{Name: "state", Type: ArgEnum, Values: []string{"open", "closed"}, Optional: true},
+		{Name: "count", Type: ArgInt},
+		{Name: "repo", Flag: true, Optional: true},
+		{Name: "force", Type: ArgBool, Flag: true, Optional: true},
+		{Name: "words", Variadic: true, Optional: true},
+	}
+	tests := []struct {
+		args    []string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			args: []string{"foo/bar#12", "3"},
+			want: map[string]interface{}{"issue": IssueRef{"foo", "bar", 12}, "count": 3},
+		},
+		{
+			args: []string{"--repo", "foo/bar", "#12", "CLOSED", "3", "--force", "two", "words"},
+			want: map[string]interface{}{
+				"issue": IssueRef{"", "", 12}, "state": "closed", "count": 3, "repo": "foo/bar", "force": true,
+				"words": []string{"two", "words"},
+			},
+		},
+		{
+			args: []string{"#12", "--repo=foo/bar", "open", "3", "--", "--not-a-flag"},
+			want: map[string]interface{}{
+				"issue": IssueRef{"", "", 12}, "state": "open", "count": 3, "repo": "foo/bar", "words": []string{"--not-a-flag"},
+			},
+		},
+		{args: []string{}, wantErr: "Missing issue"},
+		{args: []string{"#12"}, wantErr: "Missing count"},
+		{args: []string{"12", "3"}, wantErr: "issue must look like owner/repo#12 or #12"},
+		{args: []string{"#12", "three"}, wantErr: "count must be a number"},
+		{args: []string{"#12", "merged", "3"}, wantErr: "state must be one of open, closed"},
+		{args: []string{"#12", "3", "--repo"}, wantErr: "Missing value for --repo"},
+		{args: []string{"#12", "3", "--nope"}, wantErr: "Unknown flag --nope"},
+	}
+	for _, test := range tests {
+		parsed, err := ParseArgs(schema, test.args)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("ParseArgs(%v): got error %v, want %q", test.args, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseArgs(%v): unexpected error %s", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed.values, test.want) {
+			t.Errorf("ParseArgs(%v): got %v, want %v", test.args, parsed.values, test.want)
+		}
+	}
+
+	if _, err := ParseArgs(nil, []string{"extra"}); err == nil || err.Error() != "Too many arguments" {
+		t.Errorf("Expected too many arguments, got %v", err)
+	}
+}
+
+func TestParseArgsTypes(t *testing.T) {
+	// An optional argument is skipped if its value is for the argument after it
+	schema := []Arg{
+		{Name: "repo", Type: ArgRepo, Optional: true},
+		{Name: "title"},
+		{Name: "description", Optional: true},
+	}
+	tests := []struct {
+		args []string
+		want map[string]interface{}
+	}{
+		{[]string{"title"}, map[string]interface{}{"title": "title"}},
+		{[]string{"title", "description"}, map[string]interface{}{"title": "title", "description": "description"}},
+		{[]string{"foo/bar", "title"}, map[string]interface{}{"repo": "foo/bar", "title": "title"}},
+		{[]string{"foo/bar", "title", "description"}, map[string]interface{}{"repo": "foo/bar", "title": "title", "description": "description"}},
+	}
+	for _, test := range tests {
+		parsed, err := ParseArgs(schema, test.args)
+		if err != nil || !reflect.DeepEqual(parsed.values, test.want) {
+			t.Errorf("ParseArgs(%v): got %v (%v), want %v", test.args, parsed, err, test.want)
+		}
+	}
+	if _, err := ParseArgs(schema, []string{"title", "description", "extra"}); err == nil || err.Error() != "repo must look like owner/repo" {
+		t.Errorf("Expected the invalid repo to be explained, got %v", err)
+	}
+
+	// Variadic arguments keep their types
+	parsed, err := ParseArgs([]Arg{{Name: "issues", Type: ArgIssueRef, Variadic: true}}, []string{"foo/bar#1", "#2"})
+	if want := []interface{}{IssueRef{"foo", "bar", 1}, IssueRef{"", "", 2}}; err != nil || !reflect.DeepEqual(parsed.Values("issues"), want) {
+		t.Errorf("Expected issue refs, got %v (%v)", parsed, err)
+	}
+
+	// "--" is only special for commands with flags
+	parsed, err = ParseArgs([]Arg{{Name: "words", Variadic: true}}, []string{"a", "--", "b"})
+	if err != nil || parsed.String("words") != "a -- b" {
+		t.Errorf("Expected -- to be kept, got %v (%v)", parsed, err)
+	}
+}
+
+func TestCommandUsage(t *testing.T) {
+	cmd := Command{
+		Path: []string{"github", "assign"},
+		Args: []Arg{
+			{Name: "issue", Type: ArgIssueRef},
+			{Name: "username", Variadic: true},
+			{Name: "state", Type: ArgEnum, Values: []string{"open", "closed"}, Flag: true, Optional: true},
+			{Name: "force", Type: ArgBool, Flag: true, Optional: true},
+		},
+	}
+	want := "!github assign [owner/repo]#issue username... [--state (open|closed)] [--force]"
+	if got := cmd.Usage(); got != want {
+		t.Errorf("Usage: got %q, want %q", got, want)
+	}
+	cmd.Args = nil
+	cmd.Arguments = []string{"[owner/repo]#issue", "username"}
+	if got := cmd.Usage(); got != "!github assign [owner/repo]#issue username" {
+		t.Errorf("Usage without Args: got %q", got)
+	}
+}
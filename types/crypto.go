@@ -0,0 +1,16 @@
+package types
+
+import (
+	"maunium.net/go/mautrix/id"
+)
+
+// CrossSigningKeys are the cross-signing keys which Go-NEB created for a bot user, so that it can
+// sign the bot's devices.
+type CrossSigningKeys struct {
+	UserID id.UserID
+	// The public keys, in unpadded base64.
+	MasterKey      id.Ed25519
+	SelfSigningKey id.Ed25519
+	// The seeds of the private keys, encrypted with the client's pickle key.
+	EncryptedPrivateKeys []byte
+}
@@ -0,0 +1,145 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultDialogTimeout is how long a Dialog waits for an answer if it doesn't set a Timeout.
+const DefaultDialogTimeout = 5 * time.Minute
+
+// The answer which skips an optional Question.
+const skipAnswer = "skip"
+
+// A Dialog asks the sender of a command a series of questions, one message at a time, instead of
+// them having to give every argument on one line. Each message the sender sends in the room after
+// a question is their answer to it. Once every question is answered, Done is called with the
+// answers, keyed by the Name of each question.
+type Dialog struct {
+	Questions []Question
+	// How long to wait for each answer before giving up. Defaults to DefaultDialogTimeout.
+	Timeout time.Duration
+	Done    func(roomID id.RoomID, eventID id.EventID, userID id.UserID, answers *ParsedArgs) (content interface{}, err error)
+}
+
+// A Question is a step of a Dialog. Answers are checked against the Arg in the same way as command
+// arguments. Optional questions can be answered with "skip", and the answer to a Variadic question
+// is split on commas, e.g. "bug, help wanted".
+type Question struct {
+	Arg
+	// What to ask, e.g. "What should the issue be called?"
+	Prompt string
+	// Optional. Called with the answer once it has been parsed, to check it further.
+	Validate func(answer interface{}) error
+}
+
+// question returns the question to send, including how to answer it.
+func (q *Question) question() string {
+	prompt := q.Prompt
+	if q.Type == ArgEnum {
+		prompt += " (" + strings.Join(q.Values, ", ") + ")"
+	}
+	if q.Variadic {
+		prompt += " Separate them with commas."
+	}
+	if q.Optional {
+		prompt += ` Say "` + skipAnswer + `" to leave it out.`
+	}
+	return prompt
+}
+
+// DialogSession is the progress of a user through a Dialog.
+type DialogSession struct {
+	Dialog  *Dialog
+	answers *ParsedArgs
+	next    int
+}
+
+// NewDialogSession starts a Dialog from its first question.
+func NewDialogSession(dialog *Dialog) *DialogSession {
+	return &DialogSession{
+		Dialog:  dialog,
+		answers: &ParsedArgs{make(map[string]interface{})},
+	}
+}
+
+// Timeout returns how long to wait for the next answer.
+func (s *DialogSession) Timeout() time.Duration {
+	if s.Dialog.Timeout > 0 {
+		return s.Dialog.Timeout
+	}
+	return DefaultDialogTimeout
+}
+
+// Done returns true once every question has been answered.
+func (s *DialogSession) Done() bool {
+	return s.next >= len(s.Dialog.Questions)
+}
+
+// Prompt returns the next question to ask, or "" if every question has been answered.
+func (s *DialogSession) Prompt() string {
+	if s.Done() {
+		return ""
+	}
+	return s.Dialog.Questions[s.next].question()
+}
+
+// Answers returns the answers given so far.
+func (s *DialogSession) Answers() *ParsedArgs {
+	return s.answers
+}
+
+// Answer answers the next question. If the answer isn't valid, the error says why and the
+// question should be asked again.
+func (s *DialogSession) Answer(text string) error {
+	if s.Done() {
+		return fmt.Errorf("There are no more questions")
+	}
+	q := s.Dialog.Questions[s.next]
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("Missing %s", q.Name)
+	}
+	if strings.EqualFold(text, skipAnswer) {
+		if !q.Optional {
+			return fmt.Errorf("%s is required", q.Name)
+		}
+		s.next++
+		return nil
+	}
+
+	var value interface{}
+	if q.Variadic {
+		var parts []string
+		for _, part := range strings.Split(text, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) == 0 {
+			return fmt.Errorf("Missing %s", q.Name)
+		}
+		v, err := q.parseVariadic(parts)
+		if err != nil {
+			return err
+		}
+		value = v
+	} else {
+		v, err := q.parse(text)
+		if err != nil {
+			return err
+		}
+		value = v
+	}
+	if q.Validate != nil {
+		if err := q.Validate(value); err != nil {
+			return err
+		}
+	}
+	s.answers.values[q.Name] = value
+	s.next++
+	return nil
+}
@@ -0,0 +1,67 @@
+package types
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDialogSession(t *testing.T) {
+	session := NewDialogSession(&Dialog{
+		Questions: []Question{
+			{
+				Arg:    Arg{Name: "repo"},
+				Prompt: "Which repo?",
+				Validate: func(answer interface{}) error {
+					if answer.(string) == "nope" {
+						return errors.New("No such repo")
+					}
+					return nil
+				},
+			},
+			{Arg: Arg{Name: "count", Type: ArgInt}, Prompt: "How many?"},
+			{Arg: Arg{Name: "state", Type: ArgEnum, Values: []string{"open", "closed"}, Optional: true}, Prompt: "Which state?"},
+			{Arg: Arg{Name: "labels", Variadic: true, Optional: true}, Prompt: "Which labels?"},
+		},
+	})
+
+	steps := []struct {
+		answer     string
+		wantErr    string
+		wantPrompt string
+	}{
+		{"nope", "No such repo", "Which repo?"},
+		{"  foo/bar ", "", "How many?"},
+		{"three", "count must be a number", "How many?"},
+		{"3", "", `Which state? (open, closed) Say "skip" to leave it out.`},
+		{"SKIP", "", `Which labels? Separate them with commas. Say "skip" to leave it out.`},
+		{"bug, help wanted,", "", ""},
+	}
+	for _, step := range steps {
+		err := session.Answer(step.answer)
+		if step.wantErr != "" && (err == nil || err.Error() != step.wantErr) {
+			t.Errorf("Answer(%q): got error %v, want %q", step.answer, err, step.wantErr)
+		} else if step.wantErr == "" && err != nil {
+			t.Errorf("Answer(%q): unexpected error %s", step.answer, err)
+		}
+		if got := session.Prompt(); got != step.wantPrompt {
+			t.Errorf("After %q: got prompt %q, want %q", step.answer, got, step.wantPrompt)
+		}
+	}
+
+	if !session.Done() {
+		t.Fatalf("Expected the dialog to be done")
+	}
+	want := map[string]interface{}{"repo": "foo/bar", "count": 3, "labels": []string{"bug", "help wanted"}}
+	if !reflect.DeepEqual(session.Answers().values, want) {
+		t.Errorf("Answers: got %v, want %v", session.Answers().values, want)
+	}
+	if session.Timeout() != DefaultDialogTimeout {
+		t.Errorf("Expected the default timeout, got %s", session.Timeout())
+	}
+
+	required := NewDialogSession(&Dialog{Questions: []Question{{Arg: Arg{Name: "title"}}}})
+	if err := required.Answer("skip"); err == nil || err.Error() != "title is required" {
+		t.Errorf("Expected required questions not to be skipped, got %v", err)
+	}
+}
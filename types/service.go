@@ -21,6 +21,24 @@ type BotOptions struct {
 	Options     map[string]interface{}
 }
 
+// OutboxMessage is a message event which a service has asked to send into a Matrix room.
+// Outbox messages are persisted until they are delivered, so they survive homeserver downtime.
+type OutboxMessage struct {
+	// An opaque ID for this message. IDs sort in the order the messages were queued, and are
+	// used as the transaction ID when sending so retries are idempotent.
+	ID          string
+	ServiceID   string
+	UserID      id.UserID
+	RoomID      id.RoomID
+	EventType   string
+	Content     json.RawMessage
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	// True if this message will no longer be retried because it failed too many times.
+	DeadLettered bool
+}
+
 // Poller represents a thing which can poll. Services should implement this method signature to support polling.
 type Poller interface {
 	// OnPoll is called when the poller should poll. Return the timestamp when you want to be polled again.
@@ -28,6 +46,124 @@ type Poller interface {
 	OnPoll(client MatrixClient) time.Time
 }
 
+// ConfigValidator represents a service which can check its config without contacting Matrix or any
+// third party. Services should implement this method signature so that bad config can be reported
+// before the service is registered, e.g. by "go-neb validate".
+type ConfigValidator interface {
+	// ValidateConfig returns an error if the service config is invalid.
+	ValidateConfig() error
+}
+
+// Deregisterer represents a service which holds resources outside of Go-NEB, such as webhooks on a remote
+// server. Services should implement this method signature to clean up those resources when they are deleted.
+type Deregisterer interface {
+	// Deregister is called when the service is being deleted, or when its ID is reused for a different type of
+	// service, with a Client instance for ServiceUserID(). Returning an error does not stop the service from
+	// being deleted.
+	Deregister(client MatrixClient) error
+}
+
+// RateLimit configures how often each user can trigger a service's commands and expansions in a room.
+// Every command, and every expansion in a message, uses a token. Users can use up to Burst tokens at
+// once, and get PerMinute tokens back every minute.
+type RateLimit struct {
+	Burst     int     `json:"burst"`
+	PerMinute float64 `json:"per_minute"`
+}
+
+// DefaultRateLimit is used for services which do not configure a rate limit.
+var DefaultRateLimit = RateLimit{Burst: 10, PerMinute: 10}
+
+// Unlimited returns true if the rate limit is turned off, by setting PerMinute to 0.
+func (r RateLimit) Unlimited() bool {
+	return r.PerMinute <= 0
+}
+
+// Check that the rate limit is valid.
+func (r RateLimit) Check() error {
+	if !r.Unlimited() && r.Burst < 1 {
+		return errors.New("rate_limit burst must be at least 1")
+	}
+	return nil
+}
+
+// ReactionHandler is an interface which Services can implement to be told when users react to
+// messages sent by their bot.
+type ReactionHandler interface {
+	Reactions(cli MatrixClient) []Reaction
+}
+
+// RateLimited represents a service whose commands and expansions are rate limited. DefaultService implements
+// this using the "rate_limit" key in the service config, so all services can be configured in the same way.
+type RateLimited interface {
+	// CommandRateLimit returns the rate limit for the service's commands and expansions.
+	CommandRateLimit() RateLimit
+}
+
+// Webhook verification methods. See WebhookVerification.
+const (
+	// The request body is signed with HMAC-SHA256 using a shared secret.
+	VerifyHMACSHA256 = "hmac-sha256"
+	// The request has an "Authorization: Bearer <secret>" header.
+	VerifyBearerToken = "bearer"
+	// The request is signed with a Slack signing secret. See https://api.slack.com/authentication/verifying-requests-from-slack
+	VerifySlackSignature = "slack"
+)
+
+// WebhookVerification describes how incoming webhook requests for a service should be authenticated.
+//
+// Only "slack", and "hmac-sha256" with a NonceHeader, protect against replays. A "bearer" token is sent
+// unchanged with every request and a plain "hmac-sha256" signature only covers the body, so anyone who
+// captures one of these requests can send it again, as often and as late as they like. Use them over
+// HTTPS, and prefer "hmac-sha256" with a NonceHeader if the sender supports it.
+type WebhookVerification struct {
+	// The verification method: one of "hmac-sha256", "bearer" or "slack".
+	Method string `json:"method"`
+	// The shared secret, bearer token or Slack signing secret.
+	Secret string `json:"secret"`
+	// For "hmac-sha256": the header containing the hex-encoded signature. Defaults to "X-Signature".
+	// A leading "sha256=" on the header value is ignored.
+	SignatureHeader string `json:"signature_header,omitempty"`
+	// Optional, for "hmac-sha256". A header containing a unique ID for every delivery. If set, the
+	// signature must cover the timestamp header, the nonce header and the body, separated by newlines,
+	// and requests which are too old or reuse a nonce are rejected. Slack requests are always checked
+	// for replays.
+	NonceHeader string `json:"nonce_header,omitempty"`
+	// For "hmac-sha256" with a nonce_header: the header containing the time the request was sent, in
+	// seconds since the Unix epoch. Defaults to "X-Timestamp".
+	TimestampHeader string `json:"timestamp_header,omitempty"`
+	// For "slack", and "hmac-sha256" with a nonce_header: the maximum age of a request in seconds
+	// before it is rejected. Defaults to 300.
+	MaxAgeSecs int `json:"max_age_secs,omitempty"`
+}
+
+// Check that the verification config is valid.
+func (v *WebhookVerification) Check() error {
+	switch v.Method {
+	case VerifyHMACSHA256, VerifyBearerToken, VerifySlackSignature:
+	default:
+		return errors.New(`verification method must be one of "hmac-sha256", "bearer" or "slack"`)
+	}
+	if v.Secret == "" {
+		return errors.New("verification secret must be supplied")
+	}
+	if v.MaxAgeSecs < 0 {
+		return errors.New("verification max_age_secs must not be negative")
+	}
+	if v.NonceHeader != "" && v.Method != VerifyHMACSHA256 {
+		// A bearer token doesn't sign the request, so the nonce could be changed by anyone who saw it
+		return errors.New(`verification nonce_header can only be used with "hmac-sha256"`)
+	}
+	return nil
+}
+
+// WebhookVerifier represents a service which requires incoming webhook requests to be authenticated.
+// Services should implement this method signature to have requests verified before OnReceiveWebhook is called.
+type WebhookVerifier interface {
+	// WebhookVerification returns how to verify incoming webhook requests, or nil to accept all requests.
+	WebhookVerification() *WebhookVerification
+}
+
 // MatrixClient represents an object that can communicate with a Matrix server in certain ways that services require.
 type MatrixClient interface {
 	// Join a room by ID or alias. Content can optionally specify the request body.
@@ -67,11 +203,14 @@ type DefaultService struct {
 	id            string
 	serviceUserID id.UserID
 	serviceType   string
+	// Optional. How often each user can trigger the service's commands and expansions in a room.
+	// Defaults to DefaultRateLimit.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
 }
 
 // NewDefaultService creates a new service with implementations for ServiceID(), ServiceType() and ServiceUserID()
 func NewDefaultService(serviceID string, serviceUserID id.UserID, serviceType string) DefaultService {
-	return DefaultService{serviceID, serviceUserID, serviceType}
+	return DefaultService{id: serviceID, serviceUserID: serviceUserID, serviceType: serviceType}
 }
 
 // ServiceID returns the service's ID. In order for this to return the ID, DefaultService MUST have been
@@ -94,6 +233,14 @@ func (s *DefaultService) ServiceType() string {
 	return s.serviceType
 }
 
+// CommandRateLimit returns the "rate_limit" from the service config, or DefaultRateLimit if there isn't one.
+func (s *DefaultService) CommandRateLimit() RateLimit {
+	if s.RateLimit == nil {
+		return DefaultRateLimit
+	}
+	return *s.RateLimit
+}
+
 // Commands returns no commands.
 func (s *DefaultService) Commands(cli MatrixClient) []Command {
 	return []Command{}
@@ -154,6 +301,11 @@ func PollingServiceTypes() (types []string) {
 	return
 }
 
+// IsServiceType returns true if a service factory has been registered for the given type.
+func IsServiceType(serviceType string) bool {
+	return servicesByType[serviceType] != nil
+}
+
 // CreateService creates a Service of the given type and serviceID.
 // Returns an error if the Service couldn't be created.
 func CreateService(serviceID, serviceType string, serviceUserID id.UserID, serviceJSON []byte) (Service, error) {